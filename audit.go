@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/tiny"
+)
+
+// maxAuditBody is how much of a request or response body is parsed for the audit record
+const maxAuditBody = 64 * 1024
+
+// redactedKeys are parameter names whose values never end up in the audit log.
+// Keys are compared lower case and match if they contain one of these.
+var redactedKeys = []string{"password", "secret", "token", "p12", "key", "record", "pass"}
+
+// AuditSink receives one JSON encoded record per call
+type AuditSink interface {
+	Write(record []byte) error
+}
+
+// auditor records mutating calls and auth decisions, it is set up in main
+var auditor *Auditor
+
+type Auditor struct {
+	sink AuditSink
+}
+
+// NewAuditor creates the sink configured in AUDIT_LOG: stdout (the default), a file path or an http(s) webhook URL
+func NewAuditor() (*Auditor, error) {
+	target := os.Getenv("AUDIT_LOG")
+	switch {
+	case target == "" || target == "stdout":
+		return &Auditor{sink: &writerSink{w: os.Stdout}}, nil
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		return &Auditor{sink: newWebhookSink(target)}, nil
+	default:
+		f, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("could not open AUDIT_LOG %s: %w", target, err)
+		}
+		return &Auditor{sink: &writerSink{w: f}}, nil
+	}
+}
+
+// Record writes entry to the sink, failures are logged and never fail the request
+func (a *Auditor) Record(entry map[string]any) {
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("audit: could not encode record: %v", err)
+		return
+	}
+	if err := a.sink.Write(line); err != nil {
+		log.Printf("audit: could not write record: %v", err)
+	}
+}
+
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerSink) Write(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(append(record, '\n'))
+	return err
+}
+
+// webhookSink posts every record to url in the background so slow receivers do not slow down the API
+type webhookSink struct {
+	url     string
+	records chan []byte
+	client  *http.Client
+}
+
+func newWebhookSink(url string) *webhookSink {
+	s := &webhookSink{url: url, records: make(chan []byte, 1000), client: &http.Client{Timeout: 10 * time.Second}}
+	go s.run()
+	return s
+}
+
+func (s *webhookSink) Write(record []byte) error {
+	select {
+	case s.records <- record:
+		return nil
+	default:
+		return fmt.Errorf("webhook queue is full, dropping record %s", record)
+	}
+}
+
+func (s *webhookSink) run() {
+	for record := range s.records {
+		resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(record))
+		if err != nil {
+			log.Printf("audit: webhook failed, lost record %s: %v", record, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("audit: webhook returned %d, lost record %s", resp.StatusCode, record)
+		}
+	}
+}
+
+// auditRecorder keeps the status and the start of the response body for the outcome of the record
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *auditRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *auditRecorder) Write(p []byte) (int, error) {
+	if room := maxAuditBody - r.body.Len(); room > 0 {
+		r.body.Write(p[:min(len(p), room)])
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *auditRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *auditRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// mutating reports whether a call is audited: everything that is not a plain read, and reads of secrets
+func mutating(method string, pattern string) bool {
+	return (method != http.MethodGet && method != http.MethodHead && !readRoutes[pattern]) || destructiveRoutes[pattern]
+}
+
+// Middleware records every mutating call with caller, device, redacted parameters, duration and outcome
+func (a *Auditor) Middleware(next http.Handler, muxes ...*http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pattern := routePattern(r, muxes...)
+		if !mutating(r.Method, pattern) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry := map[string]any{
+			"type":     "call",
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"endpoint": pattern,
+			"remote":   r.RemoteAddr,
+		}
+		if p := getPrincipal(r.Context()); p != nil {
+			entry["principal"] = p.Name
+			entry["authMethod"] = p.Method
+		}
+		if strings.Contains(pattern, "/{udid}/") {
+			udid := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+			entry["udid"] = udid
+			// looked up before the call, an erased or rebooted device cannot be asked afterwards
+			if device, err := ios.GetDevice(udid); err == nil {
+				if serial, model, err := tiny.SerialAndModel(device); err == nil {
+					entry["serial"] = serial
+					entry["model"] = model
+				}
+			}
+		}
+		params := map[string]any{}
+		for k, v := range r.URL.Query() {
+			params[k] = strings.Join(v, ",")
+		}
+		if r.Body != nil {
+			body, _ := io.ReadAll(io.LimitReader(r.Body, maxAuditBody))
+			// the handler still needs the whole body
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			var fields map[string]any
+			if json.Unmarshal(body, &fields) == nil {
+				for k, v := range fields {
+					params[k] = v
+				}
+			}
+		}
+		entry["params"] = redact(params)
+
+		start := time.Now()
+		rec := &auditRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		entry["durationMs"] = time.Since(start).Milliseconds()
+		entry["status"] = rec.status
+		// most handlers answer 200 and report failures in the body
+		var outcome struct {
+			OK    *bool  `json:"ok"`
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(rec.body.Bytes(), &outcome) == nil && outcome.OK != nil {
+			entry["ok"] = *outcome.OK
+			if outcome.Error != "" {
+				entry["error"] = outcome.Error
+			}
+		} else {
+			entry["ok"] = rec.status < 400
+			if rec.status >= 400 {
+				entry["error"] = strings.TrimSpace(rec.body.String())
+			}
+		}
+		a.Record(entry)
+	})
+}
+
+// redact replaces secrets and shortens blobs like base64 profiles, nested objects are redacted too
+func redact(v any) any {
+	switch value := v.(type) {
+	case map[string]any:
+		result := map[string]any{}
+		for k, inner := range value {
+			lower := strings.ToLower(k)
+			secret := false
+			for _, key := range redactedKeys {
+				if strings.Contains(lower, key) {
+					secret = true
+					break
+				}
+			}
+			switch {
+			case secret:
+				result[k] = "[REDACTED]"
+			case strings.HasPrefix(lower, "b64"):
+				s, _ := inner.(string)
+				result[k] = fmt.Sprintf("[%d base64 characters]", len(s))
+			default:
+				result[k] = redact(inner)
+			}
+		}
+		return result
+	case []any:
+		result := make([]any, len(value))
+		for i, inner := range value {
+			result[i] = redact(inner)
+		}
+		return result
+	default:
+		return v
+	}
+}
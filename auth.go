@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scopes are ordered, every scope includes the ones before it
+const (
+	ScopeRead        = "read"
+	ScopeWrite       = "write"
+	ScopeDestructive = "destructive"
+)
+
+var scopeLevels = map[string]int{ScopeRead: 1, ScopeWrite: 2, ScopeDestructive: 3}
+
+// destructiveRoutes need the destructive scope, they wipe devices or change what is installed on them
+var destructiveRoutes = map[string]bool{
+	"POST /{udid}/erase":                          true,
+	"POST /{udid}/supervise/enable":               true,
+	"POST /{udid}/provision":                      true,
+	"POST /{udid}/profiles/add":                   true,
+	"POST /{udid}/profiles/generate":              true,
+	"DELETE /{udid}/profiles/{identifier}":        true,
+	"PUT /{udid}/proxy":                           true,
+	"DELETE /{udid}/proxy":                        true,
+	"POST /{udid}/provisioning-profiles":          true,
+	"DELETE /{udid}/provisioning-profiles/{uuid}": true,
+	"DELETE /{udid}/pair":                         true,
+	"GET /{udid}/pair/record":                     true,
+	"PUT /{udid}/pair/record":                     true,
+	"POST /supervision/identities":                true,
+	"POST /images":                                true,
+	usbmuxSocketRoute:                             true,
+}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Name   string   `json:"name"`
+	Method string   `json:"method"`
+	Scopes []string `json:"scopes"`
+	// Udids limits the principal to these devices, all devices if empty
+	Udids []string `json:"udids,omitempty"`
+}
+
+func (p *Principal) level() int {
+	level := 0
+	for _, s := range p.Scopes {
+		level = max(level, scopeLevels[s])
+	}
+	return level
+}
+
+// AllowsDevice reports whether the principal may access the device udid
+func (p *Principal) AllowsDevice(udid string) bool {
+	return len(p.Udids) == 0 || slices.Contains(p.Udids, udid)
+}
+
+type principalCtxKey struct{}
+
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalCtxKey{}, p)
+}
+
+// getPrincipal returns the caller, nil if authentication is disabled
+func getPrincipal(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalCtxKey{}).(*Principal)
+	return p
+}
+
+// Authenticator identifies the caller of a request. It returns nil and no error if the request
+// carries no credentials it understands, and an error if the credentials are invalid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+type AuthConfig struct {
+	Tokens      []TokenConfig      `json:"tokens"`
+	ClientCerts []ClientCertConfig `json:"clientCerts"`
+	JWT         *JWTConfig         `json:"jwt"`
+}
+
+// TokenConfig is a static bearer token. Token can be given in plain or as its hex encoded SHA-256 in TokenSHA256.
+type TokenConfig struct {
+	Name        string   `json:"name"`
+	Token       string   `json:"token"`
+	TokenSHA256 string   `json:"tokenSha256"`
+	Scopes      []string `json:"scopes"`
+	Udids       []string `json:"udids"`
+}
+
+// ClientCertConfig maps a verified client certificate to scopes by its subject common name
+type ClientCertConfig struct {
+	Name       string   `json:"name"`
+	CommonName string   `json:"commonName"`
+	Scopes     []string `json:"scopes"`
+	Udids      []string `json:"udids"`
+}
+
+// JWTConfig verifies tokens against a local JWKS file. Scopes come from the space separated
+// scope claim, devices from the udids claim.
+type JWTConfig struct {
+	JWKSFile string `json:"jwksFile"`
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+}
+
+// Auth runs the configured authenticators and authorizes every request
+type Auth struct {
+	authenticators []Authenticator
+}
+
+// LoadAuth reads the config file in AUTH_CONFIG. Without it authentication is disabled and nil is returned.
+func LoadAuth() (*Auth, error) {
+	path := os.Getenv("AUTH_CONFIG")
+	if path == "" {
+		log.Println("AUTH_CONFIG is not set, the API is open to everyone who can reach it")
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read AUTH_CONFIG %s: %w", path, err)
+	}
+	var config AuthConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid AUTH_CONFIG %s: %w", path, err)
+	}
+
+	auth := &Auth{}
+	if len(config.ClientCerts) > 0 {
+		auth.authenticators = append(auth.authenticators, &clientCertAuthenticator{certs: config.ClientCerts})
+	}
+	if len(config.Tokens) > 0 {
+		tokens := &tokenAuthenticator{hashes: map[[32]byte]TokenConfig{}}
+		for _, t := range config.Tokens {
+			var hash [32]byte
+			switch {
+			case t.Token != "":
+				hash = sha256.Sum256([]byte(t.Token))
+			case t.TokenSHA256 != "":
+				b, err := hex.DecodeString(t.TokenSHA256)
+				if err != nil || len(b) != len(hash) {
+					return nil, fmt.Errorf("invalid tokenSha256 of token %s", t.Name)
+				}
+				copy(hash[:], b)
+			default:
+				return nil, fmt.Errorf("token %s has neither token nor tokenSha256", t.Name)
+			}
+			tokens.hashes[hash] = t
+		}
+		auth.authenticators = append(auth.authenticators, tokens)
+	}
+	if config.JWT != nil {
+		keys, err := loadJWKS(config.JWT.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.authenticators = append(auth.authenticators, &jwtAuthenticator{config: *config.JWT, keys: keys})
+	}
+	if len(auth.authenticators) == 0 {
+		return nil, fmt.Errorf("AUTH_CONFIG %s configures no tokens, client certs or jwt", path)
+	}
+	return auth, nil
+}
+
+// readRoutes only need the read scope although they are not GET, they take their input in the body and change nothing
+var readRoutes = map[string]bool{
+	"POST /profiles/preview": true,
+}
+
+// requiredScope returns the scope needed for the route pattern
+func requiredScope(method string, pattern string) string {
+	if destructiveRoutes[pattern] {
+		return ScopeDestructive
+	}
+	if method == http.MethodGet || method == http.MethodHead || readRoutes[pattern] {
+		return ScopeRead
+	}
+	return ScopeWrite
+}
+
+// Middleware authenticates every request, checks its scope and device and logs the decision.
+// The principal is stored in the request context for handlers that filter by device.
+func (a *Auth) Middleware(next http.Handler, muxes ...*http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pattern := routePattern(r, muxes...)
+		udid := ""
+		if strings.Contains(pattern, "/{udid}/") {
+			udid = strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+		}
+
+		principal, err := a.authenticate(r)
+		if err != nil || principal == nil {
+			reason := "no credentials"
+			if err != nil {
+				reason = err.Error()
+			}
+			auditAuthDecision(r, pattern, udid, nil, false, reason)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		scope := requiredScope(r.Method, pattern)
+		if principal.level() < scopeLevels[scope] {
+			auditAuthDecision(r, pattern, udid, principal, false, "missing scope "+scope)
+			http.Error(w, "forbidden: missing scope "+scope, http.StatusForbidden)
+			return
+		}
+		if udid != "" && !principal.AllowsDevice(udid) {
+			auditAuthDecision(r, pattern, udid, principal, false, "device not allowed")
+			http.Error(w, "forbidden: device not allowed", http.StatusForbidden)
+			return
+		}
+		auditAuthDecision(r, pattern, udid, principal, true, "")
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	})
+}
+
+func (a *Auth) authenticate(r *http.Request) (*Principal, error) {
+	for _, authenticator := range a.authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if err != nil || principal != nil {
+			return principal, err
+		}
+	}
+	return nil, nil
+}
+
+func auditAuthDecision(r *http.Request, pattern string, udid string, p *Principal, allowed bool, reason string) {
+	entry := map[string]any{
+		"type":    "auth",
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"route":   pattern,
+		"remote":  r.RemoteAddr,
+		"allowed": allowed,
+	}
+	if udid != "" {
+		entry["udid"] = udid
+	}
+	if p != nil {
+		entry["principal"] = p.Name
+		entry["authMethod"] = p.Method
+	}
+	if reason != "" {
+		entry["reason"] = reason
+	}
+	auditor.Record(entry)
+}
+
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+type tokenAuthenticator struct {
+	hashes map[[32]byte]TokenConfig
+}
+
+func (t *tokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearerToken(r)
+	if token == "" || strings.Count(token, ".") == 2 {
+		// JWTs are left to the jwt authenticator
+		return nil, nil
+	}
+	hash := sha256.Sum256([]byte(token))
+	for known, config := range t.hashes {
+		if subtle.ConstantTimeCompare(known[:], hash[:]) == 1 {
+			return &Principal{Name: config.Name, Method: "token", Scopes: config.Scopes, Udids: config.Udids}, nil
+		}
+	}
+	return nil, errors.New("unknown token")
+}
+
+type clientCertAuthenticator struct {
+	certs []ClientCertConfig
+}
+
+// Authenticate only looks at certificates the TLS stack verified against TLS_CLIENT_CA_FILE
+func (c *clientCertAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	for _, config := range c.certs {
+		if config.CommonName == cn {
+			return &Principal{Name: config.Name, Method: "mtls", Scopes: config.Scopes, Udids: config.Udids}, nil
+		}
+	}
+	// a valid certificate without a mapping may still come with a bearer token
+	return nil, nil
+}
+
+// clientCertTLSConfig verifies client certificates against the CAs in caFile. Certificates are optional
+// so clients can still authenticate with bearer tokens.
+func clientCertTLSConfig(caFile string) (*tls.Config, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", caFile)
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}, nil
+}
+
+type jwtAuthenticator struct {
+	config JWTConfig
+	keys   map[string]crypto.PublicKey
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+	Scope     string          `json:"scope"`
+	Udids     []string        `json:"udids"`
+}
+
+func (j *jwtAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid jwt header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt signature encoding: %w", err)
+	}
+	key, ok := j.keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown jwt key id '%s'", header.Kid)
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid jwt claims: %w", err)
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt == nil || now >= *claims.ExpiresAt {
+		return nil, errors.New("jwt expired")
+	}
+	if claims.NotBefore != nil && now < *claims.NotBefore {
+		return nil, errors.New("jwt not yet valid")
+	}
+	if j.config.Issuer != "" && claims.Issuer != j.config.Issuer {
+		return nil, errors.New("jwt issuer mismatch")
+	}
+	if j.config.Audience != "" && !audienceContains(claims.Audience, j.config.Audience) {
+		return nil, errors.New("jwt audience mismatch")
+	}
+	return &Principal{Name: claims.Subject, Method: "jwt", Scopes: strings.Fields(claims.Scope), Udids: claims.Udids}, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceContains handles aud being a single string or a list
+func audienceContains(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return slices.Contains(list, audience)
+	}
+	return false
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported jwt algorithm %s", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported jwt algorithm %s", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("jwt algorithm %s does not match the key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, signature); err != nil {
+			return errors.New("invalid jwt signature")
+		}
+	case strings.HasPrefix(alg, "ES"):
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("jwt algorithm %s does not match the key", alg)
+		}
+		// JWS uses the raw r||s encoding instead of ASN.1
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid jwt signature")
+		}
+		rInt := new(big.Int).SetBytes(signature[:size])
+		sInt := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, rInt, sInt) {
+			return errors.New("invalid jwt signature")
+		}
+	default:
+		return fmt.Errorf("unsupported jwt algorithm %s", alg)
+	}
+	return nil
+}
+
+type jwk struct {
+	Kty string   `json:"kty"`
+	Kid string   `json:"kid"`
+	N   string   `json:"n"`
+	E   string   `json:"e"`
+	Crv string   `json:"crv"`
+	X   string   `json:"x"`
+	Y   string   `json:"y"`
+	X5c []string `json:"x5c"`
+}
+
+func loadJWKS(path string) (map[string]crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read jwks file %s: %w", path, err)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid jwks file %s: %w", path, err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks key '%s': %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	if len(k.X5c) > 0 {
+		der, err := base64.StdEncoding.DecodeString(k.X5c[0])
+		if err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios/simdevice"
+)
+
+// signJWS signs header.claims with key, RS256 for RSA keys and ES256 for EC keys
+func signJWS(t *testing.T, header map[string]any, claims map[string]any, key crypto.Signer) string {
+	t.Helper()
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyJWTSignature(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	split := func(token string) ([]byte, []byte) {
+		parts := strings.Split(token, ".")
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []byte(parts[0] + "." + parts[1]), signature
+	}
+	rsSigned, rsSignature := split(signJWS(t, map[string]any{"alg": "RS256"}, map[string]any{"sub": "a"}, rsaKey))
+	esSigned, esSignature := split(signJWS(t, map[string]any{"alg": "ES256"}, map[string]any{"sub": "a"}, ecKey))
+
+	tests := []struct {
+		name      string
+		alg       string
+		key       crypto.PublicKey
+		signed    []byte
+		signature []byte
+		wantErr   string
+	}{
+		{name: "RS256", alg: "RS256", key: &rsaKey.PublicKey, signed: rsSigned, signature: rsSignature},
+		{name: "ES256", alg: "ES256", key: &ecKey.PublicKey, signed: esSigned, signature: esSignature},
+		{name: "RS256 tampered", alg: "RS256", key: &rsaKey.PublicKey, signed: append(rsSigned, 'x'), signature: rsSignature, wantErr: "invalid jwt signature"},
+		{name: "ES256 tampered", alg: "ES256", key: &ecKey.PublicKey, signed: append(esSigned, 'x'), signature: esSignature, wantErr: "invalid jwt signature"},
+		{name: "RS256 with EC key", alg: "RS256", key: &ecKey.PublicKey, signed: rsSigned, signature: rsSignature, wantErr: "jwt algorithm RS256 does not match the key"},
+		{name: "ES256 with RSA key", alg: "ES256", key: &rsaKey.PublicKey, signed: esSigned, signature: esSignature, wantErr: "jwt algorithm ES256 does not match the key"},
+		{name: "ES256 short r||s", alg: "ES256", key: &ecKey.PublicKey, signed: esSigned, signature: esSignature[:63], wantErr: "invalid jwt signature"},
+		{name: "ES256 ASN.1 signature", alg: "ES256", key: &ecKey.PublicKey, signed: esSigned, signature: append(esSignature, 0), wantErr: "invalid jwt signature"},
+		{name: "HS256", alg: "HS256", key: &rsaKey.PublicKey, signed: rsSigned, signature: rsSignature, wantErr: "unsupported jwt algorithm HS256"},
+		{name: "none", alg: "none", key: &rsaKey.PublicKey, signed: rsSigned, wantErr: "unsupported jwt algorithm none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyJWTSignature(tt.alg, tt.key, tt.signed, tt.signature)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("got error %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := &jwtAuthenticator{
+		config: JWTConfig{Issuer: "https://idp.example.com", Audience: "tinyios"},
+		keys:   map[string]crypto.PublicKey{"k1": &key.PublicKey},
+	}
+	now := time.Now().Unix()
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"sub": "ci", "iss": "https://idp.example.com", "aud": "tinyios", "exp": now + 60,
+			"scope": "read write", "udids": []string{"00008030-00000000000000c1"},
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+	header := map[string]any{"alg": "ES256", "kid": "k1"}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{name: "valid", token: signJWS(t, header, claims(nil), key)},
+		{name: "audience list", token: signJWS(t, header, claims(map[string]any{"aud": []string{"other", "tinyios"}}), key)},
+		{name: "not before passed", token: signJWS(t, header, claims(map[string]any{"nbf": now - 10}), key)},
+		{name: "expired", token: signJWS(t, header, claims(map[string]any{"exp": now - 1}), key), wantErr: "jwt expired"},
+		{name: "no expiry", token: signJWS(t, header, claims(map[string]any{"exp": nil}), key), wantErr: "jwt expired"},
+		{name: "not yet valid", token: signJWS(t, header, claims(map[string]any{"nbf": now + 60}), key), wantErr: "jwt not yet valid"},
+		{name: "issuer", token: signJWS(t, header, claims(map[string]any{"iss": "https://evil.example.com"}), key), wantErr: "jwt issuer mismatch"},
+		{name: "audience", token: signJWS(t, header, claims(map[string]any{"aud": "other"}), key), wantErr: "jwt audience mismatch"},
+		{name: "audience not in list", token: signJWS(t, header, claims(map[string]any{"aud": []string{"a", "b"}}), key), wantErr: "jwt audience mismatch"},
+		{name: "no audience", token: signJWS(t, header, claims(map[string]any{"aud": nil}), key), wantErr: "jwt audience mismatch"},
+		{name: "unknown kid", token: signJWS(t, map[string]any{"alg": "ES256", "kid": "k2"}, claims(nil), key), wantErr: "unknown jwt key id 'k2'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/devices", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			p, err := authenticator.Authenticate(r)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Name != "ci" || p.Method != "jwt" || p.level() != scopeLevels[ScopeWrite] || !p.AllowsDevice("00008030-00000000000000c1") || p.AllowsDevice("other") {
+				t.Fatalf("unexpected principal %+v", p)
+			}
+		})
+	}
+
+	// static tokens are not the jwt authenticator's business
+	r := httptest.NewRequest("GET", "/devices", nil)
+	r.Header.Set("Authorization", "Bearer static-token")
+	if p, err := authenticator.Authenticate(r); p != nil || err != nil {
+		t.Fatalf("expected no decision, got %v %v", p, err)
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	authenticator := &tokenAuthenticator{hashes: map[[32]byte]TokenConfig{
+		sha256.Sum256([]byte("s3cret")): {Name: "ci", Scopes: []string{ScopeRead}},
+	}}
+	tests := []struct {
+		name          string
+		authorization string
+		wantPrincipal string
+		wantErr       bool
+	}{
+		{name: "known token", authorization: "Bearer s3cret", wantPrincipal: "ci"},
+		{name: "unknown token", authorization: "Bearer wrong", wantErr: true},
+		{name: "jwt", authorization: "Bearer a.b.c"},
+		{name: "no bearer", authorization: "Basic czNjcmV0"},
+		{name: "no header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/devices", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			p, err := authenticator.Authenticate(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			name := ""
+			if p != nil {
+				name = p.Name
+			}
+			if name != tt.wantPrincipal {
+				t.Fatalf("got principal %q, want %q", name, tt.wantPrincipal)
+			}
+		})
+	}
+}
+
+func TestRequiredScope(t *testing.T) {
+	for route := range destructiveRoutes {
+		method, _, _ := strings.Cut(route, " ")
+		if scope := requiredScope(method, route); scope != ScopeDestructive {
+			t.Errorf("%s needs %s, want %s", route, scope, ScopeDestructive)
+		}
+	}
+	tests := []struct {
+		method  string
+		pattern string
+		want    string
+	}{
+		{"GET", "GET /devices", ScopeRead},
+		{"HEAD", "GET /{udid}/info", ScopeRead},
+		{"POST", "POST /{udid}/reboot", ScopeWrite},
+		{"DELETE", "DELETE /jobs/{id}", ScopeWrite},
+		{"POST", "POST /profiles/preview", ScopeRead},
+		{"GET", "GET /{udid}/pair/record", ScopeDestructive},
+		{"POST", "", ScopeWrite},
+	}
+	for _, tt := range tests {
+		if scope := requiredScope(tt.method, tt.pattern); scope != tt.want {
+			t.Errorf("%s %s needs %s, want %s", tt.method, tt.pattern, scope, tt.want)
+		}
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	allowed := "00008030-00000000000000c1"
+	other := "00008030-00000000000000c2"
+	auth := &Auth{authenticators: []Authenticator{&tokenAuthenticator{hashes: map[[32]byte]TokenConfig{
+		sha256.Sum256([]byte("reader")): {Name: "reader", Scopes: []string{ScopeRead}, Udids: []string{allowed}},
+		sha256.Sum256([]byte("writer")): {Name: "writer", Scopes: []string{ScopeWrite}},
+		sha256.Sum256([]byte("admin")):  {Name: "admin", Scopes: []string{ScopeDestructive}},
+	}}}}
+	api := startAPIWithAuth(t, auth, simdevice.NewDevice(allowed), simdevice.NewDevice(other))
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		want   int
+	}{
+		{name: "no credentials", method: "GET", path: "/devices", want: http.StatusUnauthorized},
+		{name: "unknown token", token: "nope", method: "GET", path: "/devices", want: http.StatusUnauthorized},
+		{name: "read", token: "reader", method: "GET", path: "/" + allowed + "/supervised", want: http.StatusOK},
+		{name: "device not allowed", token: "reader", method: "GET", path: "/" + other + "/supervised", want: http.StatusForbidden},
+		{name: "write with read scope", token: "reader", method: "POST", path: "/" + allowed + "/reboot", want: http.StatusForbidden},
+		{name: "read-only POST with read scope", token: "reader", method: "POST", path: "/profiles/preview", want: http.StatusBadRequest},
+		{name: "destructive with write scope", token: "writer", method: "POST", path: "/" + allowed + "/erase", want: http.StatusForbidden},
+		{name: "destructive GET with write scope", token: "writer", method: "GET", path: "/" + allowed + "/pair/record", want: http.StatusForbidden},
+		{name: "destructive", token: "admin", method: "GET", path: "/" + other + "/pair/record", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.token != "" {
+				header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if status := callWithHeader(t, api, header, tt.method, tt.path, nil, nil); status != tt.want {
+				t.Fatalf("got %d, want %d", status, tt.want)
+			}
+		})
+	}
+
+	// the device list only shows the devices of the principal
+	var list DevicesResponse
+	callWithHeader(t, api, http.Header{"Authorization": {"Bearer reader"}}, "GET", "/devices", nil, &list)
+	if len(list.Devices) != 1 || list.Devices[0].UDID != allowed {
+		t.Fatalf("unexpected devices %+v", list.Devices)
+	}
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert: cert, key: key}
+}
+
+// clientCert issues a client certificate for cn
+func (ca testCA) clientCert(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertAuthenticator(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := clientCertTLSConfig(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := &clientCertAuthenticator{certs: []ClientCertConfig{{Name: "rack-1", CommonName: "rack-1.example.com", Scopes: []string{ScopeWrite}}}}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := authenticator.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if p == nil {
+			w.Write([]byte("-"))
+			return
+		}
+		w.Write([]byte(p.Name + " " + p.Method))
+	}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(cert *tls.Certificate) (string, error) {
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = nil
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		var body strings.Builder
+		_, err = io.Copy(&body, resp.Body)
+		return body.String(), err
+	}
+
+	mapped := ca.clientCert(t, "rack-1.example.com")
+	unmapped := ca.clientCert(t, "rack-2.example.com")
+	foreign := newTestCA(t).clientCert(t, "rack-1.example.com")
+	if got, err := get(&mapped); err != nil || got != "rack-1 mtls" {
+		t.Errorf("mapped certificate: got %q %v", got, err)
+	}
+	if got, err := get(&unmapped); err != nil || got != "-" {
+		t.Errorf("unmapped certificate: got %q %v", got, err)
+	}
+	if got, err := get(nil); err != nil || got != "-" {
+		t.Errorf("no certificate: got %q %v", got, err)
+	}
+	if _, err := get(&foreign); err == nil {
+		t.Error("certificate of another CA was accepted")
+	}
+
+	// certificates the TLS stack did not verify are ignored
+	r := httptest.NewRequest("GET", "/devices", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{mapped.Leaf}}
+	if p, err := authenticator.Authenticate(r); p != nil || err != nil {
+		t.Fatalf("unverified certificate: got %v %v", p, err)
+	}
+}
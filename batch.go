@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/tiny"
+)
+
+const defaultBatchConcurrency = 4
+
+var errDeviceNotAllowed = errors.New("device not allowed")
+
+// batchScopes are the batch operations with the scope they need, the same as their single device routes
+var batchScopes = map[string]string{
+	"install":     ScopeWrite,
+	"uninstall":   ScopeWrite,
+	"profileAdd":  ScopeDestructive,
+	"reboot":      ScopeWrite,
+	"imageEnable": ScopeWrite,
+	"settings":    ScopeWrite,
+}
+
+// BatchRequest runs one operation on several devices, given by UDID or by a label selector
+type BatchRequest struct {
+	// Operation is one of install, uninstall, profileAdd, reboot, imageEnable and settings
+	Operation string   `json:"operation"`
+	Udids     []string `json:"udids"`
+	Selector  string   `json:"selector"`
+	// Concurrency is capped by BATCH_CONCURRENCY, 4 if not set
+	Concurrency int `json:"concurrency"`
+	// URL of the IPA for install, fetched through the artifact cache. A path on the host works as well.
+	URL string `json:"url"`
+	// BundleID for uninstall
+	BundleID string `json:"bundleId"`
+	// B64Profile and Org for profileAdd
+	B64Profile string            `json:"b64profile"`
+	Org        string            `json:"org"`
+	Settings   ProvisionSettings `json:"settings"`
+}
+
+// BatchDeviceResult is the outcome on one device, Result is what the single device route would have answered
+type BatchDeviceResult struct {
+	Udid   string          `json:"udid"`
+	OK     bool            `json:"ok"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+func batchConcurrency(requested int) int {
+	limit := defaultBatchConcurrency
+	if v, err := strconv.Atoi(os.Getenv("BATCH_CONCURRENCY")); err == nil && v > 0 {
+		limit = v
+	}
+	if requested > 0 && requested < limit {
+		return requested
+	}
+	return limit
+}
+
+// validate checks the parameters of the operation before any device is touched
+func (b *BatchRequest) validate() error {
+	if _, ok := batchScopes[b.Operation]; !ok {
+		return fmt.Errorf("unknown operation %q", b.Operation)
+	}
+	if len(b.Udids) == 0 && b.Selector == "" {
+		return errors.New("udids or selector needed")
+	}
+	switch b.Operation {
+	case "install":
+		if b.URL == "" {
+			return errors.New("url missing")
+		}
+	case "uninstall":
+		if b.BundleID == "" {
+			return errors.New("bundleId missing")
+		}
+	case "profileAdd":
+		if _, err := base64.StdEncoding.DecodeString(b.B64Profile); err != nil || b.B64Profile == "" {
+			return errors.New("invalid base64 profile")
+		}
+		if _, err := supervision.Get(b.Org); err != nil {
+			return err
+		}
+	case "settings":
+		if b.Settings == (ProvisionSettings{}) {
+			return errors.New("settings missing")
+		}
+	}
+	return nil
+}
+
+// batchOperation returns the function run on every device, downloads and decoding happen once here. release, if not
+// nil, frees what the function needs once all devices are done.
+func batchOperation(ctx context.Context, b BatchRequest, job *Job) (func(ios.DeviceEntry) string, func(), error) {
+	switch b.Operation {
+	case "install":
+		path, release, err := batchArtifact(ctx, b.URL, job)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(d ios.DeviceEntry) string { return tiny.AppInstall(d, path) }, release, nil
+	case "uninstall":
+		return func(d ios.DeviceEntry) string { return tiny.AppUninstall(d, b.BundleID) }, nil, nil
+	case "profileAdd":
+		data, _ := base64.StdEncoding.DecodeString(b.B64Profile)
+		identity, err := supervision.Get(b.Org)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(d ios.DeviceEntry) string { return tiny.ProfileAdd(d, data, identity.P12, identity.P12Password) }, nil, nil
+	case "reboot":
+		return tiny.Reboot, nil, nil
+	case "imageEnable":
+		return tiny.ImageEnable, nil, nil
+	default:
+		settings := tiny.ProvisionSettings(b.Settings)
+		return func(d ios.DeviceEntry) string { return tiny.SettingsApply(d, settings) }, nil, nil
+	}
+}
+
+// batchArtifact fetches url through the artifact cache once for all devices of the batch
+func batchArtifact(ctx context.Context, url string, job *Job) (string, func(), error) {
+	if !isURL(url) {
+		return url, nil, nil
+	}
+	job.Progress("download", tiny.StepRunning, nil)
+	path, release, err := cachedArtifact(ctx, url)
+	if err != nil {
+		job.Progress("download", tiny.StepFailed, err)
+		return "", nil, err
+	}
+	job.Progress("download", tiny.StepDone, nil)
+	return path, release, nil
+}
+
+// runBatch runs the operation on udids, at most concurrency at a time. Devices not started when the job is
+// cancelled are skipped. Every device is a step of the job and its result is published as soon as it is known.
+func runBatch(ctx context.Context, b BatchRequest, udids []string, leaseToken string, job *Job) error {
+	operation, release, err := batchOperation(ctx, b, job)
+	if err != nil {
+		return err
+	}
+	if release != nil {
+		defer release()
+	}
+
+	var mu sync.Mutex
+	results := map[string]BatchDeviceResult{}
+	publish := func(result BatchDeviceResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		results[result.Udid] = result
+		list := make([]BatchDeviceResult, 0, len(results))
+		for _, r := range results {
+			list = append(list, r)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Udid < list[j].Udid })
+		job.SetResult(list)
+	}
+
+	slots := make(chan struct{}, batchConcurrency(b.Concurrency))
+	var wg sync.WaitGroup
+	for _, udid := range udids {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			job.Progress(udid, tiny.StepSkipped, ctx.Err())
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			job.Progress(udid, tiny.StepRunning, nil)
+			result := runBatchDevice(udid, leaseToken, operation)
+			if result.OK {
+				job.Progress(udid, tiny.StepDone, nil)
+			} else {
+				job.Progress(udid, tiny.StepFailed, errors.New(result.Error))
+			}
+			publish(result)
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, result := range results {
+		if !result.OK {
+			failed++
+		}
+	}
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case failed > 0:
+		return fmt.Errorf("%d of %d devices failed", failed, len(udids))
+	}
+	return nil
+}
+
+func runBatchDevice(udid string, leaseToken string, operation func(ios.DeviceEntry) string) BatchDeviceResult {
+	result := BatchDeviceResult{Udid: udid}
+	if lease, ok := leases.Allows(udid, leaseToken); !ok {
+		result.Error = "leased by " + lease.Owner
+		return result
+	}
+	device, err := ios.GetDevice(udid)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Result = json.RawMessage(operation(device))
+	var outcome struct {
+		OK    *bool  `json:"ok"`
+		Error string `json:"error"`
+	}
+	_ = json.Unmarshal(result.Result, &outcome)
+	result.OK = outcome.OK == nil || *outcome.OK
+	if !result.OK {
+		result.Error = outcome.Error
+		if result.Error == "" {
+			result.Error = "failed"
+		}
+	}
+	return result
+}
+
+// batchDevices resolves the UDIDs or selector of b to the devices p may use
+func batchDevices(b BatchRequest, p *Principal) ([]string, error) {
+	if len(b.Udids) > 0 {
+		for _, udid := range b.Udids {
+			if p != nil && !p.AllowsDevice(udid) {
+				return nil, fmt.Errorf("%w: %s", errDeviceNotAllowed, udid)
+			}
+		}
+		return b.Udids, nil
+	}
+	selector, err := ParseSelector(b.Selector)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := listDevices(p)
+	if err != nil {
+		return nil, err
+	}
+	udids := []string{}
+	for _, device := range devices {
+		if selector.Matches(device.Labels) {
+			udids = append(udids, device.UDID)
+		}
+	}
+	sort.Strings(udids)
+	return udids, nil
+}
+
+// batch godoc
+// @Summary      Run an operation on many devices
+// @Description  Runs install, uninstall, profileAdd, reboot, imageEnable or settings on the devices given by udids or
+// @Description  selector as one job with a step and a result per device. At most BATCH_CONCURRENCY devices are worked on
+// @Description  at a time and an IPA is fetched through the artifact cache once for all of them. Cancelling the job skips the devices not started yet.
+// @Description  Leased devices need the lease token in X-Lease-Token, the others fail.
+// @Tags         jobs
+// @Accept       json
+// @Produce      json
+// @Param        request body BatchRequest true "Operation, devices and parameters"
+// @Success      202 {object} Job
+// @Failure      400 {string} string "invalid JSON, operation or parameters"
+// @Failure      403 {string} string "missing scope or device not allowed"
+// @Failure      404 {string} string "no device matches"
+// @Router       /batch [post]
+func batch(w http.ResponseWriter, r *http.Request) {
+	var b BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := b.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := getPrincipal(r.Context())
+	if scope := batchScopes[b.Operation]; p != nil && p.level() < scopeLevels[scope] {
+		http.Error(w, "forbidden: missing scope "+scope, http.StatusForbidden)
+		return
+	}
+	udids, err := batchDevices(b, p)
+	switch {
+	case errors.Is(err, errDeviceNotAllowed):
+		http.Error(w, "forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case len(udids) == 0:
+		http.Error(w, "no device matches "+b.Selector, http.StatusNotFound)
+		return
+	}
+	leaseToken := r.Header.Get(LeaseTokenHeader)
+	steps := udids
+	if b.Operation == "install" && (strings.HasPrefix(b.URL, "http://") || strings.HasPrefix(b.URL, "https://")) {
+		steps = append([]string{"download"}, udids...)
+	}
+	job := jobs.StartMulti("batch", udids, steps, func(ctx context.Context, job *Job) error {
+		return runBatch(ctx, b, udids, leaseToken, job)
+	})
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJob(w, job)
+}
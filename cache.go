@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios/artifactcache"
+)
+
+const defaultArtifactCacheDir = "./cache"
+
+// artifacts caches IPAs and developer images for all devices, see LoadArtifactCache
+var artifacts *artifactcache.Cache
+
+// CacheResponse lists the cached artifacts, the most recently used first
+type CacheResponse struct {
+	Dir string `json:"dir"`
+	// MaxBytes is 0 if the cache is not limited
+	MaxBytes int64                 `json:"maxBytes"`
+	Size     int64                 `json:"size"`
+	Entries  []artifactcache.Entry `json:"entries"`
+}
+
+// LoadArtifactCache opens the cache in ARTIFACT_CACHE_DIR, ./cache if not set. ARTIFACT_CACHE_MAX_SIZE limits it to
+// a number of bytes, with an optional K, M or G suffix. ARTIFACT_CACHE_REVALIDATE is how long a URL is used before the
+// server is asked whether it changed, 1h if not set and 0 to never ask.
+func LoadArtifactCache() (*artifactcache.Cache, error) {
+	dir := os.Getenv("ARTIFACT_CACHE_DIR")
+	if dir == "" {
+		dir = defaultArtifactCacheDir
+	}
+	var maxBytes int64
+	if v := os.Getenv("ARTIFACT_CACHE_MAX_SIZE"); v != "" {
+		size, err := parseSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ARTIFACT_CACHE_MAX_SIZE %s", v)
+		}
+		maxBytes = size
+	}
+	revalidateAfter := artifactcache.DefaultRevalidateAfter
+	if v := os.Getenv("ARTIFACT_CACHE_REVALIDATE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid ARTIFACT_CACHE_REVALIDATE %s", v)
+		}
+		revalidateAfter = d
+	}
+	cache, err := artifactcache.New(dir, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	cache.SetRevalidateAfter(revalidateAfter)
+	return cache, nil
+}
+
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("invalid size")
+	}
+	return size * multiplier, nil
+}
+
+// cachedArtifact returns the path of url in the artifact cache, downloading it if needed. The file is kept until
+// release is called. Paths on the host are returned as they are.
+func cachedArtifact(ctx context.Context, url string) (string, func(), error) {
+	if !isURL(url) {
+		return url, func() {}, nil
+	}
+	entry, release, err := artifacts.Acquire(ctx, url)
+	if err != nil {
+		return "", nil, err
+	}
+	return artifacts.Path(entry.Hash), release, nil
+}
+
+// isURL reports whether path is fetched through the artifact cache
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// listCache godoc
+// @Summary      List artifact cache
+// @Description  Lists the cached IPAs and developer images with their SHA-256, size, source URLs and last use
+// @Tags         cache
+// @Produce      json
+// @Success      200 {object} CacheResponse
+// @Router       /cache [get]
+func listCache(w http.ResponseWriter, r *http.Request) {
+	result, _ := json.Marshal(CacheResponse{
+		Dir:      artifacts.Dir(),
+		MaxBytes: artifacts.MaxBytes(),
+		Size:     artifacts.Size(),
+		Entries:  artifacts.List(),
+	})
+	writeResponse(w, 200, result)
+}
+
+// deleteCacheEntry godoc
+// @Summary      Delete cached artifact
+// @Description  Removes the artifact with the SHA-256 from the cache, it is downloaded again when needed
+// @Tags         cache
+// @Produce      json
+// @Param        hash   path      string  true  "SHA-256 of the artifact"
+// @Success      200 {object} GenericResponse
+// @Failure      404 {string} string "not cached"
+// @Failure      409 {string} string "in use by a running install"
+// @Router       /cache/{hash} [delete]
+func deleteCacheEntry(w http.ResponseWriter, r *http.Request) {
+	err := artifacts.Delete(r.PathValue("hash"))
+	switch {
+	case errors.Is(err, artifactcache.ErrInUse):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	result, _ := json.Marshal(GenericResponse{OK: true})
+	writeResponse(w, 200, result)
+}
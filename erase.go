@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios/tiny"
+)
+
+// eraseTokenTTL is how long a confirmation token returned by the first erase call stays valid
+const eraseTokenTTL = 2 * time.Minute
+
+type eraseConfirmation struct {
+	token   string
+	expires time.Time
+}
+
+// eraseState keeps the pending confirmation per device and the snapshots taken before erasing.
+// Both live in memory, a restart drops them.
+var eraseState = struct {
+	sync.Mutex
+	confirmations map[string]eraseConfirmation
+	snapshots     map[string]tiny.EraseSnapshot
+}{confirmations: map[string]eraseConfirmation{}, snapshots: map[string]tiny.EraseSnapshot{}}
+
+// EraseRequest confirms an erase, the body is omitted on the first call
+type EraseRequest struct {
+	Token string `json:"token"`
+	// Snapshot records apps, profiles and settings before erasing, see GET /{udid}/erase/snapshot
+	Snapshot bool `json:"snapshot"`
+}
+
+type EraseConfirmationResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+	Udid    string    `json:"udid"`
+	tiny.EraseTarget
+}
+
+// EraseResult is the result of a finished erase job
+type EraseResult struct {
+	ActivationState string `json:"activationState"`
+}
+
+// erase godoc
+// @Summary      Erase device
+// @Description  Erases all content and settings in two calls. Without a token a confirmation token is returned together with
+// @Description  the device name, serial and model. Calling again with that token starts the erase as a job that waits
+// @Description  for the device to come back and reports its activation state.
+// @Tags         device
+// @Accept       json
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        request body EraseRequest false "Confirmation token from the first call"
+// @Success      200 {object} EraseConfirmationResponse
+// @Success      202 {object} Job
+// @Failure      409 {string} string "invalid or expired confirmation token"
+// @Router       /{udid}/erase [post]
+func erase(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	udid := d.Properties.SerialNumber
+
+	var u EraseRequest
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if u.Token == "" {
+		target, err := tiny.GetEraseTarget(d)
+		if err != nil {
+			http.Error(w, "could not read device: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		token := make([]byte, 8)
+		_, _ = rand.Read(token)
+		confirmation := eraseConfirmation{token: hex.EncodeToString(token), expires: time.Now().Add(eraseTokenTTL)}
+		eraseState.Lock()
+		eraseState.confirmations[udid] = confirmation
+		eraseState.Unlock()
+		result, _ := json.Marshal(EraseConfirmationResponse{Token: confirmation.token, Expires: confirmation.expires, Udid: udid, EraseTarget: target})
+		writeResponse(w, 200, result)
+		return
+	}
+
+	// tokens are single use, a failed attempt needs a new one
+	eraseState.Lock()
+	confirmation, ok := eraseState.confirmations[udid]
+	delete(eraseState.confirmations, udid)
+	eraseState.Unlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(confirmation.token), []byte(u.Token)) != 1 || time.Now().After(confirmation.expires) {
+		http.Error(w, "invalid or expired confirmation token", http.StatusConflict)
+		return
+	}
+
+	job := jobs.Start("erase", udid, tiny.EraseSteps(u.Snapshot), func(ctx context.Context, job *Job) error {
+		var snapshot *tiny.EraseSnapshot
+		if u.Snapshot {
+			snapshot = &tiny.EraseSnapshot{}
+		}
+		state, err := tiny.EraseAndWait(ctx, d, snapshot, job.Progress)
+		if snapshot != nil && !snapshot.Taken.IsZero() {
+			eraseState.Lock()
+			eraseState.snapshots[udid] = *snapshot
+			eraseState.Unlock()
+		}
+		if err != nil {
+			return err
+		}
+		job.SetResult(EraseResult{ActivationState: state})
+		return nil
+	})
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJob(w, job)
+}
+
+// eraseSnapshot godoc
+// @Summary      Get pre-erase snapshot
+// @Description  Returns the apps, profiles and settings recorded before the last erase with snapshot: true
+// @Tags         device
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Success      200 {object} tiny.EraseSnapshot
+// @Failure      404 {string} string "no snapshot"
+// @Router       /{udid}/erase/snapshot [get]
+func eraseSnapshot(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	snapshot, ok := getEraseSnapshot(d.Properties.SerialNumber)
+	if !ok {
+		http.Error(w, "no snapshot", http.StatusNotFound)
+		return
+	}
+	result, _ := json.Marshal(snapshot)
+	writeResponse(w, 200, result)
+}
+
+func getEraseSnapshot(udid string) (tiny.EraseSnapshot, bool) {
+	eraseState.Lock()
+	defer eraseState.Unlock()
+	snapshot, ok := eraseState.snapshots[udid]
+	return snapshot, ok
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"strings"
 
 	dtx "github.com/danielpaulus/go-ios/ios/dtx_codec"
 	"github.com/danielpaulus/go-ios/ios/nskeyedarchiver"
@@ -14,6 +15,15 @@ import (
 // It only needs the global dtx channel as all AX methods are invoked on it.
 type ControlInterface struct {
 	channel *dtx.Channel
+	conn    *dtx.Connection
+}
+
+// Close closes the underlying DTX connection to the AX service
+func (a ControlInterface) Close() error {
+	if a.conn == nil {
+		return nil
+	}
+	return a.conn.Close()
 }
 
 type Action int
@@ -27,6 +37,16 @@ type actionMeta struct {
 	HumanReadable string
 }
 
+// ParseAction converts a human readable action name like "tap" into an Action
+func ParseAction(name string) (Action, error) {
+	switch strings.ToLower(name) {
+	case "tap", "activate":
+		return ActionTap, nil
+	default:
+		return 0, fmt.Errorf("unknown accessibility action '%s'", name)
+	}
+}
+
 func getActionMeta(action Action) actionMeta {
 	switch action {
 	case ActionTap:
@@ -46,6 +66,22 @@ const (
 	DirectionLast     MoveDirection = 6
 )
 
+// ParseMoveDirection converts one of next, previous, first or last into a MoveDirection
+func ParseMoveDirection(direction string) (MoveDirection, error) {
+	switch strings.ToLower(direction) {
+	case "next":
+		return DirectionNext, nil
+	case "previous", "prev":
+		return DirectionPrevious, nil
+	case "first":
+		return DirectionFirst, nil
+	case "last":
+		return DirectionLast, nil
+	default:
+		return 0, fmt.Errorf("unknown move direction '%s'", direction)
+	}
+}
+
 // AXElementData represents the data returned from Move operations
 type AXElementData struct {
 	PlatformElementValue string `json:"platformElementValue"` // Base64-encoded platform element data
@@ -81,6 +117,7 @@ func (a ControlInterface) init() error {
 	a.channel.RegisterMethodForRemote("hostInspectorMonitoredEventTypeChanged:")
 	a.channel.RegisterMethodForRemote("hostAppStateChanged:")
 	a.channel.RegisterMethodForRemote("hostInspectorNotificationReceived:")
+	a.channel.RegisterMethodForRemote(auditCompletedSelector)
 	go a.readhostAppStateChanged()
 	go a.readhostInspectorNotificationReceived()
 
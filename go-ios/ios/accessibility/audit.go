@@ -0,0 +1,245 @@
+package accessibility
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/danielpaulus/go-ios/ios/nskeyedarchiver"
+	log "github.com/sirupsen/logrus"
+)
+
+const auditCompletedSelector = "hostDeviceDidCompleteAuditCategoriesWithAuditIssues:"
+
+// auditTypesByClassification maps the IssueClassificationValue_v1 of an issue to the
+// audit type that produced it, the device only reports the numeric classification.
+var auditTypesByClassification = map[uint64]string{
+	12:   "testTypeContrast",
+	13:   "testTypeContrast",
+	100:  "testTypeHitRegion",
+	1000: "testTypeElementDetection",
+	3001: "testTypeDynamicText",
+	3002: "testTypeDynamicText",
+	3003: "testTypeTextClipped",
+	5000: "testTypeSufficientElementDescription",
+}
+
+// AuditIssue is a single accessibility problem found by the audit daemon on the device
+type AuditIssue struct {
+	// AuditType is empty for classifications this package does not know, Classification is always set
+	AuditType                string      `json:"auditType,omitempty"`
+	Classification           uint64      `json:"classification"`
+	Description              string      `json:"description,omitempty"`
+	ElementRect              interface{} `json:"elementRect,omitempty"`
+	FontSize                 interface{} `json:"fontSize,omitempty"`
+	MLGeneratedDescription   interface{} `json:"mlGeneratedDescription,omitempty"`
+	LongDescriptionExtraInfo interface{} `json:"longDescriptionExtraInfo,omitempty"`
+	ForegroundColor          interface{} `json:"foregroundColor,omitempty"`
+	BackgroundColor          interface{} `json:"backgroundColor,omitempty"`
+	// Extra holds the keys of the issue that have no field above, as the device sent them
+	Extra map[string]interface{} `json:"extra,omitempty"`
+}
+
+// knownIssueKeys are the keys of an audit issue that are mapped to AuditIssue fields
+var knownIssueKeys = map[string]bool{
+	"IssueClassificationValue_v1":    true,
+	"ElementRectValue_v1":            true,
+	"FontSizeValue_v1":               true,
+	"MLGeneratedDescriptionValue_v1": true,
+	"LongDescriptionExtraInfo_v1":    true,
+	"ForegroundColorValue_v1":        true,
+	"BackgroundColorValue_v1":        true,
+}
+
+// auditTypeFor returns the audit type of a classification, empty for classifications this package does not know
+func auditTypeFor(classification uint64) string {
+	return auditTypesByClassification[classification]
+}
+
+// AuditTypes returns all audit types (or audit case IDs on devices with api version < 15) supported by the device
+func (a ControlInterface) AuditTypes() ([]string, error) {
+	apiVersion, err := a.deviceAPIVersion()
+	if err != nil {
+		return nil, err
+	}
+	return a.deviceAllAuditCaseIDs(apiVersion)
+}
+
+// HumanReadableDescription returns the localized description the device has for an audit type
+func (a ControlInterface) HumanReadableDescription(auditType string) (string, error) {
+	return a.deviceHumanReadableDescriptionForAuditCaseID(auditType)
+}
+
+// SetAuditTargetPid restricts inspection and audits to the process with the given pid, 0 means the whole device
+func (a ControlInterface) SetAuditTargetPid(pid uint64) error {
+	return a.deviceSetAuditTargetPid(pid)
+}
+
+// RunAudit runs the given audit types on the device and waits for the issues to be reported.
+// If auditTypes is empty, all types supported by the device are run.
+func (a ControlInterface) RunAudit(ctx context.Context, auditTypes []string) ([]AuditIssue, error) {
+	apiVersion, err := a.deviceAPIVersion()
+	if err != nil {
+		return nil, err
+	}
+	if len(auditTypes) == 0 {
+		auditTypes, err = a.deviceAllAuditCaseIDs(apiVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+	a.channel.RegisterMethodForRemote(auditCompletedSelector)
+
+	types := make([]interface{}, len(auditTypes))
+	for i, t := range auditTypes {
+		types[i] = t
+	}
+	if apiVersion >= 15 {
+		err = a.channel.MethodCallAsync("deviceBeginAuditTypes:", types)
+	} else {
+		err = a.channel.MethodCallAsync("deviceBeginAuditCaseIDs:", types)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed starting audit: %w", err)
+	}
+
+	msg, err := a.channel.ReceiveMethodCallWithTimeout(ctx, auditCompletedSelector)
+	if err != nil {
+		return nil, fmt.Errorf("failed waiting for audit result: %w", err)
+	}
+	args := msg.Auxiliary.GetArguments()
+	if len(args) == 0 {
+		return nil, fmt.Errorf("audit result without arguments")
+	}
+	argBytes, ok := args[0].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected audit result argument type: %T", args[0])
+	}
+	unarchived, err := nskeyedarchiver.Unarchive(argBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed unarchiving audit result: %w", err)
+	}
+	if len(unarchived) == 0 {
+		return []AuditIssue{}, nil
+	}
+	issues, err := parseAuditIssues(unwrapAXObject(unarchived[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	descriptions := map[string]string{}
+	for i := range issues {
+		t := issues[i].AuditType
+		if t == "" {
+			// the device only describes audit types, not raw classifications
+			issues[i].Description = "audit classification " + strconv.FormatUint(issues[i].Classification, 10)
+			continue
+		}
+		if _, ok := descriptions[t]; !ok {
+			desc, err := a.deviceHumanReadableDescriptionForAuditCaseID(t)
+			if err != nil {
+				log.Debugf("no human readable description for audit type %s: %v", t, err)
+			}
+			if desc == "" {
+				desc = "audit type " + t
+			}
+			descriptions[t] = desc
+		}
+		issues[i].Description = descriptions[t]
+	}
+	return issues, nil
+}
+
+// unwrapAXObject strips the {"ObjectType": ..., "Value": ...} envelopes the AX service
+// wraps around every value, leaving plain maps, slices and primitives.
+func unwrapAXObject(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if _, ok := value["ObjectType"]; ok {
+			return unwrapAXObject(value["Value"])
+		}
+		result := make(map[string]interface{}, len(value))
+		for k, inner := range value {
+			result[k] = unwrapAXObject(inner)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, inner := range value {
+			result[i] = unwrapAXObject(inner)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+func parseAuditIssues(result interface{}) ([]AuditIssue, error) {
+	var list []interface{}
+	switch r := result.(type) {
+	case []interface{}:
+		list = r
+	case map[string]interface{}:
+		for _, key := range []string{"value", "Value"} {
+			if l, ok := r[key].([]interface{}); ok {
+				list = l
+				break
+			}
+		}
+		if list == nil {
+			return nil, fmt.Errorf("audit result does not contain an issue list: %v", r)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected audit result type: %T", result)
+	}
+
+	issues := make([]AuditIssue, 0, len(list))
+	for _, entry := range list {
+		fields, ok := entry.(map[string]interface{})
+		if !ok {
+			log.Warnf("skipping audit issue with unexpected type: %T", entry)
+			continue
+		}
+		classification := toUint64(fields["IssueClassificationValue_v1"])
+		var extra map[string]interface{}
+		for k, v := range fields {
+			if !knownIssueKeys[k] {
+				if extra == nil {
+					extra = map[string]interface{}{}
+				}
+				extra[k] = v
+			}
+		}
+		issues = append(issues, AuditIssue{
+			AuditType:                auditTypeFor(classification),
+			Classification:           classification,
+			ElementRect:              fields["ElementRectValue_v1"],
+			FontSize:                 fields["FontSizeValue_v1"],
+			MLGeneratedDescription:   fields["MLGeneratedDescriptionValue_v1"],
+			LongDescriptionExtraInfo: fields["LongDescriptionExtraInfo_v1"],
+			ForegroundColor:          fields["ForegroundColorValue_v1"],
+			BackgroundColor:          fields["BackgroundColorValue_v1"],
+			Extra:                    extra,
+		})
+	}
+	return issues, nil
+}
+
+func toUint64(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		return uint64(n)
+	case int:
+		return uint64(n)
+	case uint32:
+		return uint64(n)
+	case int32:
+		return uint64(n)
+	case float64:
+		return uint64(n)
+	default:
+		return 0
+	}
+}
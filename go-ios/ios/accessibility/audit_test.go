@@ -0,0 +1,59 @@
+package accessibility
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAuditIssues(t *testing.T) {
+	tests := []struct {
+		name   string
+		result interface{}
+		want   []AuditIssue
+	}{
+		{
+			name: "known classification",
+			result: []interface{}{map[string]interface{}{
+				"IssueClassificationValue_v1": uint64(12),
+				"FontSizeValue_v1":            float64(17),
+			}},
+			want: []AuditIssue{{AuditType: "testTypeContrast", Classification: 12, FontSize: float64(17)}},
+		},
+		{
+			name: "unknown classification keeps the raw value and keys",
+			result: map[string]interface{}{"value": []interface{}{map[string]interface{}{
+				"IssueClassificationValue_v1": int64(4242),
+				"NewAuditKey_v1":              "something",
+			}}},
+			want: []AuditIssue{{Classification: 4242, Extra: map[string]interface{}{"NewAuditKey_v1": "something"}}},
+		},
+		{
+			name:   "entries that are no maps are skipped",
+			result: map[string]interface{}{"Value": []interface{}{"garbage"}},
+			want:   []AuditIssue{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issues, err := parseAuditIssues(unwrapAXObject(tt.result))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, issues)
+		})
+	}
+}
+
+func TestParseAuditIssuesInvalid(t *testing.T) {
+	_, err := parseAuditIssues(map[string]interface{}{"other": 1})
+	assert.Error(t, err)
+	_, err = parseAuditIssues("result")
+	assert.Error(t, err)
+}
+
+func TestUnwrapAXObject(t *testing.T) {
+	wrapped := map[string]interface{}{"ObjectType": "AXAuditIssue_v1", "Value": map[string]interface{}{
+		"IssueClassificationValue_v1": map[string]interface{}{"ObjectType": "passthrough", "Value": uint64(100)},
+	}}
+	assert.Equal(t, map[string]interface{}{"IssueClassificationValue_v1": uint64(100)}, unwrapAXObject(wrapped))
+}
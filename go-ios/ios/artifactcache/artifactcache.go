@@ -0,0 +1,549 @@
+// Package artifactcache keeps downloaded IPAs and developer disk images on disk, addressed by the SHA-256 of their
+// content. Every file is fetched once no matter how many callers ask for it at the same time, and the least recently
+// used files are evicted when the cache grows over its size limit.
+package artifactcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRevalidateAfter is how long a downloaded url is used before the server is asked whether it changed
+const DefaultRevalidateAfter = time.Hour
+
+// ErrNotFound is returned for hashes that are not in the cache
+var ErrNotFound = errors.New("artifact not cached")
+
+// ErrInUse is returned when deleting an entry that is pinned by Acquire
+var ErrInUse = errors.New("artifact in use")
+
+// Entry is one cached file
+type Entry struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+	// Sources are the URLs the content was fetched from
+	Sources  []string  `json:"sources"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// source is the content a url had when it was downloaded or checked last, with the validators for conditional
+// requests
+type source struct {
+	Hash         string    `json:"hash"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Checked      time.Time `json:"checked"`
+}
+
+type fetch struct {
+	done  chan struct{}
+	entry Entry
+	err   error
+}
+
+type extraction struct {
+	done chan struct{}
+	err  error
+}
+
+// Cache stores files in <dir>/blobs/<sha256>, zips it extracted in <dir>/extracted/<sha256> and the list of
+// entries in <dir>/index.json, so the cache survives restarts.
+type Cache struct {
+	dir      string
+	maxBytes int64
+	client   *http.Client
+	// revalidateAfter is 0 if urls are never checked again
+	revalidateAfter time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]*Entry
+	sources  map[string]*source
+	inflight map[string]*fetch
+	// extracting are the zips being extracted, by hash
+	extracting map[string]*extraction
+	// pins counts the callers of Acquire that still use an entry
+	pins map[string]int
+}
+
+type index struct {
+	Entries []Entry            `json:"entries"`
+	Sources map[string]*source `json:"sources,omitempty"`
+}
+
+// New opens the cache in dir, creating it if needed. maxBytes limits the size of the cached files, 0 means no limit.
+func New(dir string, maxBytes int64) (*Cache, error) {
+	for _, sub := range []string{"blobs", "extracted", "links", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("artifactcache: could not create %s: %w", dir, err)
+		}
+	}
+	c := &Cache{
+		dir:             dir,
+		maxBytes:        maxBytes,
+		client:          &http.Client{Timeout: 30 * time.Minute},
+		revalidateAfter: DefaultRevalidateAfter,
+		entries:         map[string]*Entry{},
+		sources:         map[string]*source{},
+		inflight:        map[string]*fetch{},
+		extracting:      map[string]*extraction{},
+		pins:            map[string]int{},
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("artifactcache: could not read index: %w", err)
+	}
+	var idx index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("artifactcache: invalid index: %w", err)
+	}
+	for _, entry := range idx.Entries {
+		if _, err := os.Stat(c.Path(entry.Hash)); err != nil {
+			continue
+		}
+		entry := entry
+		c.entries[entry.Hash] = &entry
+		for _, url := range entry.Sources {
+			src, ok := idx.Sources[url]
+			if !ok || src.Hash != entry.Hash {
+				// indexes without validators are checked on first use
+				src = &source{Hash: entry.Hash}
+			}
+			c.sources[url] = src
+		}
+	}
+	return c, nil
+}
+
+// Dir is the directory the cache lives in
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// MaxBytes is the size limit, 0 if there is none
+func (c *Cache) MaxBytes() int64 {
+	return c.maxBytes
+}
+
+// SetRevalidateAfter changes how long a downloaded url is used before it is checked again, 0 never checks again
+func (c *Cache) SetRevalidateAfter(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.revalidateAfter = d
+}
+
+// Path is where the content with hash is stored
+func (c *Cache) Path(hash string) string {
+	return filepath.Join(c.dir, "blobs", hash)
+}
+
+// Get returns the entry for url, downloading it if it is not cached yet. Once the url was not checked for the
+// revalidation interval, the server is asked with a conditional request whether it changed. Concurrent calls for the
+// same url share one download. It runs on its own context, so a caller that gives up on ctx does not fail the
+// download for the others.
+func (c *Cache) Get(ctx context.Context, url string) (Entry, error) {
+	c.mu.Lock()
+	if src, ok := c.sources[url]; ok && (c.revalidateAfter <= 0 || time.Since(src.Checked) < c.revalidateAfter) {
+		if entry, ok := c.entries[src.Hash]; ok {
+			entry.LastUsed = time.Now()
+			result := *entry
+			c.saveLocked()
+			c.mu.Unlock()
+			return result, nil
+		}
+	}
+	f, ok := c.inflight[url]
+	if !ok {
+		f = &fetch{done: make(chan struct{})}
+		c.inflight[url] = f
+		go c.runFetch(url, f)
+	}
+	c.mu.Unlock()
+	select {
+	case <-f.done:
+		return f.entry, f.err
+	case <-ctx.Done():
+		return Entry{}, ctx.Err()
+	}
+}
+
+// runFetch downloads url for all callers waiting on f, the client timeout bounds it
+func (c *Cache) runFetch(url string, f *fetch) {
+	f.entry, f.err = c.download(context.Background(), url)
+	c.mu.Lock()
+	delete(c.inflight, url)
+	c.mu.Unlock()
+	close(f.done)
+}
+
+// Acquire returns the entry for url like Get and pins it, so its file is neither evicted nor deleted until release is
+// called. Callers that use the file after Get returned should use Acquire instead.
+func (c *Cache) Acquire(ctx context.Context, url string) (Entry, func(), error) {
+	for {
+		entry, err := c.Get(ctx, url)
+		if err != nil {
+			return Entry{}, nil, err
+		}
+		if release, ok := c.pin(entry.Hash); ok {
+			return entry, release, nil
+		}
+		// evicted by another download before it was pinned
+	}
+}
+
+// pin keeps the entry with hash until the returned function is called
+func (c *Cache) pin(hash string) (func(), bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[hash]; !ok {
+		return nil, false
+	}
+	c.pins[hash]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.unpinLocked(hash)
+		})
+	}, true
+}
+
+func (c *Cache) unpinLocked(hash string) {
+	if c.pins[hash]--; c.pins[hash] == 0 {
+		delete(c.pins, hash)
+	}
+	// entries kept over the limit while pinned go now
+	c.evictLocked("")
+	c.saveLocked()
+}
+
+// Lookup returns the entry for url if it is cached, without downloading it or counting it as used
+func (c *Cache) Lookup(url string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	src, ok := c.sources[url]
+	if !ok {
+		return Entry{}, false
+	}
+	entry, ok := c.entries[src.Hash]
+	if !ok {
+		return Entry{}, false
+	}
+	return *entry, true
+}
+
+// download fetches url, conditionally if it is cached. The cached content is kept when the url did not change or the
+// check fails.
+func (c *Cache) download(ctx context.Context, url string) (Entry, error) {
+	c.mu.Lock()
+	var cached source
+	src, revalidate := c.sources[url]
+	if revalidate {
+		cached = *src
+	}
+	c.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return Entry{}, err
+	}
+	if revalidate {
+		log.Infof("artifactcache: checking %s", url)
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	} else {
+		log.Infof("artifactcache: downloading %s", url)
+	}
+	resp, err := c.client.Do(req)
+	notModified := err == nil && revalidate && resp.StatusCode == http.StatusNotModified
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if !notModified {
+			err = fmt.Errorf("artifactcache: download of %s: %s", url, resp.Status)
+		}
+	}
+	if revalidate && (err != nil || notModified) {
+		if err != nil {
+			log.Warnf("artifactcache: could not check %s, using the cached copy: %v", url, err)
+		}
+		if entry, ok := c.checked(url, cached.Hash); ok {
+			return entry, nil
+		}
+		if err == nil {
+			// evicted while it was checked
+			return c.downloadAgain(ctx, url)
+		}
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	defer resp.Body.Close()
+	return c.store(resp.Body, url, resp.Header)
+}
+
+// downloadAgain fetches url unconditionally
+func (c *Cache) downloadAgain(ctx context.Context, url string) (Entry, error) {
+	c.mu.Lock()
+	delete(c.sources, url)
+	c.mu.Unlock()
+	return c.download(ctx, url)
+}
+
+// checked marks url as checked now if it still points to hash
+func (c *Cache) checked(url string, hash string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	src, ok := c.sources[url]
+	if !ok || src.Hash != hash {
+		return Entry{}, false
+	}
+	entry, ok := c.entries[hash]
+	if !ok {
+		return Entry{}, false
+	}
+	now := time.Now()
+	src.Checked = now
+	entry.LastUsed = now
+	c.saveLocked()
+	return *entry, true
+}
+
+// store writes r to a temporary file while hashing it and moves it to its blob afterwards. header has the validators
+// of the response.
+func (c *Cache) store(r io.Reader, url string, header http.Header) (Entry, error) {
+	tmp, err := os.CreateTemp(filepath.Join(c.dir, "tmp"), "artifact-*")
+	if err != nil {
+		return Entry{}, err
+	}
+	defer os.Remove(tmp.Name())
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return Entry{}, fmt.Errorf("artifactcache: could not store %s: %w", url, err)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	entry, ok := c.entries[hash]
+	if !ok {
+		if err := os.Rename(tmp.Name(), c.Path(hash)); err != nil {
+			return Entry{}, err
+		}
+		entry = &Entry{Hash: hash, Size: size, Sources: []string{}, Created: now}
+		c.entries[hash] = entry
+	}
+	entry.LastUsed = now
+	if previous, ok := c.sources[url]; ok && previous.Hash != hash {
+		// the url changed, the old content stays cached under its other urls
+		if old, ok := c.entries[previous.Hash]; ok {
+			old.Sources = slices.DeleteFunc(old.Sources, func(s string) bool { return s == url })
+		}
+	}
+	if !contains(entry.Sources, url) {
+		entry.Sources = append(entry.Sources, url)
+	}
+	c.sources[url] = &source{Hash: hash, ETag: header.Get("ETag"), LastModified: header.Get("Last-Modified"), Checked: now}
+	c.evictLocked(hash)
+	c.saveLocked()
+	return *entry, nil
+}
+
+// Extract unzips the entry with hash once and returns the directory it was extracted to. Concurrent calls for the same
+// hash share one extraction, the entry is pinned while it runs and the cache stays usable.
+func (c *Cache) Extract(hash string) (string, error) {
+	dest := filepath.Join(c.dir, "extracted", hash)
+	c.mu.Lock()
+	if _, ok := c.entries[hash]; !ok {
+		c.mu.Unlock()
+		return "", ErrNotFound
+	}
+	if _, err := os.Stat(dest); err == nil {
+		c.mu.Unlock()
+		return dest, nil
+	}
+	x, ok := c.extracting[hash]
+	if ok {
+		c.mu.Unlock()
+		<-x.done
+	} else {
+		x = &extraction{done: make(chan struct{})}
+		c.extracting[hash] = x
+		c.pins[hash]++
+		c.mu.Unlock()
+		x.err = c.unzip(hash, dest)
+		c.mu.Lock()
+		delete(c.extracting, hash)
+		c.unpinLocked(hash)
+		c.mu.Unlock()
+		close(x.done)
+	}
+	if x.err != nil {
+		return "", x.err
+	}
+	return dest, nil
+}
+
+// unzip extracts the blob of hash to a temporary directory and moves it to dest when it is complete
+func (c *Cache) unzip(hash string, dest string) error {
+	tmp, err := os.MkdirTemp(filepath.Join(c.dir, "tmp"), "extract-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if _, _, err := ios.Unzip(c.Path(hash), tmp); err != nil {
+		return fmt.Errorf("artifactcache: could not extract %s: %w", hash, err)
+	}
+	return os.Rename(tmp, dest)
+}
+
+// Link makes the entry with hash available as <dir>/links/<name>, for consumers that expect files with a given name
+// next to each other. Links of evicted entries dangle until they are linked again.
+func (c *Cache) Link(hash string, name string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[hash]; !ok {
+		return "", ErrNotFound
+	}
+	link := filepath.Join(c.dir, "links", name)
+	if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+		return "", err
+	}
+	target, err := filepath.Abs(c.Path(hash))
+	if err != nil {
+		return "", err
+	}
+	if current, err := os.Readlink(link); err == nil && current == target {
+		return link, nil
+	}
+	_ = os.Remove(link)
+	return link, os.Symlink(target, link)
+}
+
+// List returns all entries, the most recently used first
+func (c *Cache) List() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := make([]Entry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastUsed.After(list[j].LastUsed) })
+	return list
+}
+
+// Size is the number of bytes of all cached files
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sizeLocked()
+}
+
+// Delete removes the entry with hash and everything extracted from it, unless it is pinned
+func (c *Cache) Delete(hash string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[hash]; !ok {
+		return ErrNotFound
+	}
+	if c.pins[hash] > 0 {
+		return ErrInUse
+	}
+	c.removeLocked(hash)
+	c.saveLocked()
+	return nil
+}
+
+func (c *Cache) sizeLocked() int64 {
+	var size int64
+	for _, entry := range c.entries {
+		size += entry.Size
+	}
+	return size
+}
+
+// evictLocked removes the least recently used entries until the cache fits its limit. keep and pinned entries are never
+// evicted, the cache stays over its limit while they do not fit.
+func (c *Cache) evictLocked(keep string) {
+	if c.maxBytes <= 0 {
+		return
+	}
+	size := c.sizeLocked()
+	for size > c.maxBytes {
+		var oldest *Entry
+		for hash, entry := range c.entries {
+			if hash != keep && c.pins[hash] == 0 && (oldest == nil || entry.LastUsed.Before(oldest.LastUsed)) {
+				oldest = entry
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		log.Infof("artifactcache: evicting %s (%d bytes)", oldest.Hash, oldest.Size)
+		size -= oldest.Size
+		c.removeLocked(oldest.Hash)
+	}
+}
+
+func (c *Cache) removeLocked(hash string) {
+	entry := c.entries[hash]
+	for _, url := range entry.Sources {
+		delete(c.sources, url)
+	}
+	delete(c.entries, hash)
+	_ = os.Remove(c.Path(hash))
+	_ = os.RemoveAll(filepath.Join(c.dir, "extracted", hash))
+}
+
+// saveLocked writes the index through a temporary file, a failure only costs the cache its memory of the files
+func (c *Cache) saveLocked() {
+	idx := index{Entries: make([]Entry, 0, len(c.entries)), Sources: c.sources}
+	for _, entry := range c.entries {
+		idx.Entries = append(idx.Entries, *entry)
+	}
+	data, _ := json.MarshalIndent(idx, "", "  ")
+	path := filepath.Join(c.dir, "index.json")
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		log.Warnf("artifactcache: could not write index: %v", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Warnf("artifactcache: could not write index: %v", err)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,284 @@
+package artifactcache_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios/artifactcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func server(t *testing.T, requests *atomic.Int32, release <-chan struct{}) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if release != nil {
+			<-release
+		}
+		w.Write([]byte(strings.Repeat(r.URL.Path, 10)))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestConcurrentGetsDownloadOnce(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	s := server(t, &requests, release)
+	cache, err := artifactcache.New(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	entries := make([]artifactcache.Entry, 5)
+	for i := range entries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entry, err := cache.Get(context.Background(), s.URL+"/app.ipa")
+			entries[i] = entry
+			assert.NoError(t, err)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), requests.Load())
+	sum := sha256.Sum256([]byte(strings.Repeat("/app.ipa", 10)))
+	for _, entry := range entries {
+		assert.Equal(t, hex.EncodeToString(sum[:]), entry.Hash)
+	}
+	data, err := os.ReadFile(cache.Path(entries[0].Hash))
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("/app.ipa", 10), string(data))
+}
+
+func TestCancelledGetDoesNotFailOthers(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	s := server(t, &requests, release)
+	cache, err := artifactcache.New(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := cache.Get(ctx, s.URL+"/app.ipa")
+		first <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	second := make(chan error, 1)
+	go func() {
+		_, err := cache.Get(context.Background(), s.URL+"/app.ipa")
+		second <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-first, context.Canceled)
+	close(release)
+	assert.NoError(t, <-second)
+	assert.Equal(t, int32(1), requests.Load())
+	assert.Len(t, cache.List(), 1)
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	var requests atomic.Int32
+	s := server(t, &requests, nil)
+	dir := t.TempDir()
+	// every file is 40 bytes, two fit
+	cache, err := artifactcache.New(dir, 80)
+	require.NoError(t, err)
+
+	a, err := cache.Get(context.Background(), s.URL+"/a.a")
+	require.NoError(t, err)
+	b, err := cache.Get(context.Background(), s.URL+"/b.b")
+	require.NoError(t, err)
+	_, err = cache.Get(context.Background(), s.URL+"/a.a")
+	require.NoError(t, err)
+	c, err := cache.Get(context.Background(), s.URL+"/c.c")
+	require.NoError(t, err)
+
+	hashes := []string{}
+	for _, entry := range cache.List() {
+		hashes = append(hashes, entry.Hash)
+	}
+	assert.Equal(t, []string{c.Hash, a.Hash}, hashes)
+	assert.Equal(t, int64(80), cache.Size())
+	_, err = os.Stat(cache.Path(b.Hash))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, int32(3), requests.Load())
+
+	reopened, err := artifactcache.New(dir, 80)
+	require.NoError(t, err)
+	assert.Len(t, reopened.List(), 2)
+	_, err = reopened.Get(context.Background(), s.URL+"/a.a")
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestAcquiredEntriesAreKept(t *testing.T) {
+	var requests atomic.Int32
+	s := server(t, &requests, nil)
+	// every file is 40 bytes, one fits
+	cache, err := artifactcache.New(t.TempDir(), 40)
+	require.NoError(t, err)
+
+	a, release, err := cache.Acquire(context.Background(), s.URL+"/a.a")
+	require.NoError(t, err)
+	b, err := cache.Get(context.Background(), s.URL+"/b.b")
+	require.NoError(t, err)
+	_, err = os.Stat(cache.Path(a.Hash))
+	assert.NoError(t, err, "pinned entry was evicted")
+	assert.ErrorIs(t, cache.Delete(a.Hash), artifactcache.ErrInUse)
+	assert.Equal(t, int64(80), cache.Size())
+
+	release()
+	release()
+	assert.Equal(t, int64(40), cache.Size())
+	_, err = os.Stat(cache.Path(a.Hash))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(cache.Path(b.Hash))
+	assert.NoError(t, err)
+}
+
+func TestRevalidates(t *testing.T) {
+	var mu sync.Mutex
+	content := "v1"
+	var requests, downloads atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		mu.Lock()
+		defer mu.Unlock()
+		etag := `"` + content + `"`
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads.Add(1)
+		w.Write([]byte(content))
+	}))
+	dir := t.TempDir()
+	cache, err := artifactcache.New(dir, 0)
+	require.NoError(t, err)
+	cache.SetRevalidateAfter(time.Millisecond)
+	url := s.URL + "/latest/app.ipa"
+
+	first, err := cache.Get(context.Background(), url)
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	unchanged, err := cache.Get(context.Background(), url)
+	require.NoError(t, err)
+	assert.Equal(t, first.Hash, unchanged.Hash)
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Equal(t, int32(1), downloads.Load())
+
+	mu.Lock()
+	content = "v2"
+	mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	changed, err := cache.Get(context.Background(), url)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Hash, changed.Hash)
+	assert.Equal(t, int32(2), downloads.Load())
+	data, err := os.ReadFile(cache.Path(changed.Hash))
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(data))
+	for _, entry := range cache.List() {
+		if entry.Hash == first.Hash {
+			assert.Empty(t, entry.Sources)
+		}
+	}
+
+	// the validators survive a restart and an unreachable server keeps the cached copy
+	reopened, err := artifactcache.New(dir, 0)
+	require.NoError(t, err)
+	reopened.SetRevalidateAfter(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	_, err = reopened.Get(context.Background(), url)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), downloads.Load())
+	s.Close()
+	time.Sleep(5 * time.Millisecond)
+	offline, err := reopened.Get(context.Background(), url)
+	require.NoError(t, err)
+	assert.Equal(t, changed.Hash, offline.Hash)
+}
+
+func TestConcurrentExtract(t *testing.T) {
+	var zipped bytes.Buffer
+	w := zip.NewWriter(&zipped)
+	f, err := w.Create("Restore/BuildManifest.plist")
+	require.NoError(t, err)
+	f.Write([]byte("manifest"))
+	require.NoError(t, w.Close())
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(zipped.Bytes())
+	}))
+	defer s.Close()
+	cache, err := artifactcache.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	entry, err := cache.Get(context.Background(), s.URL+"/image.zip")
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	dirs := make([]string, 5)
+	for i := range dirs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dir, err := cache.Extract(entry.Hash)
+			assert.NoError(t, err)
+			dirs[i] = dir
+		}()
+	}
+	wg.Wait()
+	for _, dir := range dirs {
+		assert.Equal(t, dirs[0], dir)
+	}
+	data, err := os.ReadFile(filepath.Join(dirs[0], "Restore", "BuildManifest.plist"))
+	require.NoError(t, err)
+	assert.Equal(t, "manifest", string(data))
+	// the extraction does not keep the entry pinned
+	require.NoError(t, cache.Delete(entry.Hash))
+	_, err = cache.Extract(entry.Hash)
+	assert.ErrorIs(t, err, artifactcache.ErrNotFound)
+}
+
+func TestDelete(t *testing.T) {
+	var requests atomic.Int32
+	s := server(t, &requests, nil)
+	cache, err := artifactcache.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	entry, err := cache.Get(context.Background(), s.URL+"/a")
+	require.NoError(t, err)
+
+	require.NoError(t, cache.Delete(entry.Hash))
+	assert.ErrorIs(t, cache.Delete(entry.Hash), artifactcache.ErrNotFound)
+	assert.Empty(t, cache.List())
+	_, err = cache.Get(context.Background(), s.URL+"/a")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestFailedDownload(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	defer s.Close()
+	cache, err := artifactcache.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	_, err = cache.Get(context.Background(), s.URL+"/missing")
+	assert.Error(t, err)
+	assert.Empty(t, cache.List())
+}
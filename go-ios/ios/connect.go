@@ -96,7 +96,7 @@ func ConnectToService(device DeviceEntry, serviceName string) (DeviceConnectionI
 		return nil, err
 	}
 
-	muxConn, err := NewUsbMuxConnectionSimple()
+	muxConn, err := NewUsbMuxConnectionForDevice(device)
 	if err != nil {
 		return nil, fmt.Errorf("Could not connect to usbmuxd socket, is it running? %w", err)
 	}
@@ -331,7 +331,7 @@ func (muxConn *UsbMuxConnection) connectWithStartServiceResponse(deviceID int, s
 }
 
 func ConnectLockdownWithSession(device DeviceEntry) (*LockDownConnection, error) {
-	muxConnection, err := NewUsbMuxConnectionSimple()
+	muxConnection, err := NewUsbMuxConnectionForDevice(device)
 	if err != nil {
 		return nil, fmt.Errorf("USBMuxConnection failed: %w", err)
 	}
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"go.mozilla.org/pkcs7"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 const bitSize = 2048
@@ -290,3 +291,17 @@ func CreateDERFormattedSupervisionCert() (*CaCertificate, error) {
 		Csr:           string(csr),
 	}, nil
 }
+
+// ToP12 encodes the certificate and private key into a password protected p12 file, like the openssl command
+// in the docs of CreateDERFormattedSupervisionCert does. The result can be used for PairSupervised.
+func (c *CaCertificate) ToP12(password string) ([]byte, error) {
+	cert, err := x509.ParseCertificate(c.CertDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing certificate: %w", err)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(c.PrivateKeyDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing private key: %w", err)
+	}
+	return pkcs12.Encode(rand.Reader, key, cert, nil, password)
+}
@@ -0,0 +1,29 @@
+package ios_test
+
+import (
+	"bytes"
+	"testing"
+
+	ios "github.com/danielpaulus/go-ios/ios"
+	"github.com/stretchr/testify/assert"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestSupervisionCertToP12(t *testing.T) {
+	cert, err := ios.CreateDERFormattedSupervisionCert()
+	if !assert.NoError(t, err) {
+		return
+	}
+	p12, err := cert.ToP12("secret")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, decoded, err := pkcs12.Decode(p12, "secret")
+	if assert.NoError(t, err) {
+		assert.True(t, bytes.Equal(cert.CertDER, decoded.Raw))
+	}
+
+	_, _, err = pkcs12.Decode(p12, "wrong")
+	assert.Error(t, err)
+}
@@ -54,6 +54,68 @@ func (diagnosticsConn *Connection) Battery() (IORegistry, error) {
 	return diagnosticsfromBytes(response).Diagnostics.IORegistry, nil
 }
 
+// IORegistryQuery returns the raw ioregistry entry for the given plane, entry name and entry class.
+// Empty arguments are left out of the request, at least one of name and class should be set.
+func (diagnosticsConn *Connection) IORegistryQuery(plane string, name string, class string) (map[string]interface{}, error) {
+	req := newIORegistryRequest()
+	if plane != "" {
+		req.addPlane(plane)
+	}
+	if name != "" {
+		req.addName(name)
+	}
+	if class != "" {
+		req.addClass(class)
+	}
+	encoded, err := req.encoded()
+	if err != nil {
+		return nil, err
+	}
+	diagnostics, err := diagnosticsConn.sendRequest(encoded)
+	if err != nil {
+		return nil, err
+	}
+	registry, ok := diagnostics["IORegistry"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("no ioregistry entry found for plane:'%s' name:'%s' class:'%s'", plane, name, class)
+	}
+	return registry, nil
+}
+
+// Query returns the raw diagnostics for a domain like All, WiFi, GasGauge, NAND or HDMI
+func (diagnosticsConn *Connection) Query(domain string) (map[string]interface{}, error) {
+	bytes, err := diagnosticsConn.plistCodec.Encode(diagnosticsRequest{domain})
+	if err != nil {
+		return nil, err
+	}
+	return diagnosticsConn.sendRequest(bytes)
+}
+
+// sendRequest sends an encoded request and returns the Diagnostics dictionary of the response
+func (diagnosticsConn *Connection) sendRequest(encoded []byte) (map[string]interface{}, error) {
+	reader := diagnosticsConn.deviceConn.Reader()
+	err := diagnosticsConn.deviceConn.Send(encoded)
+	if err != nil {
+		return nil, err
+	}
+	response, err := diagnosticsConn.plistCodec.Decode(reader)
+	if err != nil {
+		return nil, err
+	}
+	plist, err := ios.ParsePlist(response)
+	if err != nil {
+		return nil, err
+	}
+	if status, _ := plist["Status"].(string); status != "Success" {
+		return nil, fmt.Errorf("diagnostics request failed, response: %+v", plist)
+	}
+	diagnostics, ok := plist["Diagnostics"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("diagnostics response without Diagnostics: %+v", plist)
+	}
+	return diagnostics, nil
+}
+
 func (diagnosticsConn *Connection) Reboot() error {
 	req := rebootRequest{Request: "Restart", WaitForDisconnect: true, DisplayFail: true, DisplayPass: true}
 	reader := diagnosticsConn.deviceConn.Reader()
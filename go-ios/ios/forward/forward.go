@@ -33,7 +33,7 @@ func Forward(device ios.DeviceEntry, hostPort uint16, phonePort uint16) (*ConnLi
 		quit:     make(chan interface{}),
 	}
 
-	go connectionAccept(cl, device.DeviceID, phonePort)
+	go connectionAccept(cl, device, phonePort)
 
 	return cl, nil
 }
@@ -50,7 +50,7 @@ func (cl *ConnListener) Close() error {
 	return nil
 }
 
-func connectionAccept(cl *ConnListener, deviceID int, phonePort uint16) {
+func connectionAccept(cl *ConnListener, device ios.DeviceEntry, phonePort uint16) {
 	for {
 		select {
 		case <-cl.quit:
@@ -63,19 +63,19 @@ func connectionAccept(cl *ConnListener, deviceID int, phonePort uint16) {
 				continue
 			}
 			log.WithFields(log.Fields{"conn": fmt.Sprintf("%#v", cl)}).Info("new client connected")
-			go StartNewProxyConnection(context.TODO(), clientConn, deviceID, phonePort)
+			go StartNewProxyConnection(context.TODO(), clientConn, device, phonePort)
 		}
 	}
 }
 
-func StartNewProxyConnection(ctx context.Context, clientConn io.ReadWriteCloser, deviceID int, phonePort uint16) error {
-	usbmuxConn, err := ios.NewUsbMuxConnectionSimple()
+func StartNewProxyConnection(ctx context.Context, clientConn io.ReadWriteCloser, device ios.DeviceEntry, phonePort uint16) error {
+	usbmuxConn, err := ios.NewUsbMuxConnectionForDevice(device)
 	if err != nil {
 		log.Errorf("could not connect to usbmuxd: %+v", err)
 		clientConn.Close()
 		return fmt.Errorf("could not connect to usbmuxd: %v", err)
 	}
-	muxError := usbmuxConn.Connect(deviceID, phonePort)
+	muxError := usbmuxConn.Connect(device.DeviceID, phonePort)
 	if muxError != nil {
 		log.WithFields(log.Fields{"conn": fmt.Sprintf("%#v", clientConn), "err": muxError, "phonePort": phonePort}).Infof("could not connect to phone")
 		clientConn.Close()
@@ -97,15 +97,28 @@ func (conn *DeveloperDiskImageMounter) MountImage(imagePath string) error {
 }
 
 func (conn *DeveloperDiskImageMounter) UnmountImage() error {
+	return unmountImage(conn.plistRw, "/Developer")
+}
+
+// unmountImage unmounts the image at mountPath and waits for the device to confirm it
+func unmountImage(plistRw ios.PlistCodecReadWriter, mountPath string) error {
 	req := map[string]interface{}{
 		"Command":   "UnmountImage",
-		"MountPath": "/Developer",
+		"MountPath": mountPath,
 	}
 	log.Debugf("sending: %+v", req)
-	err := conn.plistRw.Write(req)
+	err := plistRw.Write(req)
 	if err != nil {
 		return err
 	}
+	var resp map[string]interface{}
+	err = plistRw.Read(&resp)
+	if err != nil {
+		return fmt.Errorf("unmountImage: failed to read response for 'UnmountImage': %w", err)
+	}
+	if deviceError, ok := resp["Error"]; ok {
+		return fmt.Errorf("unmountImage: device responded with error: %v", deviceError)
+	}
 	return nil
 }
 
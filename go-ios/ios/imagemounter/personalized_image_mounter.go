@@ -64,6 +64,7 @@ func (p PersonalizedDeveloperDiskImageMounter) ListImages() ([][]byte, error) {
 //
 // MountImage gets device identifiers and a nonce from the device first, which needs to be signed by Apple
 // and after that the developer disk image is sent to the device with this signature to be able to mount it.
+// With TicketDir set a ticket signed before is tried first and a new one is only requested if the device rejects it.
 func (p PersonalizedDeveloperDiskImageMounter) MountImage(imagePath string) error {
 	manifest, err := loadBuildManifest(path.Join(imagePath, "BuildManifest.plist"))
 	if err != nil {
@@ -74,24 +75,52 @@ func (p PersonalizedDeveloperDiskImageMounter) MountImage(imagePath string) erro
 	if err != nil {
 		return fmt.Errorf("MountImage: failed to query personalization identifiers: %w", err)
 	}
-	nonce, err := p.queryPersonalizedImageNonce()
-	if err != nil {
-		return fmt.Errorf("MountImage: failed to get nonce: %w", err)
-	}
 
 	identity, err := manifest.findIdentity(identifiers)
 	if err != nil {
 		return fmt.Errorf("MountImage: could not find identity for identifiers %+v: %w", identifiers, err)
 	}
 
+	dmgPath := path.Join(imagePath, identity.Manifest.PersonalizedDmg.Info.Path)
+	trustCache, err := os.ReadFile(path.Join(imagePath, identity.Manifest.LoadableTrustCache.Info.Path))
+	if err != nil {
+		return fmt.Errorf("MountImage: could not load trust-cache. %w", err)
+	}
+
+	if ticket := loadTicket(p.ecid, identity); ticket != nil {
+		err = p.mountSigned(dmgPath, ticket, trustCache)
+		if err == nil {
+			log.Debugf("MountImage: mounted with cached ticket")
+			return p.hangUp()
+		}
+		log.Infof("MountImage: cached ticket not accepted, requesting a new one: %v", err)
+		removeTicket(p.ecid, identity)
+	}
+
+	nonce, err := p.queryPersonalizedImageNonce()
+	if err != nil {
+		return fmt.Errorf("MountImage: failed to get nonce: %w", err)
+	}
+
 	signature, err := p.tss.getSignature(identity, identifiers, nonce, p.ecid)
 	if err != nil {
 		return fmt.Errorf("MountImage: failed to get signature from Apple: %w", err)
 	}
 
-	dmgPath := path.Join(imagePath, identity.Manifest.PersonalizedDmg.Info.Path)
+	err = p.mountSigned(dmgPath, signature, trustCache)
+	if err != nil {
+		return err
+	}
+	saveTicket(p.ecid, identity, signature)
+	return p.hangUp()
+}
 
+// mountSigned uploads the image at dmgPath and mounts it with signature
+func (p PersonalizedDeveloperDiskImageMounter) mountSigned(dmgPath string, signature []byte, trustCache []byte) error {
 	imageSize, err := getFileSize(dmgPath)
+	if err != nil {
+		return fmt.Errorf("MountImage: %w", err)
+	}
 
 	err = sendUploadRequest(p.plistRw, "Personalized", signature, imageSize)
 	if err != nil {
@@ -112,17 +141,15 @@ func (p PersonalizedDeveloperDiskImageMounter) MountImage(imagePath string) erro
 		return err
 	}
 
-	trustCache, err := os.ReadFile(path.Join(imagePath, identity.Manifest.LoadableTrustCache.Info.Path))
-	if err != nil {
-		return fmt.Errorf("MountImage: could not load trust-cache. %w", err)
-	}
-
 	err = p.mountPersonalizedImage(signature, trustCache)
 	if err != nil {
 		return fmt.Errorf("MountImage: mount command failed: %w", err)
 	}
+	return nil
+}
 
-	err = hangUp(p.plistRw)
+func (p PersonalizedDeveloperDiskImageMounter) hangUp() error {
+	err := hangUp(p.plistRw)
 	if err != nil {
 		return fmt.Errorf("MountImage: HangUp command failed: %w", err)
 	}
@@ -130,16 +157,7 @@ func (p PersonalizedDeveloperDiskImageMounter) MountImage(imagePath string) erro
 }
 
 func (p PersonalizedDeveloperDiskImageMounter) UnmountImage() error {
-	req := map[string]interface{}{
-		"Command":   "UnmountImage",
-		"MountPath": "/System/Developer",
-	}
-	log.Debugf("sending: %+v", req)
-	err := p.plistRw.Write(req)
-	if err != nil {
-		return err
-	}
-	return nil
+	return unmountImage(p.plistRw, "/System/Developer")
 }
 
 func (p PersonalizedDeveloperDiskImageMounter) queryPersonalizedImageNonce() ([]byte, error) {
@@ -223,6 +241,9 @@ func (p PersonalizedDeveloperDiskImageMounter) mountPersonalizedImage(signatureB
 	if err != nil {
 		return fmt.Errorf("mountPersonalizedImage: failed to read response for 'MountImage': %w", err)
 	}
+	if deviceError, ok := res["Error"]; ok {
+		return fmt.Errorf("mountPersonalizedImage: device responded with error: %v %v", deviceError, res["DetailedError"])
+	}
 	return nil
 }
 
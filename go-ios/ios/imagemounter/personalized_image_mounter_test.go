@@ -0,0 +1,138 @@
+package imagemounter
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"howett.net/plist"
+)
+
+// standInMounter answers the mobile_image_mounter commands of MountImage on conn. Mounting with a rejected
+// signature fails like a device that does not accept the ticket. It returns the signatures of the mount attempts
+// once the host hangs up.
+func standInMounter(t *testing.T, conn net.Conn, rejected []byte) <-chan [][]byte {
+	attempts := make(chan [][]byte, 1)
+	go func() {
+		defer conn.Close()
+		plistRw := ios.NewPlistCodecReadWriter(conn, conn)
+		var signatures [][]byte
+		defer func() { attempts <- signatures }()
+		for {
+			var req map[string]interface{}
+			if err := plistRw.Read(&req); err != nil {
+				return
+			}
+			var err error
+			switch req["Command"] {
+			case "QueryPersonalizationIdentifiers":
+				err = plistRw.Write(map[string]interface{}{"PersonalizationIdentifiers": map[string]interface{}{"BoardId": 1, "ChipID": 2}})
+			case "QueryNonce":
+				err = plistRw.Write(map[string]interface{}{"PersonalizationNonce": []byte("nonce")})
+			case "ReceiveBytes":
+				if err = plistRw.Write(map[string]interface{}{"Status": "ReceiveBytesAck"}); err != nil {
+					break
+				}
+				image := make([]byte, req["ImageSize"].(uint64))
+				if _, err = io.ReadFull(conn, image); err != nil {
+					break
+				}
+				assert.Equal(t, "dmg", string(image))
+				err = plistRw.Write(map[string]interface{}{"Status": "Complete"})
+			case "MountImage":
+				signature := req["ImageSignature"].([]byte)
+				signatures = append(signatures, signature)
+				assert.Equal(t, []byte("trust"), req["ImageTrustCache"])
+				if string(signature) == string(rejected) {
+					err = plistRw.Write(map[string]interface{}{"Error": "ImageMountFailed", "DetailedError": "ticket rejected"})
+					break
+				}
+				err = plistRw.Write(map[string]interface{}{"Status": "Complete"})
+			case "Hangup":
+				return
+			default:
+				t.Errorf("unexpected command %v", req["Command"])
+				return
+			}
+			if err != nil {
+				t.Errorf("stand-in mounter: %v", err)
+				return
+			}
+		}
+	}()
+	return attempts
+}
+
+func personalizedImage(t *testing.T) (string, buildIdentity) {
+	dir := t.TempDir()
+	manifest := map[string]interface{}{"BuildIdentities": []interface{}{map[string]interface{}{
+		"ApBoardID": "0x1",
+		"ApChipID":  "0x2",
+		"Manifest": map[string]interface{}{
+			"LoadableTrustCache": map[string]interface{}{"Digest": []byte{3, 4}, "Info": map[string]interface{}{"Path": "trust"}},
+			"PersonalizedDMG":    map[string]interface{}{"Digest": []byte{1, 2}, "Info": map[string]interface{}{"Path": "image.dmg"}},
+		},
+	}}}
+	data, err := plist.Marshal(manifest, plist.XMLFormat)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "BuildManifest.plist"), data, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "image.dmg"), []byte("dmg"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "trust"), []byte("trust"), 0o644))
+	m, err := loadBuildManifest(filepath.Join(dir, "BuildManifest.plist"))
+	require.NoError(t, err)
+	identity, err := m.findIdentity(personalizationIdentifiers{BoardId: 1, ChipID: 2})
+	require.NoError(t, err)
+	return dir, identity
+}
+
+func TestMountImageRetriesRejectedTicket(t *testing.T) {
+	var tssRequests atomic.Int32
+	tss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tssRequests.Add(1)
+		var request map[string]interface{}
+		body, _ := io.ReadAll(r.Body)
+		_, err := plist.Unmarshal(body, &request)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("nonce"), request["ApNonce"])
+		ticket, _ := plist.Marshal(map[string]interface{}{"ApImg4Ticket": []byte("fresh")}, plist.XMLFormat)
+		w.Write([]byte("STATUS=0&MESSAGE=SUCCESS&REQUEST_STRING=" + string(ticket)))
+	}))
+	defer tss.Close()
+	defer func(url, dir string) { TSSURL, TicketDir = url, dir }(TSSURL, TicketDir)
+	TSSURL = tss.URL
+	TicketDir = t.TempDir()
+
+	imagePath, identity := personalizedImage(t)
+	saveTicket(42, identity, []byte("stale"))
+	mount := func(rejected string) [][]byte {
+		host, device := net.Pipe()
+		attempts := standInMounter(t, device, []byte(rejected))
+		deviceConn := ios.NewDeviceConnectionWithRWC(host)
+		defer deviceConn.Close()
+		mounter := PersonalizedDeveloperDiskImageMounter{
+			deviceConn: deviceConn,
+			plistRw:    ios.NewPlistCodecReadWriter(deviceConn.Reader(), deviceConn.Writer()),
+			tss:        newTssClient(),
+			ecid:       42,
+		}
+		require.NoError(t, mounter.MountImage(imagePath))
+		return <-attempts
+	}
+
+	// the cached ticket is rejected, removed and a new one from TSS is used on the same connection
+	assert.Equal(t, [][]byte{[]byte("stale"), []byte("fresh")}, mount("stale"))
+	assert.Equal(t, int32(1), tssRequests.Load())
+	assert.Equal(t, []byte("fresh"), loadTicket(42, identity))
+
+	// the new ticket is cached and mounting again does not ask TSS
+	assert.Equal(t, [][]byte{[]byte("fresh")}, mount("stale"))
+	assert.Equal(t, int32(1), tssRequests.Load())
+}
@@ -0,0 +1,306 @@
+package imagemounter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/artifactcache"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoImage is returned when no developer image can be found for a device without downloading one
+var ErrNoImage = errors.New("no image available")
+
+var errNotCached = errors.New("not cached")
+
+// ErrInvalidImage is returned for uploads that do not contain a developer image
+var ErrInvalidImage = errors.New("invalid image")
+
+// ImageSource finds developer images for devices. Images in Dir are used first, then the ones in Cache and finally
+// they are downloaded into Cache from MirrorURL or the public locations DownloadImageFor uses.
+type ImageSource struct {
+	// Dir holds images in the layout of DownloadImageFor: <version>/DeveloperDiskImage.dmg with its signature, and
+	// ddi-15F31d/Restore for iOS 17 and later
+	Dir string
+	// MirrorURL has the layout of Dir, with ddi-15F31d.zip instead of the extracted directory
+	MirrorURL string
+	// Offline never downloads, devices without a local image get ErrNoImage
+	Offline bool
+	Cache   *artifactcache.Cache
+}
+
+// LocalImage is a developer image that can be mounted without downloading it
+type LocalImage struct {
+	// Version is the iOS version the image is for, 17+ for the personalized image
+	Version      string `json:"version"`
+	Personalized bool   `json:"personalized"`
+	// Source is dir for images in Dir and cache for downloaded ones
+	Source string `json:"source"`
+	Path   string `json:"path,omitempty"`
+}
+
+// ImageFor returns the path of the developer image for device, see ImageForVersion
+func (s ImageSource) ImageFor(ctx context.Context, device ios.DeviceEntry) (string, error) {
+	allValues, err := ios.GetValues(device)
+	if err != nil {
+		return "", err
+	}
+	return s.ImageForVersion(ctx, allValues.Value.ProductVersion)
+}
+
+// ImageForVersion returns the path of the developer image for devices running productVersion. For iOS 17 and later
+// that is the Restore directory of the personalized image.
+func (s ImageSource) ImageForVersion(ctx context.Context, productVersion string) (string, error) {
+	parsedVersion, err := semver.NewVersion(productVersion)
+	if err != nil {
+		return "", fmt.Errorf("ImageForVersion: failed parsing ios productversion: '%s' with %w", productVersion, err)
+	}
+	noImage := fmt.Errorf("%w for iOS %d.%d", ErrNoImage, parsedVersion.Major(), parsedVersion.Minor())
+	personalized := !parsedVersion.LessThan(ios.IOS17())
+	if local, ok := s.localImage(parsedVersion); ok {
+		log.Infof("device iOS version: %s, using developer image %s", productVersion, local)
+		return local, nil
+	}
+	if s.Cache == nil {
+		return "", noImage
+	}
+	if personalized {
+		entry, err := s.fetch(ctx, s.personalizedURL())
+		if err != nil {
+			return "", noImageError(noImage, err)
+		}
+		extracted, err := s.Cache.Extract(entry.Hash)
+		if err != nil {
+			return "", err
+		}
+		return path.Join(extracted, "Restore"), nil
+	}
+	version := MatchAvailable(productVersion)
+	log.Infof("device iOS version: %s, getting developer image for iOS %s", productVersion, version)
+	imageURL, signatureURL := s.imageURLs(version)
+	image, err := s.fetch(ctx, imageURL)
+	if err != nil {
+		return "", noImageError(noImage, err)
+	}
+	signature, err := s.fetch(ctx, signatureURL)
+	if err != nil {
+		return "", noImageError(noImage, err)
+	}
+	// MountImage expects the signature next to the image
+	versionDir := path.Join("ddi", strings.Split(version, " (")[0])
+	if _, err := s.Cache.Link(signature.Hash, path.Join(versionDir, signatureFile)); err != nil {
+		return "", err
+	}
+	return s.Cache.Link(image.Hash, path.Join(versionDir, imageFile))
+}
+
+// fetch gets url from the cache, downloading it unless the source is offline
+func (s ImageSource) fetch(ctx context.Context, url string) (artifactcache.Entry, error) {
+	if s.Offline {
+		entry, ok := s.Cache.Lookup(url)
+		if !ok {
+			return artifactcache.Entry{}, errNotCached
+		}
+		return entry, nil
+	}
+	return s.Cache.Get(ctx, url)
+}
+
+// noImageError keeps the cause of failed downloads, offline there is none worth reporting
+func noImageError(noImage error, err error) error {
+	if errors.Is(err, errNotCached) {
+		return noImage
+	}
+	return fmt.Errorf("%w: %w", noImage, err)
+}
+
+func (s ImageSource) personalizedURL() string {
+	if s.MirrorURL != "" {
+		return strings.TrimSuffix(s.MirrorURL, "/") + "/" + xcode15_4_ddi + ".zip"
+	}
+	return devicebox + xcode15_4_ddi + ".zip"
+}
+
+// imageURLs returns where the image and signature for version, one of availableVersions, are downloaded from
+func (s ImageSource) imageURLs(version string) (string, string) {
+	if s.MirrorURL != "" {
+		base := strings.TrimSuffix(s.MirrorURL, "/") + "/" + strings.Split(version, " (")[0] + "/"
+		return base + imageFile, base + signatureFile
+	}
+	return versionMap[version] + "/" + imageFile + "?raw=true", versionMap[version] + "/" + signatureFile + "?raw=true"
+}
+
+// localImage looks for an image in Dir. Before iOS 17 the image of the highest version of the same major version not
+// newer than the device is used.
+func (s ImageSource) localImage(version *semver.Version) (string, bool) {
+	if s.Dir == "" {
+		return "", false
+	}
+	if !version.LessThan(ios.IOS17()) {
+		restore := filepath.Join(s.Dir, xcode15_4_ddi, "Restore")
+		if _, err := os.Stat(filepath.Join(restore, "BuildManifest.plist")); err != nil {
+			return "", false
+		}
+		return restore, true
+	}
+	var best *semver.Version
+	var bestPath string
+	for _, image := range s.dirImages() {
+		v, err := semver.NewVersion(image.Version)
+		if err != nil || v.Major() != version.Major() || v.GreaterThan(version) {
+			continue
+		}
+		if best == nil || v.GreaterThan(best) {
+			best = v
+			bestPath = image.Path
+		}
+	}
+	return bestPath, best != nil
+}
+
+func (s ImageSource) dirImages() []LocalImage {
+	images := []LocalImage{}
+	dirs, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return images
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		if dir.Name() == xcode15_4_ddi {
+			restore := filepath.Join(s.Dir, xcode15_4_ddi, "Restore")
+			if _, err := os.Stat(filepath.Join(restore, "BuildManifest.plist")); err == nil {
+				images = append(images, LocalImage{Version: "17+", Personalized: true, Source: "dir", Path: restore})
+			}
+			continue
+		}
+		if _, err := semver.NewVersion(dir.Name()); err != nil {
+			continue
+		}
+		image := filepath.Join(s.Dir, dir.Name(), imageFile)
+		if _, err := os.Stat(image + ".signature"); err != nil {
+			continue
+		}
+		images = append(images, LocalImage{Version: dir.Name(), Source: "dir", Path: image})
+	}
+	return images
+}
+
+// Available lists the images that can be mounted without downloading, from Dir and the cache
+func (s ImageSource) Available() []LocalImage {
+	images := []LocalImage{}
+	if s.Dir != "" {
+		images = append(images, s.dirImages()...)
+	}
+	if s.Cache != nil {
+		if _, ok := s.Cache.Lookup(s.personalizedURL()); ok {
+			images = append(images, LocalImage{Version: "17+", Personalized: true, Source: "cache"})
+		}
+		for _, version := range availableVersions {
+			imageURL, signatureURL := s.imageURLs(version)
+			_, image := s.Cache.Lookup(imageURL)
+			_, signature := s.Cache.Lookup(signatureURL)
+			if image && signature {
+				images = append(images, LocalImage{Version: strings.Split(version, " (")[0], Source: "cache"})
+			}
+		}
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		a, _ := semver.NewVersion(strings.TrimSuffix(images[i].Version, "+"))
+		b, _ := semver.NewVersion(strings.TrimSuffix(images[j].Version, "+"))
+		return a.LessThan(b)
+	})
+	return images
+}
+
+// Add extracts an uploaded zip into Dir, replacing the image for the same version. For iOS 17 and later the zip has
+// to contain the Restore directory of the personalized image, before that DeveloperDiskImage.dmg and its signature.
+func (s ImageSource) Add(zipPath string, productVersion string) (LocalImage, error) {
+	version, err := semver.NewVersion(productVersion)
+	if err != nil {
+		return LocalImage{}, fmt.Errorf("%w: version %s", ErrInvalidImage, productVersion)
+	}
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return LocalImage{}, err
+	}
+	tmp, err := os.MkdirTemp(s.Dir, ".upload-*")
+	if err != nil {
+		return LocalImage{}, err
+	}
+	defer os.RemoveAll(tmp)
+	if _, _, err := ios.Unzip(zipPath, tmp); err != nil {
+		return LocalImage{}, fmt.Errorf("%w: %w", ErrInvalidImage, err)
+	}
+
+	if !version.LessThan(ios.IOS17()) {
+		manifest := findFile(tmp, "BuildManifest.plist")
+		if manifest == "" || filepath.Base(filepath.Dir(manifest)) != "Restore" {
+			return LocalImage{}, fmt.Errorf("%w: no Restore/BuildManifest.plist", ErrInvalidImage)
+		}
+		target := filepath.Join(s.Dir, xcode15_4_ddi)
+		if err := replaceDir(target, map[string]string{filepath.Dir(manifest): "Restore"}); err != nil {
+			return LocalImage{}, err
+		}
+		return LocalImage{Version: "17+", Personalized: true, Source: "dir", Path: filepath.Join(target, "Restore")}, nil
+	}
+	image := findFile(tmp, imageFile)
+	if image == "" {
+		return LocalImage{}, fmt.Errorf("%w: no %s", ErrInvalidImage, imageFile)
+	}
+	if _, err := os.Stat(image + ".signature"); err != nil {
+		return LocalImage{}, fmt.Errorf("%w: no %s", ErrInvalidImage, signatureFile)
+	}
+	name := fmt.Sprintf("%d.%d", version.Major(), version.Minor())
+	if version.Patch() > 0 {
+		name = fmt.Sprintf("%s.%d", name, version.Patch())
+	}
+	target := filepath.Join(s.Dir, name)
+	if err := replaceDir(target, map[string]string{image: imageFile, image + ".signature": signatureFile}); err != nil {
+		return LocalImage{}, err
+	}
+	return LocalImage{Version: name, Source: "dir", Path: filepath.Join(target, imageFile)}, nil
+}
+
+// replaceDir recreates dir with the files moved into it under their new names
+func replaceDir(dir string, files map[string]string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for from, name := range files {
+		if err := os.Rename(from, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findFile returns the least deep file called name below dir
+func findFile(dir string, name string) string {
+	found := ""
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && d.Name() == "__MACOSX" {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && d.Name() == name && (found == "" || strings.Count(p, string(filepath.Separator)) < strings.Count(found, string(filepath.Separator))) {
+			found = p
+		}
+		return nil
+	})
+	return found
+}
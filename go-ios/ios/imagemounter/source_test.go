@@ -0,0 +1,92 @@
+package imagemounter_test
+
+import (
+	"archive/zip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielpaulus/go-ios/ios/artifactcache"
+	"github.com/danielpaulus/go-ios/ios/imagemounter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeZip(t *testing.T, files map[string]string) string {
+	path := filepath.Join(t.TempDir(), "image.zip")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		fw, err := w.Create(name)
+		require.NoError(t, err)
+		fw.Write([]byte(content))
+	}
+	require.NoError(t, w.Close())
+	require.NoError(t, f.Close())
+	return path
+}
+
+func TestImageSourceDir(t *testing.T) {
+	source := imagemounter.ImageSource{Dir: t.TempDir(), Offline: true}
+
+	_, err := source.Add(writeZip(t, map[string]string{"DeveloperDiskImage.dmg": "dmg"}), "16.4")
+	assert.ErrorIs(t, err, imagemounter.ErrInvalidImage)
+	image, err := source.Add(writeZip(t, map[string]string{
+		"16.4/DeveloperDiskImage.dmg":           "dmg",
+		"16.4/DeveloperDiskImage.dmg.signature": "sig",
+	}), "16.4")
+	require.NoError(t, err)
+	_, err = source.Add(writeZip(t, map[string]string{"ddi/Restore/BuildManifest.plist": "manifest"}), "17.0")
+	require.NoError(t, err)
+
+	path, err := source.ImageForVersion(context.Background(), "16.4.1")
+	require.NoError(t, err)
+	assert.Equal(t, image.Path, path)
+	data, err := os.ReadFile(path + ".signature")
+	require.NoError(t, err)
+	assert.Equal(t, "sig", string(data))
+
+	path, err = source.ImageForVersion(context.Background(), "17.5")
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(path, "BuildManifest.plist"))
+
+	_, err = source.ImageForVersion(context.Background(), "16.3")
+	assert.ErrorIs(t, err, imagemounter.ErrNoImage)
+	assert.EqualError(t, err, "no image available for iOS 16.3")
+
+	assert.Equal(t, []imagemounter.LocalImage{
+		{Version: "16.4", Source: "dir", Path: image.Path},
+		{Version: "17+", Personalized: true, Source: "dir", Path: filepath.Join(source.Dir, "ddi-15F31d", "Restore")},
+	}, source.Available())
+}
+
+func TestImageSourceMirror(t *testing.T) {
+	requests := []string{}
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer mirror.Close()
+	cache, err := artifactcache.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	source := imagemounter.ImageSource{Dir: t.TempDir(), MirrorURL: mirror.URL + "/ddi/", Cache: cache}
+
+	path, err := source.ImageForVersion(context.Background(), "15.7.2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/ddi/15.7/DeveloperDiskImage.dmg", "/ddi/15.7/DeveloperDiskImage.dmg.signature"}, requests)
+	data, err := os.ReadFile(path + ".signature")
+	require.NoError(t, err)
+	assert.Equal(t, "/ddi/15.7/DeveloperDiskImage.dmg.signature", string(data))
+	assert.Equal(t, []imagemounter.LocalImage{{Version: "15.7", Source: "cache"}}, source.Available())
+
+	source.Offline = true
+	_, err = source.ImageForVersion(context.Background(), "15.7.2")
+	require.NoError(t, err)
+	_, err = source.ImageForVersion(context.Background(), "14.8")
+	assert.ErrorIs(t, err, imagemounter.ErrNoImage)
+	assert.Len(t, requests, 2)
+}
@@ -0,0 +1,63 @@
+package imagemounter
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TSSURL is where signing tickets for personalized images are requested. A local caching proxy or a stand-in for
+// tests can answer instead of Apple.
+var TSSURL = "https://gs.apple.com/TSS/controller?action=2"
+
+// TicketDir keeps the signing tickets of personalized images per ECID and build identity, so mounting again does not
+// need TSS as long as the device accepts the ticket. Tickets are not kept if it is empty.
+var TicketDir = ""
+
+func ticketPath(ecid uint64, identity buildIdentity) string {
+	if TicketDir == "" {
+		return ""
+	}
+	return filepath.Join(TicketDir, fmt.Sprintf("%x", ecid), hex.EncodeToString(identity.Manifest.PersonalizedDmg.Digest)+".img4ticket")
+}
+
+// loadTicket returns the cached ticket for the device and image, nil if there is none
+func loadTicket(ecid uint64, identity buildIdentity) []byte {
+	path := ticketPath(ecid, identity)
+	if path == "" {
+		return nil
+	}
+	ticket, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return ticket
+}
+
+// saveTicket caches ticket, failures are only logged as the ticket can always be requested again
+func saveTicket(ecid uint64, identity buildIdentity, ticket []byte) {
+	path := ticketPath(ecid, identity)
+	if path == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		log.Warnf("saveTicket: could not create %s: %v", filepath.Dir(path), err)
+		return
+	}
+	if err := os.WriteFile(path+".tmp", ticket, 0o600); err != nil {
+		log.Warnf("saveTicket: could not write %s: %v", path, err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Warnf("saveTicket: could not write %s: %v", path, err)
+	}
+}
+
+func removeTicket(ecid uint64, identity buildIdentity) {
+	if path := ticketPath(ecid, identity); path != "" {
+		_ = os.Remove(path)
+	}
+}
@@ -0,0 +1,51 @@
+package imagemounter
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"howett.net/plist"
+)
+
+func TestTSSURL(t *testing.T) {
+	var request map[string]interface{}
+	tss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, err := plist.Unmarshal(body, &request)
+		assert.NoError(t, err)
+		ticket, _ := plist.Marshal(map[string]interface{}{"ApImg4Ticket": []byte("ticket")}, plist.XMLFormat)
+		w.Write([]byte("STATUS=0&MESSAGE=SUCCESS&REQUEST_STRING=" + string(ticket)))
+	}))
+	defer tss.Close()
+	defer func(url string) { TSSURL = url }(TSSURL)
+	TSSURL = tss.URL
+
+	ticket, err := newTssClient().getSignature(buildIdentity{}, personalizationIdentifiers{BoardId: 1, ChipID: 2}, []byte("nonce"), 42)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ticket"), ticket)
+	assert.Equal(t, uint64(42), request["ApECID"])
+	assert.Equal(t, []byte("nonce"), request["ApNonce"])
+}
+
+func TestTicketCache(t *testing.T) {
+	defer func(dir string) { TicketDir = dir }(TicketDir)
+	var identity, other buildIdentity
+	identity.Manifest.PersonalizedDmg.Digest = []byte{1, 2}
+	other.Manifest.PersonalizedDmg.Digest = []byte{3, 4}
+
+	TicketDir = ""
+	saveTicket(42, identity, []byte("ticket"))
+	assert.Nil(t, loadTicket(42, identity))
+
+	TicketDir = t.TempDir()
+	saveTicket(42, identity, []byte("ticket"))
+	assert.Equal(t, []byte("ticket"), loadTicket(42, identity))
+	assert.Nil(t, loadTicket(43, identity))
+	assert.Nil(t, loadTicket(42, other))
+	removeTicket(42, identity)
+	assert.Nil(t, loadTicket(42, identity))
+}
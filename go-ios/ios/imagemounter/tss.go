@@ -13,7 +13,7 @@ import (
 	"howett.net/plist"
 )
 
-// tssClient is used to talk to https://gs.apple.com/TSS for getting the personalized developer disk image signatures
+// tssClient is used to talk to TSSURL, https://gs.apple.com/TSS by default, for getting the personalized developer disk image signatures
 type tssClient struct {
 	h *http.Client
 }
@@ -81,7 +81,7 @@ func (t tssClient) getSignature(identity buildIdentity, identifiers personalizat
 		},
 		Timeout: 1 * time.Minute,
 	}
-	req, err := http.NewRequest("POST", "https://gs.apple.com/TSS/controller?action=2", buf)
+	req, err := http.NewRequest("POST", TSSURL, buf)
 	if err != nil {
 		return nil, err
 	}
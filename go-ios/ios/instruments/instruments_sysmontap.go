@@ -2,6 +2,7 @@ package instruments
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/danielpaulus/go-ios/ios"
 	dtx "github.com/danielpaulus/go-ios/ios/dtx_codec"
@@ -10,14 +11,18 @@ import (
 
 type sysmontapMsgDispatcher struct {
 	messages chan dtx.Message
+	closed   chan struct{}
 }
 
 func newSysmontapMsgDispatcher() *sysmontapMsgDispatcher {
-	return &sysmontapMsgDispatcher{make(chan dtx.Message)}
+	return &sysmontapMsgDispatcher{make(chan dtx.Message), make(chan struct{})}
 }
 
 func (p *sysmontapMsgDispatcher) Dispatch(m dtx.Message) {
-	p.messages <- m
+	select {
+	case p.messages <- m:
+	case <-p.closed:
+	}
 }
 
 const sysmontapName = "com.apple.instruments.server.services.sysmontap"
@@ -28,6 +33,9 @@ type sysmontapService struct {
 
 	deviceInfoService *DeviceInfoService
 	msgDispatcher     *sysmontapMsgDispatcher
+
+	procAttrs []interface{}
+	sysAttrs  []interface{}
 }
 
 // NewSysmontapService creates a new sysmontapService
@@ -36,6 +44,12 @@ type sysmontapService struct {
 // the expected rate and the actual rate of samples delivery. We can only conclude, that the lower the rate in digits,
 // the faster the samples are delivered
 func NewSysmontapService(device ios.DeviceEntry, samplingInterval int) (*sysmontapService, error) {
+	return NewSysmontapServiceWithSampleInterval(device, samplingInterval, 500*time.Millisecond)
+}
+
+// NewSysmontapServiceWithSampleInterval creates a new sysmontapService like NewSysmontapService, but additionally
+// sets the interval in which the device takes samples of the system and process attributes.
+func NewSysmontapServiceWithSampleInterval(device ios.DeviceEntry, samplingInterval int, sampleInterval time.Duration) (*sysmontapService, error) {
 	deviceInfoService, err := NewDeviceInfoService(device)
 	if err != nil {
 		return nil, err
@@ -66,7 +80,7 @@ func NewSysmontapService(device ios.DeviceEntry, samplingInterval int) (*sysmont
 		"sysAttrs":       sysAttrs,
 		"cpuUsage":       true,
 		"physFootprint":  true,
-		"sampleInterval": 500000000,
+		"sampleInterval": sampleInterval.Nanoseconds(),
 	}
 	_, err = processControlChannel.MethodCall("setConfig:", config)
 	if err != nil {
@@ -78,12 +92,12 @@ func NewSysmontapService(device ios.DeviceEntry, samplingInterval int) (*sysmont
 		return nil, err
 	}
 
-	return &sysmontapService{processControlChannel, dtxConn, deviceInfoService, msgDispatcher}, nil
+	return &sysmontapService{processControlChannel, dtxConn, deviceInfoService, msgDispatcher, procAttrs, sysAttrs}, nil
 }
 
 // Close closes up the DTX connection, message dispatcher and dtx.Message channel
 func (s *sysmontapService) Close() error {
-	close(s.msgDispatcher.messages)
+	close(s.msgDispatcher.closed)
 
 	s.deviceInfoService.Close()
 	return s.conn.Close()
@@ -97,17 +111,26 @@ func (s *sysmontapService) ReceiveCPUUsage() chan SysmontapMessage {
 	go func() {
 		defer close(messages)
 
-		for msg := range s.msgDispatcher.messages {
+		for {
+			var msg dtx.Message
+			select {
+			case msg = <-s.msgDispatcher.messages:
+			case <-s.msgDispatcher.closed:
+				log.Infof("sysmontap message dispatcher channel closed")
+				return
+			}
 			sysmontapMessage, err := mapToCPUUsage(msg)
 			if err != nil {
 				log.Debugf("expected `sysmontapMessage` from global channel, but received %v", msg)
 				continue
 			}
 
-			messages <- sysmontapMessage
+			select {
+			case messages <- sysmontapMessage:
+			case <-s.msgDispatcher.closed:
+				return
+			}
 		}
-
-		log.Infof("sysmontap message dispatcher channel closed")
 	}()
 
 	return messages
@@ -175,3 +198,146 @@ func mapToCPUUsage(msg dtx.Message) (SysmontapMessage, error) {
 	}
 	return sysmontapMessage, nil
 }
+
+// ProcessSample contains the resource usage of a single process at the time of a sysmontap sample
+type ProcessSample struct {
+	Pid              uint64
+	Name             string
+	CPUUsage         float64
+	PhysFootprint    uint64
+	DiskBytesRead    uint64
+	DiskBytesWritten uint64
+	ThreadCount      uint64
+}
+
+// SysmontapSample is a single sample of system wide attributes and per process usage.
+// System maps the names of the device's system attributes to their sampled values.
+type SysmontapSample struct {
+	Timestamp time.Time
+	System    map[string]interface{}
+	Processes []ProcessSample
+}
+
+// ReceiveSamples returns a chan of SysmontapSample with system attributes and per process usage.
+// Only one of ReceiveSamples or ReceiveCPUUsage should be used on a sysmontapService as both consume the same messages.
+// The method will close the result channel automatically as soon as the service is closed.
+func (s *sysmontapService) ReceiveSamples() chan SysmontapSample {
+	samples := make(chan SysmontapSample)
+	go func() {
+		defer close(samples)
+
+		for {
+			var msg dtx.Message
+			select {
+			case msg = <-s.msgDispatcher.messages:
+			case <-s.msgDispatcher.closed:
+				log.Infof("sysmontap message dispatcher channel closed")
+				return
+			}
+			sample, err := s.mapToSample(msg)
+			if err != nil {
+				log.Debugf("expected process sample from global channel, but received %v", msg)
+				continue
+			}
+
+			select {
+			case samples <- sample:
+			case <-s.msgDispatcher.closed:
+				return
+			}
+		}
+	}()
+
+	return samples
+}
+
+func (s *sysmontapService) mapToSample(msg dtx.Message) (SysmontapSample, error) {
+	if len(msg.Payload) != 1 {
+		return SysmontapSample{}, fmt.Errorf("payload of message should have only one element: %+v", msg)
+	}
+	resultArray, ok := msg.Payload[0].([]interface{})
+	if !ok {
+		return SysmontapSample{}, fmt.Errorf("expected resultArray of type []interface{}: %+v", msg.Payload[0])
+	}
+
+	sample := SysmontapSample{Timestamp: time.Now()}
+	foundProcesses := false
+	for _, result := range resultArray {
+		resultMap, ok := result.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if system, ok := resultMap["System"].([]interface{}); ok {
+			sample.System = zipAttributes(s.sysAttrs, system)
+		}
+		processes, ok := resultMap["Processes"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		foundProcesses = true
+		for _, values := range processes {
+			valueList, ok := values.([]interface{})
+			if !ok {
+				continue
+			}
+			sample.Processes = append(sample.Processes, mapToProcessSample(zipAttributes(s.procAttrs, valueList)))
+		}
+	}
+	if !foundProcesses {
+		return SysmontapSample{}, fmt.Errorf("message does not contain process samples: %+v", msg)
+	}
+	return sample, nil
+}
+
+// zipAttributes maps attribute names to the values of a sysmontap sample, the device
+// sends the values in the same order as the attributes were configured.
+func zipAttributes(attrs []interface{}, values []interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(attrs))
+	for i, attr := range attrs {
+		name, ok := attr.(string)
+		if !ok || i >= len(values) {
+			continue
+		}
+		result[name] = values[i]
+	}
+	return result
+}
+
+func mapToProcessSample(attrs map[string]interface{}) ProcessSample {
+	name, _ := attrs["name"].(string)
+	return ProcessSample{
+		Pid:              toUint64(attrs["pid"]),
+		Name:             name,
+		CPUUsage:         toFloat64(attrs["cpuUsage"]),
+		PhysFootprint:    toUint64(attrs["physFootprint"]),
+		DiskBytesRead:    toUint64(attrs["diskBytesRead"]),
+		DiskBytesWritten: toUint64(attrs["diskBytesWritten"]),
+		ThreadCount:      toUint64(attrs["threadCount"]),
+	}
+}
+
+func toUint64(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		return uint64(n)
+	case float64:
+		return uint64(n)
+	default:
+		return 0
+	}
+}
+
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case uint64:
+		return float64(n)
+	case int64:
+		return float64(n)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,91 @@
+package instruments
+
+import (
+	"sort"
+	"testing"
+
+	dtx "github.com/danielpaulus/go-ios/ios/dtx_codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapToSample(t *testing.T) {
+	s := &sysmontapService{
+		procAttrs: []interface{}{"pid", "name", "cpuUsage", "physFootprint", "diskBytesRead", "diskBytesWritten", "threadCount"},
+		sysAttrs:  []interface{}{"vmFreeCount", "physMemSize"},
+	}
+	tests := []struct {
+		name      string
+		system    []interface{}
+		processes map[string]interface{}
+		want      []ProcessSample
+		wantSys   map[string]interface{}
+	}{
+		{
+			name:      "uint64 values",
+			processes: map[string]interface{}{"1": []interface{}{uint64(1), "launchd", float64(0.5), uint64(4096), uint64(10), uint64(20), uint64(3)}},
+			want:      []ProcessSample{{Pid: 1, Name: "launchd", CPUUsage: 0.5, PhysFootprint: 4096, DiskBytesRead: 10, DiskBytesWritten: 20, ThreadCount: 3}},
+		},
+		{
+			name:      "int64 values",
+			processes: map[string]interface{}{"2": []interface{}{int64(2), "SpringBoard", int64(2), int64(8192), int64(11), int64(21), int64(4)}},
+			want:      []ProcessSample{{Pid: 2, Name: "SpringBoard", CPUUsage: 2, PhysFootprint: 8192, DiskBytesRead: 11, DiskBytesWritten: 21, ThreadCount: 4}},
+		},
+		{
+			name:      "float64 values",
+			processes: map[string]interface{}{"3": []interface{}{float64(3), "backboardd", uint64(1), float64(1024), float64(12), float64(22), float64(5)}},
+			want:      []ProcessSample{{Pid: 3, Name: "backboardd", CPUUsage: 1, PhysFootprint: 1024, DiskBytesRead: 12, DiskBytesWritten: 22, ThreadCount: 5}},
+		},
+		{
+			name:      "fewer values than attributes",
+			processes: map[string]interface{}{"4": []interface{}{uint64(4), "mediaserverd", float64(1.5)}},
+			want:      []ProcessSample{{Pid: 4, Name: "mediaserverd", CPUUsage: 1.5}},
+		},
+		{
+			name:      "unexpected types are zero",
+			processes: map[string]interface{}{"5": []interface{}{"5", uint64(5), "high"}},
+			want:      []ProcessSample{{}},
+		},
+		{
+			name:   "several processes and system attributes",
+			system: []interface{}{uint64(100)},
+			processes: map[string]interface{}{
+				"6": []interface{}{uint64(6), "a"},
+				"7": []interface{}{uint64(7), "b"},
+			},
+			want:    []ProcessSample{{Pid: 6, Name: "a"}, {Pid: 7, Name: "b"}},
+			wantSys: map[string]interface{}{"vmFreeCount": uint64(100)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := map[string]interface{}{"Processes": tt.processes}
+			if tt.system != nil {
+				result["System"] = tt.system
+			}
+			sample, err := s.mapToSample(dtx.Message{Payload: []interface{}{[]interface{}{result}}})
+			require.NoError(t, err)
+			sort.Slice(sample.Processes, func(i, j int) bool { return sample.Processes[i].Pid < sample.Processes[j].Pid })
+			assert.Equal(t, tt.want, sample.Processes)
+			assert.Equal(t, tt.wantSys, sample.System)
+		})
+	}
+}
+
+func TestMapToSampleErrors(t *testing.T) {
+	s := &sysmontapService{}
+	tests := []struct {
+		name    string
+		payload []interface{}
+	}{
+		{name: "no payload", payload: []interface{}{}},
+		{name: "no result array", payload: []interface{}{"garbage"}},
+		{name: "no processes", payload: []interface{}{[]interface{}{map[string]interface{}{"System": []interface{}{}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.mapToSample(dtx.Message{Payload: tt.payload})
+			assert.Error(t, err)
+		})
+	}
+}
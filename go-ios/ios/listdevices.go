@@ -55,10 +55,12 @@ type DeviceList struct {
 // f.ex. to enable LockdownSSL. More importantly it contains
 // DeviceProperties where the udid is stored.
 type DeviceEntry struct {
-	DeviceID         int
-	MessageType      string
-	Properties       DeviceProperties
-	Address          string
+	DeviceID    int
+	MessageType string
+	Properties  DeviceProperties
+	Address     string
+	// UsbmuxdSocket is the usbmuxd endpoint the device was listed on
+	UsbmuxdSocket    string
 	Rsd              RsdPortProvider
 	UserspaceTUN     bool
 	UserspaceTUNHost string
@@ -111,12 +113,7 @@ func (muxConn *UsbMuxConnection) ListDevices() (DeviceList, error) {
 // ListDevices returns a DeviceList containing data about all
 // currently connected iOS devices using a new UsbMuxConnection
 func ListDevices() (DeviceList, error) {
-	muxConnection, err := NewUsbMuxConnectionSimple()
-	if err != nil {
-		return DeviceList{}, err
-	}
-	defer muxConnection.Close()
-	return muxConnection.ListDevices()
+	return listAllEndpoints()
 }
 
 type detailsEntry struct {
@@ -21,10 +21,12 @@ type AttachedMessage struct {
 	MessageType string
 	DeviceID    int
 	Properties  DeviceProperties
+	// UsbmuxdSocket is the endpoint that sent the message, DeviceIDs are only unique per endpoint
+	UsbmuxdSocket string `plist:"-"`
 }
 
 func (a AttachedMessage) DeviceEntry() DeviceEntry {
-	return DeviceEntry{DeviceID: a.DeviceID, MessageType: "Attached", Properties: a.Properties}
+	return DeviceEntry{DeviceID: a.DeviceID, MessageType: "Attached", Properties: a.Properties, UsbmuxdSocket: a.UsbmuxdSocket}
 }
 
 func attachedFromBytes(plistBytes []byte) (AttachedMessage, error) {
@@ -85,13 +87,7 @@ func (muxConn *UsbMuxConnection) Listen() (func() (AttachedMessage, error), erro
 	}, nil
 }
 
+// Listen receives attach and detach events of all usbmuxd endpoints until the returned close function is called
 func Listen() (func() (AttachedMessage, error), func() error, error) {
-	deviceConn, err := NewDeviceConnection(GetUsbmuxdSocket())
-	if err != nil {
-		return nil, nil, fmt.Errorf("could not connect to usbmuxd: %w", err)
-	}
-	muxConnection := NewUsbMuxConnection(deviceConn)
-
-	attachedReceiver, err := muxConnection.Listen()
-	return attachedReceiver, muxConnection.Close, err
+	return listenAllEndpoints()
 }
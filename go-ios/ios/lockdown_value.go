@@ -252,12 +252,20 @@ func getAllValuesResponseFromBytes(plistBytes []byte) GetAllValuesResponse {
 
 // GetValuesPlist returns the full lockdown values response as a map, so it can be converted to JSON easily.
 func GetValuesPlist(device DeviceEntry) (map[string]interface{}, error) {
+	return GetValuesPlistForDomain(device, "")
+}
+
+// GetValuesPlistForDomain returns all lockdown values of the given domain, like com.apple.disk_usage.
+// An empty domain returns the global values, same as GetValuesPlist.
+func GetValuesPlistForDomain(device DeviceEntry, domain string) (map[string]interface{}, error) {
 	lockdownConnection, err := ConnectLockdownWithSession(device)
 	if err != nil {
 		return map[string]interface{}{}, err
 	}
 	defer lockdownConnection.Close()
-	err = lockdownConnection.Send(newGetValue(""))
+	request := newGetValue("")
+	request.Domain = domain
+	err = lockdownConnection.Send(request)
 	if err != nil {
 		return map[string]interface{}{}, err
 	}
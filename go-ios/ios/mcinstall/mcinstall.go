@@ -284,6 +284,20 @@ func (mcInstallConn *Connection) HandleList() ([]ProfileInfo, error) {
 	return mcInstallConn.readExchangeResponse(reader)
 }
 
+// GetCloudConfiguration returns the cloud configuration of the device, for supervised devices it contains the
+// OrganizationName and SupervisorHostCertificates
+func (mcInstallConn *Connection) GetCloudConfiguration() (map[string]interface{}, error) {
+	response, err := check(mcInstallConn.sendAndReceive(request("GetCloudConfiguration")))
+	if err != nil {
+		return map[string]interface{}{}, err
+	}
+	config, _ := response["CloudConfiguration"].(map[string]interface{})
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+	return config, nil
+}
+
 // Close closes the underlying DeviceConnection
 func (mcInstallConn *Connection) Close() error {
 	return mcInstallConn.deviceConn.Close()
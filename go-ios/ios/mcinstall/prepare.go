@@ -74,11 +74,53 @@ func GetAllSetupSkipOptions() []string {
 	return skipAllSetup
 }
 
+// The steps Prepare runs, in order. They are reported to the progress callback of PrepareWithProgress.
+const (
+	StepActivationCheck    = "activationCheck"
+	StepCloudConfiguration = "cloudConfiguration"
+	StepInitialProfile     = "initialProfile"
+	StepLanguage           = "language"
+	StepSystemTime         = "systemTime"
+	StepSkipSetup          = "skipSetup"
+)
+
+// ValidateSkipOptions returns an error naming every entry of skip that is not one of GetAllSetupSkipOptions()
+func ValidateSkipOptions(skip []string) error {
+	known := map[string]bool{}
+	for _, option := range skipAllSetup {
+		known[option] = true
+	}
+	var unknown []string
+	for _, option := range skip {
+		if !known[option] {
+			unknown = append(unknown, option)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown skip options %v", unknown)
+	}
+	return nil
+}
+
 // Prepare prepares an activated device and supervises it if desired. skip is the list of setup options to skip, use GetAllSetupSkipOptions()
 // to get a list of all available options. certBytes is the DER encoded supervision certificate. If it is nil then the device won't be supervised.
 // ios.CreateDERFormattedSupervisionCert() provides an example how to generate these certificates. Orgname can be any string, it will show up as the
 // supervision name on the device. Locale and lang can be set. If they are empty strings, then the default will be en_US and en.
 func Prepare(device ios.DeviceEntry, skip []string, certBytes []byte, orgname string, locale string, lang string) error {
+	return PrepareWithProgress(device, skip, certBytes, orgname, locale, lang, nil)
+}
+
+// PrepareWithProgress works like Prepare and calls progress after every step with the step name and its result.
+// Preparation stops at the first failing step, so steps after it are not reported. progress can be nil.
+func PrepareWithProgress(device ios.DeviceEntry, skip []string, certBytes []byte, orgname string, locale string, lang string, progress func(step string, err error)) error {
+	if progress == nil {
+		progress = func(string, error) {}
+	}
+	run := func(step string, f func() error) error {
+		err := f()
+		progress(step, err)
+		return err
+	}
 	if locale == "" {
 		locale = "en_US"
 	}
@@ -86,21 +128,68 @@ func Prepare(device ios.DeviceEntry, skip []string, certBytes []byte, orgname st
 		lang = "en"
 	}
 
-	supervise := certBytes != nil
-	isActivated, err := mobileactivation.IsActivated(device)
+	err := run(StepActivationCheck, func() error {
+		isActivated, err := mobileactivation.IsActivated(device)
+		if err != nil {
+			return err
+		}
+		if !isActivated {
+			return fmt.Errorf("please activate the device first")
+		}
+		log.Infof("device is activated:%v", isActivated)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	if !isActivated {
-		return fmt.Errorf("please activate the device first")
-	}
-	log.Infof("device is activated:%v", isActivated)
 
 	conn, err := New(device)
 	if err != nil {
+		progress(StepCloudConfiguration, err)
 		return err
 	}
 	defer conn.Close()
+
+	err = run(StepCloudConfiguration, func() error {
+		return setCloudConfiguration(conn, skip, certBytes, orgname)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = run(StepInitialProfile, func() error {
+		err := conn.AddProfile([]byte(initialProfile))
+		if err != nil {
+			return err
+		}
+		_, err = check(conn.sendAndReceive(request("HelloHostIdentifier")))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = run(StepLanguage, func() error {
+		return ios.SetLanguage(device, ios.LanguageConfiguration{Language: lang, Locale: locale})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = run(StepSystemTime, func() error {
+		return ios.SetSystemTime(device)
+	})
+	if err != nil {
+		return err
+	}
+
+	return run(StepSkipSetup, func() error {
+		return setupSkipSetup(device)
+	})
+}
+
+func setCloudConfiguration(conn *Connection, skip []string, certBytes []byte, orgname string) error {
+	supervise := certBytes != nil
 	log.Info("send flush request")
 	re, err := check(conn.sendAndReceive(request("Flush")))
 	if err != nil {
@@ -141,7 +230,7 @@ func Prepare(device ios.DeviceEntry, skip []string, certBytes []byte, orgname st
 		return fmt.Errorf("failed setting cloud config, resp: %v err: %v", setResp, err)
 	}
 	log.Debugf("set response: %v", setResp)
-	hello, err = check(conn.sendAndReceive(request("HelloHostIdentifier")))
+	_, err = check(conn.sendAndReceive(request("HelloHostIdentifier")))
 	if err != nil {
 		return err
 	}
@@ -152,7 +241,7 @@ func Prepare(device ios.DeviceEntry, skip []string, certBytes []byte, orgname st
 	}
 	log.Debugf("cloud config config: %v", config)
 
-	hello, err = check(conn.sendAndReceive(request("HelloHostIdentifier")))
+	_, err = check(conn.sendAndReceive(request("HelloHostIdentifier")))
 	if err != nil {
 		return err
 	}
@@ -161,30 +250,8 @@ func Prepare(device ios.DeviceEntry, skip []string, certBytes []byte, orgname st
 		// the device always throws a CertificateRejected error here, but it works just fine
 		log.Debug(err)
 	}
-	hello, err = check(conn.sendAndReceive(request("HelloHostIdentifier")))
-	if err != nil {
-		return err
-	}
-	err = conn.AddProfile([]byte(initialProfile))
-	if err != nil {
-		return err
-	}
-	hello, err = check(conn.sendAndReceive(request("HelloHostIdentifier")))
-	if err != nil {
-		return err
-	}
-
-	err = ios.SetLanguage(device, ios.LanguageConfiguration{Language: lang, Locale: locale})
-	if err != nil {
-		return err
-	}
-
-	err = ios.SetSystemTime(device)
-	if err != nil {
-		return err
-	}
-
-	return setupSkipSetup(device)
+	_, err = check(conn.sendAndReceive(request("HelloHostIdentifier")))
+	return err
 }
 
 func setupSkipSetup(device ios.DeviceEntry) error {
@@ -0,0 +1,262 @@
+package mcinstall
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/google/uuid"
+	"howett.net/plist"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Profile describes a configuration profile built by BuildProfile. Exactly one field of every
+// PayloadSpec has to be set. The json tags allow taking profiles straight from API requests.
+type Profile struct {
+	Identifier        string        `json:"identifier"`
+	DisplayName       string        `json:"displayName"`
+	Organization      string        `json:"organization"`
+	Description       string        `json:"description"`
+	RemovalDisallowed bool          `json:"removalDisallowed"`
+	Payloads          []PayloadSpec `json:"payloads"`
+}
+
+type PayloadSpec struct {
+	Wifi         *WifiPayload          `json:"wifi,omitempty"`
+	Certificate  *CertificatePayload   `json:"certificate,omitempty"`
+	Restrictions *RestrictionsPayload  `json:"restrictions,omitempty"`
+	WebClip      *WebClipPayload       `json:"webClip,omitempty"`
+	SingleApp    *SingleAppModePayload `json:"singleApp,omitempty"`
+}
+
+// WifiPayload configures a Wi-Fi network. Security is one of None, WEP, WPA, WPA2, WPA3 or Any.
+// ProxyType is None, Manual or Auto, Auto uses ProxyPACURL.
+type WifiPayload struct {
+	SSID        string `json:"ssid"`
+	Security    string `json:"security"`
+	Password    string `json:"password"`
+	Hidden      bool   `json:"hidden"`
+	AutoJoin    *bool  `json:"autoJoin"`
+	ProxyType   string `json:"proxyType"`
+	ProxyServer string `json:"proxyServer"`
+	ProxyPort   int    `json:"proxyPort"`
+	ProxyPACURL string `json:"proxyPacUrl"`
+}
+
+// CertificatePayload installs a root CA, Data is PEM or DER encoded
+type CertificatePayload struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
+
+// RestrictionsPayload holds com.apple.applicationaccess keys like allowCamera: false
+type RestrictionsPayload struct {
+	Restrictions map[string]any `json:"restrictions"`
+}
+
+type WebClipPayload struct {
+	Label       string `json:"label"`
+	URL         string `json:"url"`
+	Icon        []byte `json:"icon"`
+	IsRemovable bool   `json:"isRemovable"`
+	FullScreen  bool   `json:"fullScreen"`
+}
+
+// SingleAppModePayload locks a supervised device to one app, Options are keys like DisableTouch
+type SingleAppModePayload struct {
+	BundleID string          `json:"bundleId"`
+	Options  map[string]bool `json:"options"`
+}
+
+var wifiSecurityTypes = map[string]bool{"None": true, "WEP": true, "WPA": true, "WPA2": true, "WPA3": true, "Any": true}
+
+// BuildProfile returns the XML plist of p
+func BuildProfile(p Profile) ([]byte, error) {
+	if p.Identifier == "" {
+		return nil, fmt.Errorf("profile identifier must not be empty")
+	}
+	if len(p.Payloads) == 0 {
+		return nil, fmt.Errorf("profile has no payloads")
+	}
+	if p.DisplayName == "" {
+		p.DisplayName = p.Identifier
+	}
+
+	content := make([]map[string]any, 0, len(p.Payloads))
+	for i, spec := range p.Payloads {
+		payloadType, payload, err := spec.build()
+		if err != nil {
+			return nil, fmt.Errorf("payload %d: %w", i, err)
+		}
+		payloadUUID := strings.ToUpper(uuid.New().String())
+		payload["PayloadType"] = payloadType
+		payload["PayloadVersion"] = 1
+		payload["PayloadUUID"] = payloadUUID
+		payload["PayloadIdentifier"] = fmt.Sprintf("%s.%s.%s", p.Identifier, payloadType, payloadUUID)
+		if _, ok := payload["PayloadDisplayName"]; !ok {
+			payload["PayloadDisplayName"] = payloadType
+		}
+		content = append(content, payload)
+	}
+
+	profile := map[string]any{
+		"PayloadContent":           content,
+		"PayloadDisplayName":       p.DisplayName,
+		"PayloadIdentifier":        p.Identifier,
+		"PayloadRemovalDisallowed": p.RemovalDisallowed,
+		"PayloadType":              "Configuration",
+		"PayloadUUID":              strings.ToUpper(uuid.New().String()),
+		"PayloadVersion":           1,
+	}
+	if p.Organization != "" {
+		profile["PayloadOrganization"] = p.Organization
+	}
+	if p.Description != "" {
+		profile["PayloadDescription"] = p.Description
+	}
+	return plist.MarshalIndent(profile, plist.XMLFormat, "\t")
+}
+
+func (s PayloadSpec) build() (string, map[string]any, error) {
+	set := 0
+	for _, isSet := range []bool{s.Wifi != nil, s.Certificate != nil, s.Restrictions != nil, s.WebClip != nil, s.SingleApp != nil} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return "", nil, fmt.Errorf("exactly one payload type must be set, got %d", set)
+	}
+	switch {
+	case s.Wifi != nil:
+		return s.Wifi.build()
+	case s.Certificate != nil:
+		return s.Certificate.build()
+	case s.Restrictions != nil:
+		return s.Restrictions.build()
+	case s.WebClip != nil:
+		return s.WebClip.build()
+	default:
+		return s.SingleApp.build()
+	}
+}
+
+func (w WifiPayload) build() (string, map[string]any, error) {
+	if w.SSID == "" {
+		return "", nil, fmt.Errorf("wifi: ssid must not be empty")
+	}
+	if w.Security == "" {
+		w.Security = "Any"
+	}
+	if !wifiSecurityTypes[w.Security] {
+		return "", nil, fmt.Errorf("wifi: unknown security type '%s'", w.Security)
+	}
+	payload := map[string]any{
+		"PayloadDisplayName": "Wi-Fi " + w.SSID,
+		"SSID_STR":           w.SSID,
+		"HIDDEN_NETWORK":     w.Hidden,
+		"AutoJoin":           w.AutoJoin == nil || *w.AutoJoin,
+		"EncryptionType":     w.Security,
+	}
+	if w.Password != "" {
+		payload["Password"] = w.Password
+	}
+	switch w.ProxyType {
+	case "", "None":
+	case "Manual":
+		if w.ProxyServer == "" || w.ProxyPort == 0 {
+			return "", nil, fmt.Errorf("wifi: manual proxy needs proxyServer and proxyPort")
+		}
+		payload["ProxyType"] = "Manual"
+		payload["ProxyServer"] = w.ProxyServer
+		payload["ProxyServerPort"] = w.ProxyPort
+	case "Auto":
+		payload["ProxyType"] = "Auto"
+		if w.ProxyPACURL != "" {
+			payload["ProxyPACURL"] = w.ProxyPACURL
+		}
+	default:
+		return "", nil, fmt.Errorf("wifi: unknown proxy type '%s'", w.ProxyType)
+	}
+	return "com.apple.wifi.managed", payload, nil
+}
+
+func (c CertificatePayload) build() (string, map[string]any, error) {
+	der := c.Data
+	if block, _ := pem.Decode(c.Data); block != nil {
+		der = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", nil, fmt.Errorf("certificate: %w", err)
+	}
+	name := c.Name
+	if name == "" {
+		name = cert.Subject.CommonName
+	}
+	return "com.apple.security.root", map[string]any{
+		"PayloadDisplayName":         name,
+		"PayloadCertificateFileName": name + ".cer",
+		"PayloadContent":             der,
+	}, nil
+}
+
+func (r RestrictionsPayload) build() (string, map[string]any, error) {
+	if len(r.Restrictions) == 0 {
+		return "", nil, fmt.Errorf("restrictions: no restrictions given")
+	}
+	payload := map[string]any{"PayloadDisplayName": "Restrictions"}
+	for k, v := range r.Restrictions {
+		if strings.HasPrefix(k, "Payload") {
+			return "", nil, fmt.Errorf("restrictions: %s is not a restriction", k)
+		}
+		// json numbers arrive as float64, restrictions like ratingApps are integers
+		if f, ok := v.(float64); ok && f == float64(int64(f)) {
+			v = int64(f)
+		}
+		payload[k] = v
+	}
+	return "com.apple.applicationaccess", payload, nil
+}
+
+func (c WebClipPayload) build() (string, map[string]any, error) {
+	if c.Label == "" || c.URL == "" {
+		return "", nil, fmt.Errorf("webclip: label and url must not be empty")
+	}
+	payload := map[string]any{
+		"PayloadDisplayName": "Web Clip " + c.Label,
+		"Label":              c.Label,
+		"URL":                c.URL,
+		"IsRemovable":        c.IsRemovable,
+		"FullScreen":         c.FullScreen,
+	}
+	if len(c.Icon) > 0 {
+		payload["Icon"] = c.Icon
+	}
+	return "com.apple.webClip.managed", payload, nil
+}
+
+func (s SingleAppModePayload) build() (string, map[string]any, error) {
+	if s.BundleID == "" {
+		return "", nil, fmt.Errorf("single app mode: bundleId must not be empty")
+	}
+	app := map[string]any{"Identifier": s.BundleID}
+	if len(s.Options) > 0 {
+		app["Options"] = s.Options
+	}
+	return "com.apple.app.lock", map[string]any{
+		"PayloadDisplayName": "Single App Mode",
+		"App":                app,
+	}, nil
+}
+
+// SignProfile wraps profile in CMS signed data using the certificate and key of the p12
+func SignProfile(profile []byte, p12bytes []byte, p12Password string) ([]byte, error) {
+	key, cert, err := pkcs12.Decode(p12bytes, p12Password)
+	if err != nil {
+		return nil, err
+	}
+	return ios.Sign(profile, cert, key)
+}
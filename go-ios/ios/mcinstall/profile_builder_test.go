@@ -0,0 +1,188 @@
+package mcinstall_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios/mcinstall"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"howett.net/plist"
+)
+
+func rootCA(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Example Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return der
+}
+
+func TestBuildProfile(t *testing.T) {
+	ca := rootCA(t)
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca})
+	noAutoJoin := false
+
+	tests := []struct {
+		name        string
+		payload     mcinstall.PayloadSpec
+		payloadType string
+		want        map[string]any
+	}{
+		{
+			name:        "wifi",
+			payload:     mcinstall.PayloadSpec{Wifi: &mcinstall.WifiPayload{SSID: "office", Security: "WPA2", Password: "secret"}},
+			payloadType: "com.apple.wifi.managed",
+			want:        map[string]any{"PayloadDisplayName": "Wi-Fi office", "SSID_STR": "office", "EncryptionType": "WPA2", "Password": "secret", "AutoJoin": true, "HIDDEN_NETWORK": false},
+		},
+		{
+			name: "wifi with manual proxy",
+			payload: mcinstall.PayloadSpec{Wifi: &mcinstall.WifiPayload{
+				SSID: "guest", Hidden: true, AutoJoin: &noAutoJoin, ProxyType: "Manual", ProxyServer: "proxy.example.com", ProxyPort: 8080,
+			}},
+			payloadType: "com.apple.wifi.managed",
+			want: map[string]any{
+				"EncryptionType": "Any", "AutoJoin": false, "HIDDEN_NETWORK": true,
+				"ProxyType": "Manual", "ProxyServer": "proxy.example.com", "ProxyServerPort": uint64(8080),
+			},
+		},
+		{
+			name:        "wifi with pac proxy",
+			payload:     mcinstall.PayloadSpec{Wifi: &mcinstall.WifiPayload{SSID: "guest", ProxyType: "Auto", ProxyPACURL: "http://example.com/proxy.pac"}},
+			payloadType: "com.apple.wifi.managed",
+			want:        map[string]any{"ProxyType": "Auto", "ProxyPACURL": "http://example.com/proxy.pac"},
+		},
+		{
+			name:        "certificate in PEM",
+			payload:     mcinstall.PayloadSpec{Certificate: &mcinstall.CertificatePayload{Data: caPEM}},
+			payloadType: "com.apple.security.root",
+			want:        map[string]any{"PayloadDisplayName": "Example Root CA", "PayloadCertificateFileName": "Example Root CA.cer", "PayloadContent": ca},
+		},
+		{
+			name:        "certificate in DER",
+			payload:     mcinstall.PayloadSpec{Certificate: &mcinstall.CertificatePayload{Name: "Proxy CA", Data: ca}},
+			payloadType: "com.apple.security.root",
+			want:        map[string]any{"PayloadDisplayName": "Proxy CA", "PayloadCertificateFileName": "Proxy CA.cer", "PayloadContent": ca},
+		},
+		{
+			name:        "restrictions",
+			payload:     mcinstall.PayloadSpec{Restrictions: &mcinstall.RestrictionsPayload{Restrictions: map[string]any{"allowCamera": false, "ratingApps": float64(200)}}},
+			payloadType: "com.apple.applicationaccess",
+			want:        map[string]any{"PayloadDisplayName": "Restrictions", "allowCamera": false, "ratingApps": uint64(200)},
+		},
+		{
+			name:        "web clip",
+			payload:     mcinstall.PayloadSpec{WebClip: &mcinstall.WebClipPayload{Label: "Example", URL: "https://example.com", Icon: []byte{1, 2}, FullScreen: true}},
+			payloadType: "com.apple.webClip.managed",
+			want:        map[string]any{"PayloadDisplayName": "Web Clip Example", "Label": "Example", "URL": "https://example.com", "Icon": []byte{1, 2}, "FullScreen": true, "IsRemovable": false},
+		},
+		{
+			name:        "single app mode",
+			payload:     mcinstall.PayloadSpec{SingleApp: &mcinstall.SingleAppModePayload{BundleID: "com.example.kiosk", Options: map[string]bool{"DisableTouch": true}}},
+			payloadType: "com.apple.app.lock",
+			want: map[string]any{"PayloadDisplayName": "Single App Mode", "App": map[string]any{
+				"Identifier": "com.example.kiosk", "Options": map[string]any{"DisableTouch": true},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := mcinstall.BuildProfile(mcinstall.Profile{Identifier: "com.example.profile", Payloads: []mcinstall.PayloadSpec{tt.payload}})
+			require.NoError(t, err)
+			var profile map[string]any
+			_, err = plist.Unmarshal(data, &profile)
+			require.NoError(t, err)
+			assert.Equal(t, "Configuration", profile["PayloadType"])
+			assert.Equal(t, "com.example.profile", profile["PayloadDisplayName"])
+
+			content := profile["PayloadContent"].([]any)
+			require.Len(t, content, 1)
+			payload := content[0].(map[string]any)
+			assert.Equal(t, tt.payloadType, payload["PayloadType"])
+			assert.Equal(t, uint64(1), payload["PayloadVersion"])
+			assert.Regexp(t, "^com.example.profile."+tt.payloadType+".[0-9A-F-]{36}$", payload["PayloadIdentifier"])
+			for k, v := range tt.want {
+				assert.Equal(t, v, payload[k], k)
+			}
+		})
+	}
+}
+
+func TestBuildProfilePreview(t *testing.T) {
+	data, err := mcinstall.BuildProfile(mcinstall.Profile{
+		Identifier:        "com.example.profile",
+		DisplayName:       "Example",
+		Organization:      "Example Org",
+		Description:       "Office setup",
+		RemovalDisallowed: true,
+		Payloads: []mcinstall.PayloadSpec{
+			{Wifi: &mcinstall.WifiPayload{SSID: "office"}},
+			{WebClip: &mcinstall.WebClipPayload{Label: "Intranet", URL: "https://intranet.example.com"}},
+		},
+	})
+	require.NoError(t, err)
+	preview, err := mcinstall.ParseProfile(data)
+	require.NoError(t, err)
+	assert.Equal(t, "com.example.profile", preview.Identifier)
+	assert.Equal(t, "Example", preview.DisplayName)
+	assert.Equal(t, "Example Org", preview.Organization)
+	assert.Equal(t, "Office setup", preview.Description)
+	assert.True(t, preview.RemovalDisallowed)
+	require.Len(t, preview.Payloads, 2)
+	assert.Equal(t, "com.apple.wifi.managed", preview.Payloads[0].Type)
+	assert.Equal(t, "com.apple.webClip.managed", preview.Payloads[1].Type)
+}
+
+func TestBuildProfileErrors(t *testing.T) {
+	valid := mcinstall.PayloadSpec{WebClip: &mcinstall.WebClipPayload{Label: "Example", URL: "https://example.com"}}
+	tests := []struct {
+		name    string
+		profile mcinstall.Profile
+		wantErr string
+	}{
+		{name: "no identifier", profile: mcinstall.Profile{Payloads: []mcinstall.PayloadSpec{valid}}, wantErr: "profile identifier must not be empty"},
+		{name: "no payloads", profile: mcinstall.Profile{Identifier: "p"}, wantErr: "profile has no payloads"},
+		{name: "empty payload", profile: mcinstall.Profile{Identifier: "p", Payloads: []mcinstall.PayloadSpec{valid, {}}}, wantErr: "payload 1: exactly one payload type must be set, got 0"},
+		{
+			name: "two payload types",
+			profile: mcinstall.Profile{Identifier: "p", Payloads: []mcinstall.PayloadSpec{{
+				WebClip: valid.WebClip, SingleApp: &mcinstall.SingleAppModePayload{BundleID: "com.example"},
+			}}},
+			wantErr: "payload 0: exactly one payload type must be set, got 2",
+		},
+		{name: "wifi without ssid", profile: mcinstall.Profile{Identifier: "p", Payloads: []mcinstall.PayloadSpec{{Wifi: &mcinstall.WifiPayload{}}}}, wantErr: "wifi: ssid must not be empty"},
+		{name: "wifi security", profile: mcinstall.Profile{Identifier: "p", Payloads: []mcinstall.PayloadSpec{{Wifi: &mcinstall.WifiPayload{SSID: "s", Security: "WPA4"}}}}, wantErr: "wifi: unknown security type 'WPA4'"},
+		{name: "wifi manual proxy", profile: mcinstall.Profile{Identifier: "p", Payloads: []mcinstall.PayloadSpec{{Wifi: &mcinstall.WifiPayload{SSID: "s", ProxyType: "Manual"}}}}, wantErr: "wifi: manual proxy needs proxyServer and proxyPort"},
+		{name: "wifi proxy type", profile: mcinstall.Profile{Identifier: "p", Payloads: []mcinstall.PayloadSpec{{Wifi: &mcinstall.WifiPayload{SSID: "s", ProxyType: "Socks"}}}}, wantErr: "wifi: unknown proxy type 'Socks'"},
+		{name: "certificate", profile: mcinstall.Profile{Identifier: "p", Payloads: []mcinstall.PayloadSpec{{Certificate: &mcinstall.CertificatePayload{Data: []byte("nope")}}}}, wantErr: "payload 0: certificate: "},
+		{name: "no restrictions", profile: mcinstall.Profile{Identifier: "p", Payloads: []mcinstall.PayloadSpec{{Restrictions: &mcinstall.RestrictionsPayload{}}}}, wantErr: "restrictions: no restrictions given"},
+		{
+			name:    "payload key as restriction",
+			profile: mcinstall.Profile{Identifier: "p", Payloads: []mcinstall.PayloadSpec{{Restrictions: &mcinstall.RestrictionsPayload{Restrictions: map[string]any{"PayloadType": "x"}}}}},
+			wantErr: "restrictions: PayloadType is not a restriction",
+		},
+		{name: "web clip", profile: mcinstall.Profile{Identifier: "p", Payloads: []mcinstall.PayloadSpec{{WebClip: &mcinstall.WebClipPayload{Label: "l"}}}}, wantErr: "webclip: label and url must not be empty"},
+		{name: "single app", profile: mcinstall.Profile{Identifier: "p", Payloads: []mcinstall.PayloadSpec{{SingleApp: &mcinstall.SingleAppModePayload{}}}}, wantErr: "single app mode: bundleId must not be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := mcinstall.BuildProfile(tt.profile)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package mcinstall
+
+import (
+	"fmt"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"go.mozilla.org/pkcs7"
+	"howett.net/plist"
+)
+
+// ProfilePreview describes a configuration profile without installing it
+type ProfilePreview struct {
+	Identifier        string
+	DisplayName       string
+	Description       string
+	Organization      string
+	UUID              string
+	RemovalDisallowed bool
+	// Signed is true for CMS signed profiles, Signer is the common name of the signing certificate
+	Signed   bool
+	Signer   string
+	Payloads []PayloadPreview
+}
+
+type PayloadPreview struct {
+	Type        string
+	Identifier  string
+	DisplayName string
+}
+
+type configurationProfile struct {
+	PayloadIdentifier        string
+	PayloadDisplayName       string
+	PayloadDescription       string
+	PayloadOrganization      string
+	PayloadUUID              string
+	PayloadType              string
+	PayloadRemovalDisallowed bool
+	PayloadContent           []struct {
+		PayloadType        string
+		PayloadIdentifier  string
+		PayloadDisplayName string
+	}
+}
+
+// ParseProfile reads a .mobileconfig, either a plain plist or CMS signed.
+// The signature is not verified, the device does that on install.
+func ParseProfile(data []byte) (ProfilePreview, error) {
+	preview := ProfilePreview{}
+	if _, err := ios.ParsePlist(data); err != nil {
+		signed, err := pkcs7.Parse(data)
+		if err != nil {
+			return preview, fmt.Errorf("profile is neither a plist nor CMS signed data: %w", err)
+		}
+		preview.Signed = true
+		if signer := signed.GetOnlySigner(); signer != nil {
+			preview.Signer = signer.Subject.CommonName
+		}
+		data = signed.Content
+	}
+
+	var profile configurationProfile
+	if _, err := plist.Unmarshal(data, &profile); err != nil {
+		return preview, fmt.Errorf("could not decode profile: %w", err)
+	}
+	if profile.PayloadType != "Configuration" {
+		return preview, fmt.Errorf("unexpected PayloadType '%s', expected 'Configuration'", profile.PayloadType)
+	}
+	preview.Identifier = profile.PayloadIdentifier
+	preview.DisplayName = profile.PayloadDisplayName
+	preview.Description = profile.PayloadDescription
+	preview.Organization = profile.PayloadOrganization
+	preview.UUID = profile.PayloadUUID
+	preview.RemovalDisallowed = profile.PayloadRemovalDisallowed
+	preview.Payloads = []PayloadPreview{}
+	for _, p := range profile.PayloadContent {
+		preview.Payloads = append(preview.Payloads, PayloadPreview{
+			Type:        p.PayloadType,
+			Identifier:  p.PayloadIdentifier,
+			DisplayName: p.PayloadDisplayName,
+		})
+	}
+	return preview, nil
+}
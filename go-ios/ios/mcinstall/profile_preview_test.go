@@ -0,0 +1,102 @@
+package mcinstall_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/mcinstall"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"howett.net/plist"
+)
+
+func marshalProfile(t *testing.T, profile map[string]any) []byte {
+	data, err := plist.MarshalIndent(profile, plist.XMLFormat, "\t")
+	require.NoError(t, err)
+	return data
+}
+
+func signProfile(t *testing.T, profile []byte) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Example Signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	signed, err := ios.Sign(profile, cert, key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestParseProfile(t *testing.T) {
+	profile := marshalProfile(t, map[string]any{
+		"PayloadType":              "Configuration",
+		"PayloadIdentifier":        "com.example.profile",
+		"PayloadDisplayName":       "Example",
+		"PayloadDescription":       "An example profile",
+		"PayloadOrganization":      "Example Org",
+		"PayloadUUID":              "8D6E3C5A-1B2C-4D5E-8F90-A1B2C3D4E5F6",
+		"PayloadRemovalDisallowed": true,
+		"PayloadContent": []map[string]any{
+			{"PayloadType": "com.apple.wifi.managed", "PayloadIdentifier": "com.example.profile.wifi", "PayloadDisplayName": "Wi-Fi"},
+			{"PayloadType": "com.apple.webClip.managed", "PayloadIdentifier": "com.example.profile.clip"},
+		},
+	})
+	preview := mcinstall.ProfilePreview{
+		Identifier:        "com.example.profile",
+		DisplayName:       "Example",
+		Description:       "An example profile",
+		Organization:      "Example Org",
+		UUID:              "8D6E3C5A-1B2C-4D5E-8F90-A1B2C3D4E5F6",
+		RemovalDisallowed: true,
+		Payloads: []mcinstall.PayloadPreview{
+			{Type: "com.apple.wifi.managed", Identifier: "com.example.profile.wifi", DisplayName: "Wi-Fi"},
+			{Type: "com.apple.webClip.managed", Identifier: "com.example.profile.clip"},
+		},
+	}
+	signedPreview := preview
+	signedPreview.Signed = true
+	signedPreview.Signer = "Example Signer"
+
+	empty := marshalProfile(t, map[string]any{"PayloadType": "Configuration", "PayloadIdentifier": "com.example.empty"})
+	payload := marshalProfile(t, map[string]any{"PayloadType": "com.apple.wifi.managed", "PayloadIdentifier": "com.example.wifi"})
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    mcinstall.ProfilePreview
+		wantErr string
+	}{
+		{name: "plain", data: profile, want: preview},
+		{name: "signed", data: signProfile(t, profile), want: signedPreview},
+		{name: "no payloads", data: empty, want: mcinstall.ProfilePreview{Identifier: "com.example.empty", Payloads: []mcinstall.PayloadPreview{}}},
+		{name: "not a configuration", data: payload, wantErr: "unexpected PayloadType 'com.apple.wifi.managed', expected 'Configuration'"},
+		{name: "signed payload", data: signProfile(t, payload), wantErr: "unexpected PayloadType 'com.apple.wifi.managed'"},
+		{name: "garbage", data: []byte("not a profile"), wantErr: "profile is neither a plist nor CMS signed data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mcinstall.ParseProfile(tt.data)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
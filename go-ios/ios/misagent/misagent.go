@@ -26,39 +26,102 @@ func New(device ios.DeviceEntry) (*Connection, error) {
 	return &c, nil
 }
 
-func (c *Connection) CopyAll() error {
-	msg := map[string]interface{}{
+// Close closes the underlying DeviceConnection
+func (c *Connection) Close() error {
+	return c.deviceConn.Close()
+}
+
+// CopyAll returns the raw CMS signed data of all provisioning profiles installed on the device
+func (c *Connection) CopyAll() ([][]byte, error) {
+	resp, err := c.request(map[string]interface{}{
 		"MessageType": "CopyAll",
 		"ProfileType": "Provisioning",
+	})
+	if err != nil {
+		return nil, err
+	}
+	payload, ok := resp["Payload"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("misagent response without Payload %v", resp)
+	}
+	profiles := make([][]byte, 0, len(payload))
+	for _, p := range payload {
+		data, ok := p.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("misagent returned a profile of type %T", p)
+		}
+		profiles = append(profiles, data)
+	}
+	return profiles, nil
+}
+
+// List returns all parsed provisioning profiles installed on the device. Profiles that cannot be parsed are
+// returned with only Error set, so one broken profile does not hide the others.
+func (c *Connection) List() ([]ProvisioningProfile, error) {
+	all, err := c.CopyAll()
+	if err != nil {
+		return nil, err
 	}
+	profiles := make([]ProvisioningProfile, 0, len(all))
+	for _, data := range all {
+		profile, err := ParseProvisioningProfile(data)
+		if err != nil {
+			profile = ProvisioningProfile{Devices: []string{}, Error: err.Error()}
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// Install installs a .mobileprovision file, a profile with the same UUID is replaced
+func (c *Connection) Install(profile []byte) error {
+	_, err := c.request(map[string]interface{}{
+		"MessageType": "Install",
+		"Profile":     profile,
+		"ProfileType": "Provisioning",
+	})
+	return err
+}
+
+// Remove deletes the provisioning profile with the given UUID
+func (c *Connection) Remove(uuid string) error {
+	_, err := c.request(map[string]interface{}{
+		"MessageType": "Remove",
+		"ProfileID":   uuid,
+		"ProfileType": "Provisioning",
+	})
+	return err
+}
+
+func (c *Connection) request(msg map[string]interface{}) (map[string]interface{}, error) {
 	reader := c.deviceConn.Reader()
 	requestBytes, err := c.plistCodec.Encode(msg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = c.deviceConn.Send(requestBytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	responseBytes, err := c.plistCodec.Decode(reader)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	resp, err := ios.ParsePlist(responseBytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	t, ok := resp["Status"]
 	if !ok {
-		return fmt.Errorf("misagent invalid response %v", resp)
+		return nil, fmt.Errorf("misagent invalid response %v", resp)
 	}
-	i, ok := t.(int)
+	i, ok := t.(uint64)
 	if !ok {
-		return fmt.Errorf("misagent invalid status in response %v", resp)
+		return nil, fmt.Errorf("misagent invalid status in response %v", resp)
 	}
 	if i == 0 {
-		return nil
+		return resp, nil
 	}
-	return fmt.Errorf("misagent returned error code %d in response %v", i, resp)
+	return nil, fmt.Errorf("misagent returned error code %d in response %v", i, resp)
 }
@@ -0,0 +1,75 @@
+package misagent
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+	"howett.net/plist"
+)
+
+// ProvisioningProfile is the content of a .mobileprovision file
+type ProvisioningProfile struct {
+	UUID         string         `json:"uuid"`
+	Name         string         `json:"name"`
+	TeamID       string         `json:"teamId"`
+	TeamName     string         `json:"teamName"`
+	AppID        string         `json:"appId"`
+	AppIDName    string         `json:"appIdName"`
+	Created      time.Time      `json:"created"`
+	Expires      time.Time      `json:"expires"`
+	Entitlements map[string]any `json:"entitlements"`
+	// Devices is empty for enterprise profiles, they have AllDevices set instead
+	Devices    []string `json:"devices"`
+	AllDevices bool     `json:"allDevices"`
+	// Error is set by List for profiles on the device that could not be parsed
+	Error string `json:"error,omitempty"`
+}
+
+type mobileProvision struct {
+	UUID                 string
+	Name                 string
+	AppIDName            string
+	TeamIdentifier       []string
+	TeamName             string
+	CreationDate         time.Time
+	ExpirationDate       time.Time
+	Entitlements         map[string]any
+	ProvisionedDevices   []string
+	ProvisionsAllDevices bool
+}
+
+// ParseProvisioningProfile decodes a CMS signed .mobileprovision. The signature is not verified.
+func ParseProvisioningProfile(data []byte) (ProvisioningProfile, error) {
+	signed, err := pkcs7.Parse(data)
+	if err != nil {
+		return ProvisioningProfile{}, fmt.Errorf("provisioning profile is not CMS signed data: %w", err)
+	}
+	var p mobileProvision
+	if _, err := plist.Unmarshal(signed.Content, &p); err != nil {
+		return ProvisioningProfile{}, fmt.Errorf("could not decode provisioning profile: %w", err)
+	}
+
+	profile := ProvisioningProfile{
+		UUID:         p.UUID,
+		Name:         p.Name,
+		TeamName:     p.TeamName,
+		AppIDName:    p.AppIDName,
+		Created:      p.CreationDate,
+		Expires:      p.ExpirationDate,
+		Entitlements: p.Entitlements,
+		Devices:      p.ProvisionedDevices,
+		AllDevices:   p.ProvisionsAllDevices,
+	}
+	if profile.Devices == nil {
+		profile.Devices = []string{}
+	}
+	if len(p.TeamIdentifier) > 0 {
+		profile.TeamID = p.TeamIdentifier[0]
+	}
+	// the application identifier is prefixed with the team ID, e.g. ABCDE12345.com.example.app
+	appID, _ := p.Entitlements["application-identifier"].(string)
+	profile.AppID = strings.TrimPrefix(appID, profile.TeamID+".")
+	return profile, nil
+}
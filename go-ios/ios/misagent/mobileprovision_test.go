@@ -0,0 +1,41 @@
+package misagent_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios/misagent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProvisioningProfile(t *testing.T) {
+	data, err := os.ReadFile("testdata/example.mobileprovision")
+	require.NoError(t, err)
+
+	profile, err := misagent.ParseProvisioningProfile(data)
+	require.NoError(t, err)
+	assert.Equal(t, misagent.ProvisioningProfile{
+		UUID:      "3C8A6A6E-9C4D-4F7A-8B1E-2F3D4C5B6A79",
+		Name:      "Example Development",
+		TeamID:    "ABCDE12345",
+		TeamName:  "Example Team",
+		AppID:     "com.example.app",
+		AppIDName: "Example App",
+		Created:   time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC),
+		Expires:   time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC),
+		Entitlements: map[string]any{
+			"application-identifier":              "ABCDE12345.com.example.app",
+			"com.apple.developer.team-identifier": "ABCDE12345",
+			"get-task-allow":                      true,
+		},
+		Devices: []string{"00008030-000000000000000A", "00008101-000000000000000B"},
+	}, profile)
+}
+
+func TestParseProvisioningProfileInvalid(t *testing.T) {
+	_, err := misagent.ParseProvisioningProfile([]byte("<plist></plist>"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "provisioning profile is not CMS signed data")
+}
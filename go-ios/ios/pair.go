@@ -28,7 +28,7 @@ func PairSupervised(device DeviceEntry, p12bytes []byte, p12Password string) err
 	if err != nil {
 		return err
 	}
-	usbmuxConn, err := NewUsbMuxConnectionSimple()
+	usbmuxConn, err := NewUsbMuxConnectionForDevice(device)
 	if err != nil {
 		return err
 	}
@@ -92,7 +92,7 @@ func PairSupervised(device DeviceEntry, p12bytes []byte, p12Password string) err
 	}
 	escrow := respMap["EscrowBag"].([]byte)
 
-	usbmuxConn, err = NewUsbMuxConnectionSimple()
+	usbmuxConn, err = NewUsbMuxConnectionForDevice(device)
 	defer usbmuxConn.Close()
 	if err != nil {
 		return err
@@ -145,6 +145,12 @@ func extractPairingChallenge(resp []byte) ([]byte, error) {
 	return challenge, nil
 }
 
+// ErrPairingDialogResponsePending is returned by Pair while the trust dialog is shown on the device
+var ErrPairingDialogResponsePending = errors.New("Please accept the PairingDialog on the device and run pairing again!")
+
+// ErrUserDeniedPairing is returned by Pair if the user tapped "Don't Trust"
+var ErrUserDeniedPairing = errors.New("the user denied pairing on the device")
+
 // Pair tries to pair with a device. The first time usually
 // fails because the user has to accept a trust pop up on the iOS device.
 // What you have to do to pair is:
@@ -152,7 +158,7 @@ func extractPairingChallenge(resp []byte) ([]byte, error) {
 // 2. accept the trust pop up on the device
 // 3. run the Pair() function a second time
 func Pair(device DeviceEntry) error {
-	usbmuxConn, err := NewUsbMuxConnectionSimple()
+	usbmuxConn, err := NewUsbMuxConnectionForDevice(device)
 	if err != nil {
 		return err
 	}
@@ -191,12 +197,15 @@ func Pair(device DeviceEntry) error {
 	}
 	response := getLockdownPairResponsefromBytes(resp)
 	if isPairingDialogOpen(response) {
-		return fmt.Errorf("Please accept the PairingDialog on the device and run pairing again!")
+		return ErrPairingDialogResponsePending
+	}
+	if response.Error == "UserDeniedPairing" {
+		return ErrUserDeniedPairing
 	}
 	if response.Error != "" {
 		return fmt.Errorf("Lockdown error: %s", response.Error)
 	}
-	usbmuxConn, err = NewUsbMuxConnectionSimple()
+	usbmuxConn, err = NewUsbMuxConnectionForDevice(device)
 	defer usbmuxConn.Close()
 	if err != nil {
 		return err
@@ -2,6 +2,7 @@ package ios
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 
 	plist "howett.net/plist"
@@ -31,6 +32,9 @@ func newReadPair(udid string) ReadPair {
 	return data
 }
 
+// ErrPairRecordNotFound is returned when usbmuxd has no pair record for a device
+var ErrPairRecordNotFound = errors.New("pair record not found")
+
 // PairRecordData only holds a []byte containing the PairRecord data as
 // a serialized Plist.
 type PairRecordData struct {
@@ -62,7 +66,7 @@ func pairRecordDatafromBytes(plistBytes []byte) (PairRecordData, error) {
 	}
 	if data.PairRecordData == nil {
 		resp := MuxResponsefromBytes(plistBytes)
-		return data, fmt.Errorf("ReadPair failed with errorcode '%d', is the device paired?", resp.Number)
+		return data, fmt.Errorf("ReadPair failed with errorcode '%d', is the device paired? %w", resp.Number, ErrPairRecordNotFound)
 	}
 	return data, nil
 }
@@ -88,12 +92,15 @@ func (muxConn *UsbMuxConnection) ReadPair(udid string) (PairRecord, error) {
 		return PairRecord{}, fmt.Errorf("error reading PairRecord: %w", err)
 	}
 	pairRecordData, err := pairRecordDatafromBytes(resp.Payload)
-	return PairRecordfromBytes(pairRecordData.PairRecordData), err
+	if err != nil {
+		return PairRecord{}, err
+	}
+	return PairRecordfromBytes(pairRecordData.PairRecordData), nil
 }
 
 // ReadPairRecord creates a new USBMuxConnection just to read the pair record and closes it right after than.
 func ReadPairRecord(udid string) (PairRecord, error) {
-	muxConnection, err := NewUsbMuxConnectionSimple()
+	muxConnection, err := newUsbMuxConnectionForUdid(udid)
 	if err != nil {
 		return PairRecord{}, fmt.Errorf("could not create usbmuxConnection with error %w", err)
 	}
@@ -0,0 +1,29 @@
+package ios_test
+
+import (
+	"testing"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/simdevice"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadPairRecordNotFound(t *testing.T) {
+	server, err := simdevice.NewServer()
+	require.NoError(t, err)
+	defer server.Close()
+	t.Setenv("USBMUXD_SOCKET_ADDRESS", server.Addr())
+	server.Attach(simdevice.NewDevice("00008030-000000000000000B"), false)
+	server.Attach(simdevice.NewDevice("00008030-000000000000000C"), true)
+
+	_, err = ios.ReadPairRecord("00008030-000000000000000B")
+	assert.ErrorIs(t, err, ios.ErrPairRecordNotFound)
+	_, err = ios.ReadPairRecord("00008030-000000000000000C")
+	assert.NoError(t, err)
+
+	server.Close()
+	_, err = ios.ReadPairRecord("00008030-000000000000000C")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ios.ErrPairRecordNotFound)
+}
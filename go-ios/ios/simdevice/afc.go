@@ -0,0 +1,277 @@
+package simdevice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/danielpaulus/go-ios/ios/afc"
+)
+
+type openFile struct {
+	path   string
+	offset int
+}
+
+// serveAfc runs an afc file system over d.Files. Directories exist as long as a file below them does
+// or they were created with make_dir.
+func serveAfc(d *Device, conn net.Conn) {
+	files := map[uint64]*openFile{}
+	nextFd := uint64(1)
+	for {
+		request, err := afc.Decode(conn)
+		if err != nil {
+			return
+		}
+		var response afc.AfcPacket
+		switch request.Header.Operation {
+		case afc.Afc_operation_file_info:
+			response = d.afcStat(afcPath(request.HeaderPayload))
+		case afc.Afc_operation_read_dir:
+			response = d.afcReadDir(afcPath(request.HeaderPayload))
+		case afc.Afc_operation_make_dir:
+			d.mu.Lock()
+			d.dirs[afcPath(request.HeaderPayload)] = true
+			d.mu.Unlock()
+			response = afcStatus(afc.Afc_Err_Success)
+		case afc.Afc_operation_remove_path:
+			response = afcStatus(d.afcRemove(afcPath(request.HeaderPayload), false))
+		case afc.Afc_operation_remove_path_and_contents:
+			response = afcStatus(d.afcRemove(afcPath(request.HeaderPayload), true))
+		case afc.Afc_operation_device_info:
+			response = afcData(afcPairs("Model", fmt.Sprint(d.value("ProductType")), "FSTotalBytes", "64000000000", "FSFreeBytes", "32000000000", "FSBlockSize", "4096"))
+		case afc.Afc_operation_file_open:
+			if len(request.HeaderPayload) < 8 {
+				response = afcStatus(afc.Afc_Err_InvalidArgument)
+				break
+			}
+			mode := binary.LittleEndian.Uint64(request.HeaderPayload)
+			p := afcPath(request.HeaderPayload[8:])
+			code := d.afcOpen(p, mode)
+			if code != afc.Afc_Err_Success {
+				response = afcStatus(code)
+				break
+			}
+			fd := nextFd
+			nextFd++
+			files[fd] = &openFile{path: p}
+			if mode == afc.Afc_Mode_APPEND || mode == afc.Afc_Mode_RDAPPEND {
+				d.mu.Lock()
+				files[fd].offset = len(d.Files[p])
+				d.mu.Unlock()
+			}
+			header := make([]byte, 8)
+			binary.LittleEndian.PutUint64(header, fd)
+			response = afcPacket(afc.Afc_operation_file_open_result, header, nil)
+		case afc.Afc_operation_file_read:
+			f, size := afcFile(files, request.HeaderPayload)
+			if f == nil {
+				response = afcStatus(afc.Afc_Err_InvalidArgument)
+				break
+			}
+			d.mu.Lock()
+			content := d.Files[f.path]
+			end := min(len(content), f.offset+size)
+			data := append([]byte{}, content[min(f.offset, end):end]...)
+			d.mu.Unlock()
+			f.offset += len(data)
+			response = afcData(data)
+		case afc.Afc_operation_file_write:
+			f, _ := afcFile(files, request.HeaderPayload)
+			if f == nil {
+				response = afcStatus(afc.Afc_Err_InvalidArgument)
+				break
+			}
+			d.mu.Lock()
+			content := d.Files[f.path]
+			if len(content) < f.offset {
+				content = append(content, make([]byte, f.offset-len(content))...)
+			}
+			content = append(content[:f.offset], append(request.Payload, content[min(len(content), f.offset+len(request.Payload)):]...)...)
+			d.Files[f.path] = content
+			d.mu.Unlock()
+			f.offset += len(request.Payload)
+			response = afcStatus(afc.Afc_Err_Success)
+		case afc.Afc_operation_file_close:
+			if len(request.HeaderPayload) >= 8 {
+				delete(files, binary.LittleEndian.Uint64(request.HeaderPayload))
+			}
+			response = afcStatus(afc.Afc_Err_Success)
+		default:
+			response = afcStatus(afc.Afc_Err_UnknownPacketType)
+		}
+		response.Header.Packet_num = request.Header.Packet_num
+		if err := afc.Encode(response, conn); err != nil {
+			return
+		}
+	}
+}
+
+// afcPath normalizes a path, some requests terminate it with a NUL and some do not
+func afcPath(raw []byte) string {
+	return path.Clean("/" + strings.TrimRight(string(raw), "\x00"))
+}
+
+func afcFile(files map[uint64]*openFile, header []byte) (*openFile, int) {
+	if len(header) < 8 {
+		return nil, 0
+	}
+	size := 0
+	if len(header) >= 16 {
+		size = int(binary.LittleEndian.Uint64(header[8:]))
+	}
+	return files[binary.LittleEndian.Uint64(header)], size
+}
+
+func afcPacket(operation uint64, header []byte, payload []byte) afc.AfcPacket {
+	thisLength := afc.Afc_header_size + uint64(len(header))
+	return afc.AfcPacket{
+		Header:        afc.AfcPacketHeader{Magic: afc.Afc_magic, Operation: operation, This_length: thisLength, Entire_length: thisLength + uint64(len(payload))},
+		HeaderPayload: header,
+		Payload:       payload,
+	}
+}
+
+func afcStatus(code uint64) afc.AfcPacket {
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint64(header, code)
+	return afcPacket(afc.Afc_operation_status, header, nil)
+}
+
+func afcData(data []byte) afc.AfcPacket {
+	return afcPacket(afc.Afc_operation_data, nil, data)
+}
+
+// afcPairs encodes keys and values as NUL terminated strings
+func afcPairs(pairs ...string) []byte {
+	var buf bytes.Buffer
+	for _, s := range pairs {
+		buf.WriteString(s)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func (d *Device) value(key string) any {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.Values[key]
+}
+
+// isDir reports whether p is the root, was created with make_dir or has files below it, callers hold d.mu
+func (d *Device) isDir(p string) bool {
+	if p == "/" || d.dirs[p] {
+		return true
+	}
+	for name := range d.Files {
+		if strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	for name := range d.dirs {
+		if strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Device) afcStat(p string) afc.AfcPacket {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if content, ok := d.Files[p]; ok {
+		return afcData(afcPairs("st_size", fmt.Sprint(len(content)), "st_blocks", fmt.Sprint((len(content)+511)/512), "st_nlink", "1", "st_ifmt", "S_IFREG", "st_mtime", "0", "st_birthtime", "0"))
+	}
+	if d.isDir(p) {
+		return afcData(afcPairs("st_size", "64", "st_blocks", "0", "st_nlink", "2", "st_ifmt", "S_IFDIR", "st_mtime", "0", "st_birthtime", "0"))
+	}
+	return afcStatus(afc.Afc_Err_ObjectNotFound)
+}
+
+func (d *Device) afcReadDir(p string) afc.AfcPacket {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.Files[p]; ok || !d.isDir(p) {
+		return afcStatus(afc.Afc_Err_ObjectNotFound)
+	}
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	children := map[string]bool{}
+	add := func(name string) {
+		if strings.HasPrefix(name, prefix) {
+			children[strings.SplitN(strings.TrimPrefix(name, prefix), "/", 2)[0]] = true
+		}
+	}
+	for name := range d.Files {
+		add(name)
+	}
+	for name := range d.dirs {
+		add(name)
+	}
+	names := []string{".", ".."}
+	sorted := []string{}
+	for name := range children {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return afcData(afcPairs(append(names, sorted...)...))
+}
+
+func (d *Device) afcRemove(p string, recursive bool) uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.Files[p]; ok {
+		delete(d.Files, p)
+		return afc.Afc_Err_Success
+	}
+	if !d.isDir(p) || p == "/" {
+		return afc.Afc_Err_ObjectNotFound
+	}
+	prefix := p + "/"
+	for name := range d.Files {
+		if strings.HasPrefix(name, prefix) {
+			if !recursive {
+				return afc.Afc_Err_DirNotEmpty
+			}
+			delete(d.Files, name)
+		}
+	}
+	for name := range d.dirs {
+		if strings.HasPrefix(name, prefix) {
+			if !recursive {
+				return afc.Afc_Err_DirNotEmpty
+			}
+			delete(d.dirs, name)
+		}
+	}
+	delete(d.dirs, p)
+	return afc.Afc_Err_Success
+}
+
+// afcOpen checks that p can be opened with mode, writing modes create the file and WR and WRONLY truncate it
+func (d *Device) afcOpen(p string, mode uint64) uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.Files[p]; !ok && d.isDir(p) {
+		return afc.Afc_Err_ObjectIsDir
+	}
+	_, exists := d.Files[p]
+	switch mode {
+	case afc.Afc_Mode_RDONLY, afc.Afc_Mode_RW:
+		if !exists {
+			return afc.Afc_Err_ObjectNotFound
+		}
+	case afc.Afc_Mode_WRONLY, afc.Afc_Mode_WR:
+		d.Files[p] = []byte{}
+	case afc.Afc_Mode_APPEND, afc.Afc_Mode_RDAPPEND:
+		if !exists {
+			d.Files[p] = []byte{}
+		}
+	default:
+		return afc.Afc_Err_InvalidArgument
+	}
+	return afc.Afc_Err_Success
+}
@@ -0,0 +1,216 @@
+// Package simdevice simulates iOS devices for tests that cannot rely on hardware.
+// A Server speaks the usbmuxd protocol on a local TCP port that USBMUXD_SOCKET_ADDRESS can point at.
+// Every attached Device runs a fake lockdownd and stub installation_proxy, MCInstall,
+// mobile_image_mounter and afc services. Sessions and services never enable SSL, go-ios
+// only switches to TLS when the device asks for it.
+package simdevice
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"sync"
+	"time"
+)
+
+// ServiceHandler serves one connection to a service started through lockdown
+type ServiceHandler func(d *Device, conn net.Conn)
+
+// LockdownHandler answers a lockdown request, it replaces the built in handling of that request
+type LockdownHandler func(d *Device, request map[string]any) map[string]any
+
+// Profile is a configuration profile installed on a simulated device
+type Profile struct {
+	Identifier        string
+	DisplayName       string
+	Description       string
+	UUID              string
+	RemovalDisallowed bool
+	Data              []byte
+}
+
+// Device is the state of a simulated device. Fields can be changed before the device is attached,
+// afterwards use Update so services do not see half written state.
+type Device struct {
+	Udid string
+	// Values are the global lockdown values, Domains the values of other lockdown domains
+	Values  map[string]any
+	Domains map[string]map[string]any
+	// Apps are installation_proxy app infos, at least CFBundleIdentifier and ApplicationType are expected
+	Apps     []map[string]any
+	Profiles []Profile
+	// ImageSignatures are the signatures of mounted developer disk images
+	ImageSignatures [][]byte
+	DevMode         bool
+	// Files is the afc file system, directories are implied by the paths
+	Files map[string][]byte
+	// PendingTrustPrompts is how often a Pair request answers PairingDialogResponsePending before it succeeds
+	PendingTrustPrompts int
+	DenyPairing         bool
+	// RebootDelay is how long the device stays detached when it erases or reboots
+	RebootDelay time.Duration
+
+	mu             sync.Mutex
+	server         *Server
+	dirs           map[string]bool
+	deviceID       int
+	trustedHosts   map[string]bool
+	privateKey     *rsa.PrivateKey
+	lockdown       map[string]LockdownHandler
+	services       map[string]ServiceHandler
+	startedService map[uint16]string
+	nextPort       uint16
+}
+
+// NewDevice returns an activated, unsupervised iPhone running iOS 16 with no apps or profiles
+func NewDevice(udid string) *Device {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	publicKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+	d := &Device{
+		Udid: udid,
+		Values: map[string]any{
+			"ActivationState":   "Activated",
+			"BuildVersion":      "20H115",
+			"CPUArchitecture":   "arm64e",
+			"DeviceClass":       "iPhone",
+			"DeviceName":        "Simulated iPhone",
+			"DevicePublicKey":   publicKey,
+			"HardwareModel":     "N104AP",
+			"ModelNumber":       "MWLT2",
+			"ProductName":       "iPhone OS",
+			"ProductType":       "iPhone12,1",
+			"ProductVersion":    "16.7.2",
+			"ProtocolVersion":   "2",
+			"SerialNumber":      "SIM" + udid[max(0, len(udid)-7):],
+			"TimeZone":          "Europe/Berlin",
+			"UniqueChipID":      uint64(4711),
+			"UniqueDeviceID":    udid,
+			"WiFiAddress":       "f0:18:98:00:00:01",
+			"TotalDiskCapacity": uint64(64000000000),
+		},
+		Domains: map[string]map[string]any{
+			"com.apple.mobile.chaperone": {"DeviceIsChaperoned": false},
+			"com.apple.international": {
+				"Language":           "en",
+				"Locale":             "en_US",
+				"SupportedLanguages": []any{"en", "de", "fr"},
+				"SupportedLocales":   []any{"en_US", "de_DE", "fr_FR"},
+			},
+			"com.apple.disk_usage": {"TotalDiskCapacity": uint64(64000000000), "AmountDataAvailable": uint64(32000000000)},
+		},
+		Apps:           []map[string]any{},
+		Profiles:       []Profile{},
+		Files:          map[string][]byte{},
+		dirs:           map[string]bool{},
+		RebootDelay:    100 * time.Millisecond,
+		trustedHosts:   map[string]bool{},
+		privateKey:     key,
+		lockdown:       map[string]LockdownHandler{},
+		startedService: map[uint16]string{},
+		nextPort:       49152,
+	}
+	d.services = map[string]ServiceHandler{
+		installationProxyService: serveInstallationProxy,
+		mcInstallService:         serveMCInstall,
+		imageMounterService:      serveImageMounter,
+		afcService:               serveAfc,
+	}
+	return d
+}
+
+// HandleService adds or replaces the handler of a lockdown service
+func (d *Device) HandleService(name string, handler ServiceHandler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.services[name] = handler
+}
+
+// HandleLockdown replaces the handling of a lockdown request like GetValue or Pair
+func (d *Device) HandleLockdown(request string, handler LockdownHandler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lockdown[request] = handler
+}
+
+// Update runs f while holding the device's lock
+func (d *Device) Update(f func(d *Device)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f(d)
+}
+
+// Supervised reports whether the device is supervised
+func (d *Device) Supervised() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	supervised, _ := d.Domains["com.apple.mobile.chaperone"]["DeviceIsChaperoned"].(bool)
+	return supervised
+}
+
+// SetSupervised changes the supervision state lockdown reports
+func (d *Device) SetSupervised(supervised bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.setDomainValue("com.apple.mobile.chaperone", "DeviceIsChaperoned", supervised)
+}
+
+// DeviceID is the usbmuxd id of the current attachment, it changes whenever the device reattaches
+func (d *Device) DeviceID() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deviceID
+}
+
+// setDomainValue stores a lockdown value, callers hold d.mu
+func (d *Device) setDomainValue(domain string, key string, value any) {
+	if domain == "" {
+		d.Values[key] = value
+		return
+	}
+	if d.Domains[domain] == nil {
+		d.Domains[domain] = map[string]any{}
+	}
+	d.Domains[domain][key] = value
+}
+
+// wipe resets the device like an erase does, callers hold d.mu
+func (d *Device) wipe() {
+	d.Apps = []map[string]any{}
+	d.Profiles = []Profile{}
+	d.ImageSignatures = nil
+	d.DevMode = false
+	d.Files = map[string][]byte{}
+	d.dirs = map[string]bool{}
+	d.trustedHosts = map[string]bool{}
+	d.Values["ActivationState"] = "Unactivated"
+	d.setDomainValue("com.apple.mobile.chaperone", "DeviceIsChaperoned", false)
+	delete(d.Domains, "cloudConfiguration")
+}
+
+// startService registers a started service and returns the port it can be connected on, callers hold d.mu
+func (d *Device) startService(name string) (uint16, bool) {
+	if _, ok := d.services[name]; !ok {
+		return 0, false
+	}
+	port := d.nextPort
+	d.nextPort++
+	d.startedService[port] = name
+	return port, true
+}
+
+// takeService returns the handler of a service started on port, every start allows one connection
+func (d *Device) takeService(port uint16) (ServiceHandler, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name, ok := d.startedService[port]
+	if !ok {
+		return nil, false
+	}
+	delete(d.startedService, port)
+	return d.services[name], true
+}
@@ -0,0 +1,171 @@
+package simdevice
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/google/uuid"
+)
+
+// readMessage reads one length prefixed plist like lockdown and most services use
+func readMessage(r io.Reader) (map[string]any, error) {
+	data, err := ios.NewPlistCodec().Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return ios.ParsePlist(data)
+}
+
+func writeMessage(w io.Writer, message any) error {
+	data, err := ios.NewPlistCodec().Encode(message)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// serveLockdown answers lockdown requests until the client hangs up
+func (d *Device) serveLockdown(conn net.Conn) {
+	session := ""
+	for {
+		request, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		name, _ := request["Request"].(string)
+
+		d.mu.Lock()
+		custom, ok := d.lockdown[name]
+		d.mu.Unlock()
+		var response map[string]any
+		if ok {
+			response = custom(d, request)
+		} else {
+			response = d.lockdownRequest(name, request, &session)
+		}
+		if response == nil {
+			continue
+		}
+		response["Request"] = name
+		if err := writeMessage(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+func (d *Device) lockdownRequest(name string, request map[string]any, session *string) map[string]any {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key, _ := request["Key"].(string)
+	domain, _ := request["Domain"].(string)
+
+	switch name {
+	case "QueryType":
+		return map[string]any{"Type": "com.apple.mobile.lockdown"}
+	case "GetValue":
+		values := d.Values
+		if domain != "" {
+			values = d.Domains[domain]
+		}
+		if key == "" {
+			return map[string]any{"Domain": domain, "Value": copyMap(values)}
+		}
+		value, ok := values[key]
+		if !ok {
+			return map[string]any{"Domain": domain, "Key": key, "Error": "MissingValue"}
+		}
+		return map[string]any{"Domain": domain, "Key": key, "Value": value}
+	case "SetValue":
+		if *session == "" {
+			return map[string]any{"Error": "NoRunningSession"}
+		}
+		d.setDomainValue(domain, key, request["Value"])
+		return map[string]any{"Domain": domain, "Key": key}
+	case "StartSession":
+		hostID, _ := request["HostID"].(string)
+		if !d.trustedHosts[hostID] {
+			return map[string]any{"Error": "InvalidHostID"}
+		}
+		*session = strings.ToUpper(uuid.New().String())
+		return map[string]any{"SessionID": *session, "EnableSessionSSL": false}
+	case "StopSession":
+		*session = ""
+		return map[string]any{}
+	case "StartService":
+		if *session == "" {
+			return map[string]any{"Error": "NoRunningSession"}
+		}
+		service, _ := request["Service"].(string)
+		port, ok := d.startService(service)
+		if !ok {
+			return map[string]any{"Service": service, "Error": "InvalidService"}
+		}
+		return map[string]any{"Service": service, "Port": port, "EnableServiceSSL": false}
+	case "Pair":
+		return d.pair(request)
+	case "Unpair":
+		record, _ := request["PairRecord"].(map[string]any)
+		hostID, _ := record["HostID"].(string)
+		delete(d.trustedHosts, hostID)
+		return map[string]any{}
+	case "EnterRecovery":
+		return map[string]any{}
+	}
+	return map[string]any{"Error": "InvalidRequest"}
+}
+
+// pair trusts the host of the request. Supervised pairing with a SupervisorCertificate answers with a
+// challenge first like real devices do, the signature of the challenge response is not checked.
+func (d *Device) pair(request map[string]any) map[string]any {
+	record, _ := request["PairRecord"].(map[string]any)
+	options, _ := request["PairingOptions"].(map[string]any)
+	hostID, _ := record["HostID"].(string)
+	if hostID == "" {
+		return map[string]any{"Error": "InvalidPairRecord"}
+	}
+
+	_, supervisor := options["SupervisorCertificate"]
+	_, challengeResponse := options["ChallengeResponse"]
+	supervised, _ := d.Domains["com.apple.mobile.chaperone"]["DeviceIsChaperoned"].(bool)
+	switch {
+	case supervisor && supervised:
+		challenge := make([]byte, 32)
+		_, _ = rand.Read(challenge)
+		return map[string]any{"Error": "MCChallengeRequired", "ExtendedResponse": map[string]any{"PairingChallenge": challenge}}
+	case challengeResponse:
+	case d.DenyPairing:
+		return map[string]any{"Error": "UserDeniedPairing"}
+	case d.PendingTrustPrompts > 0:
+		d.PendingTrustPrompts--
+		return map[string]any{"Error": "PairingDialogResponsePending"}
+	}
+	d.trustedHosts[hostID] = true
+	escrow := make([]byte, 16)
+	_, _ = rand.Read(escrow)
+	return map[string]any{"EscrowBag": []byte(hex.EncodeToString(escrow))}
+}
+
+func copyMap(m map[string]any) map[string]any {
+	result := map[string]any{}
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
+
+// Trusts reports whether the device accepts sessions from the host of a pair record
+func (d *Device) Trusts(pairRecord []byte) (bool, error) {
+	hostID, err := pairRecordHostID(pairRecord)
+	if err != nil {
+		return false, fmt.Errorf("invalid pair record: %w", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.trustedHosts[hostID], nil
+}
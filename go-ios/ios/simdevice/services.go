@@ -0,0 +1,238 @@
+package simdevice
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+
+	"github.com/danielpaulus/go-ios/ios/mcinstall"
+	"github.com/google/uuid"
+)
+
+const (
+	installationProxyService = "com.apple.mobile.installation_proxy"
+	mcInstallService         = "com.apple.mobile.MCInstall"
+	imageMounterService      = "com.apple.mobile.mobile_image_mounter"
+	afcService               = "com.apple.afc"
+)
+
+// serveInstallationProxy supports Browse and Uninstall
+func serveInstallationProxy(d *Device, conn net.Conn) {
+	for {
+		request, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		switch request["Command"] {
+		case "Browse":
+			options, _ := request["ClientOptions"].(map[string]any)
+			applicationType, _ := options["ApplicationType"].(string)
+			d.mu.Lock()
+			list := []any{}
+			for _, app := range d.Apps {
+				if applicationType == "" || app["ApplicationType"] == applicationType {
+					list = append(list, copyMap(app))
+				}
+			}
+			d.mu.Unlock()
+			if len(list) > 0 {
+				err = writeMessage(conn, map[string]any{"Status": "BrowsingApplications", "CurrentIndex": 0, "CurrentAmount": len(list), "CurrentList": list})
+				if err != nil {
+					return
+				}
+			}
+			err = writeMessage(conn, map[string]any{"Status": "Complete"})
+		case "Uninstall":
+			bundleID, _ := request["ApplicationIdentifier"].(string)
+			d.mu.Lock()
+			found := false
+			for i, app := range d.Apps {
+				if app["CFBundleIdentifier"] == bundleID {
+					d.Apps = append(d.Apps[:i], d.Apps[i+1:]...)
+					found = true
+					break
+				}
+			}
+			d.mu.Unlock()
+			if !found {
+				err = writeMessage(conn, map[string]any{"Error": "APIInternalError", "ErrorDescription": "app not installed"})
+				break
+			}
+			err = writeMessage(conn, map[string]any{"Status": "Complete"})
+		default:
+			err = writeMessage(conn, map[string]any{"Error": "UnknownCommand"})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// serveMCInstall supports profile listing, installation and removal, supervision escalation,
+// cloud configuration and erasing. Erasing wipes the device and reattaches it after RebootDelay.
+func serveMCInstall(d *Device, conn net.Conn) {
+	acknowledged := func(extra map[string]any) map[string]any {
+		response := map[string]any{"Status": "Acknowledged"}
+		for k, v := range extra {
+			response[k] = v
+		}
+		return response
+	}
+	for {
+		request, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		var response map[string]any
+		switch request["RequestType"] {
+		case "GetProfileList":
+			d.mu.Lock()
+			identifiers := []any{}
+			manifest := map[string]any{}
+			metadata := map[string]any{}
+			for _, p := range d.Profiles {
+				identifiers = append(identifiers, p.Identifier)
+				manifest[p.Identifier] = map[string]any{"Description": p.Description, "IsActive": true}
+				metadata[p.Identifier] = map[string]any{
+					"PayloadDescription":       p.Description,
+					"PayloadDisplayName":       p.DisplayName,
+					"PayloadRemovalDisallowed": p.RemovalDisallowed,
+					"PayloadUUID":              p.UUID,
+					"PayloadVersion":           uint64(1),
+				}
+			}
+			d.mu.Unlock()
+			response = acknowledged(map[string]any{"OrderedIdentifiers": identifiers, "ProfileManifest": manifest, "ProfileMetadata": metadata})
+		case "InstallProfile", "InstallProfileSilent":
+			data, _ := request["Payload"].([]byte)
+			preview, err := mcinstall.ParseProfile(data)
+			if err != nil {
+				response = map[string]any{"Status": "Error", "ErrorChain": []any{map[string]any{"LocalizedDescription": err.Error()}}}
+				break
+			}
+			profile := Profile{
+				Identifier:        preview.Identifier,
+				DisplayName:       preview.DisplayName,
+				Description:       preview.Description,
+				UUID:              preview.UUID,
+				RemovalDisallowed: preview.RemovalDisallowed,
+				Data:              data,
+			}
+			d.mu.Lock()
+			replaced := false
+			for i, p := range d.Profiles {
+				if p.Identifier == profile.Identifier {
+					d.Profiles[i] = profile
+					replaced = true
+				}
+			}
+			if !replaced {
+				d.Profiles = append(d.Profiles, profile)
+			}
+			d.mu.Unlock()
+			response = acknowledged(nil)
+		case "RemoveProfile":
+			identifier, _ := request["ProfileIdentifier"].(string)
+			d.mu.Lock()
+			for i, p := range d.Profiles {
+				if p.Identifier == identifier {
+					d.Profiles = append(d.Profiles[:i], d.Profiles[i+1:]...)
+					break
+				}
+			}
+			d.mu.Unlock()
+			response = acknowledged(nil)
+		case "Escalate":
+			challenge := make([]byte, 32)
+			_, _ = rand.Read(challenge)
+			response = acknowledged(map[string]any{"Challenge": challenge})
+		case "GetCloudConfiguration":
+			d.mu.Lock()
+			config := copyMap(d.Domains["cloudConfiguration"])
+			d.mu.Unlock()
+			response = acknowledged(map[string]any{"CloudConfiguration": config})
+		case "SetCloudConfiguration":
+			config, _ := request["CloudConfiguration"].(map[string]any)
+			d.mu.Lock()
+			d.Domains["cloudConfiguration"] = config
+			if supervised, _ := config["IsSupervised"].(bool); supervised {
+				d.setDomainValue("com.apple.mobile.chaperone", "DeviceIsChaperoned", true)
+			}
+			d.mu.Unlock()
+			response = acknowledged(nil)
+		case "EraseDevice":
+			writeMessage(conn, acknowledged(nil))
+			d.mu.Lock()
+			d.wipe()
+			server := d.server
+			d.mu.Unlock()
+			if server != nil {
+				server.Reboot(d.Udid)
+			}
+			return
+		default:
+			// Flush, EscalateResponse, ProceedWithKeybagMigration, HTTPProxy and friends just need an acknowledgement
+			response = acknowledged(nil)
+		}
+		if err := writeMessage(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// serveImageMounter supports looking up, uploading, mounting and unmounting developer disk images
+// and the developer mode query. Uploaded image bytes are discarded.
+func serveImageMounter(d *Device, conn net.Conn) {
+	for {
+		request, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		var response map[string]any
+		switch request["Command"] {
+		case "LookupImage":
+			d.mu.Lock()
+			signatures := []any{}
+			for _, s := range d.ImageSignatures {
+				signatures = append(signatures, s)
+			}
+			d.mu.Unlock()
+			response = map[string]any{"ImageSignature": signatures, "Status": "Complete"}
+		case "ReceiveBytes":
+			size, _ := toInt(request["ImageSize"])
+			if err := writeMessage(conn, map[string]any{"Status": "ReceiveBytesAck"}); err != nil {
+				return
+			}
+			if _, err := io.CopyN(io.Discard, conn, int64(size)); err != nil {
+				return
+			}
+			response = map[string]any{"Status": "Complete"}
+		case "MountImage":
+			signature, _ := request["ImageSignature"].([]byte)
+			if signature == nil {
+				signature = []byte(uuid.New().String())
+			}
+			d.mu.Lock()
+			d.ImageSignatures = append(d.ImageSignatures, signature)
+			d.mu.Unlock()
+			response = map[string]any{"Status": "Complete"}
+		case "UnmountImage":
+			d.mu.Lock()
+			d.ImageSignatures = nil
+			d.mu.Unlock()
+			response = map[string]any{"Status": "Complete"}
+		case "QueryDeveloperModeStatus":
+			d.mu.Lock()
+			response = map[string]any{"DeveloperModeStatus": d.DevMode}
+			d.mu.Unlock()
+		case "Hangup":
+			writeMessage(conn, map[string]any{"Status": "Complete"})
+			return
+		default:
+			response = map[string]any{"Error": "UnknownCommand"}
+		}
+		if err := writeMessage(conn, response); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package simdevice_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/afc"
+	"github.com/danielpaulus/go-ios/ios/imagemounter"
+	"github.com/danielpaulus/go-ios/ios/installationproxy"
+	"github.com/danielpaulus/go-ios/ios/mcinstall"
+	"github.com/danielpaulus/go-ios/ios/simdevice"
+	"github.com/danielpaulus/go-ios/ios/tiny"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func start(t *testing.T, d *simdevice.Device, paired bool) (*simdevice.Server, ios.DeviceEntry) {
+	server, err := simdevice.NewServer()
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+	t.Setenv("USBMUXD_SOCKET_ADDRESS", server.Addr())
+	server.Attach(d, paired)
+	entry, err := ios.GetDevice(d.Udid)
+	require.NoError(t, err)
+	return server, entry
+}
+
+func TestListAndValues(t *testing.T) {
+	_, entry := start(t, simdevice.NewDevice("00008030-0000000000000001"), true)
+
+	list, err := ios.ListDevices()
+	require.NoError(t, err)
+	require.Len(t, list.DeviceList, 1)
+
+	values, err := ios.GetValues(entry)
+	require.NoError(t, err)
+	assert.Equal(t, "16.7.2", values.Value.ProductVersion)
+	assert.Equal(t, "iPhone12,1", values.Value.ProductType)
+
+	language, err := ios.GetLanguage(entry)
+	require.NoError(t, err)
+	assert.Equal(t, "en_US", language.Locale)
+}
+
+func TestAppsAndProfiles(t *testing.T) {
+	d := simdevice.NewDevice("00008030-0000000000000002")
+	d.Apps = append(d.Apps, map[string]any{"CFBundleIdentifier": "com.example.app", "CFBundleName": "Example", "ApplicationType": "User"})
+	_, entry := start(t, d, true)
+
+	proxy, err := installationproxy.New(entry)
+	require.NoError(t, err)
+	apps, err := proxy.BrowseUserApps()
+	proxy.Close()
+	require.NoError(t, err)
+	require.Len(t, apps, 1)
+	assert.Equal(t, "com.example.app", apps[0].CFBundleIdentifier())
+
+	profile, err := mcinstall.BuildProfile(mcinstall.Profile{
+		Identifier: "com.example.profile",
+		Payloads:   []mcinstall.PayloadSpec{{WebClip: &mcinstall.WebClipPayload{Label: "Example", URL: "https://example.com"}}},
+	})
+	require.NoError(t, err)
+	conn, err := mcinstall.New(entry)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.AddProfile(profile))
+	profiles, err := conn.HandleList()
+	require.NoError(t, err)
+	require.Len(t, profiles, 1)
+	assert.Equal(t, "com.example.profile", profiles[0].Identifier)
+	require.NoError(t, conn.RemoveProfile("com.example.profile"))
+	profiles, err = conn.HandleList()
+	require.NoError(t, err)
+	assert.Empty(t, profiles)
+}
+
+func TestImageMount(t *testing.T) {
+	d := simdevice.NewDevice("00008030-0000000000000003")
+	_, entry := start(t, d, true)
+
+	image := filepath.Join(t.TempDir(), "DeveloperDiskImage.dmg")
+	require.NoError(t, os.WriteFile(image, []byte("image"), 0o644))
+	require.NoError(t, os.WriteFile(image+".signature", []byte("signature"), 0o644))
+	require.NoError(t, imagemounter.MountImage(entry, image))
+
+	mounter, err := imagemounter.NewImageMounter(entry)
+	require.NoError(t, err)
+	defer mounter.Close()
+	signatures, err := mounter.ListImages()
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("signature")}, signatures)
+}
+
+func TestAfc(t *testing.T) {
+	d := simdevice.NewDevice("00008030-0000000000000004")
+	_, entry := start(t, d, true)
+
+	conn, err := afc.New(entry)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.MkDir("/Downloads"))
+	require.NoError(t, conn.WriteToFile(bytes.NewReader([]byte("hello")), "/Downloads/hello.txt"))
+
+	info, err := conn.Stat("/Downloads")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	files, err := conn.ListFiles("/Downloads", "*")
+	require.NoError(t, err)
+	assert.Contains(t, files, "hello.txt")
+
+	target := filepath.Join(t.TempDir(), "hello.txt")
+	require.NoError(t, conn.Pull("/Downloads/hello.txt", target))
+	content, err := os.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+
+	require.Error(t, conn.Remove("/Downloads"))
+	require.NoError(t, conn.RemoveAll("/Downloads"))
+	_, err = conn.Stat("/Downloads/hello.txt")
+	assert.Error(t, err)
+}
+
+func TestPairWithTrustDialog(t *testing.T) {
+	d := simdevice.NewDevice("00008030-0000000000000005")
+	d.PendingTrustPrompts = 1
+	server, entry := start(t, d, false)
+
+	_, err := ios.GetValues(entry)
+	require.Error(t, err)
+
+	waited := false
+	require.NoError(t, tiny.PairWithTrustDialog(context.Background(), entry, func() { waited = true }))
+	assert.True(t, waited)
+
+	record, ok := server.PairRecord(d.Udid)
+	require.True(t, ok)
+	trusted, err := d.Trusts(record)
+	require.NoError(t, err)
+	assert.True(t, trusted)
+	_, err = ios.GetValues(entry)
+	assert.NoError(t, err)
+}
+
+func TestEraseReattaches(t *testing.T) {
+	d := simdevice.NewDevice("00008030-0000000000000006")
+	d.Apps = append(d.Apps, map[string]any{"CFBundleIdentifier": "com.example.app", "ApplicationType": "User"})
+	_, entry := start(t, d, true)
+
+	snapshot := tiny.EraseSnapshot{}
+	state, err := tiny.EraseAndWait(context.Background(), entry, &snapshot, func(string, string, error) {})
+	require.NoError(t, err)
+	assert.Equal(t, "Unactivated", state)
+	assert.NotEqual(t, entry.DeviceID, d.DeviceID())
+	require.Len(t, snapshot.Apps, 1)
+	assert.Equal(t, "com.example.app", snapshot.Apps[0].BundleID)
+	assert.Equal(t, "Europe/Berlin", snapshot.Settings.TimeZone)
+}
+
+func TestMultipleEndpoints(t *testing.T) {
+	a, err := simdevice.NewServer()
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := simdevice.NewServer()
+	require.NoError(t, err)
+	defer b.Close()
+	t.Setenv("USBMUXD_SOCKET_ADDRESS", a.Addr()+","+b.Addr())
+
+	// both devices get DeviceID 1, only the endpoint tells them apart
+	first := simdevice.NewDevice("00008030-0000000000000007")
+	second := simdevice.NewDevice("00008030-0000000000000008")
+	second.Values["DeviceName"] = "Second"
+	a.Attach(first, true)
+	b.Attach(second, true)
+
+	list, err := ios.ListDevices()
+	require.NoError(t, err)
+	require.Len(t, list.DeviceList, 2)
+	entry, err := ios.GetDevice(second.Udid)
+	require.NoError(t, err)
+	assert.Equal(t, "tcp://"+b.Addr(), entry.UsbmuxdSocket)
+	values, err := ios.GetValues(entry)
+	require.NoError(t, err)
+	assert.Equal(t, "Second", values.Value.DeviceName)
+
+	receive, closeListener, err := ios.Listen()
+	require.NoError(t, err)
+	defer closeListener()
+	seen := map[string]string{}
+	for len(seen) < 2 {
+		msg, err := receive()
+		require.NoError(t, err)
+		seen[msg.Properties.SerialNumber] = msg.UsbmuxdSocket
+	}
+	assert.Equal(t, "tcp://"+a.Addr(), seen[first.Udid])
+
+	a.Close()
+	list, err = ios.ListDevices()
+	require.NoError(t, err)
+	require.Len(t, list.DeviceList, 1)
+	states := ios.UsbmuxdEndpoints()
+	require.Len(t, states, 2)
+	assert.False(t, states[0].Reachable)
+	assert.True(t, states[1].Reachable)
+	assert.Equal(t, 1, states[1].Devices)
+}
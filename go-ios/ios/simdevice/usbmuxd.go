@@ -0,0 +1,360 @@
+package simdevice
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/google/uuid"
+	"howett.net/plist"
+)
+
+// usbmuxd result codes
+const (
+	resultOK                = 0
+	resultBadDevice         = 2
+	resultConnectionRefused = 3
+	resultBadCommand        = 1
+)
+
+// lockdownPort is the port lockdownd listens on, clients send it in network byte order
+const lockdownPort = 62078
+
+// Server is a usbmuxd replacement serving simulated devices over TCP
+type Server struct {
+	listener net.Listener
+	buid     string
+
+	mu           sync.Mutex
+	devices      map[string]*Device
+	pairRecords  map[string][]byte
+	listeners    map[*muxConn]bool
+	nextDeviceID int
+	closed       bool
+}
+
+type muxConn struct {
+	conn net.Conn
+	// mu serializes writes, Listen connections get events from other goroutines
+	mu sync.Mutex
+}
+
+// NewServer starts a server on a random local port
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener:     listener,
+		buid:         strings.ToUpper(uuid.New().String()),
+		devices:      map[string]*Device{},
+		pairRecords:  map[string][]byte{},
+		listeners:    map[*muxConn]bool{},
+		nextDeviceID: 1,
+	}
+	go s.accept()
+	return s, nil
+}
+
+// Addr is the host:port to put into USBMUXD_SOCKET_ADDRESS
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops accepting connections and closes all Listen connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.conn.Close()
+	}
+	s.mu.Unlock()
+	return s.listener.Close()
+}
+
+// Attach plugs in d. With paired the host already has a pair record the device trusts.
+func (s *Server) Attach(d *Device, paired bool) {
+	s.mu.Lock()
+	d.mu.Lock()
+	d.server = s
+	d.deviceID = s.nextDeviceID
+	s.nextDeviceID++
+	if paired {
+		hostID := strings.ToUpper(uuid.New().String())
+		d.trustedHosts[hostID] = true
+		s.pairRecords[d.Udid] = []byte(ios.ToPlist(ios.PairRecord{HostID: hostID, SystemBUID: s.buid, WiFiMACAddress: fmt.Sprint(d.Values["WiFiAddress"])}))
+	}
+	s.devices[d.Udid] = d
+	event := attachedEvent(d)
+	d.mu.Unlock()
+	s.mu.Unlock()
+	s.broadcast(event)
+}
+
+// Detach unplugs the device with udid
+func (s *Server) Detach(udid string) {
+	s.mu.Lock()
+	d, ok := s.devices[udid]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.devices, udid)
+	s.mu.Unlock()
+	s.broadcast(map[string]any{"MessageType": "Detached", "DeviceID": d.DeviceID()})
+}
+
+// Reboot detaches the device and attaches it again with a new DeviceID after its RebootDelay
+func (s *Server) Reboot(udid string) {
+	s.mu.Lock()
+	d, ok := s.devices[udid]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	s.Detach(udid)
+	d.mu.Lock()
+	d.ImageSignatures = nil
+	delay := d.RebootDelay
+	d.mu.Unlock()
+	time.AfterFunc(delay, func() {
+		s.mu.Lock()
+		closed := s.closed
+		s.mu.Unlock()
+		if !closed {
+			s.Attach(d, false)
+		}
+	})
+}
+
+// PairRecord returns the pair record the host keeps for udid
+func (s *Server) PairRecord(udid string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.pairRecords[udid]
+	return record, ok
+}
+
+func attachedEvent(d *Device) map[string]any {
+	return map[string]any{"MessageType": "Attached", "DeviceID": d.deviceID, "Properties": properties(d)}
+}
+
+func properties(d *Device) map[string]any {
+	return map[string]any{
+		"ConnectionSpeed": 480000000,
+		"ConnectionType":  "USB",
+		"DeviceID":        d.deviceID,
+		"LocationID":      0,
+		"ProductID":       4776,
+		"SerialNumber":    d.Udid,
+	}
+}
+
+func (s *Server) broadcast(event map[string]any) {
+	s.mu.Lock()
+	listeners := make([]*muxConn, 0, len(s.listeners))
+	for l := range s.listeners {
+		listeners = append(listeners, l)
+	}
+	s.mu.Unlock()
+	for _, l := range listeners {
+		if err := l.write(0, event); err != nil {
+			s.mu.Lock()
+			delete(s.listeners, l)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(&muxConn{conn: conn})
+	}
+}
+
+func (c *muxConn) write(tag uint32, message any) error {
+	payload := []byte(ios.ToPlist(message))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := ios.UsbMuxHeader{Length: 16 + uint32(len(payload)), Version: 1, Request: 8, Tag: tag}
+	if err := binary.Write(c.conn, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+func (c *muxConn) result(tag uint32, number int) error {
+	return c.write(tag, map[string]any{"MessageType": "Result", "Number": number})
+}
+
+func (c *muxConn) read() (uint32, map[string]any, error) {
+	var header ios.UsbMuxHeader
+	if err := binary.Read(c.conn, binary.LittleEndian, &header); err != nil {
+		return 0, nil, err
+	}
+	if header.Length < 16 {
+		return 0, nil, fmt.Errorf("invalid usbmuxd header length %d", header.Length)
+	}
+	payload := make([]byte, header.Length-16)
+	if _, err := io.ReadFull(c.conn, payload); err != nil {
+		return 0, nil, err
+	}
+	var message map[string]any
+	if _, err := plist.Unmarshal(payload, &message); err != nil {
+		return 0, nil, err
+	}
+	return header.Tag, message, nil
+}
+
+func (s *Server) device(id int) (*Device, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.devices {
+		if d.DeviceID() == id {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// serve answers usbmuxd requests until the connection is closed or handed to a device by Connect
+func (s *Server) serve(c *muxConn) {
+	for {
+		tag, message, err := c.read()
+		if err != nil {
+			s.mu.Lock()
+			delete(s.listeners, c)
+			s.mu.Unlock()
+			c.conn.Close()
+			return
+		}
+		messageType, _ := message["MessageType"].(string)
+		switch messageType {
+		case "ListDevices":
+			s.mu.Lock()
+			list := []any{}
+			for _, d := range s.devices {
+				d.mu.Lock()
+				list = append(list, map[string]any{"DeviceID": d.deviceID, "MessageType": "Attached", "Properties": properties(d)})
+				d.mu.Unlock()
+			}
+			s.mu.Unlock()
+			err = c.write(tag, map[string]any{"DeviceList": list})
+		case "Listen":
+			if err = c.result(tag, resultOK); err != nil {
+				break
+			}
+			s.mu.Lock()
+			s.listeners[c] = true
+			events := []map[string]any{}
+			for _, d := range s.devices {
+				d.mu.Lock()
+				events = append(events, attachedEvent(d))
+				d.mu.Unlock()
+			}
+			s.mu.Unlock()
+			for _, event := range events {
+				if err = c.write(0, event); err != nil {
+					break
+				}
+			}
+		case "ReadBUID":
+			err = c.write(tag, map[string]any{"BUID": s.buid})
+		case "ReadPairRecord":
+			record, ok := s.PairRecord(fmt.Sprint(message["PairRecordID"]))
+			if !ok {
+				err = c.result(tag, resultBadDevice)
+				break
+			}
+			err = c.write(tag, map[string]any{"PairRecordData": record})
+		case "SavePairRecord":
+			data, _ := message["PairRecordData"].([]byte)
+			s.mu.Lock()
+			s.pairRecords[fmt.Sprint(message["PairRecordID"])] = data
+			s.mu.Unlock()
+			err = c.result(tag, resultOK)
+		case "DeletePairRecord":
+			s.mu.Lock()
+			delete(s.pairRecords, fmt.Sprint(message["PairRecordID"]))
+			s.mu.Unlock()
+			err = c.result(tag, resultOK)
+		case "Connect":
+			s.connect(c, tag, message)
+			return
+		default:
+			err = c.result(tag, resultBadCommand)
+		}
+		if err != nil {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// connect hands the connection to lockdownd or a started service of the device
+func (s *Server) connect(c *muxConn, tag uint32, message map[string]any) {
+	id, _ := toInt(message["DeviceID"])
+	port, _ := toInt(message["PortNumber"])
+	// the port arrives in network byte order
+	port = int(port&0xff)<<8 | int(port>>8&0xff)
+
+	d, ok := s.device(int(id))
+	if !ok {
+		c.result(tag, resultBadDevice)
+		c.conn.Close()
+		return
+	}
+	if port == lockdownPort {
+		if c.result(tag, resultOK) == nil {
+			d.serveLockdown(c.conn)
+		}
+		c.conn.Close()
+		return
+	}
+	handler, ok := d.takeService(uint16(port))
+	if !ok {
+		c.result(tag, resultConnectionRefused)
+		c.conn.Close()
+		return
+	}
+	if c.result(tag, resultOK) == nil {
+		handler(d, c.conn)
+	}
+	c.conn.Close()
+}
+
+func toInt(v any) (int, bool) {
+	switch n := v.(type) {
+	case uint64:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case int:
+		return n, true
+	}
+	return 0, false
+}
+
+// pairRecordHostID extracts the HostID of a pair record plist
+func pairRecordHostID(record []byte) (string, error) {
+	var parsed ios.PairRecord
+	if _, err := plist.Unmarshal(record, &parsed); err != nil {
+		return "", err
+	}
+	if parsed.HostID == "" {
+		return "", errors.New("pair record has no HostID")
+	}
+	return parsed.HostID, nil
+}
@@ -0,0 +1,203 @@
+package tiny
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/accessibility"
+	"github.com/danielpaulus/go-ios/ios/instruments"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const axTimeout = 10 * time.Second
+
+const axAuditTimeout = 2 * time.Minute
+
+type AxSession struct {
+	Udid    string
+	control accessibility.ControlInterface
+	mu      sync.Mutex
+	current *accessibility.AXElementData
+}
+
+var globalAxSessions = sync.Map{}
+
+func loadAxSession(device ios.DeviceEntry) (*AxSession, bool) {
+	s, ok := globalAxSessions.Load(device.Properties.SerialNumber)
+	if !ok {
+		return nil, false
+	}
+	session, ok := s.(*AxSession)
+	return session, ok
+}
+
+func AxSessionStart(device ios.DeviceEntry) string {
+	if _, ok := loadAxSession(device); ok {
+		return convertToJSONString(map[string]any{"ok": true})
+	}
+	control, err := accessibility.New(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	control.SwitchToDevice()
+	control.EnableSelectionMode()
+
+	session := &AxSession{
+		Udid:    device.Properties.SerialNumber,
+		control: control,
+	}
+	if _, loaded := globalAxSessions.LoadOrStore(device.Properties.SerialNumber, session); loaded {
+		control.Close()
+	}
+	return convertToJSONString(map[string]any{"ok": true})
+}
+
+func AxSessionStop(device ios.DeviceEntry) string {
+	session, ok := loadAxSession(device)
+	if !ok {
+		return convertToJSONString(map[string]any{"ok": false, "error": "no accessibility session"})
+	}
+	globalAxSessions.Delete(device.Properties.SerialNumber)
+	session.control.TurnOff()
+	if err := session.control.Close(); err != nil {
+		log.WithField("udid", session.Udid).WithError(err).Debug("closing ax connection failed")
+	}
+	return convertToJSONString(map[string]any{"ok": true})
+}
+
+func AxMove(device ios.DeviceEntry, direction string) string {
+	session, ok := loadAxSession(device)
+	if !ok {
+		return convertToJSONString(map[string]any{"ok": false, "error": "no accessibility session"})
+	}
+	if direction == "" {
+		direction = "next"
+	}
+	d, err := accessibility.ParseMoveDirection(direction)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), axTimeout)
+	defer cancel()
+	element, err := session.control.Move(ctx, d)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	session.current = &element
+	return convertToJSONString(map[string]any{"ok": true, "element": element})
+}
+
+func AxElement(device ios.DeviceEntry) string {
+	session, ok := loadAxSession(device)
+	if !ok {
+		return convertToJSONString(map[string]any{"ok": false, "error": "no accessibility session"})
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.current == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), axTimeout)
+		defer cancel()
+		element, err := session.control.GetElement(ctx)
+		if err != nil {
+			return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+		}
+		session.current = &element
+	}
+	return convertToJSONString(map[string]any{"ok": true, "element": session.current})
+}
+
+// AxAction performs the named action on the given element, or the currently selected one if platformElement is empty.
+func AxAction(device ios.DeviceEntry, action string, platformElement string) string {
+	session, ok := loadAxSession(device)
+	if !ok {
+		return convertToJSONString(map[string]any{"ok": false, "error": "no accessibility session"})
+	}
+	if action == "" {
+		action = "tap"
+	}
+	a, err := accessibility.ParseAction(action)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if platformElement == "" {
+		if session.current == nil {
+			return convertToJSONString(map[string]any{"ok": false, "error": "no element selected"})
+		}
+		platformElement = session.current.PlatformElementValue
+	}
+	err = session.control.PerformAction(a, platformElement)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	return convertToJSONString(map[string]any{"ok": true})
+}
+
+// AxAudit runs the accessibility audit on the device, restricted to the app with bundleID if it is set.
+func AxAudit(device ios.DeviceEntry, bundleID string) string {
+	var pid uint64
+	if bundleID != "" {
+		var err error
+		pid, err = pidForBundleID(device, bundleID)
+		if err != nil {
+			return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+		}
+	}
+
+	control, err := accessibility.New(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	defer control.Close()
+
+	err = control.SetAuditTargetPid(pid)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), axAuditTimeout)
+	defer cancel()
+	issues, err := control.RunAudit(ctx, nil)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	return convertToJSONString(map[string]any{"ok": true, "issues": issues})
+}
+
+// pidForBundleID returns the pid of the running app with bundleID, launching it if it is not running yet.
+func pidForBundleID(device ios.DeviceEntry, bundleID string) (uint64, error) {
+	processName, err := executableForBundleID(device, bundleID)
+	if err != nil {
+		return 0, err
+	}
+
+	service, err := instruments.NewDeviceInfoService(device)
+	if err != nil {
+		return 0, err
+	}
+	defer service.Close()
+	processList, err := service.ProcessList()
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range processList {
+		if p.Name == processName {
+			return p.Pid, nil
+		}
+	}
+
+	pControl, err := instruments.NewProcessControl(device)
+	if err != nil {
+		return 0, err
+	}
+	defer pControl.Close()
+	return pControl.LaunchApp(bundleID, map[string]any{})
+}
@@ -0,0 +1,105 @@
+package tiny
+
+import (
+	"fmt"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/diagnostics"
+)
+
+var diagnosticsDomains = []string{"All", "WiFi", "GasGauge", "NAND", "HDMI"}
+
+type BatteryStatus struct {
+	Level                 int     `json:"level"`
+	Charging              bool    `json:"charging"`
+	FullyCharged          bool    `json:"fullyCharged"`
+	ExternalConnected     bool    `json:"externalConnected"`
+	TemperatureCelsius    float64 `json:"temperatureCelsius"`
+	VoltageMillivolts     int     `json:"voltageMillivolts"`
+	InstantAmperage       int     `json:"instantAmperage"`
+	CycleCount            uint64  `json:"cycleCount"`
+	DesignCapacity        uint64  `json:"designCapacity"`
+	NominalChargeCapacity uint64  `json:"nominalChargeCapacity"`
+	// HealthPercent is the nominal charge capacity relative to the design capacity
+	HealthPercent   float64 `json:"healthPercent"`
+	AtWarnLevel     bool    `json:"atWarnLevel"`
+	AtCriticalLevel bool    `json:"atCriticalLevel"`
+}
+
+func Battery(device ios.DeviceEntry) string {
+	conn, err := diagnostics.New(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	defer conn.Close()
+	registry, err := conn.Battery()
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+
+	status := BatteryStatus{
+		Level:                 registry.CurrentCapacity,
+		Charging:              registry.IsCharging,
+		TemperatureCelsius:    float64(registry.Temperature) / 100,
+		VoltageMillivolts:     registry.Voltage,
+		InstantAmperage:       registry.InstantAmperage,
+		CycleCount:            registry.CycleCount,
+		DesignCapacity:        registry.DesignCapacity,
+		NominalChargeCapacity: registry.NominalChargeCapacity,
+		AtWarnLevel:           registry.AtWarnLevel,
+		AtCriticalLevel:       registry.AtCriticalLevel,
+	}
+	if registry.DesignCapacity > 0 {
+		status.HealthPercent = float64(registry.NominalChargeCapacity) * 100 / float64(registry.DesignCapacity)
+	}
+	// lockdown knows about the charger, the ioregistry does not
+	if info, err := ios.GetBatteryDiagnostics(device); err == nil {
+		status.FullyCharged = info.FullyCharged
+		status.ExternalConnected = info.ExternalConnected
+	}
+	return convertToJSONString(map[string]any{"ok": true, "battery": status})
+}
+
+// Diagnostics returns the raw diagnostics of one of diagnosticsDomains, All if domain is empty.
+func Diagnostics(device ios.DeviceEntry, domain string) string {
+	if domain == "" {
+		domain = "All"
+	}
+	valid := false
+	for _, d := range diagnosticsDomains {
+		if d == domain {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return convertToJSONString(map[string]any{"ok": false, "error": fmt.Sprintf("unknown diagnostics domain '%s', use one of %v", domain, diagnosticsDomains)})
+	}
+
+	conn, err := diagnostics.New(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	defer conn.Close()
+	values, err := conn.Query(domain)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	return convertToJSONString(map[string]any{"ok": true, "diagnostics": values})
+}
+
+func IORegistry(device ios.DeviceEntry, plane string, name string, class string) string {
+	if name == "" && class == "" {
+		return convertToJSONString(map[string]any{"ok": false, "error": "name or class is required"})
+	}
+	conn, err := diagnostics.New(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	defer conn.Close()
+	entry, err := conn.IORegistryQuery(plane, name, class)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	return convertToJSONString(map[string]any{"ok": true, "ioregistry": entry})
+}
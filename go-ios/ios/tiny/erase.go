@@ -0,0 +1,260 @@
+package tiny
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/installationproxy"
+	"github.com/danielpaulus/go-ios/ios/mcinstall"
+)
+
+// eraseReattachTimeout is how long EraseAndWait waits for the device to come back, erasing takes several minutes
+const eraseReattachTimeout = 15 * time.Minute
+
+// EraseTarget identifies the device about to be erased so callers can double check it before confirming
+type EraseTarget struct {
+	Name   string `json:"name"`
+	Serial string `json:"serial"`
+	Model  string `json:"model"`
+}
+
+// EraseSnapshot is the state of a device before it was erased
+type EraseSnapshot struct {
+	Taken    time.Time         `json:"taken"`
+	Apps     []SnapshotApp     `json:"apps"`
+	Profiles []SnapshotProfile `json:"profiles"`
+	Settings ProvisionSettings `json:"settings"`
+}
+
+type SnapshotApp struct {
+	BundleID string `json:"bundleId"`
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+}
+
+type SnapshotProfile struct {
+	Identifier  string `json:"identifier"`
+	DisplayName string `json:"displayName"`
+}
+
+// SnapshotItems are the apps and profiles of a snapshot that could not be restored
+type SnapshotItems struct {
+	Apps     []SnapshotApp     `json:"apps"`
+	Profiles []SnapshotProfile `json:"profiles"`
+}
+
+// MissingSnapshotItems returns the apps and profiles of snapshot that are not installed on the device
+func MissingSnapshotItems(device ios.DeviceEntry, snapshot EraseSnapshot) (SnapshotItems, error) {
+	missing := SnapshotItems{Apps: []SnapshotApp{}, Profiles: []SnapshotProfile{}}
+	current, err := TakeEraseSnapshot(device)
+	if err != nil {
+		return missing, err
+	}
+	apps := map[string]bool{}
+	for _, app := range current.Apps {
+		apps[app.BundleID] = true
+	}
+	for _, app := range snapshot.Apps {
+		if !apps[app.BundleID] {
+			missing.Apps = append(missing.Apps, app)
+		}
+	}
+	profiles := map[string]bool{}
+	for _, p := range current.Profiles {
+		profiles[p.Identifier] = true
+	}
+	for _, p := range snapshot.Profiles {
+		if !profiles[p.Identifier] {
+			missing.Profiles = append(missing.Profiles, p)
+		}
+	}
+	return missing, nil
+}
+
+// EraseSteps returns the names of the steps EraseAndWait runs, in order
+func EraseSteps(snapshot bool) []string {
+	if snapshot {
+		return []string{"snapshot", "erase", "reattach", "activation"}
+	}
+	return []string{"erase", "reattach", "activation"}
+}
+
+func GetEraseTarget(device ios.DeviceEntry) (EraseTarget, error) {
+	values, err := ios.GetValuesPlist(device)
+	if err != nil {
+		return EraseTarget{}, err
+	}
+	cacheValues(device, "lockdown", values)
+	target := EraseTarget{}
+	target.Name, _ = values["DeviceName"].(string)
+	target.Serial, _ = values["SerialNumber"].(string)
+	target.Model, _ = values["ProductType"].(string)
+	return target, nil
+}
+
+// TakeEraseSnapshot records the user apps, profiles, language, locale and time zone of the device.
+// Profile contents cannot be read back from a device, only their identifiers are kept.
+func TakeEraseSnapshot(device ios.DeviceEntry) (EraseSnapshot, error) {
+	snapshot := EraseSnapshot{Taken: time.Now(), Apps: []SnapshotApp{}, Profiles: []SnapshotProfile{}}
+
+	svc, err := installationproxy.New(device)
+	if err != nil {
+		return snapshot, err
+	}
+	apps, err := svc.BrowseUserApps()
+	svc.Close()
+	if err != nil {
+		return snapshot, fmt.Errorf("apps: %w", err)
+	}
+	for _, app := range apps {
+		snapshot.Apps = append(snapshot.Apps, SnapshotApp{
+			BundleID: app.CFBundleIdentifier(),
+			Name:     app.CFBundleName(),
+			Version:  app.CFBundleShortVersionString(),
+		})
+	}
+
+	conn, err := mcinstall.New(device)
+	if err != nil {
+		return snapshot, err
+	}
+	profiles, err := conn.HandleList()
+	conn.Close()
+	if err != nil {
+		return snapshot, fmt.Errorf("profiles: %w", err)
+	}
+	for _, p := range profiles {
+		snapshot.Profiles = append(snapshot.Profiles, SnapshotProfile{Identifier: p.Identifier, DisplayName: p.Metadata.PayloadDisplayName})
+	}
+
+	language, err := ios.GetLanguage(device)
+	if err != nil {
+		return snapshot, fmt.Errorf("settings: %w", err)
+	}
+	values, err := ios.GetValuesPlist(device)
+	if err != nil {
+		return snapshot, fmt.Errorf("settings: %w", err)
+	}
+	snapshot.Settings.Locale = language.Locale
+	snapshot.Settings.Lang = language.Language
+	snapshot.Settings.TimeZone, _ = values["TimeZone"].(string)
+	return snapshot, nil
+}
+
+// EraseAndWait erases the device, waits until it detached and attached again and returns its new activation state.
+// If snapshot is not nil the device state is stored there before erasing, a failing snapshot stops the erase.
+func EraseAndWait(ctx context.Context, device ios.DeviceEntry, snapshot *EraseSnapshot, progress func(step string, status string, err error)) (string, error) {
+	udid := device.Properties.SerialNumber
+	// listen before erasing so the detach cannot be missed
+	receive, closeListener, err := ios.Listen()
+	if err != nil {
+		return "", err
+	}
+	defer closeListener()
+
+	var state string
+	steps := map[string]func() error{
+		"snapshot": func() error {
+			s, err := TakeEraseSnapshot(device)
+			if err != nil {
+				return err
+			}
+			*snapshot = s
+			return nil
+		},
+		"erase": func() error {
+			return mcinstall.Erase(device)
+		},
+		"reattach": func() error {
+			device, err = waitForReattach(ctx, receive, closeListener, device)
+			return err
+		},
+		"activation": func() error {
+			state, err = activationState(device)
+			return err
+		},
+	}
+	for _, name := range EraseSteps(snapshot != nil) {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		progress(name, StepRunning, nil)
+		if err := steps[name](); err != nil {
+			progress(name, StepFailed, err)
+			return "", fmt.Errorf("%s %s: %w", udid, name, err)
+		}
+		progress(name, StepDone, nil)
+	}
+	return state, nil
+}
+
+// waitForReattach reads usbmuxd events until device detached and a device with the same UDID attached again.
+// Detach events only carry the DeviceID, which is only unique per usbmuxd endpoint, so the old entry is needed.
+func waitForReattach(ctx context.Context, receive func() (ios.AttachedMessage, error), closeListener func() error, device ios.DeviceEntry) (ios.DeviceEntry, error) {
+	type event struct {
+		msg ios.AttachedMessage
+		err error
+	}
+	events := make(chan event)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			msg, err := receive()
+			select {
+			case events <- event{msg, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	timeout := time.After(eraseReattachTimeout)
+	detached := false
+	for {
+		select {
+		case <-ctx.Done():
+			// unblocks the reading goroutine
+			closeListener()
+			return device, ctx.Err()
+		case <-timeout:
+			closeListener()
+			return device, fmt.Errorf("device did not come back within %s", eraseReattachTimeout)
+		case e := <-events:
+			if e.err != nil {
+				return device, fmt.Errorf("lost usbmuxd listener: %w", e.err)
+			}
+			switch {
+			case e.msg.DeviceDetached() && e.msg.DeviceID == device.DeviceID && e.msg.UsbmuxdSocket == device.UsbmuxdSocket:
+				detached = true
+			case detached && e.msg.DeviceAttached() && e.msg.Properties.SerialNumber == device.Properties.SerialNumber:
+				return e.msg.DeviceEntry(), nil
+			}
+		}
+	}
+}
+
+// activationState reads ActivationState without a session, an erased device no longer knows our pair record
+func activationState(device ios.DeviceEntry) (string, error) {
+	muxConnection, err := ios.NewUsbMuxConnectionForDevice(device)
+	if err != nil {
+		return "", err
+	}
+	defer muxConnection.ReleaseDeviceConnection()
+	lockdown, err := muxConnection.ConnectLockdown(device.DeviceID)
+	if err != nil {
+		return "", err
+	}
+	defer lockdown.Close()
+	value, err := lockdown.GetValue("ActivationState")
+	if err != nil {
+		return "", err
+	}
+	state, _ := value.(string)
+	return state, nil
+}
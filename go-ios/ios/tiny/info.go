@@ -0,0 +1,207 @@
+package tiny
+
+import (
+	"sync"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/diagnostics"
+)
+
+// immutableKeys are lockdown and MobileGestalt keys whose values cannot change while the device is up.
+// Values like the iOS version only change across reboots, which is why caches are kept per boot.
+var immutableKeys = map[string]bool{
+	"BluetoothAddress":                     true,
+	"BoardId":                              true,
+	"BuildVersion":                         true,
+	"CPUArchitecture":                      true,
+	"ChipID":                               true,
+	"DeviceClass":                          true,
+	"DieID":                                true,
+	"EthernetAddress":                      true,
+	"HardwareModel":                        true,
+	"HardwarePlatform":                     true,
+	"InternationalMobileEquipmentIdentity": true,
+	"MLBSerialNumber":                      true,
+	"ModelNumber":                          true,
+	"ProductName":                          true,
+	"ProductType":                          true,
+	"ProductVersion":                       true,
+	"RegionInfo":                           true,
+	"SerialNumber":                         true,
+	"TotalDiskCapacity":                    true,
+	"UniqueChipID":                         true,
+	"UniqueDeviceID":                       true,
+	"WiFiAddress":                          true,
+	"WirelessBoardSerialNumber":            true,
+	"main-screen-width":                    true,
+	"main-screen-height":                   true,
+	"main-screen-scale":                    true,
+}
+
+// bootCache holds immutable values of a device for as long as it stays attached. usbmuxd hands out
+// a new DeviceID whenever a device attaches, so a changed DeviceID means the device rebooted or was replugged.
+type bootCache struct {
+	deviceID int
+	values   map[string]map[string]any
+}
+
+var propertyCaches = struct {
+	sync.Mutex
+	devices map[string]*bootCache
+}{devices: map[string]*bootCache{}}
+
+func cachedValues(device ios.DeviceEntry, source string) map[string]any {
+	propertyCaches.Lock()
+	defer propertyCaches.Unlock()
+	c, ok := propertyCaches.devices[device.Properties.SerialNumber]
+	if !ok || c.deviceID != device.DeviceID {
+		return map[string]any{}
+	}
+	result := map[string]any{}
+	for k, v := range c.values[source] {
+		result[k] = v
+	}
+	return result
+}
+
+func cacheValues(device ios.DeviceEntry, source string, values map[string]any) {
+	propertyCaches.Lock()
+	defer propertyCaches.Unlock()
+	c, ok := propertyCaches.devices[device.Properties.SerialNumber]
+	if !ok || c.deviceID != device.DeviceID {
+		c = &bootCache{deviceID: device.DeviceID, values: map[string]map[string]any{}}
+		propertyCaches.devices[device.Properties.SerialNumber] = c
+	}
+	if c.values[source] == nil {
+		c.values[source] = map[string]any{}
+	}
+	for k, v := range values {
+		if immutableKeys[k] {
+			c.values[source][k] = v
+		}
+	}
+}
+
+// Info returns all lockdown values of the given domain, or the global values if domain is empty. If keys are given
+// only those are returned, immutable global keys are answered from the per boot cache when possible.
+func Info(device ios.DeviceEntry, domain string, keys []string) string {
+	if len(keys) > 0 {
+		return infoKeys(device, domain, keys)
+	}
+	values, err := ios.GetValuesPlistForDomain(device, domain)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	if domain == "" {
+		cacheValues(device, "lockdown", values)
+	}
+	return convertToJSONString(map[string]any{"ok": true, "info": values})
+}
+
+func infoKeys(device ios.DeviceEntry, domain string, keys []string) string {
+	result := map[string]any{}
+	var missing []string
+	if domain == "" {
+		cached := cachedValues(device, "lockdown")
+		for _, k := range keys {
+			if v, ok := cached[k]; ok {
+				result[k] = v
+				continue
+			}
+			missing = append(missing, k)
+		}
+	} else {
+		missing = keys
+	}
+	if len(missing) == 0 {
+		return convertToJSONString(map[string]any{"ok": true, "info": result})
+	}
+
+	conn, err := ios.ConnectLockdownWithSession(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	defer conn.Close()
+	queried := map[string]any{}
+	for _, k := range missing {
+		v, err := conn.GetValueForDomain(k, domain)
+		if err != nil {
+			return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+		}
+		// lockdown answers unknown keys without a value
+		if v != nil {
+			queried[k] = v
+			result[k] = v
+		}
+	}
+	if domain == "" {
+		cacheValues(device, "lockdown", queried)
+	}
+	return convertToJSONString(map[string]any{"ok": true, "info": result})
+}
+
+// Gestalt queries the given MobileGestalt keys. Immutable keys are answered from the per boot cache when possible.
+func Gestalt(device ios.DeviceEntry, keys []string) string {
+	if len(keys) == 0 {
+		return convertToJSONString(map[string]any{"ok": false, "error": "no keys given"})
+	}
+	cached := cachedValues(device, "gestalt")
+	result := map[string]any{}
+	var missing []string
+	for _, k := range keys {
+		if v, ok := cached[k]; ok {
+			result[k] = v
+			continue
+		}
+		missing = append(missing, k)
+	}
+	if len(missing) == 0 {
+		return convertToJSONString(map[string]any{"ok": true, "gestalt": result})
+	}
+
+	conn, err := diagnostics.New(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	defer conn.Close()
+	resp, err := conn.MobileGestaltQuery(missing)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	// the response looks like {Diagnostics: {MobileGestalt: {Status: MobileGestaltSuccess, <key>: <value>}}}
+	respMap, _ := resp.(map[string]any)
+	diag, _ := respMap["Diagnostics"].(map[string]any)
+	gestalt, _ := diag["MobileGestalt"].(map[string]any)
+	queried := map[string]any{}
+	for _, k := range missing {
+		if v, ok := gestalt[k]; ok {
+			queried[k] = v
+			result[k] = v
+		}
+	}
+	cacheValues(device, "gestalt", queried)
+
+	response := map[string]any{"ok": true, "gestalt": result}
+	if status, ok := gestalt["Status"].(string); ok && status != "MobileGestaltSuccess" {
+		response["status"] = status
+	}
+	return convertToJSONString(response)
+}
+
+// SerialAndModel returns the serial number and product type of the device, answered from the per boot cache when possible
+func SerialAndModel(device ios.DeviceEntry) (string, string, error) {
+	cached := cachedValues(device, "lockdown")
+	serial, _ := cached["SerialNumber"].(string)
+	model, _ := cached["ProductType"].(string)
+	if serial != "" && model != "" {
+		return serial, model, nil
+	}
+	values, err := ios.GetValuesPlist(device)
+	if err != nil {
+		return "", "", err
+	}
+	cacheValues(device, "lockdown", values)
+	serial, _ = values["SerialNumber"].(string)
+	model, _ = values["ProductType"].(string)
+	return serial, model, nil
+}
@@ -0,0 +1,136 @@
+package tiny
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/instruments"
+)
+
+// xcodeDefaultSamplingRate is what Xcode uses for the sysmontap "ur" config value
+const xcodeDefaultSamplingRate = 10
+
+const metricsSnapshotTimeout = 15 * time.Second
+
+// MetricsFilter selects the processes included in metrics samples. An empty filter selects all processes.
+type MetricsFilter struct {
+	Pid      uint64
+	BundleID string
+}
+
+type MetricsSample struct {
+	Timestamp time.Time                   `json:"timestamp"`
+	System    map[string]any              `json:"system,omitempty"`
+	Processes []instruments.ProcessSample `json:"processes"`
+}
+
+// processMatcher resolves the filter into a func matching process samples, bundle IDs are resolved to their executable name.
+func processMatcher(device ios.DeviceEntry, filter MetricsFilter) (func(instruments.ProcessSample) bool, error) {
+	var name string
+	if filter.BundleID != "" {
+		var err error
+		name, err = executableForBundleID(device, filter.BundleID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return func(p instruments.ProcessSample) bool {
+		if filter.Pid != 0 && p.Pid != filter.Pid {
+			return false
+		}
+		if name != "" && p.Name != name {
+			return false
+		}
+		return true
+	}, nil
+}
+
+func toMetricsSample(sample instruments.SysmontapSample, match func(instruments.ProcessSample) bool) MetricsSample {
+	processes := []instruments.ProcessSample{}
+	for _, p := range sample.Processes {
+		if match(p) {
+			processes = append(processes, p)
+		}
+	}
+	return MetricsSample{
+		Timestamp: sample.Timestamp,
+		System:    sample.System,
+		Processes: processes,
+	}
+}
+
+// MetricsSnapshot waits for a single sysmontap sample and returns it together with the device's network interfaces.
+func MetricsSnapshot(device ios.DeviceEntry, filter MetricsFilter) string {
+	match, err := processMatcher(device, filter)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+
+	sysmon, err := instruments.NewSysmontapService(device, xcodeDefaultSamplingRate)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	defer sysmon.Close()
+
+	var sample instruments.SysmontapSample
+	select {
+	case s, ok := <-sysmon.ReceiveSamples():
+		if !ok {
+			return convertToJSONString(map[string]any{"ok": false, "error": "sysmontap closed"})
+		}
+		sample = s
+	case <-time.After(metricsSnapshotTimeout):
+		return convertToJSONString(map[string]any{"ok": false, "error": "timed out waiting for sample"})
+	}
+
+	result := map[string]any{
+		"ok":     true,
+		"sample": toMetricsSample(sample, match),
+	}
+
+	deviceInfo, err := instruments.NewDeviceInfoService(device)
+	if err == nil {
+		defer deviceInfo.Close()
+		if network, err := deviceInfo.NetworkInformation(); err == nil {
+			result["network"] = network
+		}
+	}
+	return convertToJSONString(result)
+}
+
+// MetricsStream sends a JSON encoded MetricsSample to emit at most once per interval until ctx is done or emit fails.
+func MetricsStream(ctx context.Context, device ios.DeviceEntry, filter MetricsFilter, interval time.Duration, emit func(string) error) error {
+	match, err := processMatcher(device, filter)
+	if err != nil {
+		return err
+	}
+
+	sysmon, err := instruments.NewSysmontapServiceWithSampleInterval(device, xcodeDefaultSamplingRate, interval)
+	if err != nil {
+		return err
+	}
+	defer sysmon.Close()
+
+	samples := sysmon.ReceiveSamples()
+	var last time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case sample, ok := <-samples:
+			if !ok {
+				return fmt.Errorf("sysmontap closed")
+			}
+			// leave some slack so samples arriving slightly early are not dropped
+			if sample.Timestamp.Sub(last) < interval-interval/10 {
+				continue
+			}
+			last = sample.Timestamp
+			if err := emit(convertToJSONString(toMetricsSample(sample, match))); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package tiny
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+)
+
+// trustDialogTimeout is how long PairWithTrustDialog waits for the user to answer the trust dialog
+const trustDialogTimeout = 2 * time.Minute
+
+// StepWaitingForTrust is reported while the "Trust this computer" dialog is open on the device
+const StepWaitingForTrust = "waitingForTrust"
+
+// PairWithTrustDialog pairs without supervision. The first attempt opens the trust dialog on the device,
+// waiting is called once and the pairing is retried until the user accepts, declines or the timeout passes.
+func PairWithTrustDialog(ctx context.Context, device ios.DeviceEntry, waiting func()) error {
+	timeout := time.After(trustDialogTimeout)
+	notified := false
+	for {
+		err := ios.Pair(device)
+		if !errors.Is(err, ios.ErrPairingDialogResponsePending) {
+			return err
+		}
+		if !notified {
+			waiting()
+			notified = true
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return fmt.Errorf("the trust dialog was not accepted within %v", trustDialogTimeout)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// Unpair removes the host from the device's trusted hosts and deletes the pair record.
+// The pair record is deleted even if the device could not be reached.
+func Unpair(device ios.DeviceEntry) string {
+	unpairErr := ios.Unpair(device)
+	err := ios.DeletePairRecord(device.Properties.SerialNumber)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	if unpairErr != nil {
+		return convertToJSONString(map[string]any{"ok": true, "warning": "pair record deleted, but the device was not unpaired: " + unpairErr.Error()})
+	}
+	return convertToJSONString(map[string]any{"ok": true})
+}
+
+// PairValidate reports whether the device accepts the pair record, unlike Paired which only checks it exists
+func PairValidate(device ios.DeviceEntry) string {
+	err := ios.ValidatePair(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": true, "valid": false, "error": err.Error()})
+	}
+	return convertToJSONString(map[string]any{"ok": true, "valid": true})
+}
+
+// PairRecordExport returns the pair record plist, it contains the host's private key
+func PairRecordExport(device ios.DeviceEntry) string {
+	data, err := ios.ReadPairRecordData(device.Properties.SerialNumber)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	return convertToJSONString(map[string]any{"ok": true, "b64record": data})
+}
+
+func PairRecordImport(device ios.DeviceEntry, data []byte) string {
+	err := ios.SavePairRecord(device.Properties.SerialNumber, data)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	return PairValidate(device)
+}
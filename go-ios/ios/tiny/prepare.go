@@ -0,0 +1,81 @@
+package tiny
+
+import (
+	"fmt"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/mcinstall"
+)
+
+// PrepareOptions configures PrepareDevice. CertDER, P12 and P12Password are only used if Supervise is set.
+type PrepareOptions struct {
+	Skip        []string
+	Org         string
+	Locale      string
+	Lang        string
+	Supervise   bool
+	CertDER     []byte
+	P12         []byte
+	P12Password string
+	// Profiles are installed in order once preparation succeeded
+	Profiles [][]byte
+}
+
+type PrepareStep struct {
+	Step  string `json:"step"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// PrepareDevice prepares the device like Prepare and reports the result of every step it ran
+func PrepareDevice(device ios.DeviceEntry, opts PrepareOptions) string {
+	if opts.Skip == nil {
+		opts.Skip = mcinstall.GetAllSetupSkipOptions()
+	}
+	if err := mcinstall.ValidateSkipOptions(opts.Skip); err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error(), "steps": []PrepareStep{}})
+	}
+	if opts.Org == "" {
+		opts.Org = "ios"
+	}
+	var cert []byte
+	if opts.Supervise {
+		cert = opts.CertDER
+	}
+
+	steps := []PrepareStep{}
+	report := func(step string, err error) {
+		s := PrepareStep{Step: step, Ok: err == nil}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		steps = append(steps, s)
+	}
+	err := mcinstall.PrepareWithProgress(device, opts.Skip, cert, opts.Org, opts.Locale, opts.Lang, report)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error(), "steps": steps})
+	}
+
+	ok := true
+	for i, profile := range opts.Profiles {
+		err := installProfile(device, profile, opts)
+		report(fmt.Sprintf("profile[%d]", i), err)
+		if err != nil {
+			ok = false
+		}
+	}
+	return convertToJSONString(map[string]any{"ok": ok, "steps": steps})
+}
+
+// installProfile installs silently on supervised devices, otherwise the user has to approve the profile in Settings
+func installProfile(device ios.DeviceEntry, profile []byte, opts PrepareOptions) error {
+	conn, err := mcinstall.New(device)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if opts.Supervise {
+		return conn.AddProfileSupervised(profile, opts.P12, opts.P12Password)
+	}
+	return conn.AddProfile(profile)
+}
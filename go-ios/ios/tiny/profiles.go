@@ -0,0 +1,77 @@
+package tiny
+
+import (
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/mcinstall"
+)
+
+// ProfilePreview parses a profile without talking to the device
+func ProfilePreview(profileData []byte) string {
+	preview, err := mcinstall.ParseProfile(profileData)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	return convertToJSONString(map[string]any{"ok": true, "preview": preview})
+}
+
+func ProfileRemove(device ios.DeviceEntry, identifier string) string {
+	profileService, err := mcinstall.New(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	defer profileService.Close()
+	err = profileService.RemoveProfile(identifier)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	return convertToJSONString(map[string]any{"ok": true})
+}
+
+// ProxySet installs the global HTTP proxy profile, which only works on supervised devices
+func ProxySet(device ios.DeviceEntry, host string, port string, user string, pass string, p12 []byte, p12Password string) string {
+	supervised, err := IsSupervised(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	if !supervised {
+		return convertToJSONString(map[string]any{"ok": false, "error": "a global HTTP proxy requires a supervised device"})
+	}
+	err = mcinstall.SetHttpProxy(device, host, port, user, pass, p12, p12Password)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	return convertToJSONString(map[string]any{"ok": true})
+}
+
+func ProxyRemove(device ios.DeviceEntry) string {
+	err := mcinstall.RemoveProxy(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	return convertToJSONString(map[string]any{"ok": true})
+}
+
+// ProfileGenerate builds profile, signs it if sign is set and installs it silently unless install is false.
+// The generated profile is returned base64 encoded so it can be reused.
+func ProfileGenerate(device ios.DeviceEntry, profile mcinstall.Profile, sign bool, install bool, p12 []byte, p12Password string) string {
+	data, err := mcinstall.BuildProfile(profile)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	if sign {
+		data, err = mcinstall.SignProfile(data, p12, p12Password)
+		if err != nil {
+			return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+		}
+	}
+	response := map[string]any{"ok": true, "identifier": profile.Identifier, "b64profile": data}
+	if !install {
+		return convertToJSONString(response)
+	}
+	err = mcinstall.InstallProfileSilent(device, p12, p12Password, data)
+	if err != nil {
+		response["ok"] = false
+		response["error"] = err.Error()
+	}
+	return convertToJSONString(response)
+}
@@ -0,0 +1,343 @@
+package tiny
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/amfi"
+	"github.com/danielpaulus/go-ios/ios/installationproxy"
+	"github.com/danielpaulus/go-ios/ios/mcinstall"
+	"github.com/danielpaulus/go-ios/ios/mobileactivation"
+	"github.com/danielpaulus/go-ios/ios/notificationproxy"
+	"github.com/danielpaulus/go-ios/ios/zipconduit"
+)
+
+// ProvisionSpec is the state a device should be brought to. Unset fields are left alone,
+// nothing that is already in place is undone.
+type ProvisionSpec struct {
+	Activated bool
+	// Supervised prepares the device with the identity below, SkipSetup and the settings
+	Supervised  bool
+	Org         string
+	CertDER     []byte
+	P12         []byte
+	P12Password string
+	Skip        []string
+	Paired      bool
+	DevMode     bool
+	Image       bool
+	Profiles    []ProvisionProfile
+	Apps        []ProvisionApp
+	Settings    ProvisionSettings
+	Wda         bool
+}
+
+// ProvisionProfile is installed unless a profile with Identifier is already present
+type ProvisionProfile struct {
+	Identifier string
+	Data       []byte
+}
+
+// ProvisionApp is installed from Path unless BundleID is already installed
+type ProvisionApp struct {
+	BundleID string
+	Path     string
+}
+
+type ProvisionSettings struct {
+	Locale   string
+	Lang     string
+	TimeZone string
+}
+
+// Statuses reported to the progress callback of Provision
+const (
+	StepRunning = "running"
+	StepDone    = "done"
+	StepSkipped = "skipped"
+	StepFailed  = "failed"
+)
+
+// ProvisionSteps returns the names of the steps Provision runs for spec, in order
+func ProvisionSteps(spec ProvisionSpec) []string {
+	var steps []string
+	if spec.Activated {
+		steps = append(steps, "activate")
+	}
+	if spec.Supervised {
+		steps = append(steps, "supervise")
+	}
+	if spec.Paired {
+		steps = append(steps, "pair")
+	}
+	if spec.DevMode {
+		steps = append(steps, "devmode")
+	}
+	if spec.Image {
+		steps = append(steps, "image")
+	}
+	if len(spec.Profiles) > 0 {
+		steps = append(steps, "profiles")
+	}
+	if len(spec.Apps) > 0 {
+		steps = append(steps, "apps")
+	}
+	if spec.Settings != (ProvisionSettings{}) {
+		steps = append(steps, "settings")
+	}
+	if spec.Wda {
+		steps = append(steps, "wda")
+	}
+	return steps
+}
+
+// Provision checks every step of spec against the device and runs the ones that are missing.
+// progress is called when a step starts and when it ends with StepDone, StepSkipped or StepFailed.
+// It stops at the first failing step or when ctx is cancelled.
+func Provision(ctx context.Context, device ios.DeviceEntry, spec ProvisionSpec, progress func(step string, status string, err error)) error {
+	udid := device.Properties.SerialNumber
+	steps := map[string]func() (bool, error){
+		"activate": func() (bool, error) {
+			activated, err := IsActivated(device)
+			if err != nil || activated {
+				return false, err
+			}
+			return true, mobileactivation.Activate(device)
+		},
+		"supervise": func() (bool, error) {
+			supervised, err := IsSupervised(device)
+			if err != nil {
+				return false, err
+			}
+			if supervised {
+				return false, checkSupervisor(device, spec.CertDER, spec.Org)
+			}
+			skip := spec.Skip
+			if skip == nil {
+				skip = mcinstall.GetAllSetupSkipOptions()
+			}
+			return true, mcinstall.Prepare(device, skip, spec.CertDER, spec.Org, spec.Settings.Locale, spec.Settings.Lang)
+		},
+		"pair": func() (bool, error) {
+			paired, err := IsPaired(device)
+			if err != nil || paired {
+				return false, err
+			}
+			// supervised devices pair without the trust dialog
+			if supervised, _ := IsSupervised(device); supervised && spec.P12 != nil {
+				return true, ios.PairSupervised(device, spec.P12, spec.P12Password)
+			}
+			return true, PairWithTrustDialog(ctx, device, func() {
+				progress("pair", StepWaitingForTrust, nil)
+			})
+		},
+		"devmode": func() (bool, error) {
+			enabled, err := IsDevModeEnabled(device)
+			if err != nil || enabled {
+				return false, err
+			}
+			// enabling developer mode reboots the device
+			err = amfi.EnableDeveloperMode(device, true)
+			if err != nil {
+				return true, err
+			}
+			device, err = waitForReboot(ctx, udid)
+			return true, err
+		},
+		"image": func() (bool, error) {
+			mounted, err := IsImageMounted(device)
+			if err != nil || mounted {
+				return false, err
+			}
+			return true, mountDeveloperImage(device)
+		},
+		"profiles": func() (bool, error) {
+			return provisionProfiles(device, spec)
+		},
+		"apps": func() (bool, error) {
+			return provisionApps(device, spec.Apps)
+		},
+		"settings": func() (bool, error) {
+			return provisionSettings(device, spec.Settings)
+		},
+		"wda": func() (bool, error) {
+			if _, running := globalSessions.Load(udid); running {
+				return false, nil
+			}
+			return true, runWda(device)
+		},
+	}
+
+	for _, name := range ProvisionSteps(spec) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		progress(name, StepRunning, nil)
+		changed, err := steps[name]()
+		switch {
+		case err != nil:
+			progress(name, StepFailed, err)
+			return fmt.Errorf("%s: %w", name, err)
+		case changed:
+			progress(name, StepDone, nil)
+		default:
+			progress(name, StepSkipped, nil)
+		}
+	}
+	return nil
+}
+
+// waitForReboot waits for the device to show up again and for springboard to finish starting.
+// The returned entry replaces the old one, usbmuxd assigns a new DeviceID on every attach.
+func waitForReboot(ctx context.Context, udid string) (ios.DeviceEntry, error) {
+	timeout := time.After(5 * time.Minute)
+	for {
+		device, err := ios.GetDevice(udid)
+		if err == nil {
+			if err := notificationproxy.WaitUntilSpringboardStarted(device); err != nil {
+				return device, err
+			}
+			return device, nil
+		}
+		select {
+		case <-ctx.Done():
+			return ios.DeviceEntry{}, ctx.Err()
+		case <-timeout:
+			return ios.DeviceEntry{}, fmt.Errorf("device %s did not come back after reboot", udid)
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// checkSupervisor fails for devices that are supervised with another certificate than certDER, preparing them again
+// would need an erase
+func checkSupervisor(device ios.DeviceEntry, certDER []byte, org string) error {
+	conn, err := mcinstall.New(device)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	config, err := conn.GetCloudConfiguration()
+	if err != nil {
+		return err
+	}
+	certs, _ := config["SupervisorHostCertificates"].([]interface{})
+	for _, cert := range certs {
+		if c, ok := cert.([]byte); ok && bytes.Equal(c, certDER) {
+			return nil
+		}
+	}
+	supervisor, _ := config["OrganizationName"].(string)
+	return fmt.Errorf("device is supervised by org '%s', not by '%s'", supervisor, org)
+}
+
+func provisionProfiles(device ios.DeviceEntry, spec ProvisionSpec) (bool, error) {
+	conn, err := mcinstall.New(device)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	installed, err := conn.HandleList()
+	if err != nil {
+		return false, err
+	}
+	present := map[string]bool{}
+	for _, p := range installed {
+		present[p.Identifier] = true
+	}
+
+	supervised, _ := IsSupervised(device)
+	changed := false
+	for _, p := range spec.Profiles {
+		if p.Identifier != "" && present[p.Identifier] {
+			continue
+		}
+		if supervised && spec.P12 != nil {
+			err = conn.AddProfileSupervised(p.Data, spec.P12, spec.P12Password)
+		} else {
+			err = conn.AddProfile(p.Data)
+		}
+		if err != nil {
+			return changed, fmt.Errorf("profile %s: %w", p.Identifier, err)
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+func provisionApps(device ios.DeviceEntry, apps []ProvisionApp) (bool, error) {
+	svc, err := installationproxy.New(device)
+	if err != nil {
+		return false, err
+	}
+	installed, err := svc.BrowseUserApps()
+	svc.Close()
+	if err != nil {
+		return false, err
+	}
+	present := map[string]bool{}
+	for _, app := range installed {
+		present[app.CFBundleIdentifier()] = true
+	}
+
+	changed := false
+	for _, app := range apps {
+		if app.BundleID != "" && present[app.BundleID] {
+			continue
+		}
+		conn, err := zipconduit.New(device)
+		if err != nil {
+			return changed, err
+		}
+		err = conn.SendFile(app.Path)
+		conn.Close()
+		if err != nil {
+			return changed, fmt.Errorf("app %s: %w", app.Path, err)
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// SettingsApply sets language, locale and time zone where given, changed is false if they were set already
+func SettingsApply(device ios.DeviceEntry, settings ProvisionSettings) string {
+	changed, err := provisionSettings(device, settings)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	return convertToJSONString(map[string]bool{"ok": true, "changed": changed})
+}
+
+func provisionSettings(device ios.DeviceEntry, settings ProvisionSettings) (bool, error) {
+	changed := false
+	if settings.Locale != "" || settings.Lang != "" {
+		current, err := ios.GetLanguage(device)
+		if err != nil {
+			return false, err
+		}
+		if (settings.Locale != "" && settings.Locale != current.Locale) || (settings.Lang != "" && settings.Lang != current.Language) {
+			err = ios.SetLanguage(device, ios.LanguageConfiguration{Language: settings.Lang, Locale: settings.Locale})
+			if err != nil {
+				return false, err
+			}
+			changed = true
+		}
+	}
+	if settings.TimeZone != "" {
+		values, err := ios.GetValuesPlist(device)
+		if err != nil {
+			return changed, err
+		}
+		if current, _ := values["TimeZone"].(string); current != settings.TimeZone {
+			err = ios.SetTime(device, settings.TimeZone, time.Now().Unix())
+			if err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+	return changed, nil
+}
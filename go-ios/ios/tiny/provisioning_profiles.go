@@ -0,0 +1,64 @@
+package tiny
+
+import (
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/misagent"
+)
+
+// ProvisioningProfiles lists the installed provisioning profiles, the ones that cannot be parsed with an error. If expiringWithin is positive only
+// profiles that expire before now+expiringWithin are returned, that includes already expired ones.
+func ProvisioningProfiles(device ios.DeviceEntry, expiringWithin time.Duration) string {
+	conn, err := misagent.New(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	defer conn.Close()
+	profiles, err := conn.List()
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	if expiringWithin > 0 {
+		deadline := time.Now().Add(expiringWithin)
+		filtered := []misagent.ProvisioningProfile{}
+		for _, p := range profiles {
+			// profiles that could not be parsed have no expiry and are always listed
+			if p.Error != "" || p.Expires.Before(deadline) {
+				filtered = append(filtered, p)
+			}
+		}
+		profiles = filtered
+	}
+	return convertToJSONString(map[string]any{"ok": true, "profiles": profiles})
+}
+
+func ProvisioningProfileInstall(device ios.DeviceEntry, data []byte) string {
+	profile, err := misagent.ParseProvisioningProfile(data)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	conn, err := misagent.New(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	defer conn.Close()
+	err = conn.Install(data)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	return convertToJSONString(map[string]any{"ok": true, "profile": profile})
+}
+
+func ProvisioningProfileRemove(device ios.DeviceEntry, uuid string) string {
+	conn, err := misagent.New(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	defer conn.Close()
+	err = conn.Remove(uuid)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	return convertToJSONString(map[string]any{"ok": true})
+}
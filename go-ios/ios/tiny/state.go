@@ -0,0 +1,119 @@
+package tiny
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/afc"
+	"github.com/danielpaulus/go-ios/ios/diagnostics"
+	"github.com/danielpaulus/go-ios/ios/imagemounter"
+	"github.com/danielpaulus/go-ios/ios/mobileactivation"
+)
+
+// The Is* functions are the typed counterparts of the JSON getters, they report
+// errors instead of mapping them to false so callers can tell unknown from off.
+
+func IsPaired(device ios.DeviceEntry) (bool, error) {
+	_, err := ios.ReadPairRecord(device.Properties.SerialNumber)
+	if errors.Is(err, ios.ErrPairRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func IsActivated(device ios.DeviceEntry) (bool, error) {
+	return mobileactivation.IsActivated(device)
+}
+
+func IsSupervised(device ios.DeviceEntry) (bool, error) {
+	conn, err := ios.ConnectLockdownWithSession(device)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	v, err := conn.GetValueForDomain("DeviceIsChaperoned", "com.apple.mobile.chaperone")
+	if err != nil {
+		return false, err
+	}
+	supervised, _ := v.(bool)
+	return supervised, nil
+}
+
+func IsDevModeEnabled(device ios.DeviceEntry) (bool, error) {
+	return imagemounter.IsDevModeEnabled(device)
+}
+
+func IsImageMounted(device ios.DeviceEntry) (bool, error) {
+	state, err := ImageInfo(device)
+	return state.Devimage, err
+}
+
+// ImageState describes the developer image mounted on a device
+type ImageState struct {
+	Devimage bool `json:"devimage"`
+	// Type of the mounted image, Developer before iOS 17 and Personalized from then on. Empty if none is mounted.
+	Type         string `json:"type,omitempty"`
+	Personalized bool   `json:"personalized"`
+	// Signatures of the mounted images, hex encoded
+	Signatures []string `json:"signatures"`
+}
+
+// ImageInfo asks the image mounter of device which developer images are mounted
+func ImageInfo(device ios.DeviceEntry) (ImageState, error) {
+	conn, err := imagemounter.NewImageMounter(device)
+	if err != nil {
+		return ImageState{}, err
+	}
+	defer conn.Close()
+	state := ImageState{Signatures: []string{}}
+	signatures, err := conn.ListImages()
+	if err != nil {
+		return state, err
+	}
+	for _, signature := range signatures {
+		state.Signatures = append(state.Signatures, hex.EncodeToString(signature))
+	}
+	state.Devimage = len(signatures) > 0
+	if !state.Devimage {
+		return state, nil
+	}
+	state.Type = "Developer"
+	if _, ok := conn.(imagemounter.PersonalizedDeveloperDiskImageMounter); ok {
+		state.Type = "Personalized"
+		state.Personalized = true
+	}
+	return state, nil
+}
+
+// BatteryLevel returns the current battery capacity in percent
+func BatteryLevel(device ios.DeviceEntry) (int, error) {
+	conn, err := diagnostics.New(device)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	battery, err := conn.Battery()
+	if err != nil {
+		return 0, err
+	}
+	return battery.CurrentCapacity, nil
+}
+
+// DiskSpace returns the free and total bytes of the device's data partition
+func DiskSpace(device ios.DeviceEntry) (free uint64, total uint64, err error) {
+	conn, err := afc.New(device)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	info, err := conn.GetSpaceInfo()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed reading space info: %w", err)
+	}
+	return info.FreeBytes, info.TotalBytes, nil
+}
@@ -67,7 +67,7 @@ func GetDevice(udid string) (ios.DeviceEntry, error) {
 }
 
 func Activated(device ios.DeviceEntry) string {
-	activated, err := mobileactivation.IsActivated(device)
+	activated, err := IsActivated(device)
 	if err != nil {
 		return convertToJSONString(map[string]bool{"activated": false})
 	}
@@ -83,25 +83,21 @@ func ActivateEnable(device ios.DeviceEntry) string {
 }
 
 func Supervised(device ios.DeviceEntry) string {
-	conn, err := ios.ConnectLockdownWithSession(device)
+	supervised, err := IsSupervised(device)
 	if err != nil {
 		return convertToJSONString(map[string]bool{"supervised": false})
 	}
-	defer conn.Close()
-	v, _ := conn.GetValueForDomain("DeviceIsChaperoned", "com.apple.mobile.chaperone")
-	return convertToJSONString(map[string]bool{"supervised": v.(bool)})
+	return convertToJSONString(map[string]bool{"supervised": supervised})
 }
 
 func Prepare(device ios.DeviceEntry, cder []byte, orgname string, locale string, lang string) string {
-	skip := mcinstall.GetAllSetupSkipOptions()
-	if orgname == "" {
-		orgname = "ios"
-	}
-	err := mcinstall.Prepare(device, skip, cder, orgname, locale, lang)
-	if err != nil {
-		return convertToJSONString(map[string]bool{"ok": false})
-	}
-	return convertToJSONString(map[string]bool{"ok": true})
+	return PrepareDevice(device, PrepareOptions{
+		Org:       orgname,
+		Locale:    locale,
+		Lang:      lang,
+		Supervise: cder != nil,
+		CertDER:   cder,
+	})
 }
 
 func Erase(device ios.DeviceEntry) string {
@@ -113,15 +109,12 @@ func Erase(device ios.DeviceEntry) string {
 }
 
 func Paired(device ios.DeviceEntry) string {
-	_, err := ios.ReadPairRecord(device.Properties.SerialNumber)
-	if err != nil {
-		return convertToJSONString(map[string]bool{"paired": false})
-	}
-	return convertToJSONString(map[string]bool{"paired": true})
+	paired, _ := IsPaired(device)
+	return convertToJSONString(map[string]bool{"paired": paired})
 }
 
-func PairEnable(device ios.DeviceEntry, p12 []byte) string {
-	err := ios.PairSupervised(device, p12, "a")
+func PairEnable(device ios.DeviceEntry, p12 []byte, p12Password string) string {
+	err := ios.PairSupervised(device, p12, p12Password)
 	if err != nil {
 		return convertToJSONString(map[string]bool{"ok": false})
 	}
@@ -129,7 +122,7 @@ func PairEnable(device ios.DeviceEntry, p12 []byte) string {
 }
 
 func Devmode(device ios.DeviceEntry) string {
-	enabled, _ := imagemounter.IsDevModeEnabled(device)
+	enabled, _ := IsDevModeEnabled(device)
 	return convertToJSONString(map[string]bool{"devmode": enabled})
 }
 
@@ -142,32 +135,44 @@ func DevmodeEnable(device ios.DeviceEntry) string {
 }
 
 func Image(device ios.DeviceEntry) string {
-	conn, err := imagemounter.NewImageMounter(device)
+	state, err := ImageInfo(device)
 	if err != nil {
-		return convertToJSONString(map[string]bool{"devimage": false})
+		return convertToJSONString(map[string]any{"devimage": false, "error": err.Error()})
 	}
-	signatures, err := conn.ListImages()
+	return convertToJSONString(state)
+}
+
+func ImageEnable(device ios.DeviceEntry) string {
+	err := mountDeveloperImage(device)
 	if err != nil {
-		return convertToJSONString(map[string]bool{"devimage": false})
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
 	}
-	if len(signatures) == 0 {
-		return convertToJSONString(map[string]bool{"devimage": false})
+	return convertToJSONString(map[string]bool{"ok": true})
+}
+
+func ImageUnmount(device ios.DeviceEntry) string {
+	err := imagemounter.UnmountImage(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
 	}
-	return convertToJSONString(map[string]bool{"devimage": true})
+	return convertToJSONString(map[string]bool{"ok": true})
 }
 
-func ImageEnable(device ios.DeviceEntry) string {
-	basedir := "./devimages"
+// ImageSource finds the developer images of all devices, without it they are downloaded to ./devimages
+var ImageSource *imagemounter.ImageSource
+
+func mountDeveloperImage(device ios.DeviceEntry) error {
+	var path string
 	var err error
-	path, err := imagemounter.DownloadImageFor(device, basedir)
-	if err != nil {
-		return convertToJSONString(map[string]bool{"ok": false})
+	if ImageSource != nil {
+		path, err = ImageSource.ImageFor(context.Background(), device)
+	} else {
+		path, err = imagemounter.DownloadImageFor(device, "./devimages")
 	}
-	err = imagemounter.MountImage(device, path)
 	if err != nil {
-		return convertToJSONString(map[string]bool{"ok": false})
+		return err
 	}
-	return convertToJSONString(map[string]bool{"ok": true})
+	return imagemounter.MountImage(device, path)
 }
 
 func ProfileList(device ios.DeviceEntry) string {
@@ -188,16 +193,30 @@ func ProfileList(device ios.DeviceEntry) string {
 	})
 }
 
-func ProfileAdd(device ios.DeviceEntry, profileData []byte, p12 []byte) string {
+// ProfileAdd installs silently on supervised devices. Unsupervised devices only stage the profile,
+// it shows up in Settings and is installed once the user approves it.
+func ProfileAdd(device ios.DeviceEntry, profileData []byte, p12 []byte, p12Password string) string {
+	supervised, err := IsSupervised(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
 	profileService, err := mcinstall.New(device)
 	if err != nil {
-		return convertToJSONString(map[string]bool{"ok": false})
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	defer profileService.Close()
+	if !supervised {
+		err = profileService.AddProfile(profileData)
+		if err != nil {
+			return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+		}
+		return convertToJSONString(map[string]any{"ok": true, "status": "userApprovalRequired"})
 	}
-	err = profileService.AddProfileSupervised(profileData, p12, "a")
+	err = profileService.AddProfileSupervised(profileData, p12, p12Password)
 	if err != nil {
-		return convertToJSONString(map[string]bool{"ok": false})
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
 	}
-	return convertToJSONString(map[string]bool{"ok": true})
+	return convertToJSONString(map[string]any{"ok": true, "status": "installed"})
 }
 
 func AppList(device ios.DeviceEntry) string {
@@ -223,6 +242,7 @@ func AppInstall(device ios.DeviceEntry, path string) string {
 	if err != nil {
 		return convertToJSONString(map[string]bool{"ok": false})
 	}
+	defer conn.Close()
 	err = conn.SendFile(path)
 	if err != nil {
 		return convertToJSONString(map[string]bool{"ok": false})
@@ -230,6 +250,19 @@ func AppInstall(device ios.DeviceEntry, path string) string {
 	return convertToJSONString(map[string]bool{"ok": true})
 }
 
+func AppUninstall(device ios.DeviceEntry, bundleID string) string {
+	svc, err := installationproxy.New(device)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	defer svc.Close()
+	err = svc.Uninstall(bundleID)
+	if err != nil {
+		return convertToJSONString(map[string]any{"ok": false, "error": err.Error()})
+	}
+	return convertToJSONString(map[string]bool{"ok": true})
+}
+
 func Processes(device ios.DeviceEntry) string {
 	service, err := instruments.NewDeviceInfoService(device)
 	if err != nil {
@@ -275,25 +308,10 @@ func AppKill(device ios.DeviceEntry, bundleID string) string {
 	if bundleID == "" {
 		return convertToJSONString(map[string]bool{"ok": false})
 	}
-	svc, err := installationproxy.New(device)
-	if err != nil {
-		return convertToJSONString(map[string]bool{"ok": false})
-	}
-	defer svc.Close()
-	response, err := svc.BrowseAllApps()
+	processName, err := executableForBundleID(device, bundleID)
 	if err != nil {
 		return convertToJSONString(map[string]bool{"ok": false})
 	}
-	var processName string
-	for _, app := range response {
-		if app.CFBundleIdentifier() == bundleID {
-			processName = app.CFBundleExecutable()
-			break
-		}
-	}
-	if processName == "" {
-		return convertToJSONString(map[string]bool{"ok": false})
-	}
 	service, err := instruments.NewDeviceInfoService(device)
 	if err != nil {
 		return convertToJSONString(map[string]bool{"ok": false})
@@ -320,17 +338,45 @@ func AppKill(device ios.DeviceEntry, bundleID string) string {
 	return convertToJSONString(map[string]bool{"ok": true})
 }
 
+// executableForBundleID returns the process name of the installed app with bundleID.
+func executableForBundleID(device ios.DeviceEntry, bundleID string) (string, error) {
+	svc, err := installationproxy.New(device)
+	if err != nil {
+		return "", err
+	}
+	defer svc.Close()
+	apps, err := svc.BrowseAllApps()
+	if err != nil {
+		return "", err
+	}
+	for _, app := range apps {
+		if app.CFBundleIdentifier() == bundleID {
+			return app.CFBundleExecutable(), nil
+		}
+	}
+	return "", fmt.Errorf("app '%s' is not installed", bundleID)
+}
+
 func WdaRun(device ios.DeviceEntry) string {
+	err := runWda(device)
+	if err != nil {
+		return convertToJSONString(map[string]bool{"ok": false})
+	}
+	return convertToJSONString(map[string]bool{"ok": true})
+}
+
+// runWda starts the installed WebDriverAgentRunner in the background and registers its session
+func runWda(device ios.DeviceEntry) error {
 	var bundleID, testbundleID, xctestconfig string
 	svc, err := installationproxy.New(device)
 	if err != nil {
-		return convertToJSONString(map[string]bool{"ok": false})
+		return err
 	}
 	defer svc.Close()
 
 	response, err := svc.BrowseAllApps()
 	if err != nil {
-		return convertToJSONString(map[string]bool{"ok": false})
+		return err
 	}
 	for _, app := range response {
 		if strings.Contains(app.CFBundleIdentifier(), "WebDriverAgentRunner") {
@@ -342,7 +388,7 @@ func WdaRun(device ios.DeviceEntry) string {
 	}
 
 	if bundleID == "" || testbundleID == "" || xctestconfig == "" {
-		return convertToJSONString(map[string]bool{"ok": false})
+		return fmt.Errorf("WebDriverAgentRunner is not installed")
 	}
 
 	wdaCtx, stopWda := context.WithCancel(context.Background())
@@ -373,7 +419,7 @@ func WdaRun(device ios.DeviceEntry) string {
 
 	globalSessions.Store(device.Properties.SerialNumber, session)
 
-	return convertToJSONString(map[string]bool{"ok": true})
+	return nil
 }
 
 func WdaKill(device ios.DeviceEntry) string {
@@ -0,0 +1,139 @@
+package ios
+
+import (
+	"bytes"
+	"fmt"
+
+	plist "howett.net/plist"
+)
+
+type deletePair struct {
+	BundleID            string
+	ClientVersionString string
+	MessageType         string
+	ProgName            string
+	LibUSBMuxVersion    uint32 `plist:"kLibUSBMuxVersion"`
+	PairRecordID        string
+}
+
+// Unpair removes this host from the devices trusted hosts. The pair record in usbmuxd stays,
+// use DeletePairRecord to remove it as well.
+func Unpair(device DeviceEntry) error {
+	pairRecord, err := ReadPairRecord(device.Properties.SerialNumber)
+	if err != nil {
+		return err
+	}
+	lockdown, err := ConnectLockdownWithSession(device)
+	if err != nil {
+		return err
+	}
+	defer lockdown.Close()
+	err = lockdown.Send(map[string]interface{}{
+		"Label":           "go-ios",
+		"Request":         "Unpair",
+		"ProtocolVersion": "2",
+		"PairRecord":      map[string]interface{}{"HostID": pairRecord.HostID},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := lockdown.ReadMessage()
+	if err != nil {
+		return err
+	}
+	response := getLockdownPairResponsefromBytes(resp)
+	if response.Error != "" {
+		return fmt.Errorf("Lockdown error: %s", response.Error)
+	}
+	return nil
+}
+
+// DeletePairRecord deletes the pair record of udid from usbmuxd
+func DeletePairRecord(udid string) error {
+	muxConn, err := newUsbMuxConnectionForUdid(udid)
+	if err != nil {
+		return err
+	}
+	defer muxConn.Close()
+	err = muxConn.Send(deletePair{
+		BundleID:            "go.ios.control",
+		ClientVersionString: "go-ios-1.0.0",
+		MessageType:         "DeletePairRecord",
+		ProgName:            "go-ios",
+		LibUSBMuxVersion:    3,
+		PairRecordID:        udid,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := muxConn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	muxResponse := MuxResponsefromBytes(resp.Payload)
+	if !muxResponse.IsSuccessFull() {
+		return fmt.Errorf("DeletePairRecord failed with errorcode '%d'", muxResponse.Number)
+	}
+	return nil
+}
+
+// ValidatePair starts a lockdown session, which only works if the device still accepts the pair record
+func ValidatePair(device DeviceEntry) error {
+	lockdown, err := ConnectLockdownWithSession(device)
+	if err != nil {
+		return err
+	}
+	lockdown.Close()
+	return nil
+}
+
+// ReadPairRecordData returns the pair record of udid as the plist usbmuxd stores
+func ReadPairRecordData(udid string) ([]byte, error) {
+	muxConn, err := newUsbMuxConnectionForUdid(udid)
+	if err != nil {
+		return nil, fmt.Errorf("could not create usbmuxConnection with error %w", err)
+	}
+	defer muxConn.Close()
+	err = muxConn.Send(newReadPair(udid))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := muxConn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("error reading PairRecord: %w", err)
+	}
+	data, err := pairRecordDatafromBytes(resp.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return data.PairRecordData, nil
+}
+
+// SavePairRecord stores a pair record plist, e.g. one exported on another host with ReadPairRecordData
+func SavePairRecord(udid string, pairRecordData []byte) error {
+	var record PairRecord
+	if err := plist.NewDecoder(bytes.NewReader(pairRecordData)).Decode(&record); err != nil {
+		return fmt.Errorf("invalid pair record: %w", err)
+	}
+	if record.HostID == "" || len(record.HostCertificate) == 0 || len(record.HostPrivateKey) == 0 {
+		return fmt.Errorf("invalid pair record: HostID, HostCertificate and HostPrivateKey are required")
+	}
+	muxConn, err := newUsbMuxConnectionForUdid(udid)
+	if err != nil {
+		return err
+	}
+	defer muxConn.Close()
+	err = muxConn.Send(newSavePair(udid, pairRecordData))
+	if err != nil {
+		return err
+	}
+	resp, err := muxConn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	muxResponse := MuxResponsefromBytes(resp.Payload)
+	if !muxResponse.IsSuccessFull() {
+		return fmt.Errorf("SavePairRecord failed with errorcode '%d'", muxResponse.Number)
+	}
+	return nil
+}
@@ -4,9 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
 	"reflect"
-	"runtime"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -29,21 +27,9 @@ func ToUnixSocketPath(socketAddress string) string {
 }
 
 // GetUsbmuxdSocket this is the default socket address for the platform to connect to.
+// With several endpoints configured it is the first one, see GetUsbmuxdSockets.
 func GetUsbmuxdSocket() string {
-	socket_override := os.Getenv("USBMUXD_SOCKET_ADDRESS")
-	if socket_override != "" {
-		if strings.Contains(socket_override, ":") {
-			return "tcp://" + socket_override
-		} else {
-			return "unix://" + socket_override
-		}
-	}
-	switch runtime.GOOS {
-	case "windows":
-		return "tcp://127.0.0.1:27015"
-	default:
-		return "unix:///var/run/usbmuxd"
-	}
+	return GetUsbmuxdSockets()[0]
 }
 
 // UsbMuxConnection can send and read messages to the usbmuxd process to manage pairrecors, listen for device changes
@@ -110,6 +96,21 @@ func (muxConn *UsbMuxConnection) Send(msg interface{}) error {
 	return nil
 }
 
+// Reply encodes msg with the tag of the request it answers, for serving the usbmuxd protocol to clients.
+// Events that answer no request, like attach notifications, use tag 0. This does not change the connection tag.
+func (muxConn *UsbMuxConnection) Reply(tag uint32, msg interface{}) error {
+	if muxConn.deviceConn == nil {
+		return io.EOF
+	}
+	mbytes := ToPlistBytes(msg)
+	writer := muxConn.deviceConn.Writer()
+	if err := writeHeader(len(mbytes), tag, writer); err != nil {
+		return err
+	}
+	_, err := writer.Write(mbytes)
+	return err
+}
+
 // SendMuxMessage serializes and sends a UsbMuxMessage to the underlying DeviceConnection.
 // This does not increase the tag on the connection. Is used mainly by the debug proxy to
 // forward messages between device and host
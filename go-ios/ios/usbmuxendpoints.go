@@ -0,0 +1,241 @@
+package ios
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UsbmuxdEndpoint is the state of one usbmuxd endpoint as of the last device listing
+type UsbmuxdEndpoint struct {
+	Address     string    `json:"address"`
+	Reachable   bool      `json:"reachable"`
+	Devices     int       `json:"devices"`
+	Error       string    `json:"error,omitempty"`
+	LastChecked time.Time `json:"lastChecked"`
+}
+
+// endpoints remembers the state of every endpoint and on which endpoint a UDID was last seen,
+// so calls that only know the UDID, like pair record handling, reach the right usbmuxd
+var endpoints = struct {
+	sync.Mutex
+	states  map[string]UsbmuxdEndpoint
+	devices map[string]string
+}{states: map[string]UsbmuxdEndpoint{}, devices: map[string]string{}}
+
+// GetUsbmuxdSockets returns all usbmuxd endpoints. USBMUXD_SOCKET_ADDRESS may contain a comma separated list,
+// entries with a colon are TCP addresses, others unix socket paths. Entries can also carry a tcp:// or unix:// scheme.
+func GetUsbmuxdSockets() []string {
+	override := os.Getenv("USBMUXD_SOCKET_ADDRESS")
+	sockets := []string{}
+	for _, address := range strings.Split(override, ",") {
+		address = strings.TrimSpace(address)
+		switch {
+		case address == "":
+		case strings.Contains(address, "://"):
+			sockets = append(sockets, address)
+		case strings.Contains(address, ":"):
+			sockets = append(sockets, "tcp://"+address)
+		default:
+			sockets = append(sockets, "unix://"+address)
+		}
+	}
+	if len(sockets) > 0 {
+		return sockets
+	}
+	switch runtime.GOOS {
+	case "windows":
+		return []string{"tcp://127.0.0.1:27015"}
+	default:
+		return []string{"unix:///var/run/usbmuxd"}
+	}
+}
+
+// UsbmuxdEndpoints returns the state of all configured endpoints in configuration order.
+// Endpoints that were never listed have a zero LastChecked.
+func UsbmuxdEndpoints() []UsbmuxdEndpoint {
+	endpoints.Lock()
+	defer endpoints.Unlock()
+	result := []UsbmuxdEndpoint{}
+	for _, socket := range GetUsbmuxdSockets() {
+		state, ok := endpoints.states[socket]
+		if !ok {
+			state = UsbmuxdEndpoint{Address: socket}
+		}
+		result = append(result, state)
+	}
+	return result
+}
+
+// usbmuxdSocketFor returns the endpoint udid was last listed on, or the first endpoint
+func usbmuxdSocketFor(udid string) string {
+	endpoints.Lock()
+	socket, ok := endpoints.devices[udid]
+	endpoints.Unlock()
+	if ok {
+		return socket
+	}
+	return GetUsbmuxdSocket()
+}
+
+// NewUsbMuxConnectionForDevice connects to the usbmuxd endpoint the device was listed on
+func NewUsbMuxConnectionForDevice(device DeviceEntry) (*UsbMuxConnection, error) {
+	socket := device.UsbmuxdSocket
+	if socket == "" {
+		socket = usbmuxdSocketFor(device.Properties.SerialNumber)
+	}
+	deviceConn, err := NewDeviceConnection(socket)
+	return &UsbMuxConnection{tag: 0, deviceConn: deviceConn}, err
+}
+
+// newUsbMuxConnectionForUdid connects to the usbmuxd endpoint udid was last listed on
+func newUsbMuxConnectionForUdid(udid string) (*UsbMuxConnection, error) {
+	deviceConn, err := NewDeviceConnection(usbmuxdSocketFor(udid))
+	return &UsbMuxConnection{tag: 0, deviceConn: deviceConn}, err
+}
+
+func listEndpoint(socket string) (DeviceList, error) {
+	deviceConn, err := NewDeviceConnection(socket)
+	if err != nil {
+		return DeviceList{}, err
+	}
+	muxConnection := NewUsbMuxConnection(deviceConn)
+	defer muxConnection.Close()
+	return muxConnection.ListDevices()
+}
+
+// listAllEndpoints lists the devices of every endpoint concurrently and merges them. Unreachable endpoints
+// are skipped as long as one endpoint answers. A UDID seen on several endpoints is taken from the first one.
+func listAllEndpoints() (DeviceList, error) {
+	sockets := GetUsbmuxdSockets()
+	lists := make([]DeviceList, len(sockets))
+	errs := make([]error, len(sockets))
+	var wg sync.WaitGroup
+	for i, socket := range sockets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lists[i], errs[i] = listEndpoint(socket)
+		}()
+	}
+	wg.Wait()
+
+	now := time.Now()
+	merged := DeviceList{DeviceList: []DeviceEntry{}}
+	seen := map[string]bool{}
+	var firstErr error
+	endpoints.Lock()
+	defer endpoints.Unlock()
+	for i, socket := range sockets {
+		state := UsbmuxdEndpoint{Address: socket, LastChecked: now}
+		if errs[i] != nil {
+			state.Error = errs[i].Error()
+			endpoints.states[socket] = state
+			if firstErr == nil {
+				firstErr = fmt.Errorf("usbmuxd %s: %w", socket, errs[i])
+			}
+			continue
+		}
+		state.Reachable = true
+		state.Devices = len(lists[i].DeviceList)
+		endpoints.states[socket] = state
+		for _, device := range lists[i].DeviceList {
+			udid := device.Properties.SerialNumber
+			if seen[udid] {
+				continue
+			}
+			seen[udid] = true
+			device.UsbmuxdSocket = socket
+			endpoints.devices[udid] = socket
+			merged.DeviceList = append(merged.DeviceList, device)
+		}
+	}
+	if allFailed(errs) {
+		return DeviceList{}, firstErr
+	}
+	return merged, nil
+}
+
+func allFailed(errs []error) bool {
+	for _, err := range errs {
+		if err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// listenAllEndpoints merges the Listen streams of all endpoints. Endpoints that cannot be reached are skipped
+// unless none can be, an endpoint failing later ends the merged stream with its error.
+func listenAllEndpoints() (func() (AttachedMessage, error), func() error, error) {
+	type event struct {
+		msg AttachedMessage
+		err error
+	}
+	events := make(chan event)
+	done := make(chan struct{})
+	var closers []func() error
+	var firstErr error
+	for _, socket := range GetUsbmuxdSockets() {
+		deviceConn, err := NewDeviceConnection(socket)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("could not connect to usbmuxd %s: %w", socket, err)
+			}
+			continue
+		}
+		muxConnection := NewUsbMuxConnection(deviceConn)
+		receive, err := muxConnection.Listen()
+		if err != nil {
+			muxConnection.Close()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("usbmuxd %s: %w", socket, err)
+			}
+			continue
+		}
+		closers = append(closers, muxConnection.Close)
+		go func() {
+			for {
+				msg, err := receive()
+				msg.UsbmuxdSocket = socket
+				select {
+				case events <- event{msg, err}:
+				case <-done:
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	if len(closers) == 0 {
+		return nil, nil, firstErr
+	}
+
+	var once sync.Once
+	closeAll := func() error {
+		var err error
+		once.Do(func() {
+			close(done)
+			for _, c := range closers {
+				if cerr := c(); cerr != nil && err == nil {
+					err = cerr
+				}
+			}
+		})
+		return err
+	}
+	receive := func() (AttachedMessage, error) {
+		select {
+		case e := <-events:
+			return e.msg, e.err
+		case <-done:
+			return AttachedMessage{}, fmt.Errorf("listener closed")
+		}
+	}
+	return receive, closeAll, nil
+}
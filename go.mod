@@ -2,7 +2,12 @@ module github.com/albinstman/tinystar/services/node
 
 go 1.25.1
 
-require github.com/danielpaulus/go-ios v1.0.182
+require (
+	github.com/danielpaulus/go-ios v1.0.182
+	golang.org/x/net v0.38.0
+	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.2.0
+)
 
 require (
 	github.com/Masterminds/semver v1.5.0 // indirect
@@ -18,7 +23,6 @@ require (
 	go.mozilla.org/pkcs7 v0.0.0-20210826202110-33d05740a352 // indirect
 	golang.org/x/crypto v0.36.0 // indirect
 	golang.org/x/mod v0.17.0 // indirect
-	golang.org/x/net v0.38.0 // indirect
 	golang.org/x/sync v0.12.0 // indirect
 	golang.org/x/sys v0.31.0 // indirect
 	golang.org/x/text v0.23.0 // indirect
@@ -26,7 +30,6 @@ require (
 	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 	gvisor.dev/gvisor v0.0.0-20240405191320-0878b34101b5 // indirect
 	howett.net/plist v0.0.0-20200419221736-3b63eb3a43b5 // indirect
-	software.sslmate.com/src/go-pkcs12 v0.2.0 // indirect
 )
 
 replace github.com/danielpaulus/go-ios => ./go-ios
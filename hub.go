@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios/tiny"
+)
+
+// hubHeartbeatRoute is authenticated with HUB_TOKEN instead of the scopes of AUTH_CONFIG
+const hubHeartbeatRoute = "POST /nodes/heartbeat"
+
+// errDeviceOwned is returned for heartbeats with devices that another live node reported
+var errDeviceOwned = errors.New("devices are owned by another live node")
+
+// defaultHeartbeatInterval is how often nodes report to the hub, the hub gives up on a node after three missed heartbeats
+const defaultHeartbeatInterval = 10 * time.Second
+
+// NodeHeartbeat is what a node posts to the hub, it replaces the device list the hub has for the node
+type NodeHeartbeat struct {
+	Name    string   `json:"name"`
+	URL     string   `json:"url"`
+	Devices []Device `json:"devices"`
+	// Leased lists the UDIDs with an active lease on the node
+	Leased []string `json:"leased"`
+}
+
+type HubNode struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Available bool      `json:"available"`
+	Devices   int       `json:"devices"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+type HubNodesResponse struct {
+	Nodes []HubNode `json:"nodes"`
+}
+
+// HubDevice is a device as listed by the hub, Available is false once its node stopped heartbeating
+type HubDevice struct {
+	Device
+	Node      string `json:"node"`
+	Available bool   `json:"available"`
+	// Leased is as of the last heartbeat of the node
+	Leased bool `json:"leased"`
+}
+
+type HubDevicesResponse struct {
+	Devices []HubDevice `json:"devices"`
+}
+
+type hubNode struct {
+	url      *url.URL
+	lastSeen time.Time
+	devices  []Device
+	leased   []string
+	proxy    *httputil.ReverseProxy
+}
+
+// Hub routes requests for a UDID to the node that reported it last
+type Hub struct {
+	mu      sync.Mutex
+	nodes   map[string]*hubNode
+	owners  map[string]string
+	timeout time.Duration
+	// token authenticates the heartbeats of the nodes and is sent to them instead of the client credentials,
+	// see HUB_TOKEN
+	token string
+}
+
+func NewHub(timeout time.Duration, token string) *Hub {
+	return &Hub{nodes: map[string]*hubNode{}, owners: map[string]string{}, timeout: timeout, token: token}
+}
+
+func (h *Hub) available(node *hubNode) bool {
+	return time.Since(node.lastSeen) < h.timeout
+}
+
+// newProxy forwards to target without buffering, so streamed responses reach the client as they are written.
+// WebSocket upgrades are handled by the ReverseProxy itself.
+func (h *Hub) newProxy(target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+			if h.token != "" {
+				r.Out.Header.Set("Authorization", "Bearer "+h.token)
+			}
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("hub: proxying %s %s to %s: %v", r.Method, r.URL.Path, target.Host, err)
+			http.Error(w, "node unreachable: "+err.Error(), http.StatusBadGateway)
+		},
+	}
+}
+
+// Heartbeat records the devices of a node. A UDID moves to the reporting node only once the node that owns it
+// stopped heartbeating, the UDIDs that are still owned by another live node are returned in the error.
+func (h *Hub) Heartbeat(heartbeat NodeHeartbeat) error {
+	target, err := url.Parse(heartbeat.URL)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return fmt.Errorf("invalid node url %q", heartbeat.URL)
+	}
+	if heartbeat.Name == "" {
+		return fmt.Errorf("node name missing")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	node, ok := h.nodes[heartbeat.Name]
+	if !ok || node.url.String() != target.String() {
+		node = &hubNode{url: target, proxy: h.newProxy(target)}
+		h.nodes[heartbeat.Name] = node
+	}
+	node.lastSeen = time.Now()
+	node.devices = heartbeat.Devices
+	node.leased = heartbeat.Leased
+	for udid, owner := range h.owners {
+		if owner == heartbeat.Name {
+			delete(h.owners, udid)
+		}
+	}
+	var conflicts []string
+	for _, device := range heartbeat.Devices {
+		if owner, ok := h.owners[device.UDID]; ok && owner != heartbeat.Name && h.available(h.nodes[owner]) {
+			conflicts = append(conflicts, device.UDID)
+			continue
+		}
+		h.owners[device.UDID] = heartbeat.Name
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%w: %v", errDeviceOwned, conflicts)
+	}
+	return nil
+}
+
+// node returns the node that owns udid and whether it is still heartbeating
+func (h *Hub) node(udid string) (string, *hubNode, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	name, ok := h.owners[udid]
+	if !ok {
+		return "", nil, false
+	}
+	node := h.nodes[name]
+	return name, node, h.available(node)
+}
+
+func (h *Hub) Nodes() []HubNode {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	nodes := []HubNode{}
+	for name, node := range h.nodes {
+		nodes = append(nodes, HubNode{Name: name, URL: node.url.String(), Available: h.available(node), Devices: len(node.devices), LastSeen: node.lastSeen})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes
+}
+
+func (h *Hub) Devices() []HubDevice {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	devices := []HubDevice{}
+	for udid, name := range h.owners {
+		node := h.nodes[name]
+		for _, device := range node.devices {
+			if device.UDID == udid {
+				devices = append(devices, HubDevice{Device: device, Node: name, Available: h.available(node), Leased: slices.Contains(node.leased, udid)})
+			}
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].UDID < devices[j].UDID })
+	return devices
+}
+
+func (h *Hub) availableNodes() []*hubNode {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	nodes := []*hubNode{}
+	for _, node := range h.nodes {
+		if h.available(node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// heartbeat godoc
+// @Summary      Node heartbeat
+// @Description  Nodes started with HUB_URL post their device list here. A node that misses three heartbeats is marked
+// @Description  unavailable and requests for its devices fail with 503 until it reports again.
+// @Tags         hub
+// @Accept       json
+// @Produce      json
+// @Description  Heartbeats carry HUB_TOKEN as bearer token. Devices another live node reported are not taken over.
+// @Param        request body NodeHeartbeat true "Node and its devices"
+// @Success      200 {object} GenericResponse
+// @Failure      400 {string} string "invalid heartbeat"
+// @Failure      401 {string} string "invalid hub token"
+// @Failure      409 {string} string "devices are owned by another live node"
+// @Router       /nodes/heartbeat [post]
+func (h *Hub) heartbeat(w http.ResponseWriter, r *http.Request) {
+	if h.token == "" || subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(h.token)) != 1 {
+		auditAuthDecision(r, hubHeartbeatRoute, "", nil, false, "invalid hub token")
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var heartbeat NodeHeartbeat
+	if err := json.NewDecoder(r.Body).Decode(&heartbeat); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	err := h.Heartbeat(heartbeat)
+	switch {
+	case errors.Is(err, errDeviceOwned):
+		log.Printf("hub: heartbeat of %s: %v", heartbeat.Name, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, _ := json.Marshal(GenericResponse{OK: true})
+	writeResponse(w, 200, result)
+}
+
+// listNodes godoc
+// @Summary      List nodes
+// @Description  Lists the nodes that reported to the hub, with their address, device count and last heartbeat
+// @Tags         hub
+// @Produce      json
+// @Success      200 {object} HubNodesResponse
+// @Router       /nodes [get]
+func (h *Hub) listNodes(w http.ResponseWriter, _ *http.Request) {
+	result, _ := json.Marshal(HubNodesResponse{Nodes: h.Nodes()})
+	writeResponse(w, 200, result)
+}
+
+// listDevices godoc
+// @Summary      List devices of all nodes
+// @Description  In hub mode GET /devices lists the devices of every node together with the node name.
+// @Description  Devices of nodes that stopped heartbeating stay listed with available false.
+// @Description  With available=1 only devices of live nodes that are not leased are listed.
+// @Tags         hub
+// @Produce      json
+// @Param        available query string false "1 to list only available devices without a lease"
+// @Param        selector query string false "Comma separated label terms, as reported by the nodes"
+// @Success      200 {object} HubDevicesResponse
+// @Router       /devices [get]
+func (h *Hub) listDevices(w http.ResponseWriter, r *http.Request) {
+	p := getPrincipal(r.Context())
+	available := r.URL.Query().Get("available") == "1"
+	selector, err := ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	devices := []HubDevice{}
+	for _, device := range h.Devices() {
+		if p != nil && !p.AllowsDevice(device.UDID) {
+			continue
+		}
+		if available && (!device.Available || device.Leased) {
+			continue
+		}
+		if !selector.Matches(device.Labels) {
+			continue
+		}
+		devices = append(devices, device)
+	}
+	result, _ := json.Marshal(HubDevicesResponse{Devices: devices})
+	writeResponse(w, 200, result)
+}
+
+// device proxies every /{udid}/ route to the node that owns the device
+func (h *Hub) device(w http.ResponseWriter, r *http.Request) {
+	udid := r.PathValue("udid")
+	name, node, available := h.node(udid)
+	switch {
+	case node == nil:
+		http.Error(w, "device not found", http.StatusNotFound)
+	case !available:
+		http.Error(w, fmt.Sprintf("node %s stopped heartbeating", name), http.StatusServiceUnavailable)
+	default:
+		node.proxy.ServeHTTP(w, r)
+	}
+}
+
+// job answers for batch jobs of the hub itself and otherwise asks every available node,
+// jobs are only known to the node that runs them. Nodes check HUB_TOKEN instead of the caller, so the devices of
+// the job are checked against the caller here before it is shown or cancelled.
+func (h *Hub) job(w http.ResponseWriter, r *http.Request) {
+	if _, ok := jobs.Get(r.PathValue("id")); ok {
+		if r.Method == http.MethodDelete {
+			cancelJob(w, r)
+		} else {
+			getJob(w, r)
+		}
+		return
+	}
+	for _, node := range h.availableNodes() {
+		resp, err := h.nodeRequest(r.Context(), node, http.MethodGet, r.URL.Path, nil, r.Header)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			continue
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+			relay(w, resp)
+			return
+		}
+		var job Job
+		err = json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid job from node %s: %v", node.url, err), http.StatusBadGateway)
+			return
+		}
+		if !visibleJob(r, &job) {
+			break
+		}
+		if r.Method == http.MethodGet {
+			writeJob(w, &job)
+			return
+		}
+		resp, err = h.nodeRequest(r.Context(), node, r.Method, r.URL.Path, nil, r.Header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		relay(w, resp)
+		return
+	}
+	http.Error(w, "unknown job", http.StatusNotFound)
+}
+
+// allocate godoc
+// @Summary      Allocate device on any node
+// @Description  In hub mode the allocation is tried on every live node in turn until one has a free matching device
+// @Tags         hub
+// @Accept       json
+// @Produce      json
+// @Param        request body AllocateRequest true "Selector and optional lease"
+// @Success      200 {object} AllocateResponse
+// @Failure      404 {string} string "no free device matches"
+// @Router       /allocate [post]
+func (h *Hub) allocate(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.fanOut(w, r, body, "no free device matches")
+}
+
+// nodeRequest sends a request to node with the credentials and lease token of the client request header,
+// or with HUB_TOKEN if it is set
+func (h *Hub) nodeRequest(ctx context.Context, node *hubNode, method string, path string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, node.url.JoinPath(path).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"Content-Type", "Authorization", LeaseTokenHeader} {
+		if v := header.Get(key); v != "" {
+			req.Header.Set(key, v)
+		}
+	}
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// fanOut sends r to the live nodes in turn and answers with the first response that is not a 404
+func (h *Hub) fanOut(w http.ResponseWriter, r *http.Request, body []byte, notFound string) {
+	for _, node := range h.availableNodes() {
+		resp, err := h.nodeRequest(r.Context(), node, r.Method, r.URL.Path, body, r.Header)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			continue
+		}
+		relay(w, resp)
+		return
+	}
+	http.Error(w, notFound, http.StatusNotFound)
+}
+
+// relay writes the response of a node to w and closes it
+func relay(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// nodeBatch is the part of a hub batch that runs on one node
+type nodeBatch struct {
+	node  *hubNode
+	udids []string
+	jobID string
+}
+
+// batch godoc
+// @Summary      Run an operation on devices of all nodes
+// @Description  In hub mode the devices are split by node and every node runs its part as a batch job with its own
+// @Description  concurrency limit. The hub job follows the node jobs and merges their steps and results, cancelling
+// @Description  it cancels the node jobs.
+// @Tags         hub
+// @Accept       json
+// @Produce      json
+// @Param        request body BatchRequest true "Operation, devices and parameters"
+// @Success      202 {object} Job
+// @Failure      400 {string} string "invalid JSON, operation, parameters or selector"
+// @Failure      403 {string} string "missing scope or device not allowed"
+// @Failure      404 {string} string "no device matches"
+// @Router       /batch [post]
+func (h *Hub) batch(w http.ResponseWriter, r *http.Request) {
+	var b BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := b.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := getPrincipal(r.Context())
+	if scope := batchScopes[b.Operation]; p != nil && p.level() < scopeLevels[scope] {
+		http.Error(w, "forbidden: missing scope "+scope, http.StatusForbidden)
+		return
+	}
+	parts, missing, err := h.splitBatch(b, p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(parts) == 0 {
+		http.Error(w, "no device matches "+b.Selector, http.StatusNotFound)
+		return
+	}
+
+	// the node parts are started right away, so invalid parameters are reported like on a node
+	udids := append([]string{}, missing...)
+	for i, part := range parts {
+		udids = append(udids, part.udids...)
+		nb := b
+		nb.Udids, nb.Selector = part.udids, ""
+		body, _ := json.Marshal(nb)
+		resp, err := h.nodeRequest(r.Context(), part.node, http.MethodPost, "/batch", body, r.Header)
+		if err != nil {
+			http.Error(w, "node unreachable: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		var job Job
+		if resp.StatusCode != http.StatusAccepted || json.Unmarshal(data, &job) != nil {
+			if i == 0 {
+				w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+				w.WriteHeader(resp.StatusCode)
+				w.Write(data)
+				return
+			}
+			log.Printf("hub: batch on %s: %s: %s", part.node.url.Host, resp.Status, bytes.TrimSpace(data))
+			missing = append(missing, part.udids...)
+			continue
+		}
+		parts[i].jobID = job.ID
+	}
+	sort.Strings(udids)
+
+	header := r.Header.Clone()
+	job := jobs.StartMulti("batch", udids, udids, func(ctx context.Context, job *Job) error {
+		return h.followBatch(ctx, parts, missing, len(udids), header, job)
+	})
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJob(w, job)
+}
+
+// splitBatch groups the devices of b by the node that owns them. UDIDs without a live node are returned as missing.
+func (h *Hub) splitBatch(b BatchRequest, p *Principal) ([]nodeBatch, []string, error) {
+	udids := b.Udids
+	if len(udids) == 0 {
+		selector, err := ParseSelector(b.Selector)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, device := range h.Devices() {
+			if device.Available && selector.Matches(device.Labels) {
+				udids = append(udids, device.UDID)
+			}
+		}
+	}
+	byNode := map[*hubNode]int{}
+	parts := []nodeBatch{}
+	missing := []string{}
+	for _, udid := range udids {
+		if p != nil && !p.AllowsDevice(udid) {
+			return nil, nil, fmt.Errorf("%w: %s", errDeviceNotAllowed, udid)
+		}
+		_, node, available := h.node(udid)
+		if !available {
+			missing = append(missing, udid)
+			continue
+		}
+		i, ok := byNode[node]
+		if !ok {
+			i = len(parts)
+			byNode[node] = i
+			parts = append(parts, nodeBatch{node: node})
+		}
+		parts[i].udids = append(parts[i].udids, udid)
+	}
+	return parts, missing, nil
+}
+
+// followBatch polls the node jobs every second and copies their steps and results into job
+func (h *Hub) followBatch(ctx context.Context, parts []nodeBatch, missing []string, total int, header http.Header, job *Job) error {
+	results := map[string]BatchDeviceResult{}
+	for _, udid := range missing {
+		results[udid] = BatchDeviceResult{Udid: udid, Error: "no live node has the device"}
+		job.SetStep(JobStep{Name: udid, Status: tiny.StepFailed, Error: "no live node has the device"})
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		running := false
+		for _, part := range parts {
+			if part.jobID == "" {
+				continue
+			}
+			nodeJob, err := h.nodeJob(ctx, part, header)
+			if err != nil {
+				running = true
+				continue
+			}
+			for _, step := range nodeJob.Steps {
+				job.SetStep(step)
+			}
+			var list []BatchDeviceResult
+			data, _ := json.Marshal(nodeJob.Result)
+			_ = json.Unmarshal(data, &list)
+			for _, result := range list {
+				results[result.Udid] = result
+			}
+			if nodeJob.Status == JobRunning {
+				running = true
+			}
+		}
+		list := make([]BatchDeviceResult, 0, len(results))
+		failed := 0
+		for _, result := range results {
+			list = append(list, result)
+			if !result.OK {
+				failed++
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Udid < list[j].Udid })
+		job.SetResult(list)
+		if !running {
+			if failed > 0 {
+				return fmt.Errorf("%d of %d devices failed", failed, total)
+			}
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			for _, part := range parts {
+				if resp, err := h.nodeRequest(context.Background(), part.node, http.MethodDelete, "/jobs/"+part.jobID, nil, header); err == nil {
+					resp.Body.Close()
+				}
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+func (h *Hub) nodeJob(ctx context.Context, part nodeBatch, header http.Header) (*Job, error) {
+	resp, err := h.nodeRequest(ctx, part.node, http.MethodGet, "/jobs/"+part.jobID, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return nil, fmt.Errorf("job %s on %s: %s", part.jobID, part.node.url.Host, resp.Status)
+	}
+	var job Job
+	return &job, json.NewDecoder(resp.Body).Decode(&job)
+}
+
+// newHubHandler serves the device routes of all nodes. Auth, audit and metrics apply to the proxied routes
+// like on a node, the device mux is only used to look up their patterns.
+func newHubHandler(hub *Hub, requestMetrics *RequestMetrics, auth *Auth) http.Handler {
+	root := http.NewServeMux()
+	root.HandleFunc("GET /devices", hub.listDevices)
+	root.HandleFunc("POST /allocate", hub.allocate)
+	root.HandleFunc("GET /nodes", hub.listNodes)
+	root.HandleFunc(hubHeartbeatRoute, hub.heartbeat)
+	root.HandleFunc("GET /metrics", metricsHandler(requestMetrics, NewDeviceSampler(time.Minute)))
+	root.HandleFunc("GET /jobs/{id}", hub.job)
+	root.HandleFunc("DELETE /jobs/{id}", hub.job)
+	root.HandleFunc("POST /batch", hub.batch)
+	root.HandleFunc("/{udid}/", hub.device)
+
+	deviceMux := newDeviceMux()
+	var handler http.Handler = root
+	handler = RecoveryMiddleware(handler)
+	handler = auditor.Middleware(handler, deviceMux, root)
+	if auth != nil {
+		// nodes authenticate their heartbeats with HUB_TOKEN, which need not be in AUTH_CONFIG
+		authenticated := auth.Middleware(handler, deviceMux, root)
+		heartbeat := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if routePattern(r, root) == hubHeartbeatRoute {
+				heartbeat.ServeHTTP(w, r)
+				return
+			}
+			authenticated.ServeHTTP(w, r)
+		})
+	}
+	handler = requestMetrics.Middleware(handler, deviceMux, root)
+	return handler
+}
+
+// runHeartbeat reports the local devices to the hub at hubURL every interval until stop is closed
+func runHeartbeat(hubURL string, node NodeHeartbeat, token string, interval time.Duration, stop <-chan struct{}) {
+	endpoint, err := url.JoinPath(hubURL, "/nodes/heartbeat")
+	if err != nil {
+		log.Printf("hub: invalid HUB_URL %s: %v", hubURL, err)
+		return
+	}
+	client := &http.Client{Timeout: interval}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		devices, err := listDevices(nil)
+		if err != nil {
+			log.Printf("hub: %v", err)
+			devices = []Device{}
+		}
+		node.Devices = devices
+		node.Leased = leases.Leased()
+		if err := sendHeartbeat(client, endpoint, node, token); err != nil {
+			log.Printf("hub: heartbeat to %s failed: %v", hubURL, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func sendHeartbeat(client *http.Client, endpoint string, node NodeHeartbeat, token string) error {
+	body, _ := json.Marshal(node)
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// heartbeatConfig reads the node settings for HUB_URL, the advertised NODE_URL defaults to the hostname on port 8080
+func heartbeatConfig() (NodeHeartbeat, time.Duration, error) {
+	interval := defaultHeartbeatInterval
+	if v := os.Getenv("HUB_HEARTBEAT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return NodeHeartbeat{}, 0, fmt.Errorf("invalid HUB_HEARTBEAT_INTERVAL %s", v)
+		}
+		interval = d
+	}
+	hostname, _ := os.Hostname()
+	node := NodeHeartbeat{Name: os.Getenv("NODE_NAME"), URL: os.Getenv("NODE_URL")}
+	if node.Name == "" {
+		node.Name = hostname
+	}
+	if node.URL == "" {
+		node.URL = "http://" + hostname + ":8080"
+	}
+	return node, interval, nil
+}
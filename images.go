@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/danielpaulus/go-ios/ios/artifactcache"
+	"github.com/danielpaulus/go-ios/ios/imagemounter"
+)
+
+const defaultImageDir = "./devimages"
+
+// imageSource finds developer images for ImageEnable and provisioning, see LoadImageSource
+var imageSource *imagemounter.ImageSource
+
+// ImagesResponse lists the developer images that can be mounted without downloading
+type ImagesResponse struct {
+	Dir     string                    `json:"dir"`
+	Mirror  string                    `json:"mirror,omitempty"`
+	Offline bool                      `json:"offline"`
+	Images  []imagemounter.LocalImage `json:"images"`
+}
+
+// LoadImageSource reads developer images from DDI_DIR, ./devimages if not set, and downloads missing ones into cache
+// from DDI_MIRROR_URL or the public locations. DDI_OFFLINE=true never downloads.
+func LoadImageSource(cache *artifactcache.Cache) *imagemounter.ImageSource {
+	source := &imagemounter.ImageSource{
+		Dir:       os.Getenv("DDI_DIR"),
+		MirrorURL: os.Getenv("DDI_MIRROR_URL"),
+		Offline:   os.Getenv("DDI_OFFLINE") == "true",
+		Cache:     cache,
+	}
+	if source.Dir == "" {
+		source.Dir = defaultImageDir
+	}
+	return source
+}
+
+// configureTSS requests signing tickets for personalized images from TSS_URL, Apple if not set, and keeps them in
+// TSS_TICKET_DIR, the tickets directory of the artifact cache if not set
+func configureTSS(cache *artifactcache.Cache) {
+	if url := os.Getenv("TSS_URL"); url != "" {
+		imagemounter.TSSURL = url
+	}
+	imagemounter.TicketDir = os.Getenv("TSS_TICKET_DIR")
+	if imagemounter.TicketDir == "" {
+		imagemounter.TicketDir = filepath.Join(cache.Dir(), "tickets")
+	}
+}
+
+// prewarmImages downloads the developer images of every iOS version attached, so the first image mount does not wait
+func prewarmImages(source *imagemounter.ImageSource) {
+	devices, err := listDevices(nil)
+	if err != nil {
+		log.Printf("image pre-warm: %v", err)
+		return
+	}
+	versions := map[string]bool{}
+	for _, device := range devices {
+		if device.ProductVersion != "" {
+			versions[device.ProductVersion] = true
+		}
+	}
+	for version := range versions {
+		if _, err := source.ImageForVersion(context.Background(), version); err != nil {
+			log.Printf("image pre-warm for iOS %s failed: %v", version, err)
+			continue
+		}
+		log.Printf("developer image for iOS %s cached", version)
+	}
+}
+
+// listImages godoc
+// @Summary      List developer images
+// @Description  Lists the developer images that can be mounted without downloading, from DDI_DIR and the artifact cache
+// @Tags         images
+// @Produce      json
+// @Success      200 {object} ImagesResponse
+// @Router       /images [get]
+func listImages(w http.ResponseWriter, r *http.Request) {
+	result, _ := json.Marshal(ImagesResponse{
+		Dir:     imageSource.Dir,
+		Mirror:  imageSource.MirrorURL,
+		Offline: imageSource.Offline,
+		Images:  imageSource.Available(),
+	})
+	writeResponse(w, 200, result)
+}
+
+// uploadImage godoc
+// @Summary      Upload developer image
+// @Description  Adds a zip to DDI_DIR, replacing the image for the same version. For iOS 17 and later it has to contain
+// @Description  the Restore directory of the personalized image, before that DeveloperDiskImage.dmg and its signature.
+// @Tags         images
+// @Accept       application/zip
+// @Produce      json
+// @Param        version query     string  true  "iOS version the image is for, like 16.4 or 17.0"
+// @Success      200 {object} imagemounter.LocalImage
+// @Failure      400 {string} string "version missing or invalid image"
+// @Router       /images [post]
+func uploadImage(w http.ResponseWriter, r *http.Request) {
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		http.Error(w, "version missing", http.StatusBadRequest)
+		return
+	}
+	file, err := os.CreateTemp("", "image-*.zip")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(file.Name())
+	_, err = io.Copy(file, r.Body)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		http.Error(w, "upload failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	image, err := imageSource.Add(file.Name(), version)
+	switch {
+	case errors.Is(err, imagemounter.ErrInvalidImage):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result, _ := json.Marshal(image)
+	writeResponse(w, 200, result)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios/tiny"
+)
+
+// Job states
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// finishedJobRetention is how long finished jobs can still be queried
+const finishedJobRetention = time.Hour
+
+type JobStep struct {
+	Name     string     `json:"name"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// Job is a long running operation that reports progress step by step
+type Job struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	Udid string `json:"udid,omitempty"`
+	// Udids are the devices of a job that works on several
+	Udids    []string   `json:"udids,omitempty"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Steps    []JobStep  `json:"steps"`
+	Result   any        `json:"result,omitempty"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// Progress updates the step name, it matches the progress callbacks of the tiny package.
+// Steps not announced when the job was created are appended.
+func (j *Job) Progress(name string, status string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	i := 0
+	for i < len(j.Steps) && j.Steps[i].Name != name {
+		i++
+	}
+	if i == len(j.Steps) {
+		j.Steps = append(j.Steps, JobStep{Name: name})
+	}
+	step := &j.Steps[i]
+	step.Status = status
+	switch status {
+	case tiny.StepRunning:
+		step.Started = &now
+	case tiny.StepDone, tiny.StepSkipped, tiny.StepFailed:
+		step.Finished = &now
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+}
+
+// SetStep replaces the step with the same name or appends it, for jobs that follow the steps of other jobs
+func (j *Job) SetStep(step JobStep) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := range j.Steps {
+		if j.Steps[i].Name == step.Name {
+			j.Steps[i] = step
+			return
+		}
+	}
+	j.Steps = append(j.Steps, step)
+}
+
+// SetResult stores what the job produced, it is returned with the job once it finished
+func (j *Job) SetResult(result any) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Result = result
+}
+
+func (j *Job) finish(ctx context.Context, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.Finished = &now
+	switch {
+	case err == nil:
+		j.Status = JobSucceeded
+	case ctx.Err() != nil:
+		j.Status = JobCancelled
+		j.Error = err.Error()
+	default:
+		j.Status = JobFailed
+		j.Error = err.Error()
+	}
+}
+
+func (j *Job) MarshalJSON() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	type job Job
+	return json.Marshal((*job)(j))
+}
+
+// JobStore keeps running jobs and finished ones for finishedJobRetention
+type JobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+var jobs = &JobStore{jobs: map[string]*Job{}}
+
+// Start runs f in the background as a new job. steps are the step names known upfront, they start out as pending.
+func (s *JobStore) Start(kind string, udid string, steps []string, f func(ctx context.Context, job *Job) error) *Job {
+	return s.start(kind, udid, nil, steps, f)
+}
+
+// StartMulti is Start for jobs that work on several devices
+func (s *JobStore) StartMulti(kind string, udids []string, steps []string, f func(ctx context.Context, job *Job) error) *Job {
+	return s.start(kind, "", udids, steps, f)
+}
+
+func (s *JobStore) start(kind string, udid string, udids []string, steps []string, f func(ctx context.Context, job *Job) error) *Job {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:      hex.EncodeToString(id),
+		Kind:    kind,
+		Udid:    udid,
+		Udids:   udids,
+		Status:  JobRunning,
+		Steps:   []JobStep{},
+		Created: time.Now(),
+		cancel:  cancel,
+	}
+	for _, name := range steps {
+		job.Steps = append(job.Steps, JobStep{Name: name, Status: "pending"})
+	}
+
+	s.mu.Lock()
+	s.expire()
+	s.jobs[job.ID] = job
+	s.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		job.finish(ctx, f(ctx, job))
+	}()
+	return job
+}
+
+// expire removes jobs that finished more than finishedJobRetention ago, callers hold s.mu
+func (s *JobStore) expire() {
+	for id, job := range s.jobs {
+		job.mu.Lock()
+		old := job.Finished != nil && time.Since(*job.Finished) > finishedJobRetention
+		job.mu.Unlock()
+		if old {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func (s *JobStore) Get(id string) (*Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	return job, ok
+}
+
+// List returns all jobs, newest first
+func (s *JobStore) List() []*Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	list := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		list = append(list, job)
+	}
+	sort.Slice(list, func(i, k int) bool { return list[i].Created.After(list[k].Created) })
+	return list
+}
+
+// writeJob answers with the job's current state, 202 while it is still running
+func writeJob(w http.ResponseWriter, job *Job) {
+	result, _ := json.Marshal(job)
+	status := http.StatusOK
+	job.mu.Lock()
+	if job.Status == JobRunning {
+		status = http.StatusAccepted
+	}
+	job.mu.Unlock()
+	writeResponse(w, status, result)
+}
+
+// listJobs godoc
+// @Summary      List jobs
+// @Description  Returns all running jobs and the ones that finished within the last hour
+// @Tags         jobs
+// @Produce      json
+// @Success      200 {array} Job
+// @Router       /jobs [get]
+func listJobs(w http.ResponseWriter, r *http.Request) {
+	list := []*Job{}
+	for _, job := range jobs.List() {
+		if visibleJob(r, job) {
+			list = append(list, job)
+		}
+	}
+	result, _ := json.Marshal(list)
+	writeResponse(w, 200, result)
+}
+
+// visibleJob hides jobs of other devices from principals limited to some devices
+func visibleJob(r *http.Request, job *Job) bool {
+	p := getPrincipal(r.Context())
+	if p == nil || len(p.Udids) == 0 {
+		return true
+	}
+	if len(job.Udids) > 0 {
+		return !slices.ContainsFunc(job.Udids, func(udid string) bool { return !p.AllowsDevice(udid) })
+	}
+	return job.Udid != "" && p.AllowsDevice(job.Udid)
+}
+
+// getJob godoc
+// @Summary      Get job
+// @Description  Returns the state and step progress of a job
+// @Tags         jobs
+// @Produce      json
+// @Param        id   path      string  true  "Job ID"
+// @Success      200 {object} Job
+// @Success      202 {object} Job
+// @Failure      404 {string} string "unknown job"
+// @Router       /jobs/{id} [get]
+func getJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.Get(r.PathValue("id"))
+	if !ok || !visibleJob(r, job) {
+		http.Error(w, "unknown job", http.StatusNotFound)
+		return
+	}
+	writeJob(w, job)
+}
+
+// cancelJob godoc
+// @Summary      Cancel job
+// @Description  Cancels a running job, it stops before its next step
+// @Tags         jobs
+// @Produce      json
+// @Param        id   path      string  true  "Job ID"
+// @Success      200 {object} Job
+// @Success      202 {object} Job
+// @Failure      404 {string} string "unknown job"
+// @Router       /jobs/{id} [delete]
+func cancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.Get(r.PathValue("id"))
+	if !ok || !visibleJob(r, job) {
+		http.Error(w, "unknown job", http.StatusNotFound)
+		return
+	}
+	job.cancel()
+	writeJob(w, job)
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/tiny"
+	"gopkg.in/yaml.v3"
+)
+
+// autoLabelTTL is how long supervision and developer mode state are cached, asking the device takes a lockdown session
+const autoLabelTTL = 5 * time.Minute
+
+// autoLabelKeys are derived from the device and cannot be set by operators
+var autoLabelKeys = []string{"model", "ios", "supervised", "devmode", "connection"}
+
+type autoLabels struct {
+	labels  map[string]string
+	expires time.Time
+}
+
+// LabelStore keeps the labels operators attach to UDIDs. With LABELS_FILE they are read from and written back to
+// a JSON or YAML file, depending on its extension, that maps UDIDs to labels.
+type LabelStore struct {
+	mu     sync.Mutex
+	path   string
+	labels map[string]map[string]string
+	auto   map[string]autoLabels
+}
+
+var labels = &LabelStore{labels: map[string]map[string]string{}, auto: map[string]autoLabels{}}
+
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// LoadLabels reads LABELS_FILE, a missing file is created on the first change
+func LoadLabels() (*LabelStore, error) {
+	store := &LabelStore{path: os.Getenv("LABELS_FILE"), labels: map[string]map[string]string{}, auto: map[string]autoLabels{}}
+	if store.path == "" {
+		return store, nil
+	}
+	data, err := os.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read LABELS_FILE %s: %w", store.path, err)
+	}
+	if isYAML(store.path) {
+		err = yaml.Unmarshal(data, &store.labels)
+	} else {
+		err = json.Unmarshal(data, &store.labels)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid LABELS_FILE %s: %w", store.path, err)
+	}
+	if store.labels == nil {
+		store.labels = map[string]map[string]string{}
+	}
+	return store, nil
+}
+
+// save writes the labels to a temporary file first, so a crash never leaves a half written file behind
+func (s *LabelStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	var data []byte
+	var err error
+	if isYAML(s.path) {
+		data, err = yaml.Marshal(s.labels)
+	} else {
+		data, err = json.MarshalIndent(s.labels, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Set replaces the operator labels of udid, an empty map removes them
+func (s *LabelStore) Set(udid string, set map[string]string) error {
+	for key := range set {
+		if slices.Contains(autoLabelKeys, key) {
+			return fmt.Errorf("label %s is set automatically", key)
+		}
+		if key == "" || strings.ContainsAny(key, ",=!<>") {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(set) == 0 {
+		delete(s.labels, udid)
+	} else {
+		s.labels[udid] = set
+	}
+	return s.save()
+}
+
+// Delete removes one operator label of udid
+func (s *LabelStore) Delete(udid string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.labels[udid], key)
+	if len(s.labels[udid]) == 0 {
+		delete(s.labels, udid)
+	}
+	return s.save()
+}
+
+// Labels returns the operator labels of device together with the automatic ones
+func (s *LabelStore) Labels(device Device, entry *ios.DeviceEntry) map[string]string {
+	result := map[string]string{}
+	s.mu.Lock()
+	for k, v := range s.labels[device.UDID] {
+		result[k] = v
+	}
+	auto, ok := s.auto[device.UDID]
+	s.mu.Unlock()
+
+	result["model"] = device.ProductType
+	result["ios"] = strings.SplitN(device.ProductVersion, ".", 2)[0]
+	if device.ConnectionType != "" {
+		result["connection"] = strings.ToLower(device.ConnectionType)
+	}
+	if !ok || time.Now().After(auto.expires) {
+		auto = autoLabels{labels: map[string]string{}, expires: time.Now().Add(autoLabelTTL)}
+		if entry != nil {
+			if supervised, err := tiny.IsSupervised(*entry); err == nil {
+				auto.labels["supervised"] = strconv.FormatBool(supervised)
+			}
+			if devmode, err := tiny.IsDevModeEnabled(*entry); err == nil {
+				auto.labels["devmode"] = strconv.FormatBool(devmode)
+			}
+		}
+		s.mu.Lock()
+		s.auto[device.UDID] = auto
+		s.mu.Unlock()
+	}
+	for k, v := range auto.labels {
+		result[k] = v
+	}
+	return result
+}
+
+// listDevices returns the devices p may use with their labels
+func listDevices(p *Principal) ([]Device, error) {
+	var resp DevicesResponse
+	if err := json.Unmarshal([]byte(tiny.DeviceList()), &resp); err != nil {
+		return nil, fmt.Errorf("could not list devices: %w", err)
+	}
+	entries := map[string]ios.DeviceEntry{}
+	if list, err := ios.ListDevices(); err == nil {
+		for _, entry := range list.DeviceList {
+			entries[entry.Properties.SerialNumber] = entry
+		}
+	}
+	devices := []Device{}
+	var wg sync.WaitGroup
+	for _, device := range resp.Devices {
+		if p != nil && !p.AllowsDevice(device.UDID) {
+			continue
+		}
+		devices = append(devices, device)
+	}
+	for i := range devices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var entry *ios.DeviceEntry
+			if e, ok := entries[devices[i].UDID]; ok {
+				entry = &e
+			}
+			devices[i].Labels = labels.Labels(devices[i], entry)
+		}()
+	}
+	wg.Wait()
+	return devices, nil
+}
+
+// selectorTerm is one comma separated part of a selector: key, !key or key followed by =, !=, >=, <=, > or < and a value
+type selectorTerm struct {
+	key   string
+	op    string
+	value string
+}
+
+// Selector matches device labels, all terms have to match
+type Selector []selectorTerm
+
+func ParseSelector(selector string) (Selector, error) {
+	terms := Selector{}
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.IndexAny(part, "=!<>")
+		switch {
+		case i < 0:
+			terms = append(terms, selectorTerm{key: part, op: "exists"})
+			continue
+		case i == 0 && part[0] == '!' && !strings.ContainsAny(part[1:], "=!<>"):
+			terms = append(terms, selectorTerm{key: part[1:], op: "!exists"})
+			continue
+		case i == 0:
+			return nil, fmt.Errorf("invalid selector term %q", part)
+		}
+		term := selectorTerm{key: part[:i]}
+		rest := part[i:]
+		for _, op := range []string{"!=", ">=", "<=", "=", ">", "<"} {
+			if strings.HasPrefix(rest, op) {
+				term.op, term.value = op, rest[len(op):]
+				break
+			}
+		}
+		if term.op == "" {
+			return nil, fmt.Errorf("invalid selector term %q", part)
+		}
+		if term.op != "=" && term.op != "!=" {
+			if _, err := strconv.ParseFloat(term.value, 64); err != nil {
+				return nil, fmt.Errorf("%s in %q needs a number", term.op, part)
+			}
+		}
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+// Matches reports whether labels satisfy every term. Ordering terms only match numeric label values.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, term := range s {
+		value, ok := labels[term.key]
+		switch term.op {
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		case "=":
+			if !ok || value != term.value {
+				return false
+			}
+		case "!=":
+			if ok && value == term.value {
+				return false
+			}
+		default:
+			have, err := strconv.ParseFloat(value, 64)
+			if !ok || err != nil {
+				return false
+			}
+			want, _ := strconv.ParseFloat(term.value, 64)
+			if !compare(have, term.op, want) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func compare(have float64, op string, want float64) bool {
+	switch op {
+	case ">=":
+		return have >= want
+	case "<=":
+		return have <= want
+	case ">":
+		return have > want
+	default:
+		return have < want
+	}
+}
+
+type LabelsResponse struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// getLabels godoc
+// @Summary      Get labels
+// @Description  Returns the labels of the device, the ones set by operators together with model, ios, connection,
+// @Description  supervised and devmode, which are derived from the device
+// @Tags         labels
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Success      200 {object} LabelsResponse
+// @Router       /{udid}/labels [get]
+func getLabels(w http.ResponseWriter, r *http.Request) {
+	udid := r.PathValue("udid")
+	devices, err := listDevices(nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, device := range devices {
+		if device.UDID == udid {
+			result, _ := json.Marshal(LabelsResponse{Labels: device.Labels})
+			writeResponse(w, 200, result)
+			return
+		}
+	}
+	http.Error(w, "device not found", http.StatusNotFound)
+}
+
+// setLabels godoc
+// @Summary      Set labels
+// @Description  Replaces the labels operators attached to the device, they are kept in LABELS_FILE.
+// @Description  The automatic labels cannot be set.
+// @Tags         labels
+// @Accept       json
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        request body LabelsResponse true "Labels"
+// @Success      200 {object} GenericResponse
+// @Failure      400 {string} string "invalid JSON or label"
+// @Router       /{udid}/labels [put]
+func setLabels(w http.ResponseWriter, r *http.Request) {
+	var req LabelsResponse
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := labels.Set(r.PathValue("udid"), req.Labels); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, _ := json.Marshal(GenericResponse{OK: true})
+	writeResponse(w, 200, result)
+}
+
+// deleteLabel godoc
+// @Summary      Delete label
+// @Description  Removes one label operators attached to the device
+// @Tags         labels
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        key    path      string  true  "Label key"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/labels/{key} [delete]
+func deleteLabel(w http.ResponseWriter, r *http.Request) {
+	if err := labels.Delete(r.PathValue("udid"), r.PathValue("key")); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result, _ := json.Marshal(GenericResponse{OK: true})
+	writeResponse(w, 200, result)
+}
+
+type AllocateRequest struct {
+	Selector string `json:"selector"`
+	// Lease leases the allocated device, without it the device is only picked
+	Lease *LeaseRequest `json:"lease"`
+}
+
+type AllocateResponse struct {
+	Device Device `json:"device"`
+	Lease  *Lease `json:"lease,omitempty"`
+}
+
+// allocate godoc
+// @Summary      Allocate device
+// @Description  Picks a device without lease whose labels match the selector. With lease the device is leased
+// @Description  in the same step, so two callers never get the same device.
+// @Tags         labels
+// @Accept       json
+// @Produce      json
+// @Param        request body AllocateRequest true "Selector and optional lease"
+// @Success      200 {object} AllocateResponse
+// @Failure      400 {string} string "invalid JSON, selector or lease"
+// @Failure      404 {string} string "no free device matches"
+// @Router       /allocate [post]
+func allocate(w http.ResponseWriter, r *http.Request) {
+	var req AllocateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	selector, err := ParseSelector(req.Selector)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := defaultLeaseTTL
+	if req.Lease != nil {
+		if req.Lease.Owner == "" {
+			http.Error(w, "lease owner missing", http.StatusBadRequest)
+			return
+		}
+		if ttl, err = leases.TTL(req.Lease.TTL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	devices, err := listDevices(getPrincipal(r.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].UDID < devices[j].UDID })
+	for _, device := range devices {
+		if _, leased := leases.Get(device.UDID); leased || !selector.Matches(device.Labels) {
+			continue
+		}
+		resp := AllocateResponse{Device: device}
+		if req.Lease != nil {
+			lease, ok := leases.Acquire(device.UDID, req.Lease.Owner, req.Lease.Purpose, ttl, "")
+			if !ok {
+				// leased in the meantime
+				continue
+			}
+			resp.Lease = &lease
+		}
+		result, _ := json.Marshal(resp)
+		writeResponse(w, 200, result)
+		return
+	}
+	http.Error(w, "no free device matches "+req.Selector, http.StatusNotFound)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/tiny"
+)
+
+// LeaseTokenHeader carries the lease token on calls that change a leased device
+const LeaseTokenHeader = "X-Lease-Token"
+
+const defaultLeaseTTL = 30 * time.Minute
+
+// defaultMaxLeaseTTL caps the ttl of leases unless LEASE_MAX_TTL is set
+const defaultMaxLeaseTTL = 8 * time.Hour
+
+// leaseRoutes manage the lease itself and are not locked by it
+var leaseRoutes = map[string]bool{
+	"GET /{udid}/lease":    true,
+	"POST /{udid}/lease":   true,
+	"DELETE /{udid}/lease": true,
+}
+
+type Lease struct {
+	Udid    string    `json:"udid"`
+	Owner   string    `json:"owner"`
+	Purpose string    `json:"purpose,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	// Token is only returned to the lease holder
+	Token string `json:"token,omitempty"`
+}
+
+type LeaseRequest struct {
+	Owner   string `json:"owner"`
+	Purpose string `json:"purpose"`
+	// TTL is a duration like "45m", 30 minutes if empty
+	TTL string `json:"ttl"`
+	// Token renews the lease it belongs to, the X-Lease-Token header works as well
+	Token string `json:"token"`
+}
+
+// LeaseStore keeps one lease per device in memory, a restart drops them
+type LeaseStore struct {
+	mu     sync.Mutex
+	leases map[string]*Lease
+	// cleanup runs in the background for every lease that expired without being released
+	cleanup func(lease Lease)
+	// maxTTL is the longest lease that can be taken or renewed, defaultMaxLeaseTTL if zero
+	maxTTL time.Duration
+}
+
+var leases = &LeaseStore{leases: map[string]*Lease{}}
+
+// Get returns the active lease of udid
+func (s *LeaseStore) Get(udid string) (Lease, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lease, ok := s.leases[udid]
+	if !ok || !time.Now().Before(lease.Expires) {
+		return Lease{}, false
+	}
+	return *lease, true
+}
+
+// Acquire leases udid to owner, or renews the lease if token belongs to it. A device leased by someone else
+// returns the current lease and false.
+func (s *LeaseStore) Acquire(udid string, owner string, purpose string, ttl time.Duration, token string) (Lease, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if lease, ok := s.leases[udid]; ok && now.Before(lease.Expires) {
+		if !lease.holds(token) {
+			return *lease, false
+		}
+		lease.Expires = now.Add(ttl)
+		if purpose != "" {
+			lease.Purpose = purpose
+		}
+		return *lease, true
+	}
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	lease := &Lease{Udid: udid, Owner: owner, Purpose: purpose, Created: now, Expires: now.Add(ttl), Token: hex.EncodeToString(id)}
+	s.leases[udid] = lease
+	return *lease, true
+}
+
+// TTL parses the ttl of a lease request, defaultLeaseTTL if empty. Durations above the maximum are rejected.
+func (s *LeaseStore) TTL(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultLeaseTTL, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl %s", value)
+	}
+	maxTTL := s.maxTTL
+	if maxTTL == 0 {
+		maxTTL = defaultMaxLeaseTTL
+	}
+	if ttl > maxTTL {
+		return 0, fmt.Errorf("ttl %s is longer than the maximum of %s", value, maxTTL)
+	}
+	return ttl, nil
+}
+
+// Release ends the lease of udid if token belongs to it
+func (s *LeaseStore) Release(udid string, token string) (Lease, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lease, ok := s.leases[udid]
+	if !ok || !time.Now().Before(lease.Expires) || !lease.holds(token) {
+		return Lease{}, false
+	}
+	delete(s.leases, udid)
+	return *lease, true
+}
+
+// Revoke ends the lease of udid without its token
+func (s *LeaseStore) Revoke(udid string) (Lease, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lease, ok := s.leases[udid]
+	if !ok || !time.Now().Before(lease.Expires) {
+		return Lease{}, false
+	}
+	delete(s.leases, udid)
+	return *lease, true
+}
+
+// Allows reports whether a call with token may change udid
+func (s *LeaseStore) Allows(udid string, token string) (Lease, bool) {
+	lease, ok := s.Get(udid)
+	return lease, !ok || lease.holds(token)
+}
+
+// holds reports whether token is the token of the lease, in constant time so it cannot be guessed byte by byte
+func (l *Lease) holds(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(l.Token)) == 1
+}
+
+// Leased returns the UDIDs with an active lease
+func (s *LeaseStore) Leased() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	udids := []string{}
+	now := time.Now()
+	for udid, lease := range s.leases {
+		if now.Before(lease.Expires) {
+			udids = append(udids, udid)
+		}
+	}
+	return udids
+}
+
+// expire drops expired leases and runs the cleanup hook for them
+func (s *LeaseStore) expire() {
+	s.mu.Lock()
+	expired := []Lease{}
+	now := time.Now()
+	for udid, lease := range s.leases {
+		if !now.Before(lease.Expires) {
+			expired = append(expired, *lease)
+			delete(s.leases, udid)
+		}
+	}
+	cleanup := s.cleanup
+	s.mu.Unlock()
+	for _, lease := range expired {
+		auditor.Record(map[string]any{"type": "lease", "event": "expired", "udid": lease.Udid, "owner": lease.Owner, "purpose": lease.Purpose})
+		if cleanup != nil {
+			go cleanup(lease)
+		}
+	}
+}
+
+// Run expires leases every second until stop is closed
+func (s *LeaseStore) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.expire()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Middleware answers 423 to calls that change a leased device without its token
+func (s *LeaseStore) Middleware(next http.Handler, muxes ...*http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pattern := routePattern(r, muxes...)
+		if !strings.Contains(pattern, "/{udid}/") || leaseRoutes[pattern] || !mutating(r.Method, pattern) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		udid := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+		if lease, ok := s.Allows(udid, r.Header.Get(LeaseTokenHeader)); !ok {
+			writeLocked(w, lease)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeLocked(w http.ResponseWriter, lease Lease) {
+	lease.Token = ""
+	result, _ := json.Marshal(lease)
+	writeResponse(w, http.StatusLocked, result)
+}
+
+// leaseMaxTTLFromEnv reads LEASE_MAX_TTL, defaultMaxLeaseTTL if not set
+func leaseMaxTTLFromEnv() (time.Duration, error) {
+	value := os.Getenv("LEASE_MAX_TTL")
+	if value == "" {
+		return defaultMaxLeaseTTL, nil
+	}
+	maxTTL, err := time.ParseDuration(value)
+	if err != nil || maxTTL <= 0 {
+		return 0, fmt.Errorf("invalid LEASE_MAX_TTL %s", value)
+	}
+	return maxTTL, nil
+}
+
+// leaseCleanupFromEnv builds the hook for expired leases. LEASE_CLEANUP lists built-in steps (wda, ax, proxy),
+// LEASE_CLEANUP_COMMAND is run through sh with UDID, LEASE_OWNER and LEASE_PURPOSE in its environment.
+func leaseCleanupFromEnv() (func(lease Lease), error) {
+	steps := map[string]func(ios.DeviceEntry) string{}
+	for _, step := range strings.Split(os.Getenv("LEASE_CLEANUP"), ",") {
+		switch step = strings.TrimSpace(step); step {
+		case "":
+		case "wda":
+			steps[step] = tiny.WdaKill
+		case "ax":
+			steps[step] = tiny.AxSessionStop
+		case "proxy":
+			steps[step] = tiny.ProxyRemove
+		default:
+			return nil, fmt.Errorf("unknown LEASE_CLEANUP step %s", step)
+		}
+	}
+	command := os.Getenv("LEASE_CLEANUP_COMMAND")
+	if len(steps) == 0 && command == "" {
+		return nil, nil
+	}
+	return func(lease Lease) {
+		if device, err := ios.GetDevice(lease.Udid); err == nil {
+			for name, step := range steps {
+				log.Printf("lease of %s expired, %s: %s", lease.Udid, name, step(device))
+			}
+		} else if len(steps) > 0 {
+			log.Printf("lease of %s expired, device gone: %v", lease.Udid, err)
+		}
+		if command != "" {
+			cmd := exec.Command("sh", "-c", command)
+			cmd.Env = append(os.Environ(), "UDID="+lease.Udid, "LEASE_OWNER="+lease.Owner, "LEASE_PURPOSE="+lease.Purpose)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				log.Printf("lease cleanup command for %s failed: %v: %s", lease.Udid, err, out)
+			}
+		}
+	}, nil
+}
+
+// getLease godoc
+// @Summary      Get lease
+// @Description  Returns who holds the device and until when, without the token
+// @Tags         lease
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Success      200 {object} Lease
+// @Failure      404 {string} string "not leased"
+// @Router       /{udid}/lease [get]
+func getLease(w http.ResponseWriter, r *http.Request) {
+	lease, ok := leases.Get(r.PathValue("udid"))
+	if !ok {
+		http.Error(w, "not leased", http.StatusNotFound)
+		return
+	}
+	lease.Token = ""
+	result, _ := json.Marshal(lease)
+	writeResponse(w, 200, result)
+}
+
+// acquireLease godoc
+// @Summary      Lease device
+// @Description  Leases the device to owner for ttl. While leased, calls that change the device need the returned token in
+// @Description  the X-Lease-Token header, others get 423. Posting again with the token renews the lease. The ttl can not
+// @Description  exceed LEASE_MAX_TTL, 8h if not set.
+// @Tags         lease
+// @Accept       json
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        request body LeaseRequest true "Owner, purpose and duration"
+// @Success      200 {object} Lease
+// @Failure      400 {string} string "invalid JSON, owner missing or invalid ttl"
+// @Failure      423 {object} Lease "leased by someone else"
+// @Router       /{udid}/lease [post]
+func acquireLease(w http.ResponseWriter, r *http.Request) {
+	var req LeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" {
+		req.Token = r.Header.Get(LeaseTokenHeader)
+	}
+	if req.Owner == "" && req.Token == "" {
+		http.Error(w, "owner missing", http.StatusBadRequest)
+		return
+	}
+	ttl, err := leases.TTL(req.TTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lease, ok := leases.Acquire(r.PathValue("udid"), req.Owner, req.Purpose, ttl, req.Token)
+	if !ok {
+		writeLocked(w, lease)
+		return
+	}
+	result, _ := json.Marshal(lease)
+	writeResponse(w, 200, result)
+}
+
+// releaseLease godoc
+// @Summary      Release lease
+// @Description  Ends the lease, the token has to be passed in the X-Lease-Token header. With force=1 callers with the
+// @Description  destructive scope end the lease of someone else without the token.
+// @Tags         lease
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        force  query     string  false "1 to end the lease without its token"
+// @Success      200 {object} GenericResponse
+// @Failure      403 {string} string "force needs the destructive scope"
+// @Failure      404 {string} string "not leased"
+// @Failure      423 {string} string "not the lease holder"
+// @Router       /{udid}/lease [delete]
+func releaseLease(w http.ResponseWriter, r *http.Request) {
+	udid := r.PathValue("udid")
+	if _, ok := leases.Get(udid); !ok {
+		http.Error(w, "not leased", http.StatusNotFound)
+		return
+	}
+	if r.URL.Query().Get("force") == "1" {
+		p := getPrincipal(r.Context())
+		if p != nil && p.level() < scopeLevels[ScopeDestructive] {
+			http.Error(w, "force needs the "+ScopeDestructive+" scope", http.StatusForbidden)
+			return
+		}
+		lease, ok := leases.Revoke(udid)
+		if !ok {
+			http.Error(w, "not leased", http.StatusNotFound)
+			return
+		}
+		entry := map[string]any{"type": "lease", "event": "revoked", "udid": lease.Udid, "owner": lease.Owner, "purpose": lease.Purpose}
+		if p != nil {
+			entry["principal"] = p.Name
+		}
+		auditor.Record(entry)
+		result, _ := json.Marshal(GenericResponse{OK: true})
+		writeResponse(w, 200, result)
+		return
+	}
+	if _, ok := leases.Release(udid, r.Header.Get(LeaseTokenHeader)); !ok {
+		http.Error(w, "not the lease holder", http.StatusLocked)
+		return
+	}
+	result, _ := json.Marshal(GenericResponse{OK: true})
+	writeResponse(w, 200, result)
+}
@@ -5,17 +5,22 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "embed"
 
 	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/mcinstall"
 	"github.com/danielpaulus/go-ios/ios/tiny"
 )
 
@@ -26,6 +31,8 @@ type GenericResponse struct {
 	OK bool `json:"ok"`
 }
 
+// c.der and c.p12 are the built-in supervision identity, only used when no other identity is configured
+//
 //go:embed c.der
 var cder []byte
 
@@ -42,6 +49,8 @@ type Device struct {
 	ProductType    string `json:"ProductType"`
 	ProductVersion string `json:"ProductVersion"`
 	ConnectionType string `json:"ConnectionType"`
+	// Labels are the operator labels together with the automatic ones, see GET /{udid}/labels
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type deviceCtxKey string
@@ -102,18 +111,74 @@ func writeResponse(w http.ResponseWriter, status int, data []byte) {
 	w.Write(data)
 }
 
+// routePattern returns the pattern r is routed to, searching muxes in order. Middlewares wrapping the
+// root mux cannot use r.Pattern because it is only set once the mux has routed the request.
+// Subtree patterns like "/{udid}/" only forward to a nested mux and are skipped.
+func routePattern(r *http.Request, muxes ...*http.ServeMux) string {
+	for _, mux := range muxes {
+		if _, pattern := mux.Handler(r); pattern != "" && !strings.HasSuffix(pattern, "/") {
+			return pattern
+		}
+	}
+	return ""
+}
+
 // devices godoc
 // @Summary      List devices
-// @Description  Returns a list of all connected iOS devices
+// @Description  Returns a list of all connected iOS devices with their labels. With available=1 leased devices are left
+// @Description  out, selector keeps the devices whose labels match, like ios>=17,pool=smoke.
 // @Tags         device
 // @Produce      json
+// @Param        available query string false "1 to list only devices without a lease"
+// @Param        selector query string false "Comma separated label terms: key, !key, key=value, key!=value, key>=number"
 // @Success      200 {object} DevicesResponse
+// @Failure      400 {string} string "invalid selector"
+// @Failure      500 {string} string "usbmuxd not reachable"
 // @Router       /devices [get]
-func devices(w http.ResponseWriter, _ *http.Request) {
-	devices := []byte(tiny.DeviceList())
+func devices(w http.ResponseWriter, r *http.Request) {
+	selector, err := ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	list, err := listDevices(getPrincipal(r.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	available := r.URL.Query().Get("available") == "1"
+	result := []Device{}
+	for _, device := range list {
+		if _, leased := leases.Get(device.UDID); available && leased {
+			continue
+		}
+		if selector.Matches(device.Labels) {
+			result = append(result, device)
+		}
+	}
+	devices, _ := json.Marshal(DevicesResponse{Devices: result})
 	writeResponse(w, 200, devices)
 }
 
+type UsbmuxdResponse struct {
+	Endpoints []ios.UsbmuxdEndpoint `json:"endpoints"`
+}
+
+// usbmuxd godoc
+// @Summary      List usbmuxd endpoints
+// @Description  Lists the devices of every usbmuxd endpoint in USBMUXD_SOCKET_ADDRESS and reports whether it is reachable
+// @Description  and how many devices it has. Unreachable endpoints do not hide the devices of the others.
+// @Tags         device
+// @Produce      json
+// @Success      200 {object} UsbmuxdResponse
+// @Router       /usbmuxd [get]
+func usbmuxd(w http.ResponseWriter, _ *http.Request) {
+	// listing refreshes the endpoint states, its error is in the states already
+	_, _ = ios.ListDevices()
+	result, _ := json.Marshal(UsbmuxdResponse{Endpoints: ios.UsbmuxdEndpoints()})
+	writeResponse(w, 200, result)
+}
+
 // reboot godoc
 // @Summary      Reboot device
 // @Description  Reboots the specified iOS device
@@ -170,31 +235,74 @@ func supervised(w http.ResponseWriter, r *http.Request) {
 	writeResponse(w, 200, result)
 }
 
+type SuperviseEnableRequest struct {
+	// Skip lists the setup panes to skip, all of them if omitted
+	Skip   []string `json:"skip"`
+	Org    string   `json:"org"`
+	Locale string   `json:"locale"`
+	Lang   string   `json:"lang"`
+	// Supervise defaults to true
+	Supervise *bool `json:"supervise"`
+	// B64Profiles are installed right after preparation
+	B64Profiles []string `json:"b64profiles"`
+}
+
 // superviseEnable godoc
 // @Summary      Enable supervision
-// @Description  Prepares and enables supervision on the device
+// @Description  Prepares and enables supervision on the device. The body is optional, without it all setup panes are skipped
+// @Description  and the device is supervised by the default org. The response lists the result of every preparation step.
 // @Tags         supervision
+// @Accept       json
 // @Produce      json
 // @Param        udid   path      string  true  "Device UDID"
+// @Param        org query string false "Supervision organisation, the default one if empty"
+// @Param        request body SuperviseEnableRequest false "Preparation options"
 // @Success      200 {object} GenericResponse
+// @Failure      400 {string} string "invalid JSON or unknown org"
 // @Router       /{udid}/supervise/enable [post]
 func superviseEnable(w http.ResponseWriter, r *http.Request) {
 	d, _ := getDevice(r.Context())
-	result := []byte(tiny.Prepare(d, cder, "tinyios", "en-US", "en"))
-	writeResponse(w, 200, result)
-}
 
-// erase godoc
-// @Summary      Erase device
-// @Description  Erases all content and settings from the device
-// @Tags         device
-// @Produce      json
-// @Param        udid   path      string  true  "Device UDID"
-// @Success      200 {object} GenericResponse
-// @Router       /{udid}/erase [post]
-func erase(w http.ResponseWriter, r *http.Request) {
-	d, _ := getDevice(r.Context())
-	result := []byte(tiny.Erase(d))
+	var u SuperviseEnableRequest
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil && err != io.EOF {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if u.Org == "" {
+		u.Org = r.FormValue("org")
+	}
+	identity, err := supervision.Get(u.Org)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if u.Skip != nil {
+		if err := mcinstall.ValidateSkipOptions(u.Skip); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	profiles := make([][]byte, 0, len(u.B64Profiles))
+	for i, b64 := range u.B64Profiles {
+		data, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid base64 in profile %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		profiles = append(profiles, data)
+	}
+
+	result := []byte(tiny.PrepareDevice(d, tiny.PrepareOptions{
+		Skip:        u.Skip,
+		Org:         identity.Org,
+		Locale:      u.Locale,
+		Lang:        u.Lang,
+		Supervise:   u.Supervise == nil || *u.Supervise,
+		CertDER:     identity.CertDER,
+		P12:         identity.P12,
+		P12Password: identity.P12Password,
+		Profiles:    profiles,
+	}))
 	writeResponse(w, 200, result)
 }
 
@@ -218,11 +326,120 @@ func paired(w http.ResponseWriter, r *http.Request) {
 // @Tags         pairing
 // @Produce      json
 // @Param        udid   path      string  true  "Device UDID"
+// @Param        org query string false "Supervision organisation, the default one if empty"
 // @Success      200 {object} GenericResponse
+// @Failure      400 {string} string "unknown org"
 // @Router       /{udid}/pair/enable [post]
 func pairEnable(w http.ResponseWriter, r *http.Request) {
 	d, _ := getDevice(r.Context())
-	result := []byte(tiny.PairEnable(d, p12))
+	identity, err := supervision.Get(r.FormValue("org"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result := []byte(tiny.PairEnable(d, identity.P12, identity.P12Password))
+	writeResponse(w, 200, result)
+}
+
+// pair godoc
+// @Summary      Pair device
+// @Description  Pairs an unsupervised device. The user has to accept the "Trust this computer" dialog, the returned job
+// @Description  shows the pair step as waitingForTrust until then. Supervised devices can use /pair/enable instead.
+// @Tags         pairing
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Success      202 {object} Job
+// @Router       /{udid}/pair [post]
+func pair(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	job := jobs.Start("pair", d.Properties.SerialNumber, []string{"pair"}, func(ctx context.Context, job *Job) error {
+		job.Progress("pair", tiny.StepRunning, nil)
+		err := tiny.PairWithTrustDialog(ctx, d, func() {
+			job.Progress("pair", tiny.StepWaitingForTrust, nil)
+		})
+		if err != nil {
+			job.Progress("pair", tiny.StepFailed, err)
+			return err
+		}
+		job.Progress("pair", tiny.StepDone, nil)
+		return nil
+	})
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJob(w, job)
+}
+
+// unpair godoc
+// @Summary      Unpair device
+// @Description  Removes this host from the device's trusted hosts and deletes the pair record from usbmuxd
+// @Tags         pairing
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/pair [delete]
+func unpair(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.Unpair(d))
+	writeResponse(w, 200, result)
+}
+
+// pairValidate godoc
+// @Summary      Validate pairing
+// @Description  Starts a lockdown session to check that the device still accepts the pair record
+// @Tags         pairing
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/pair/validate [get]
+func pairValidate(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.PairValidate(d))
+	writeResponse(w, 200, result)
+}
+
+// pairRecordExport godoc
+// @Summary      Export pair record
+// @Description  Returns the base64 encoded pair record plist. It contains the host's private key, treat it as a secret.
+// @Tags         pairing
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/pair/record [get]
+func pairRecordExport(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.PairRecordExport(d))
+	writeResponse(w, 200, result)
+}
+
+type PairRecordImportRequest struct {
+	B64Record string `json:"b64record"`
+}
+
+// pairRecordImport godoc
+// @Summary      Import pair record
+// @Description  Stores a pair record exported on another host and validates it
+// @Tags         pairing
+// @Accept       json
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        request body PairRecordImportRequest true "Base64 encoded pair record plist"
+// @Success      200 {object} GenericResponse
+// @Failure      400 {string} string "invalid JSON"
+// @Router       /{udid}/pair/record [put]
+func pairRecordImport(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+
+	var u PairRecordImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(u.B64Record)
+	if err != nil {
+		http.Error(w, "invalid base64 record: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := []byte(tiny.PairRecordImport(d, data))
 	writeResponse(w, 200, result)
 }
 
@@ -256,11 +473,12 @@ func devmodeEnable(w http.ResponseWriter, r *http.Request) {
 
 // image godoc
 // @Summary      Check developer disk image status
-// @Description  Returns whether the developer disk image is mounted
+// @Description  Returns whether a developer disk image is mounted, its type, whether it is personalized and the
+// @Description  signatures of the mounted images
 // @Tags         developer
 // @Produce      json
 // @Param        udid   path      string  true  "Device UDID"
-// @Success      200 {object} GenericResponse
+// @Success      200 {object} tiny.ImageState
 // @Router       /{udid}/image [get]
 func image(w http.ResponseWriter, r *http.Request) {
 	d, _ := getDevice(r.Context())
@@ -282,6 +500,20 @@ func imageEnable(w http.ResponseWriter, r *http.Request) {
 	writeResponse(w, 200, result)
 }
 
+// imageUnmount godoc
+// @Summary      Unmount developer disk image
+// @Description  Unmounts the developer disk image. Mounting a personalized image again reuses its cached signing ticket.
+// @Tags         developer
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/image/unmount [post]
+func imageUnmount(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.ImageUnmount(d))
+	writeResponse(w, 200, result)
+}
+
 // profileList godoc
 // @Summary      List profiles
 // @Description  Returns a list of configuration profiles installed on the device
@@ -300,19 +532,51 @@ type ProfileAddRequest struct {
 	B64Profile string `json:"b64profile"`
 }
 
+// profilePreview godoc
+// @Summary      Preview profile
+// @Description  Parses a configuration profile and returns its payloads without a device
+// @Tags         profiles
+// @Accept       json
+// @Produce      json
+// @Param        profile body ProfileAddRequest true "Base64 encoded profile"
+// @Success      200 {object} GenericResponse
+// @Failure      400 {string} string "invalid JSON"
+// @Router       /profiles/preview [post]
+func profilePreview(w http.ResponseWriter, r *http.Request) {
+	var u ProfileAddRequest
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(u.B64Profile)
+	if err != nil {
+		http.Error(w, "invalid base64 profile: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeResponse(w, 200, []byte(tiny.ProfilePreview(data)))
+}
+
 // profileAdd godoc
 // @Summary      Add profile
-// @Description  Installs a configuration profile on the device
+// @Description  Installs a configuration profile on the device. Supervised devices install it silently, on unsupervised
+// @Description  devices the status is userApprovalRequired until the user installs it in Settings.
 // @Tags         profiles
 // @Accept       json
 // @Produce      json
 // @Param        udid   path      string  true  "Device UDID"
 // @Param        profile body ProfileAddRequest true "Base64 encoded profile"
+// @Param        org query string false "Supervision organisation, the default one if empty"
 // @Success      200 {object} GenericResponse
 // @Failure      400 {string} string "invalid JSON"
 // @Router       /{udid}/profiles/add [post]
 func profileAdd(w http.ResponseWriter, r *http.Request) {
 	d, _ := getDevice(r.Context())
+	identity, err := supervision.Get(r.FormValue("org"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Decode JSON
 	var u ProfileAddRequest
@@ -327,7 +591,208 @@ func profileAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result := []byte(tiny.ProfileAdd(d, data, p12))
+	result := []byte(tiny.ProfileAdd(d, data, identity.P12, identity.P12Password))
+	writeResponse(w, 200, result)
+}
+
+type ProfileGenerateRequest struct {
+	mcinstall.Profile
+	// Sign signs the profile with the supervision identity
+	Sign bool `json:"sign"`
+	// Install defaults to true, false only returns the generated profile
+	Install *bool `json:"install"`
+}
+
+// profileGenerate godoc
+// @Summary      Generate profile
+// @Description  Builds a profile from Wi-Fi, certificate, restrictions, web clip and single app mode payloads
+// @Description  and installs it silently. The generated profile is returned as b64profile.
+// @Tags         profiles
+// @Accept       json
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        org query string false "Supervision organisation, the default one if empty"
+// @Param        request body ProfileGenerateRequest true "Profile description"
+// @Success      200 {object} GenericResponse
+// @Failure      400 {string} string "invalid JSON"
+// @Router       /{udid}/profiles/generate [post]
+func profileGenerate(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	identity, err := supervision.Get(r.FormValue("org"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var u ProfileGenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	install := u.Install == nil || *u.Install
+	result := []byte(tiny.ProfileGenerate(d, u.Profile, u.Sign, install, identity.P12, identity.P12Password))
+	writeResponse(w, 200, result)
+}
+
+// profileRemove godoc
+// @Summary      Remove profile
+// @Description  Removes the configuration profile with the given identifier
+// @Tags         profiles
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        identifier   path      string  true  "Profile identifier"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/profiles/{identifier} [delete]
+func profileRemove(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.ProfileRemove(d, r.PathValue("identifier")))
+	writeResponse(w, 200, result)
+}
+
+type ProxyRequest struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// proxySet godoc
+// @Summary      Set global HTTP proxy
+// @Description  Installs a profile that routes all HTTP traffic of a supervised device through the proxy
+// @Tags         profiles
+// @Accept       json
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        org query string false "Supervision organisation, the default one if empty"
+// @Param        request body ProxyRequest true "Proxy host, port and optional credentials"
+// @Success      200 {object} GenericResponse
+// @Failure      400 {string} string "invalid JSON"
+// @Router       /{udid}/proxy [put]
+func proxySet(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	identity, err := supervision.Get(r.FormValue("org"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var u ProxyRequest
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if u.Host == "" || u.Port == "" {
+		http.Error(w, "host and port are required", http.StatusBadRequest)
+		return
+	}
+	// the port ends up in an integer field of the profile
+	if _, err := strconv.Atoi(u.Port); err != nil {
+		http.Error(w, "invalid port: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := []byte(tiny.ProxySet(d, u.Host, u.Port, u.User, u.Password, identity.P12, identity.P12Password))
+	writeResponse(w, 200, result)
+}
+
+// proxyRemove godoc
+// @Summary      Remove global HTTP proxy
+// @Description  Removes the global HTTP proxy profile
+// @Tags         profiles
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/proxy [delete]
+func proxyRemove(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.ProxyRemove(d))
+	writeResponse(w, 200, result)
+}
+
+// parseDays parses durations like 7d in addition to everything time.ParseDuration understands
+func parseDays(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// provisioningProfiles godoc
+// @Summary      List provisioning profiles
+// @Description  Returns the installed provisioning profiles with team, app ID, expiry, entitlements and devices
+// @Tags         profiles
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        expiringWithin query string false "Only profiles expiring within this duration, e.g. 7d or 12h"
+// @Success      200 {object} GenericResponse
+// @Failure      400 {string} string "invalid duration"
+// @Router       /{udid}/provisioning-profiles [get]
+func provisioningProfiles(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	var within time.Duration
+	if v := r.FormValue("expiringWithin"); v != "" {
+		var err error
+		within, err = parseDays(v)
+		if err != nil || within <= 0 {
+			http.Error(w, "invalid expiringWithin: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	result := []byte(tiny.ProvisioningProfiles(d, within))
+	writeResponse(w, 200, result)
+}
+
+type ProvisioningProfileInstallRequest struct {
+	// B64Profile is the base64 encoded .mobileprovision file
+	B64Profile string `json:"b64profile"`
+}
+
+// provisioningProfileInstall godoc
+// @Summary      Install provisioning profile
+// @Description  Installs a .mobileprovision file, a profile with the same UUID is replaced
+// @Tags         profiles
+// @Accept       json
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        request body ProvisioningProfileInstallRequest true "Base64 encoded provisioning profile"
+// @Success      200 {object} GenericResponse
+// @Failure      400 {string} string "invalid JSON"
+// @Router       /{udid}/provisioning-profiles [post]
+func provisioningProfileInstall(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+
+	var u ProvisioningProfileInstallRequest
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(u.B64Profile)
+	if err != nil {
+		http.Error(w, "invalid base64 profile: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := []byte(tiny.ProvisioningProfileInstall(d, data))
+	writeResponse(w, 200, result)
+}
+
+// provisioningProfileRemove godoc
+// @Summary      Remove provisioning profile
+// @Description  Removes the provisioning profile with the given UUID
+// @Tags         profiles
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        uuid   path      string  true  "Provisioning profile UUID"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/provisioning-profiles/{uuid} [delete]
+func provisioningProfileRemove(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.ProvisioningProfileRemove(d, r.PathValue("uuid")))
 	writeResponse(w, 200, result)
 }
 
@@ -366,7 +831,7 @@ type AppInstallRequest struct {
 
 // appInstall godoc
 // @Summary      Install application
-// @Description  Installs an application from a URL on the device
+// @Description  Installs an application from a URL on the device, the IPA is kept in the artifact cache
 // @Tags         apps
 // @Accept       json
 // @Produce      json
@@ -384,7 +849,15 @@ func appInstall(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result := []byte(tiny.AppInstall(d, u.URL))
+	path, release, err := cachedArtifact(r.Context(), u.URL)
+	if err != nil {
+		log.Printf("install of %s: %v", u.URL, err)
+		result, _ := json.Marshal(GenericResponse{OK: false})
+		writeResponse(w, 200, result)
+		return
+	}
+	defer release()
+	result := []byte(tiny.AppInstall(d, path))
 	writeResponse(w, 200, result)
 }
 
@@ -445,35 +918,517 @@ func wdaKill(w http.ResponseWriter, r *http.Request) {
 	writeResponse(w, 200, result)
 }
 
-func RecoveryMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			if rec := recover(); rec != nil {
-				log.Printf("panic: %v\n%s", rec, debug.Stack())
-				http.Error(w, "internal server error", http.StatusInternalServerError)
-			}
-		}()
-		next.ServeHTTP(w, r)
-	})
+// axSessionStart godoc
+// @Summary      Start accessibility session
+// @Description  Connects to the accessibility inspector service and enables element selection
+// @Tags         accessibility
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/ax/session [post]
+func axSessionStart(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.AxSessionStart(d))
+	writeResponse(w, 200, result)
 }
 
-func main() {
-	proxyUrl := os.Getenv("HTTP_PROXY")
-	if os.Getenv("HTTPS_PROXY") != "" {
-		proxyUrl = os.Getenv("HTTPS_PROXY")
+// axSessionStop godoc
+// @Summary      Stop accessibility session
+// @Description  Turns off the accessibility inspector and closes the session
+// @Tags         accessibility
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/ax/session [delete]
+func axSessionStop(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.AxSessionStop(d))
+	writeResponse(w, 200, result)
+}
+
+// axMove godoc
+// @Summary      Move accessibility focus
+// @Description  Moves the inspector selection and returns the newly selected element
+// @Tags         accessibility
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        direction query string false "next, previous, first or last"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/ax/session/move [post]
+func axMove(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.AxMove(d, r.FormValue("direction")))
+	writeResponse(w, 200, result)
+}
+
+// axElement godoc
+// @Summary      Get selected element
+// @Description  Returns the element currently selected by the accessibility inspector
+// @Tags         accessibility
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/ax/session/element [get]
+func axElement(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.AxElement(d))
+	writeResponse(w, 200, result)
+}
+
+type AxActionRequest struct {
+	Action               string `json:"action"`
+	PlatformElementValue string `json:"platformElementValue"`
+}
+
+// axAction godoc
+// @Summary      Perform accessibility action
+// @Description  Performs an action on the given element, or the selected one if none is given
+// @Tags         accessibility
+// @Accept       json
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        request body AxActionRequest true "Action and optional element"
+// @Success      200 {object} GenericResponse
+// @Failure      400 {string} string "invalid JSON"
+// @Router       /{udid}/ax/session/action [post]
+func axAction(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+
+	var u AxActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if proxyUrl != "" {
-		parsedUrl, err := url.Parse(proxyUrl)
+	result := []byte(tiny.AxAction(d, u.Action, u.PlatformElementValue))
+	writeResponse(w, 200, result)
+}
+
+// axAudit godoc
+// @Summary      Run accessibility audit
+// @Description  Runs all accessibility audits on the device or a single app and returns the issues found
+// @Tags         accessibility
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        bundleId query string false "Application bundle identifier"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/ax/audit [get]
+func axAudit(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.AxAudit(d, r.FormValue("bundleId")))
+	writeResponse(w, 200, result)
+}
+
+func parseMetricsFilter(r *http.Request) (tiny.MetricsFilter, error) {
+	filter := tiny.MetricsFilter{BundleID: r.FormValue("bundleId")}
+	if pid := r.FormValue("pid"); pid != "" {
+		p, err := strconv.ParseUint(pid, 10, 64)
 		if err != nil {
-			log.Fatalf("could not parse proxy url %s: %v", proxyUrl, err)
+			return filter, fmt.Errorf("invalid pid: %w", err)
+		}
+		filter.Pid = p
+	}
+	return filter, nil
+}
+
+// metrics godoc
+// @Summary      Stream performance metrics
+// @Description  Streams system and per process CPU, memory, disk and thread samples as server sent events
+// @Tags         metrics
+// @Produce      text/event-stream
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        pid query int false "Only include the process with this pid"
+// @Param        bundleId query string false "Only include the process of this app"
+// @Param        interval query string false "Sample interval, e.g. 1s or 500ms (default 1s)"
+// @Success      200 {string} string "event stream"
+// @Failure      400 {string} string "invalid parameters"
+// @Router       /{udid}/metrics [get]
+func metrics(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+
+	filter, err := parseMetricsFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	interval := time.Second
+	if v := r.FormValue("interval"); v != "" {
+		interval, err = time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			http.Error(w, "invalid interval: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	err = tiny.MetricsStream(r.Context(), d, filter, interval, func(sample string) error {
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", sample); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", err.Error())
+		flusher.Flush()
+	}
+}
+
+// metricsSnapshot godoc
+// @Summary      Performance metrics snapshot
+// @Description  Returns a single sample of system and per process metrics and the network interfaces
+// @Tags         metrics
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        pid query int false "Only include the process with this pid"
+// @Param        bundleId query string false "Only include the process of this app"
+// @Success      200 {object} GenericResponse
+// @Failure      400 {string} string "invalid parameters"
+// @Router       /{udid}/metrics/snapshot [get]
+func metricsSnapshot(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+
+	filter, err := parseMetricsFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := []byte(tiny.MetricsSnapshot(d, filter))
+	writeResponse(w, 200, result)
+}
+
+// battery godoc
+// @Summary      Battery status
+// @Description  Returns battery level, charging state, temperature, cycle count, health and voltage
+// @Tags         diagnostics
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/battery [get]
+func battery(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.Battery(d))
+	writeResponse(w, 200, result)
+}
+
+// diagnosticsValues godoc
+// @Summary      Raw diagnostics
+// @Description  Returns the raw diagnostics of a domain
+// @Tags         diagnostics
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        domain query string false "All, WiFi, GasGauge, NAND or HDMI (default All)"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/diagnostics [get]
+func diagnosticsValues(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.Diagnostics(d, r.FormValue("domain")))
+	writeResponse(w, 200, result)
+}
+
+// ioregistry godoc
+// @Summary      Query IORegistry
+// @Description  Returns the IORegistry entry matching the given entry name or class
+// @Tags         diagnostics
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        name query string false "Entry name"
+// @Param        class query string false "Entry class, e.g. IOPMPowerSource"
+// @Param        plane query string false "Registry plane"
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/ioregistry [get]
+func ioregistry(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.IORegistry(d, r.FormValue("plane"), r.FormValue("name"), r.FormValue("class")))
+	writeResponse(w, 200, result)
+}
+
+// info godoc
+// @Summary      Device properties
+// @Description  Returns all lockdown values of the device, optionally of a single domain or only the given keys.
+// @Description  Keys that cannot change until the device reboots are answered from a cache.
+// @Tags         device
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        domain query string false "Lockdown domain, e.g. com.apple.disk_usage"
+// @Param        key    query []string false "Only return these keys, can be repeated" collectionFormat(multi)
+// @Success      200 {object} GenericResponse
+// @Router       /{udid}/info [get]
+func info(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+	result := []byte(tiny.Info(d, r.FormValue("domain"), r.URL.Query()["key"]))
+	writeResponse(w, 200, result)
+}
+
+type GestaltRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// gestalt godoc
+// @Summary      Query MobileGestalt
+// @Description  Returns the values of the given MobileGestalt keys
+// @Tags         device
+// @Accept       json
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        request body GestaltRequest true "MobileGestalt keys"
+// @Success      200 {object} GenericResponse
+// @Failure      400 {string} string "invalid JSON"
+// @Router       /{udid}/gestalt [post]
+func gestalt(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+
+	var u GestaltRequest
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := []byte(tiny.Gestalt(d, u.Keys))
+	writeResponse(w, 200, result)
+}
+
+type ProvisionProfile struct {
+	// Identifier is the profile's PayloadIdentifier, the profile is not installed again if it is present
+	Identifier string `json:"identifier"`
+	B64Profile string `json:"b64profile"`
+}
+
+type ProvisionApp struct {
+	// BundleID skips the install if the app is already installed
+	BundleID string `json:"bundleId"`
+	// Path is an http(s) URL fetched through the artifact cache or a path on the host
+	Path string `json:"path"`
+}
+
+type ProvisionSettings struct {
+	Locale   string `json:"locale"`
+	Lang     string `json:"lang"`
+	TimeZone string `json:"timeZone"`
+}
+
+// ProvisionRequest is the desired state of the device, steps that are not requested are left alone
+type ProvisionRequest struct {
+	Activated  bool   `json:"activated"`
+	Supervised bool   `json:"supervised"`
+	Org        string `json:"org"`
+	// Skip lists the setup panes to skip when supervising, all of them if omitted
+	Skip     []string           `json:"skip"`
+	Paired   bool               `json:"paired"`
+	DevMode  bool               `json:"devmode"`
+	Image    bool               `json:"image"`
+	Profiles []ProvisionProfile `json:"profiles"`
+	Apps     []ProvisionApp     `json:"apps"`
+	Settings ProvisionSettings  `json:"settings"`
+	Wda      bool               `json:"wda"`
+	// RestoreSnapshot fills settings that are not given from the snapshot taken before the last erase. Apps and
+	// profiles cannot be read back from a device, they are restored from apps and profiles and the ones of the
+	// snapshot that are still missing afterwards are listed in the job result.
+	RestoreSnapshot bool `json:"restoreSnapshot"`
+}
+
+// ProvisionResult is the result of a finished provision job
+type ProvisionResult struct {
+	// Unrestored lists the snapshot apps and profiles not installed after provisioning with restoreSnapshot
+	Unrestored *tiny.SnapshotItems `json:"unrestored,omitempty"`
+}
+
+// provision godoc
+// @Summary      Provision device
+// @Description  Brings the device to the requested state. Every step is checked first and only run if it is missing,
+// @Description  the steps run in the background and their progress can be followed on the returned job.
+// @Tags         provisioning
+// @Accept       json
+// @Produce      json
+// @Param        udid   path      string  true  "Device UDID"
+// @Param        request body ProvisionRequest true "Desired device state"
+// @Success      202 {object} Job
+// @Failure      400 {string} string "invalid JSON"
+// @Router       /{udid}/provision [post]
+func provision(w http.ResponseWriter, r *http.Request) {
+	d, _ := getDevice(r.Context())
+
+	var u ProvisionRequest
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	identity, err := supervision.Get(u.Org)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if u.Skip != nil {
+		if err := mcinstall.ValidateSkipOptions(u.Skip); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var snapshot tiny.EraseSnapshot
+	if u.RestoreSnapshot {
+		var ok bool
+		snapshot, ok = getEraseSnapshot(d.Properties.SerialNumber)
+		if !ok {
+			http.Error(w, "no snapshot to restore", http.StatusBadRequest)
+			return
+		}
+		if u.Settings.Locale == "" {
+			u.Settings.Locale = snapshot.Settings.Locale
+		}
+		if u.Settings.Lang == "" {
+			u.Settings.Lang = snapshot.Settings.Lang
+		}
+		if u.Settings.TimeZone == "" {
+			u.Settings.TimeZone = snapshot.Settings.TimeZone
 		}
-		http.DefaultTransport = &http.Transport{Proxy: http.ProxyURL(parsedUrl)}
 	}
 
+	spec := tiny.ProvisionSpec{
+		Activated:   u.Activated,
+		Supervised:  u.Supervised,
+		Org:         identity.Org,
+		CertDER:     identity.CertDER,
+		P12:         identity.P12,
+		P12Password: identity.P12Password,
+		Skip:        u.Skip,
+		Paired:      u.Paired,
+		DevMode:     u.DevMode,
+		Image:       u.Image,
+		Settings:    tiny.ProvisionSettings(u.Settings),
+		Wda:         u.Wda,
+	}
+	for i, p := range u.Profiles {
+		data, err := base64.StdEncoding.DecodeString(p.B64Profile)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid base64 in profile %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		spec.Profiles = append(spec.Profiles, tiny.ProvisionProfile{Identifier: p.Identifier, Data: data})
+	}
+	for _, app := range u.Apps {
+		spec.Apps = append(spec.Apps, tiny.ProvisionApp(app))
+	}
+
+	steps := tiny.ProvisionSteps(spec)
+	if slices.ContainsFunc(spec.Apps, func(app tiny.ProvisionApp) bool { return isURL(app.Path) }) {
+		steps = append([]string{"download"}, steps...)
+	}
+	job := jobs.Start("provision", d.Properties.SerialNumber, steps, func(ctx context.Context, job *Job) error {
+		release, err := provisionArtifacts(ctx, spec.Apps, job)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if err := tiny.Provision(ctx, d, spec, job.Progress); err != nil {
+			return err
+		}
+		if u.RestoreSnapshot {
+			// the devmode step reboots, which gives the device a new DeviceID
+			device, err := ios.GetDevice(d.Properties.SerialNumber)
+			if err != nil {
+				return fmt.Errorf("checking snapshot: %w", err)
+			}
+			missing, err := tiny.MissingSnapshotItems(device, snapshot)
+			if err != nil {
+				return fmt.Errorf("checking snapshot: %w", err)
+			}
+			job.SetResult(ProvisionResult{Unrestored: &missing})
+		}
+		return nil
+	})
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJob(w, job)
+}
+
+// provisionArtifacts fetches the apps given by URL through the artifact cache and points them to the cached files,
+// which are kept until release is called
+func provisionArtifacts(ctx context.Context, apps []tiny.ProvisionApp, job *Job) (func(), error) {
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for i, app := range apps {
+		if !isURL(app.Path) {
+			continue
+		}
+		job.Progress("download", tiny.StepRunning, nil)
+		path, r, err := cachedArtifact(ctx, app.Path)
+		if err != nil {
+			release()
+			err = fmt.Errorf("app %s: %w", app.Path, err)
+			job.Progress("download", tiny.StepFailed, err)
+			return nil, err
+		}
+		releases = append(releases, r)
+		apps[i].Path = path
+	}
+	if len(releases) > 0 {
+		job.Progress("download", tiny.StepDone, nil)
+	}
+	return release, nil
+}
+
+func RecoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.Printf("panic: %v\n%s", rec, debug.Stack())
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newHandler registers all routes and wraps them in the middlewares. auth may be nil, which leaves the API open.
+func newHandler(requestMetrics *RequestMetrics, deviceSampler *DeviceSampler, auth *Auth) http.Handler {
 	root := http.NewServeMux()
 	root.HandleFunc("GET /devices", devices)
+	root.HandleFunc("POST /allocate", allocate)
+	root.HandleFunc("GET /usbmuxd", usbmuxd)
+	root.HandleFunc(usbmuxSocketRoute, usbmuxSocket)
+	root.HandleFunc("GET /metrics", metricsHandler(requestMetrics, deviceSampler))
+	root.HandleFunc("GET /supervision/identities", supervisionIdentities)
+	root.HandleFunc("POST /supervision/identities", generateSupervisionIdentity)
+	root.HandleFunc("GET /jobs", listJobs)
+	root.HandleFunc("GET /jobs/{id}", getJob)
+	root.HandleFunc("DELETE /jobs/{id}", cancelJob)
+	root.HandleFunc("POST /batch", batch)
+	root.HandleFunc("POST /profiles/preview", profilePreview)
+	root.HandleFunc("GET /cache", listCache)
+	root.HandleFunc("DELETE /cache/{hash}", deleteCacheEntry)
+	root.HandleFunc("GET /images", listImages)
+	root.HandleFunc("POST /images", uploadImage)
+
+	deviceMux := newDeviceMux()
+	root.Handle("/{udid}/", deviceMiddleware(deviceMux))
 
+	var handler http.Handler = root
+	handler = RecoveryMiddleware(handler)
+	handler = leases.Middleware(handler, deviceMux, root)
+	handler = auditor.Middleware(handler, deviceMux, root)
+	if auth != nil {
+		handler = auth.Middleware(handler, deviceMux, root)
+	}
+	handler = requestMetrics.Middleware(handler, deviceMux, root)
+	return handler
+}
+
+// newDeviceMux registers the routes of a single device. The hub uses it to resolve the route patterns of requests it proxies.
+func newDeviceMux() *http.ServeMux {
 	deviceMux := http.NewServeMux()
 	deviceMux.HandleFunc("POST /{udid}/reboot", reboot)
 	deviceMux.HandleFunc("GET /{udid}/activated", activated)
@@ -481,14 +1436,28 @@ func main() {
 	deviceMux.HandleFunc("GET /{udid}/supervised", supervised)
 	deviceMux.HandleFunc("POST /{udid}/supervise/enable", superviseEnable)
 	deviceMux.HandleFunc("POST /{udid}/erase", erase)
+	deviceMux.HandleFunc("GET /{udid}/erase/snapshot", eraseSnapshot)
 	deviceMux.HandleFunc("GET /{udid}/paired", paired)
 	deviceMux.HandleFunc("POST /{udid}/pair/enable", pairEnable)
+	deviceMux.HandleFunc("POST /{udid}/pair", pair)
+	deviceMux.HandleFunc("DELETE /{udid}/pair", unpair)
+	deviceMux.HandleFunc("GET /{udid}/pair/validate", pairValidate)
+	deviceMux.HandleFunc("GET /{udid}/pair/record", pairRecordExport)
+	deviceMux.HandleFunc("PUT /{udid}/pair/record", pairRecordImport)
 	deviceMux.HandleFunc("GET /{udid}/devmode", devmode)
 	deviceMux.HandleFunc("POST /{udid}/devmode/enable", devmodeEnable)
 	deviceMux.HandleFunc("GET /{udid}/image", image)
 	deviceMux.HandleFunc("POST /{udid}/image/enable", imageEnable)
+	deviceMux.HandleFunc("POST /{udid}/image/unmount", imageUnmount)
 	deviceMux.HandleFunc("GET /{udid}/profiles/list", profileList)
 	deviceMux.HandleFunc("POST /{udid}/profiles/add", profileAdd)
+	deviceMux.HandleFunc("POST /{udid}/profiles/generate", profileGenerate)
+	deviceMux.HandleFunc("DELETE /{udid}/profiles/{identifier}", profileRemove)
+	deviceMux.HandleFunc("PUT /{udid}/proxy", proxySet)
+	deviceMux.HandleFunc("DELETE /{udid}/proxy", proxyRemove)
+	deviceMux.HandleFunc("GET /{udid}/provisioning-profiles", provisioningProfiles)
+	deviceMux.HandleFunc("POST /{udid}/provisioning-profiles", provisioningProfileInstall)
+	deviceMux.HandleFunc("DELETE /{udid}/provisioning-profiles/{uuid}", provisioningProfileRemove)
 	deviceMux.HandleFunc("GET /{udid}/apps/list", appList)
 	deviceMux.HandleFunc("POST /{udid}/apps/run", appRun)
 	deviceMux.HandleFunc("POST /{udid}/apps/install", appInstall)
@@ -496,16 +1465,147 @@ func main() {
 	deviceMux.HandleFunc("GET /{udid}/processes", processes)
 	deviceMux.HandleFunc("POST /{udid}/wda/run", wdaRun)
 	deviceMux.HandleFunc("POST /{udid}/wda/kill", wdaKill)
+	deviceMux.HandleFunc("POST /{udid}/ax/session", axSessionStart)
+	deviceMux.HandleFunc("DELETE /{udid}/ax/session", axSessionStop)
+	deviceMux.HandleFunc("POST /{udid}/ax/session/move", axMove)
+	deviceMux.HandleFunc("GET /{udid}/ax/session/element", axElement)
+	deviceMux.HandleFunc("POST /{udid}/ax/session/action", axAction)
+	deviceMux.HandleFunc("GET /{udid}/ax/audit", axAudit)
+	deviceMux.HandleFunc("GET /{udid}/metrics", metrics)
+	deviceMux.HandleFunc("GET /{udid}/metrics/snapshot", metricsSnapshot)
+	deviceMux.HandleFunc("GET /{udid}/battery", battery)
+	deviceMux.HandleFunc("GET /{udid}/diagnostics", diagnosticsValues)
+	deviceMux.HandleFunc("GET /{udid}/ioregistry", ioregistry)
+	deviceMux.HandleFunc("GET /{udid}/info", info)
+	deviceMux.HandleFunc("POST /{udid}/gestalt", gestalt)
+	deviceMux.HandleFunc("POST /{udid}/provision", provision)
+	deviceMux.HandleFunc("GET /{udid}/lease", getLease)
+	deviceMux.HandleFunc("POST /{udid}/lease", acquireLease)
+	deviceMux.HandleFunc("DELETE /{udid}/lease", releaseLease)
+	deviceMux.HandleFunc("GET /{udid}/labels", getLabels)
+	deviceMux.HandleFunc("PUT /{udid}/labels", setLabels)
+	deviceMux.HandleFunc("DELETE /{udid}/labels/{key}", deleteLabel)
+	return deviceMux
+}
 
-	root.Handle("/{udid}/", deviceMiddleware(deviceMux))
+func main() {
+	proxyUrl := os.Getenv("HTTP_PROXY")
+	if os.Getenv("HTTPS_PROXY") != "" {
+		proxyUrl = os.Getenv("HTTPS_PROXY")
+	}
 
-	var handler http.Handler = root
-	handler = RecoveryMiddleware(handler)
+	if proxyUrl != "" {
+		parsedUrl, err := url.Parse(proxyUrl)
+		if err != nil {
+			log.Fatalf("could not parse proxy url %s: %v", proxyUrl, err)
+		}
+		http.DefaultTransport = &http.Transport{Proxy: http.ProxyURL(parsedUrl)}
+	}
+
+	var err error
+	supervision, err = LoadSupervisionStore(&SupervisionIdentity{Org: "tinyios", CertDER: cder, P12: p12, P12Password: "a"})
+	if err != nil {
+		log.Fatalf("could not load supervision identities: %v", err)
+	}
+
+	metricsInterval := time.Minute
+	if v := os.Getenv("METRICS_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid METRICS_INTERVAL %s", v)
+		}
+		metricsInterval = d
+	}
+	hubMode := os.Getenv("HUB_MODE") == "true"
+	requestMetrics := NewRequestMetrics()
+	deviceSampler := NewDeviceSampler(metricsInterval)
+	stopSampler := make(chan struct{})
+	if !hubMode {
+		go deviceSampler.Run(stopSampler)
+		go leases.Run(stopSampler)
+	}
+
+	auth, err := LoadAuth()
+	if err != nil {
+		log.Fatalf("could not load auth config: %v", err)
+	}
+
+	auditor, err = NewAuditor()
+	if err != nil {
+		log.Fatalf("could not set up audit log: %v", err)
+	}
+
+	labels, err = LoadLabels()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	leases.cleanup, err = leaseCleanupFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	leases.maxTTL, err = leaseMaxTTLFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !hubMode {
+		artifacts, err = LoadArtifactCache()
+		if err != nil {
+			log.Fatalf("could not open artifact cache: %v", err)
+		}
+		imageSource = LoadImageSource(artifacts)
+		configureTSS(artifacts)
+		tiny.ImageSource = imageSource
+		if os.Getenv("ARTIFACT_CACHE_PREWARM") == "true" {
+			go prewarmImages(imageSource)
+		}
+	}
+
+	if address := os.Getenv("USBMUXD_EXPORT_ADDRESS"); address != "" {
+		listener, err := ListenUsbmuxExport(address, auth)
+		if err != nil {
+			log.Fatalf("could not start usbmuxd export: %v", err)
+		}
+		log.Printf("usbmuxd export on %s", address)
+		go usbmuxExport.Serve(listener, auth)
+	}
+
+	node, heartbeatInterval, err := heartbeatConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var handler http.Handler
+	if hubMode {
+		log.Println("Hub mode, devices are served by the nodes reporting to /nodes/heartbeat")
+		hubToken := os.Getenv("HUB_TOKEN")
+		if hubToken == "" {
+			log.Fatal("HUB_MODE needs HUB_TOKEN, nodes authenticate their heartbeats with it")
+		}
+		handler = newHubHandler(NewHub(3*heartbeatInterval, hubToken), requestMetrics, auth)
+	} else {
+		handler = newHandler(requestMetrics, deviceSampler, auth)
+		if hubURL := os.Getenv("HUB_URL"); hubURL != "" {
+			log.Printf("Reporting to hub %s as %s (%s)", hubURL, node.Name, node.URL)
+			go runHeartbeat(hubURL, node, os.Getenv("HUB_TOKEN"), heartbeatInterval, stopSampler)
+		}
+	}
 
 	server := &http.Server{
 		Addr:    ":8080",
 		Handler: handler,
 	}
+	tlsCert, tlsKey := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if clientCA := os.Getenv("TLS_CLIENT_CA_FILE"); clientCA != "" {
+		// without TLS no client certificate is ever sent and every certificate principal would be locked out
+		if tlsCert == "" || tlsKey == "" {
+			log.Fatal("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		server.TLSConfig, err = clientCertTLSConfig(clientCA)
+		if err != nil {
+			log.Fatalf("could not load TLS_CLIENT_CA_FILE: %v", err)
+		}
+	}
 
 	// Channel to listen for OS signals
 	stop := make(chan os.Signal, 1)
@@ -513,7 +1613,13 @@ func main() {
 
 	go func() {
 		log.Println("Server starting on :8080")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if tlsCert != "" {
+			err = server.ListenAndServeTLS(tlsCert, tlsKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("listen error: %v", err)
 		}
 	}()
@@ -521,6 +1627,7 @@ func main() {
 	// Wait for signal
 	<-stop
 	log.Println("Shutting down...")
+	close(stopSampler)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -0,0 +1,932 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/artifactcache"
+	"github.com/danielpaulus/go-ios/ios/imagemounter"
+	"github.com/danielpaulus/go-ios/ios/mcinstall"
+	"github.com/danielpaulus/go-ios/ios/simdevice"
+	"github.com/danielpaulus/go-ios/ios/tiny"
+)
+
+// startAPI serves the full API against a simulated usbmuxd with the devices attached and paired
+func startAPI(t *testing.T, devices ...*simdevice.Device) *httptest.Server {
+	return startAPIWithAuth(t, nil, devices...)
+}
+
+// startAPIWithAuth is startAPI with auth checking every request, nil disables authentication
+func startAPIWithAuth(t *testing.T, auth *Auth, devices ...*simdevice.Device) *httptest.Server {
+	mux, err := simdevice.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mux.Close() })
+	t.Setenv("USBMUXD_SOCKET_ADDRESS", mux.Addr())
+	for _, d := range devices {
+		mux.Attach(d, true)
+	}
+
+	supervision, err = LoadSupervisionStore(&SupervisionIdentity{Org: "tinyios", CertDER: cder, P12: p12, P12Password: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor = &Auditor{sink: &writerSink{w: io.Discard}}
+	artifacts, err = artifactcache.New(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageSource = &imagemounter.ImageSource{Dir: t.TempDir(), Offline: true, Cache: artifacts}
+	tiny.ImageSource = imageSource
+	api := httptest.NewServer(newHandler(NewRequestMetrics(), NewDeviceSampler(time.Minute), auth))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func call(t *testing.T, api *httptest.Server, method string, path string, body any, result any) int {
+	t.Helper()
+	return callWithHeader(t, api, nil, method, path, body, result)
+}
+
+func callWithHeader(t *testing.T, api *httptest.Server, header http.Header, method string, path string, body any, result any) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, api.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != nil && resp.StatusCode < 300 {
+		if err := json.Unmarshal(data, result); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, path, err, data)
+		}
+	}
+	return resp.StatusCode
+}
+
+func waitJob(t *testing.T, api *httptest.Server, job *Job) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for job.Status == JobRunning && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		call(t, api, "GET", "/jobs/"+job.ID, nil, job)
+	}
+}
+
+func TestDevicesAndState(t *testing.T) {
+	udid := "00008030-00000000000000a1"
+	api := startAPI(t, simdevice.NewDevice(udid))
+
+	var list DevicesResponse
+	if status := call(t, api, "GET", "/devices", nil, &list); status != 200 {
+		t.Fatalf("GET /devices: %d", status)
+	}
+	if len(list.Devices) != 1 || list.Devices[0].UDID != udid {
+		t.Fatalf("unexpected devices %+v", list.Devices)
+	}
+
+	var activated map[string]bool
+	call(t, api, "GET", "/"+udid+"/activated", nil, &activated)
+	if !activated["activated"] {
+		t.Error("simulated device should be activated")
+	}
+	var image tiny.ImageState
+	call(t, api, "GET", "/"+udid+"/image", nil, &image)
+	if image.Devimage || image.Type != "" || image.Personalized {
+		t.Errorf("no image should be mounted: %+v", image)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	udid := "00008030-00000000000000b1"
+	device := simdevice.NewDevice(udid)
+	api := startAPI(t, device)
+
+	var info struct {
+		OK   bool           `json:"ok"`
+		Info map[string]any `json:"info"`
+	}
+	call(t, api, "GET", "/"+udid+"/info", nil, &info)
+	if !info.OK || info.Info["ProductVersion"] != "16.7.2" {
+		t.Fatalf("unexpected info %+v", info)
+	}
+
+	// the product version is cached until the device reboots, the time zone is not
+	device.Update(func(d *simdevice.Device) {
+		d.Values["ProductVersion"] = "17.0"
+		d.Values["TimeZone"] = "Europe/Paris"
+	})
+	var keys struct {
+		Info map[string]any `json:"info"`
+	}
+	call(t, api, "GET", "/"+udid+"/info?key=ProductVersion&key=TimeZone&key=Unknown", nil, &keys)
+	want := map[string]any{"ProductVersion": "16.7.2", "TimeZone": "Europe/Paris"}
+	if !reflect.DeepEqual(keys.Info, want) {
+		t.Fatalf("got %v, want %v", keys.Info, want)
+	}
+}
+
+func TestSupervisionStore(t *testing.T) {
+	fallback := &SupervisionIdentity{Org: "tinyios", CertDER: cder, P12: p12, P12Password: "a"}
+	t.Setenv("SUPERVISION_DIR", t.TempDir())
+	store, err := LoadSupervisionStore(fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Generate("acme", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Generate("acme", "secret"); !errors.Is(err, errOrgExists) {
+		t.Fatalf("expected errOrgExists, got %v", err)
+	}
+	if _, err := store.Generate("../acme", "secret"); !errors.Is(err, errInvalidOrg) {
+		t.Fatalf("expected errInvalidOrg, got %v", err)
+	}
+	// a failed write leaves neither the identity nor a partial directory behind
+	dir := os.Getenv("SUPERVISION_DIR")
+	if err := os.WriteFile(filepath.Join(dir, "beta"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Generate("beta", "secret"); err == nil || errors.Is(err, errInvalidOrg) || errors.Is(err, errOrgExists) {
+		t.Fatalf("expected a write error, got %v", err)
+	}
+	if _, err := store.Get("beta"); err == nil {
+		t.Fatal("identity kept after a failed write")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Fatalf("unexpected files left in SUPERVISION_DIR: %v", entries)
+	}
+	os.Remove(filepath.Join(dir, "beta"))
+
+	// the built-in identity stays available next to configured ones, but is not the default
+	store, err = LoadSupervisionStore(fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orgs := store.Orgs(); !reflect.DeepEqual(orgs, []string{"acme", "tinyios"}) {
+		t.Fatalf("unexpected orgs %v", orgs)
+	}
+	if identity, _ := store.Get(""); identity.Org != "acme" {
+		t.Fatalf("default org should be acme, got %s", identity.Org)
+	}
+
+	t.Setenv("SUPERVISION_DISABLE_BUILTIN", "true")
+	store, err = LoadSupervisionStore(fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orgs := store.Orgs(); !reflect.DeepEqual(orgs, []string{"acme"}) {
+		t.Fatalf("unexpected orgs %v", orgs)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	udid := "00008030-00000000000000a2"
+	api := startAPI(t, simdevice.NewDevice(udid))
+
+	profile, err := mcinstall.BuildProfile(mcinstall.Profile{
+		Identifier: "com.example.clip",
+		Payloads:   []mcinstall.PayloadSpec{{WebClip: &mcinstall.WebClipPayload{Label: "Example", URL: "https://example.com"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var preview struct {
+		OK      bool                     `json:"ok"`
+		Preview mcinstall.ProfilePreview `json:"preview"`
+	}
+	call(t, api, "POST", "/profiles/preview", ProfileAddRequest{B64Profile: base64.StdEncoding.EncodeToString(profile)}, &preview)
+	if !preview.OK || preview.Preview.Identifier != "com.example.clip" || len(preview.Preview.Payloads) != 1 {
+		t.Fatalf("unexpected preview %+v", preview)
+	}
+
+	var added map[string]any
+	call(t, api, "POST", "/"+udid+"/profiles/add", ProfileAddRequest{B64Profile: base64.StdEncoding.EncodeToString(profile)}, &added)
+	if added["ok"] != true || added["status"] != "userApprovalRequired" {
+		t.Fatalf("unexpected add response %v", added)
+	}
+
+	var list struct {
+		Profiles []mcinstall.ProfileInfo `json:"profiles"`
+	}
+	call(t, api, "GET", "/"+udid+"/profiles/list", nil, &list)
+	if len(list.Profiles) != 1 || list.Profiles[0].Identifier != "com.example.clip" {
+		t.Fatalf("unexpected profiles %+v", list.Profiles)
+	}
+
+	call(t, api, "DELETE", "/"+udid+"/profiles/com.example.clip", nil, nil)
+	call(t, api, "GET", "/"+udid+"/profiles/list", nil, &list)
+	if len(list.Profiles) != 0 {
+		t.Fatalf("profile was not removed: %+v", list.Profiles)
+	}
+}
+
+func TestProvisionSupervised(t *testing.T) {
+	udid := "00008030-00000000000000b2"
+	api := startAPI(t, simdevice.NewDevice(udid))
+	if _, err := supervision.Generate("acme", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	var job Job
+	call(t, api, "POST", "/"+udid+"/provision", ProvisionRequest{Supervised: true}, &job)
+	waitJob(t, api, &job)
+	if job.Status != JobSucceeded || job.Steps[0].Status != tiny.StepDone {
+		t.Fatalf("unexpected job %+v", &job)
+	}
+	call(t, api, "POST", "/"+udid+"/provision", ProvisionRequest{Supervised: true}, &job)
+	waitJob(t, api, &job)
+	if job.Status != JobSucceeded || job.Steps[0].Status != tiny.StepSkipped {
+		t.Fatalf("supervising again should be skipped: %+v", &job)
+	}
+
+	// a device supervised by another org is not taken over
+	call(t, api, "POST", "/"+udid+"/provision", ProvisionRequest{Supervised: true, Org: "acme"}, &job)
+	waitJob(t, api, &job)
+	if job.Status != JobFailed || !strings.Contains(job.Error, "supervised by org 'tinyios'") {
+		t.Fatalf("unexpected job %+v", &job)
+	}
+}
+
+func TestEraseNeedsConfirmation(t *testing.T) {
+	udid := "00008030-00000000000000a3"
+	d := simdevice.NewDevice(udid)
+	api := startAPI(t, d)
+
+	var confirmation EraseConfirmationResponse
+	if status := call(t, api, "POST", "/"+udid+"/erase", nil, &confirmation); status != 200 {
+		t.Fatalf("erase without token: %d", status)
+	}
+	if confirmation.Token == "" || !strings.HasPrefix(confirmation.Serial, "SIM") {
+		t.Fatalf("unexpected confirmation %+v", confirmation)
+	}
+	if status := call(t, api, "POST", "/"+udid+"/erase", EraseRequest{Token: "wrong"}, nil); status != http.StatusConflict {
+		t.Fatalf("wrong token: %d", status)
+	}
+	// the failed attempt used up the token
+	if status := call(t, api, "POST", "/"+udid+"/erase", EraseRequest{Token: confirmation.Token}, nil); status != http.StatusConflict {
+		t.Fatalf("used token: %d", status)
+	}
+
+	call(t, api, "POST", "/"+udid+"/erase", nil, &confirmation)
+	var job Job
+	if status := call(t, api, "POST", "/"+udid+"/erase", EraseRequest{Token: confirmation.Token, Snapshot: true}, &job); status != http.StatusAccepted {
+		t.Fatalf("confirmed erase: %d", status)
+	}
+	waitJob(t, api, &job)
+	if job.Status != JobSucceeded {
+		t.Fatalf("erase job %s: %s", job.Status, job.Error)
+	}
+	result, _ := job.Result.(map[string]any)
+	if result["activationState"] != "Unactivated" {
+		t.Errorf("unexpected result %v", job.Result)
+	}
+	// the erased device no longer trusts us, so the snapshot is checked without going through the device routes
+	snapshot, ok := getEraseSnapshot(udid)
+	if !ok || snapshot.Settings.TimeZone != "Europe/Berlin" {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+}
+
+func TestProvisionSettings(t *testing.T) {
+	udid := "00008030-00000000000000b5"
+	api := startAPI(t, simdevice.NewDevice(udid))
+	provision := func(timeZone string) string {
+		var job Job
+		call(t, api, "POST", "/"+udid+"/provision", ProvisionRequest{Settings: ProvisionSettings{TimeZone: timeZone}}, &job)
+		waitJob(t, api, &job)
+		if job.Status != JobSucceeded || len(job.Steps) != 1 {
+			t.Fatalf("unexpected provision job %+v", &job)
+		}
+		return job.Steps[0].Status
+	}
+	if status := provision("Europe/Paris"); status != tiny.StepDone {
+		t.Fatalf("new time zone: %s", status)
+	}
+	if status := provision("Europe/Paris"); status != tiny.StepSkipped {
+		t.Fatalf("time zone already set: %s", status)
+	}
+}
+
+func TestProvisionAppFromURL(t *testing.T) {
+	udid := "00008030-00000000000000b4"
+	d := simdevice.NewDevice(udid)
+	d.Apps = append(d.Apps, map[string]any{"CFBundleIdentifier": "com.example.app", "ApplicationType": "User"})
+	api := startAPI(t, d)
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ipa"))
+	}))
+	defer files.Close()
+
+	var job Job
+	call(t, api, "POST", "/"+udid+"/provision", ProvisionRequest{
+		Apps: []ProvisionApp{{BundleID: "com.example.app", Path: files.URL + "/provision.ipa"}},
+	}, &job)
+	waitJob(t, api, &job)
+	if job.Status != JobSucceeded || len(job.Steps) != 2 || job.Steps[0].Name != "download" || job.Steps[0].Status != "done" {
+		t.Fatalf("unexpected provision job %+v", &job)
+	}
+	entry, ok := artifacts.Lookup(files.URL + "/provision.ipa")
+	if !ok {
+		t.Fatal("app was not fetched through the artifact cache")
+	}
+	// the job released the file
+	if err := artifacts.Delete(entry.Hash); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProvisionRestoreSnapshot(t *testing.T) {
+	udid := "00008030-00000000000000b3"
+	api := startAPI(t, simdevice.NewDevice(udid))
+	eraseState.Lock()
+	eraseState.snapshots[udid] = tiny.EraseSnapshot{
+		Taken:    time.Now(),
+		Apps:     []tiny.SnapshotApp{{BundleID: "com.example.app"}},
+		Profiles: []tiny.SnapshotProfile{{Identifier: "com.example.clip"}, {Identifier: "com.example.wifi"}},
+		Settings: tiny.ProvisionSettings{TimeZone: "Europe/Paris"},
+	}
+	eraseState.Unlock()
+	t.Cleanup(func() {
+		eraseState.Lock()
+		delete(eraseState.snapshots, udid)
+		eraseState.Unlock()
+	})
+
+	profile, err := mcinstall.BuildProfile(mcinstall.Profile{
+		Identifier: "com.example.clip",
+		Payloads:   []mcinstall.PayloadSpec{{WebClip: &mcinstall.WebClipPayload{Label: "Example", URL: "https://example.com"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job Job
+	call(t, api, "POST", "/"+udid+"/provision", ProvisionRequest{
+		RestoreSnapshot: true,
+		Profiles:        []ProvisionProfile{{Identifier: "com.example.clip", B64Profile: base64.StdEncoding.EncodeToString(profile)}},
+	}, &job)
+	waitJob(t, api, &job)
+	if job.Status != JobSucceeded {
+		t.Fatalf("provision job %s: %s", job.Status, job.Error)
+	}
+	data, _ := json.Marshal(job.Result)
+	var result ProvisionResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	want := &tiny.SnapshotItems{
+		Apps:     []tiny.SnapshotApp{{BundleID: "com.example.app"}},
+		Profiles: []tiny.SnapshotProfile{{Identifier: "com.example.wifi"}},
+	}
+	if !reflect.DeepEqual(result.Unrestored, want) {
+		t.Fatalf("unexpected result %s", data)
+	}
+}
+
+func TestUsbmuxExport(t *testing.T) {
+	udid := "00008030-00000000000000a4"
+	startAPI(t, simdevice.NewDevice(udid))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go usbmuxExport.Serve(listener, nil)
+
+	dial := func() *ios.UsbMuxConnection {
+		deviceConn, err := ios.NewDeviceConnection("tcp://" + listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ios.NewUsbMuxConnection(deviceConn)
+	}
+	muxConn := dial()
+	list, err := muxConn.ListDevices()
+	muxConn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.DeviceList) != 1 || list.DeviceList[0].Properties.SerialNumber != udid {
+		t.Fatalf("unexpected devices %+v", list.DeviceList)
+	}
+
+	muxConn = dial()
+	record, err := muxConn.ReadPair(udid)
+	muxConn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	muxConn = dial()
+	lockdown, err := muxConn.ConnectLockdown(list.DeviceList[0].DeviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lockdown.Close()
+	if _, err := lockdown.StartSession(record); err != nil {
+		t.Fatal(err)
+	}
+	version, err := lockdown.GetValue("ProductVersion")
+	if err != nil || version != "16.7.2" {
+		t.Fatalf("unexpected ProductVersion %v: %v", version, err)
+	}
+
+	// the export has no way to pass a lease token, leased devices are hidden and refuse connections
+	lease, _ := leases.Acquire(udid, "ci", "", time.Minute, "")
+	defer leases.Release(udid, lease.Token)
+	muxConn = dial()
+	leased, err := muxConn.ListDevices()
+	muxConn.Close()
+	if err != nil || len(leased.DeviceList) != 0 {
+		t.Fatalf("leased device is listed: %+v %v", leased.DeviceList, err)
+	}
+	muxConn = dial()
+	defer muxConn.Close()
+	if _, err := muxConn.ConnectLockdown(list.DeviceList[0].DeviceID); err == nil {
+		t.Fatal("connected to a device leased by someone else")
+	}
+}
+
+func TestUsbmuxExportNeedsTLS(t *testing.T) {
+	auth := &Auth{authenticators: []Authenticator{&clientCertAuthenticator{}}}
+	for _, missing := range []string{"TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_CLIENT_CA_FILE"} {
+		for _, name := range []string{"TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_CLIENT_CA_FILE"} {
+			t.Setenv(name, "/does/not/matter")
+		}
+		t.Setenv(missing, "")
+		if _, err := ListenUsbmuxExport("127.0.0.1:0", auth); err == nil || !strings.Contains(err.Error(), "needs TLS_CERT_FILE") {
+			t.Errorf("without %s: got %v", missing, err)
+		}
+	}
+}
+
+func TestHub(t *testing.T) {
+	udid := "00008030-00000000000000a5"
+	d := simdevice.NewDevice(udid)
+	d.Apps = append(d.Apps, map[string]any{"CFBundleIdentifier": "com.example.app", "ApplicationType": "User"})
+	node := startAPI(t, d)
+	hub := NewHub(time.Minute, "hub-secret")
+	hubAPI := httptest.NewServer(newHubHandler(hub, NewRequestMetrics(), nil))
+	defer hubAPI.Close()
+
+	stop := make(chan struct{})
+	go runHeartbeat(hubAPI.URL, NodeHeartbeat{Name: "node-a", URL: node.URL}, "hub-secret", time.Hour, stop)
+	defer close(stop)
+	var list HubDevicesResponse
+	deadline := time.Now().Add(5 * time.Second)
+	for len(list.Devices) == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		call(t, hubAPI, "GET", "/devices", nil, &list)
+	}
+	if len(list.Devices) != 1 || list.Devices[0].UDID != udid || list.Devices[0].Node != "node-a" || !list.Devices[0].Available {
+		t.Fatalf("unexpected devices %+v", list.Devices)
+	}
+
+	// heartbeats need HUB_TOKEN, and a live node keeps its devices
+	forged := NodeHeartbeat{Name: "node-b", URL: "http://attacker.example.com", Devices: []Device{{UDID: udid}}}
+	for token, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "hub-secret": http.StatusConflict} {
+		header := http.Header{}
+		if token != "" {
+			header.Set("Authorization", "Bearer "+token)
+		}
+		if status := callWithHeader(t, hubAPI, header, "POST", "/nodes/heartbeat", forged, nil); status != want {
+			t.Errorf("heartbeat with token %q: got %d, want %d", token, status, want)
+		}
+	}
+	call(t, hubAPI, "GET", "/devices", nil, &list)
+	if len(list.Devices) != 1 || list.Devices[0].Node != "node-a" {
+		t.Fatalf("device was taken over: %+v", list.Devices)
+	}
+
+	var activated map[string]bool
+	if status := call(t, hubAPI, "GET", "/"+udid+"/activated", nil, &activated); status != 200 || !activated["activated"] {
+		t.Fatalf("proxied request: %d %v", status, activated)
+	}
+	if status := call(t, hubAPI, "GET", "/00008030-unknown/activated", nil, nil); status != http.StatusNotFound {
+		t.Fatalf("unknown device: %d", status)
+	}
+
+	var job Job
+	if status := call(t, hubAPI, "POST", "/batch", BatchRequest{Operation: "uninstall", Selector: "ios=16", BundleID: "com.example.app"}, &job); status != http.StatusAccepted {
+		t.Fatalf("hub batch: %d", status)
+	}
+	waitJob(t, hubAPI, &job)
+	if job.Status != JobSucceeded || len(job.Steps) != 1 || job.Steps[0].Status != "done" {
+		t.Fatalf("unexpected hub batch job %+v", &job)
+	}
+
+	hub.timeout = 0
+	if status := call(t, hubAPI, "GET", "/"+udid+"/activated", nil, nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("device of a silent node: %d", status)
+	}
+	call(t, hubAPI, "GET", "/devices", nil, &list)
+	if len(list.Devices) != 1 || list.Devices[0].Available {
+		t.Fatalf("device of a silent node should be unavailable: %+v", list.Devices)
+	}
+}
+
+func TestHubHeartbeatWithAuth(t *testing.T) {
+	auditor = &Auditor{sink: &writerSink{w: io.Discard}}
+	auth := &Auth{authenticators: []Authenticator{&tokenAuthenticator{hashes: map[[32]byte]TokenConfig{
+		sha256.Sum256([]byte("reader")): {Name: "reader", Scopes: []string{ScopeRead}},
+	}}}}
+	hubAPI := httptest.NewServer(newHubHandler(NewHub(time.Minute, "hub-secret"), NewRequestMetrics(), auth))
+	defer hubAPI.Close()
+
+	heartbeat := NodeHeartbeat{Name: "node-a", URL: "http://node-a:8080", Devices: []Device{}}
+	if status := callWithHeader(t, hubAPI, http.Header{"Authorization": {"Bearer hub-secret"}}, "POST", "/nodes/heartbeat", heartbeat, nil); status != 200 {
+		t.Fatalf("heartbeat with hub token: %d", status)
+	}
+	// client tokens do not work for heartbeats and the hub token does not work for the API
+	if status := callWithHeader(t, hubAPI, http.Header{"Authorization": {"Bearer reader"}}, "POST", "/nodes/heartbeat", heartbeat, nil); status != http.StatusUnauthorized {
+		t.Fatalf("heartbeat with client token: %d", status)
+	}
+	if status := callWithHeader(t, hubAPI, http.Header{"Authorization": {"Bearer hub-secret"}}, "GET", "/nodes", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("API with hub token: %d", status)
+	}
+}
+
+func TestHubJobVisibility(t *testing.T) {
+	auditor = &Auditor{sink: &writerSink{w: io.Discard}}
+	allowed := "00008030-00000000000000c3"
+	other := "00008030-00000000000000c4"
+	// the node trusts HUB_TOKEN and shows every job
+	nodeJobs := map[string]*Job{
+		"mine":  {ID: "mine", Kind: "erase", Udid: allowed, Status: JobRunning},
+		"other": {ID: "other", Kind: "batch", Udids: []string{allowed, other}, Status: JobRunning},
+	}
+	var cancelled []string
+	var mu sync.Mutex
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		job, ok := nodeJobs[strings.TrimPrefix(r.URL.Path, "/jobs/")]
+		if !ok || r.Header.Get("Authorization") != "Bearer hub-secret" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			mu.Lock()
+			cancelled = append(cancelled, job.ID)
+			mu.Unlock()
+		}
+		writeJob(w, job)
+	}))
+	defer node.Close()
+
+	auth := &Auth{authenticators: []Authenticator{&tokenAuthenticator{hashes: map[[32]byte]TokenConfig{
+		sha256.Sum256([]byte("limited")): {Name: "limited", Scopes: []string{ScopeWrite}, Udids: []string{allowed}},
+	}}}}
+	hubAPI := httptest.NewServer(newHubHandler(NewHub(time.Minute, "hub-secret"), NewRequestMetrics(), auth))
+	defer hubAPI.Close()
+	heartbeat := NodeHeartbeat{Name: "node-a", URL: node.URL, Devices: []Device{}}
+	if status := callWithHeader(t, hubAPI, http.Header{"Authorization": {"Bearer hub-secret"}}, "POST", "/nodes/heartbeat", heartbeat, nil); status != 200 {
+		t.Fatalf("heartbeat: %d", status)
+	}
+
+	limited := http.Header{"Authorization": {"Bearer limited"}}
+	tests := []struct {
+		method string
+		id     string
+		want   int
+	}{
+		{"GET", "mine", http.StatusAccepted},
+		{"GET", "other", http.StatusNotFound},
+		{"DELETE", "other", http.StatusNotFound},
+		{"DELETE", "mine", http.StatusAccepted},
+		{"GET", "unknown", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if status := callWithHeader(t, hubAPI, limited, tt.method, "/jobs/"+tt.id, nil, nil); status != tt.want {
+			t.Errorf("%s %s: got %d, want %d", tt.method, tt.id, status, tt.want)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(cancelled, []string{"mine"}) {
+		t.Fatalf("unexpected cancelled jobs %v", cancelled)
+	}
+}
+
+func TestHubBatchScopes(t *testing.T) {
+	auditor = &Auditor{sink: &writerSink{w: io.Discard}}
+	auth := &Auth{authenticators: []Authenticator{&tokenAuthenticator{hashes: map[[32]byte]TokenConfig{
+		sha256.Sum256([]byte("writer")): {Name: "writer", Scopes: []string{ScopeWrite}},
+	}}}}
+	hubAPI := httptest.NewServer(newHubHandler(NewHub(time.Minute, "hub-secret"), NewRequestMetrics(), auth))
+	defer hubAPI.Close()
+	writer := http.Header{"Authorization": {"Bearer writer"}}
+
+	profileAdd := BatchRequest{Operation: "profileAdd", Selector: "ios=16", B64Profile: "cHJvZmlsZQ=="}
+	if status := callWithHeader(t, hubAPI, writer, "POST", "/batch", profileAdd, nil); status != http.StatusForbidden {
+		t.Fatalf("destructive operation with write scope: %d", status)
+	}
+	if status := callWithHeader(t, hubAPI, writer, "POST", "/batch", BatchRequest{Operation: "uninstall", Selector: "ios=16"}, nil); status != http.StatusBadRequest {
+		t.Fatalf("uninstall without bundleId: %d", status)
+	}
+}
+
+func TestLease(t *testing.T) {
+	udid := "00008030-00000000000000a6"
+	api := startAPI(t, simdevice.NewDevice(udid))
+
+	var lease Lease
+	if status := call(t, api, "POST", "/"+udid+"/lease", LeaseRequest{Owner: "ci", Purpose: "ui tests", TTL: "1h"}, &lease); status != 200 || lease.Token == "" {
+		t.Fatalf("lease: %d %+v", status, lease)
+	}
+	if status := call(t, api, "POST", "/"+udid+"/lease", LeaseRequest{Owner: "someone"}, nil); status != http.StatusLocked {
+		t.Fatalf("second lease: %d", status)
+	}
+	if status := call(t, api, "POST", "/"+udid+"/lease", LeaseRequest{Owner: "someone", TTL: "9h"}, nil); status != http.StatusBadRequest {
+		t.Fatalf("lease longer than the maximum: %d", status)
+	}
+	if status := call(t, api, "POST", "/"+udid+"/erase", nil, nil); status != http.StatusLocked {
+		t.Fatalf("erase without lease token: %d", status)
+	}
+	holder := http.Header{LeaseTokenHeader: {lease.Token}}
+	if status := callWithHeader(t, api, holder, "POST", "/"+udid+"/erase", nil, nil); status != 200 {
+		t.Fatalf("erase with lease token: %d", status)
+	}
+	var list DevicesResponse
+	call(t, api, "GET", "/devices?available=1", nil, &list)
+	if len(list.Devices) != 0 {
+		t.Fatalf("leased device listed as available: %+v", list.Devices)
+	}
+
+	var renewed Lease
+	callWithHeader(t, api, holder, "POST", "/"+udid+"/lease", LeaseRequest{TTL: "2h"}, &renewed)
+	if !renewed.Expires.After(lease.Expires) || renewed.Owner != "ci" {
+		t.Fatalf("renewal: %+v", renewed)
+	}
+	if status := call(t, api, "DELETE", "/"+udid+"/lease", nil, nil); status != http.StatusLocked {
+		t.Fatalf("release without token: %d", status)
+	}
+	if status := callWithHeader(t, api, holder, "DELETE", "/"+udid+"/lease", nil, nil); status != 200 {
+		t.Fatalf("release: %d", status)
+	}
+	call(t, api, "GET", "/devices?available=1", nil, &list)
+	if len(list.Devices) != 1 {
+		t.Fatalf("released device not available: %+v", list.Devices)
+	}
+
+	call(t, api, "POST", "/"+udid+"/lease", LeaseRequest{Owner: "ci"}, nil)
+	if status := call(t, api, "DELETE", "/"+udid+"/lease?force=1", nil, nil); status != 200 {
+		t.Fatalf("forced release: %d", status)
+	}
+	if _, ok := leases.Get(udid); ok {
+		t.Fatal("lease still active after forced release")
+	}
+
+	cleaned := make(chan Lease, 1)
+	leases.cleanup = func(lease Lease) { cleaned <- lease }
+	defer func() { leases.cleanup = nil }()
+	call(t, api, "POST", "/"+udid+"/lease", LeaseRequest{Owner: "ci", TTL: "1ms"}, nil)
+	time.Sleep(5 * time.Millisecond)
+	leases.expire()
+	select {
+	case lease := <-cleaned:
+		if lease.Udid != udid || lease.Owner != "ci" {
+			t.Fatalf("unexpected cleanup %+v", lease)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cleanup hook did not run for the expired lease")
+	}
+}
+
+func TestLeaseForcedRelease(t *testing.T) {
+	udid := "00008030-00000000000000a9"
+	auth := &Auth{authenticators: []Authenticator{&tokenAuthenticator{hashes: map[[32]byte]TokenConfig{
+		sha256.Sum256([]byte("writer")): {Name: "writer", Scopes: []string{ScopeWrite}},
+		sha256.Sum256([]byte("admin")):  {Name: "admin", Scopes: []string{ScopeDestructive}},
+	}}}}
+	api := startAPIWithAuth(t, auth, simdevice.NewDevice(udid))
+	writer := http.Header{"Authorization": {"Bearer writer"}}
+	admin := http.Header{"Authorization": {"Bearer admin"}}
+
+	if status := callWithHeader(t, api, writer, "POST", "/"+udid+"/lease", LeaseRequest{Owner: "ci"}, nil); status != 200 {
+		t.Fatalf("lease: %d", status)
+	}
+	if status := callWithHeader(t, api, writer, "DELETE", "/"+udid+"/lease?force=1", nil, nil); status != http.StatusForbidden {
+		t.Fatalf("forced release with write scope: %d", status)
+	}
+	if status := callWithHeader(t, api, admin, "DELETE", "/"+udid+"/lease", nil, nil); status != http.StatusLocked {
+		t.Fatalf("release without token or force: %d", status)
+	}
+	if status := callWithHeader(t, api, admin, "DELETE", "/"+udid+"/lease?force=1", nil, nil); status != 200 {
+		t.Fatalf("forced release with destructive scope: %d", status)
+	}
+	if _, ok := leases.Get(udid); ok {
+		t.Fatal("lease still active after forced release")
+	}
+}
+
+func TestLabelsAndAllocate(t *testing.T) {
+	udid := "00008030-00000000000000a7"
+	api := startAPI(t, simdevice.NewDevice(udid))
+	t.Setenv("LABELS_FILE", filepath.Join(t.TempDir(), "labels.yaml"))
+	previous := labels
+	t.Cleanup(func() { labels = previous })
+	var err error
+	labels, err = LoadLabels()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := call(t, api, "PUT", "/"+udid+"/labels", LabelsResponse{Labels: map[string]string{"ios": "99"}}, nil); status != http.StatusBadRequest {
+		t.Fatalf("setting an automatic label: %d", status)
+	}
+	call(t, api, "PUT", "/"+udid+"/labels", LabelsResponse{Labels: map[string]string{"pool": "smoke", "owner": "team-a"}}, nil)
+	reloaded, err := LoadLabels()
+	if err != nil || reloaded.labels[udid]["pool"] != "smoke" {
+		t.Fatalf("labels were not saved: %v %v", reloaded, err)
+	}
+
+	var list DevicesResponse
+	call(t, api, "GET", "/devices?selector=ios>=16,pool=smoke,!carrier", nil, &list)
+	if len(list.Devices) != 1 || list.Devices[0].Labels["model"] != "iPhone12,1" || list.Devices[0].Labels["owner"] != "team-a" {
+		t.Fatalf("unexpected devices %+v", list.Devices)
+	}
+	call(t, api, "GET", "/devices?selector=ios>=17", nil, &list)
+	if len(list.Devices) != 0 {
+		t.Fatalf("iOS 16 device matched ios>=17: %+v", list.Devices)
+	}
+	if status := call(t, api, "GET", "/devices?selector=ios>=seventeen", nil, nil); status != http.StatusBadRequest {
+		t.Fatalf("invalid selector: %d", status)
+	}
+
+	var allocated AllocateResponse
+	req := AllocateRequest{Selector: "pool=smoke", Lease: &LeaseRequest{Owner: "ci"}}
+	if status := call(t, api, "POST", "/allocate", req, &allocated); status != 200 || allocated.Device.UDID != udid || allocated.Lease == nil {
+		t.Fatalf("allocate: %d %+v", status, allocated)
+	}
+	if status := call(t, api, "POST", "/allocate", req, nil); status != http.StatusNotFound {
+		t.Fatalf("allocating a leased device: %d", status)
+	}
+	leases.Release(udid, allocated.Lease.Token)
+}
+
+func TestBatch(t *testing.T) {
+	var devices []*simdevice.Device
+	var udids []string
+	for _, udid := range []string{"00008030-00000000000000a8", "00008030-00000000000000a9"} {
+		d := simdevice.NewDevice(udid)
+		d.Apps = append(d.Apps, map[string]any{"CFBundleIdentifier": "com.example.app", "ApplicationType": "User"})
+		devices = append(devices, d)
+		udids = append(udids, udid)
+	}
+	api := startAPI(t, devices...)
+
+	if status := call(t, api, "POST", "/batch", BatchRequest{Operation: "format", Udids: udids}, nil); status != http.StatusBadRequest {
+		t.Fatalf("unknown operation: %d", status)
+	}
+	var lease Lease
+	call(t, api, "POST", "/"+udids[1]+"/lease", LeaseRequest{Owner: "someone"}, &lease)
+	defer leases.Release(udids[1], lease.Token)
+
+	var job Job
+	if status := call(t, api, "POST", "/batch", BatchRequest{Operation: "uninstall", Udids: udids, BundleID: "com.example.app"}, &job); status != http.StatusAccepted {
+		t.Fatalf("batch: %d", status)
+	}
+	waitJob(t, api, &job)
+	if job.Status != JobFailed || job.Error != "1 of 2 devices failed" || len(job.Steps) != 2 {
+		t.Fatalf("unexpected job %+v", &job)
+	}
+	var results []BatchDeviceResult
+	data, _ := json.Marshal(job.Result)
+	json.Unmarshal(data, &results)
+	if len(results) != 2 || !results[0].OK || results[1].OK || results[1].Error != "leased by someone" {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	for i, want := range []int{0, 1} {
+		var apps struct {
+			Apps []any `json:"apps"`
+		}
+		call(t, api, "GET", "/"+udids[i]+"/apps/list", nil, &apps)
+		if len(apps.Apps) != want {
+			t.Errorf("%s has %d apps, want %d", udids[i], len(apps.Apps), want)
+		}
+	}
+}
+
+func TestArtifactCache(t *testing.T) {
+	api := startAPI(t)
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ipa"))
+	}))
+	defer files.Close()
+
+	path, release, err := cachedArtifact(context.Background(), files.URL+"/app.ipa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "ipa" {
+		t.Fatalf("unexpected cached file %q: %v", data, err)
+	}
+	var cache CacheResponse
+	call(t, api, "GET", "/cache", nil, &cache)
+	if len(cache.Entries) != 1 || cache.Size != 3 || cache.Entries[0].Sources[0] != files.URL+"/app.ipa" {
+		t.Fatalf("unexpected cache %+v", cache)
+	}
+	if status := call(t, api, "DELETE", "/cache/"+cache.Entries[0].Hash, nil, nil); status != http.StatusConflict {
+		t.Fatalf("delete while in use: %d", status)
+	}
+	release()
+	if status := call(t, api, "DELETE", "/cache/"+cache.Entries[0].Hash, nil, nil); status != http.StatusOK {
+		t.Fatalf("delete: %d", status)
+	}
+	if status := call(t, api, "DELETE", "/cache/"+cache.Entries[0].Hash, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("second delete: %d", status)
+	}
+	call(t, api, "GET", "/cache", nil, &cache)
+	if len(cache.Entries) != 0 {
+		t.Fatalf("cache not empty: %+v", cache)
+	}
+}
+
+func TestImages(t *testing.T) {
+	udid := "00008030-000000000000000A"
+	api := startAPI(t, simdevice.NewDevice(udid))
+
+	var enable struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	call(t, api, "POST", "/"+udid+"/image/enable", nil, &enable)
+	if enable.OK || enable.Error != "no image available for iOS 16.7" {
+		t.Fatalf("unexpected enable without image %+v", enable)
+	}
+
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	for _, name := range []string{"DeveloperDiskImage.dmg", "DeveloperDiskImage.dmg.signature"} {
+		f, _ := w.Create(name)
+		f.Write([]byte(name))
+	}
+	w.Close()
+	resp, err := http.Post(api.URL+"/images?version=16.4", "application/zip", &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: %d", resp.StatusCode)
+	}
+	var images ImagesResponse
+	call(t, api, "GET", "/images", nil, &images)
+	if !images.Offline || len(images.Images) != 1 || images.Images[0].Version != "16.4" {
+		t.Fatalf("unexpected images %+v", images)
+	}
+
+	call(t, api, "POST", "/"+udid+"/image/enable", nil, &enable)
+	if !enable.OK {
+		t.Fatalf("enable failed: %s", enable.Error)
+	}
+	var image tiny.ImageState
+	call(t, api, "GET", "/"+udid+"/image", nil, &image)
+	if !image.Devimage || image.Type != "Developer" || image.Personalized || len(image.Signatures) != 1 {
+		t.Fatalf("unexpected image state %+v", image)
+	}
+
+	call(t, api, "POST", "/"+udid+"/image/unmount", nil, &enable)
+	if !enable.OK {
+		t.Fatalf("unmount failed: %s", enable.Error)
+	}
+	var unmounted tiny.ImageState
+	call(t, api, "GET", "/"+udid+"/image", nil, &unmounted)
+	if unmounted.Devimage || unmounted.Type != "" || unmounted.Personalized || len(unmounted.Signatures) != 0 {
+		t.Fatalf("image still mounted %+v", unmounted)
+	}
+}
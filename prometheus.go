@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/tiny"
+)
+
+// latencyBuckets are the upper bounds in seconds of the request duration histogram.
+// Device operations range from a lockdown query to an IPA install, hence the wide spread.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+type requestKey struct {
+	method string
+	route  string
+}
+
+type requestStats struct {
+	codes   map[int]uint64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// RequestMetrics counts requests, status codes and latencies per route.
+type RequestMetrics struct {
+	mu    sync.Mutex
+	stats map[requestKey]*requestStats
+}
+
+func NewRequestMetrics() *RequestMetrics {
+	return &RequestMetrics{stats: map[requestKey]*requestStats{}}
+}
+
+func (m *RequestMetrics) observe(method, route string, code int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := requestKey{method, route}
+	s, ok := m.stats[key]
+	if !ok {
+		s = &requestStats{codes: map[int]uint64{}, buckets: make([]uint64, len(latencyBuckets))}
+		m.stats[key] = s
+	}
+	s.codes[code]++
+	seconds := duration.Seconds()
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			s.buckets[i]++
+		}
+	}
+	s.sum += seconds
+	s.count++
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Middleware records every request. Routes are labelled with the pattern they are registered
+// with, so /{udid}/reboot is one series for all devices. muxes are searched in order for the pattern.
+func (m *RequestMetrics) Middleware(next http.Handler, muxes ...*http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := "unmatched"
+		if pattern := routePattern(r, muxes...); pattern != "" {
+			// patterns are registered as "METHOD /path", the method is a label of its own
+			if i := strings.IndexByte(pattern, ' '); i >= 0 {
+				pattern = pattern[i+1:]
+			}
+			route = pattern
+		}
+		m.observe(r.Method, route, rec.status, time.Since(start))
+	})
+}
+
+func (m *RequestMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.stats))
+	for k := range m.stats {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route == keys[j].route {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].route < keys[j].route
+	})
+
+	fmt.Fprintln(w, "# HELP tinyios_http_requests_total Number of HTTP requests by route and status code.")
+	fmt.Fprintln(w, "# TYPE tinyios_http_requests_total counter")
+	for _, k := range keys {
+		s := m.stats[k]
+		codes := make([]int, 0, len(s.codes))
+		for code := range s.codes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(w, "tinyios_http_requests_total{method=%q,route=%q,code=\"%d\"} %d\n", k.method, k.route, code, s.codes[code])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP tinyios_http_request_duration_seconds Latency of HTTP requests by route.")
+	fmt.Fprintln(w, "# TYPE tinyios_http_request_duration_seconds histogram")
+	for _, k := range keys {
+		s := m.stats[k]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "tinyios_http_request_duration_seconds_bucket{method=%q,route=%q,le=%q} %d\n", k.method, k.route, formatFloat(le), s.buckets[i])
+		}
+		fmt.Fprintf(w, "tinyios_http_request_duration_seconds_bucket{method=%q,route=%q,le=\"+Inf\"} %d\n", k.method, k.route, s.count)
+		fmt.Fprintf(w, "tinyios_http_request_duration_seconds_sum{method=%q,route=%q} %s\n", k.method, k.route, formatFloat(s.sum))
+		fmt.Fprintf(w, "tinyios_http_request_duration_seconds_count{method=%q,route=%q} %d\n", k.method, k.route, s.count)
+	}
+}
+
+// deviceGauges is the last sampled state of a device, nil values could not be read.
+type deviceGauges struct {
+	connected    bool
+	paired       *bool
+	activated    *bool
+	supervised   *bool
+	devmode      *bool
+	imageMounted *bool
+	batteryLevel *int
+	freeBytes    *uint64
+}
+
+// DeviceSampler periodically reads the state of all connected devices so
+// that scrapes are answered from memory and never talk to a device.
+type DeviceSampler struct {
+	interval time.Duration
+	mu       sync.Mutex
+	devices  map[string]deviceGauges
+	sampled  time.Time
+}
+
+func NewDeviceSampler(interval time.Duration) *DeviceSampler {
+	return &DeviceSampler{interval: interval, devices: map[string]deviceGauges{}}
+}
+
+// Run samples all devices every interval until stop is closed.
+func (s *DeviceSampler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.sample()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func boolPtr(b bool, err error) *bool {
+	if err != nil {
+		return nil
+	}
+	return &b
+}
+
+func (s *DeviceSampler) sample() {
+	list, err := ios.ListDevices()
+	if err != nil {
+		log.Printf("metrics: failed listing devices: %v", err)
+		return
+	}
+
+	sampled := map[string]deviceGauges{}
+	for _, device := range list.DeviceList {
+		udid := device.Properties.SerialNumber
+		g := deviceGauges{connected: true}
+		g.paired = boolPtr(tiny.IsPaired(device))
+		g.activated = boolPtr(tiny.IsActivated(device))
+		g.supervised = boolPtr(tiny.IsSupervised(device))
+		g.devmode = boolPtr(tiny.IsDevModeEnabled(device))
+		g.imageMounted = boolPtr(tiny.IsImageMounted(device))
+		if level, err := tiny.BatteryLevel(device); err == nil {
+			g.batteryLevel = &level
+		}
+		if free, _, err := tiny.DiskSpace(device); err == nil {
+			g.freeBytes = &free
+		}
+		sampled[udid] = g
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// devices seen before stay visible as disconnected so alerts can fire on them
+	for udid := range s.devices {
+		if _, ok := sampled[udid]; !ok {
+			sampled[udid] = deviceGauges{connected: false}
+		}
+	}
+	s.devices = sampled
+	s.sampled = time.Now()
+}
+
+func (s *DeviceSampler) write(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	udids := make([]string, 0, len(s.devices))
+	for udid := range s.devices {
+		udids = append(udids, udid)
+	}
+	sort.Strings(udids)
+
+	gauge := func(name, help string, value func(deviceGauges) (float64, bool)) {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		for _, udid := range udids {
+			if v, ok := value(s.devices[udid]); ok {
+				fmt.Fprintf(w, "%s{udid=%q} %s\n", name, udid, formatFloat(v))
+			}
+		}
+	}
+	boolGauge := func(get func(deviceGauges) *bool) func(deviceGauges) (float64, bool) {
+		return func(g deviceGauges) (float64, bool) {
+			b := get(g)
+			if b == nil {
+				return 0, false
+			}
+			if *b {
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+
+	gauge("tinyios_device_connected", "Whether the device is connected via usbmuxd.", func(g deviceGauges) (float64, bool) {
+		if g.connected {
+			return 1, true
+		}
+		return 0, true
+	})
+	gauge("tinyios_device_paired", "Whether a pair record exists for the device.", boolGauge(func(g deviceGauges) *bool { return g.paired }))
+	gauge("tinyios_device_activated", "Whether the device is activated.", boolGauge(func(g deviceGauges) *bool { return g.activated }))
+	gauge("tinyios_device_supervised", "Whether the device is supervised.", boolGauge(func(g deviceGauges) *bool { return g.supervised }))
+	gauge("tinyios_device_devmode", "Whether developer mode is enabled.", boolGauge(func(g deviceGauges) *bool { return g.devmode }))
+	gauge("tinyios_device_image_mounted", "Whether a developer disk image is mounted.", boolGauge(func(g deviceGauges) *bool { return g.imageMounted }))
+	gauge("tinyios_device_battery_level_percent", "Current battery capacity in percent.", func(g deviceGauges) (float64, bool) {
+		if g.batteryLevel == nil {
+			return 0, false
+		}
+		return float64(*g.batteryLevel), true
+	})
+	gauge("tinyios_device_disk_free_bytes", "Free bytes on the device's data partition.", func(g deviceGauges) (float64, bool) {
+		if g.freeBytes == nil {
+			return 0, false
+		}
+		return float64(*g.freeBytes), true
+	})
+
+	if !s.sampled.IsZero() {
+		fmt.Fprintln(w, "# HELP tinyios_device_last_sample_timestamp_seconds Unix time of the last device sample.")
+		fmt.Fprintln(w, "# TYPE tinyios_device_last_sample_timestamp_seconds gauge")
+		fmt.Fprintf(w, "tinyios_device_last_sample_timestamp_seconds %d\n", s.sampled.Unix())
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// metricsHandler serves the request and device metrics in the Prometheus text format
+func metricsHandler(requests *RequestMetrics, sampler *DeviceSampler) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(200)
+		sampler.write(w)
+		requests.write(w)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Files expected in every organisation directory below SUPERVISION_DIR.
+// The directory layout works for plain folders as well as mounted secrets.
+const (
+	supervisionCertFile     = "cert.der"
+	supervisionP12File      = "identity.p12"
+	supervisionPasswordFile = "password"
+)
+
+// SupervisionIdentity is the certificate and key an organisation supervises its devices with
+type SupervisionIdentity struct {
+	Org         string
+	CertDER     []byte
+	P12         []byte
+	P12Password string
+}
+
+// errOrgExists is returned by Generate for organisations that already have an identity
+var errOrgExists = errors.New("supervision org already exists")
+
+// errInvalidOrg is returned by Generate for org names that can not be used as a directory name
+var errInvalidOrg = errors.New("invalid org name")
+
+// supervision is loaded on startup and used by all handlers that supervise, pair or install profiles
+var supervision *SupervisionStore
+
+// SupervisionStore holds all supervision identities by organisation name
+type SupervisionStore struct {
+	mu         sync.RWMutex
+	identities map[string]*SupervisionIdentity
+	defaultOrg string
+	dir        string
+}
+
+// LoadSupervisionStore loads identities from the directory in SUPERVISION_DIR and from the SUPERVISION_*
+// environment variables. fallback stays available next to them so devices supervised with it can still be managed,
+// unless SUPERVISION_DISABLE_BUILTIN=true. It is only the default org if nothing else is configured.
+func LoadSupervisionStore(fallback *SupervisionIdentity) (*SupervisionStore, error) {
+	store := &SupervisionStore{
+		identities: map[string]*SupervisionIdentity{},
+		dir:        os.Getenv("SUPERVISION_DIR"),
+	}
+
+	if store.dir != "" {
+		entries, err := os.ReadDir(store.dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("could not read SUPERVISION_DIR %s: %w", store.dir, err)
+		}
+		for _, entry := range entries {
+			// mounted kubernetes secrets contain hidden ..data directories
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			identity, err := loadIdentityDir(filepath.Join(store.dir, entry.Name()), entry.Name())
+			if err != nil {
+				return nil, err
+			}
+			store.identities[identity.Org] = identity
+		}
+	}
+
+	if org := os.Getenv("SUPERVISION_ORG"); org != "" {
+		cert, err := base64.StdEncoding.DecodeString(os.Getenv("SUPERVISION_CERT"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 in SUPERVISION_CERT: %w", err)
+		}
+		p12, err := base64.StdEncoding.DecodeString(os.Getenv("SUPERVISION_P12"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 in SUPERVISION_P12: %w", err)
+		}
+		identity := &SupervisionIdentity{Org: org, CertDER: cert, P12: p12, P12Password: os.Getenv("SUPERVISION_P12_PASSWORD")}
+		if err := identity.validate(); err != nil {
+			return nil, err
+		}
+		store.identities[org] = identity
+	}
+
+	store.defaultOrg = os.Getenv("SUPERVISION_DEFAULT_ORG")
+	if store.defaultOrg == "" {
+		store.defaultOrg = os.Getenv("SUPERVISION_ORG")
+	}
+	if store.defaultOrg == "" {
+		orgs := store.Orgs()
+		if len(orgs) > 0 {
+			store.defaultOrg = orgs[0]
+		}
+	}
+
+	if fallback != nil && os.Getenv("SUPERVISION_DISABLE_BUILTIN") != "true" {
+		if _, ok := store.identities[fallback.Org]; !ok {
+			if len(store.identities) == 0 {
+				log.Printf("no supervision identity configured, using the built-in identity of org %s which is shared by all tinyios installs", fallback.Org)
+			}
+			store.identities[fallback.Org] = fallback
+		}
+		if store.defaultOrg == "" {
+			store.defaultOrg = fallback.Org
+		}
+	}
+	if _, ok := store.identities[store.defaultOrg]; !ok && store.defaultOrg != "" {
+		return nil, fmt.Errorf("default supervision org %s is not configured", store.defaultOrg)
+	}
+	return store, nil
+}
+
+func loadIdentityDir(dir string, org string) (*SupervisionIdentity, error) {
+	cert, err := os.ReadFile(filepath.Join(dir, supervisionCertFile))
+	if err != nil {
+		return nil, fmt.Errorf("could not read supervision cert of org %s: %w", org, err)
+	}
+	p12, err := os.ReadFile(filepath.Join(dir, supervisionP12File))
+	if err != nil {
+		return nil, fmt.Errorf("could not read supervision p12 of org %s: %w", org, err)
+	}
+	password, err := os.ReadFile(filepath.Join(dir, supervisionPasswordFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read p12 password of org %s: %w", org, err)
+	}
+	identity := &SupervisionIdentity{Org: org, CertDER: cert, P12: p12, P12Password: strings.TrimSpace(string(password))}
+	return identity, identity.validate()
+}
+
+func (i *SupervisionIdentity) validate() error {
+	if _, _, err := pkcs12.Decode(i.P12, i.P12Password); err != nil {
+		return fmt.Errorf("could not decode p12 of supervision org %s: %w", i.Org, err)
+	}
+	return nil
+}
+
+// Fingerprint is the SHA-256 of the supervision certificate
+func (i *SupervisionIdentity) Fingerprint() string {
+	sum := sha256.Sum256(i.CertDER)
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the identity of org, or the default identity if org is empty
+func (s *SupervisionStore) Get(org string) (*SupervisionIdentity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if org == "" {
+		org = s.defaultOrg
+	}
+	identity, ok := s.identities[org]
+	if !ok {
+		return nil, fmt.Errorf("unknown supervision org '%s'", org)
+	}
+	return identity, nil
+}
+
+// Orgs returns the names of all organisations, sorted. Callers must hold s.mu once the store is shared.
+func (s *SupervisionStore) Orgs() []string {
+	orgs := make([]string, 0, len(s.identities))
+	for org := range s.identities {
+		orgs = append(orgs, org)
+	}
+	sort.Strings(orgs)
+	return orgs
+}
+
+// Generate creates a fresh supervision identity for org and stores it in SUPERVISION_DIR if one is configured. The
+// files are written to a hidden directory first and renamed into place once complete.
+func (s *SupervisionStore) Generate(org string, password string) (*SupervisionIdentity, error) {
+	if org == "" || strings.ContainsAny(org, `/\`) || strings.HasPrefix(org, ".") {
+		return nil, fmt.Errorf("%w '%s'", errInvalidOrg, org)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.identities[org]; ok {
+		return nil, fmt.Errorf("%w: '%s'", errOrgExists, org)
+	}
+
+	cert, err := ios.CreateDERFormattedSupervisionCert()
+	if err != nil {
+		return nil, err
+	}
+	p12, err := cert.ToP12(password)
+	if err != nil {
+		return nil, err
+	}
+	identity := &SupervisionIdentity{Org: org, CertDER: cert.CertDER, P12: p12, P12Password: password}
+
+	if s.dir != "" {
+		if err := s.writeIdentityDir(identity); err != nil {
+			return nil, fmt.Errorf("could not store supervision identity of org %s: %w", org, err)
+		}
+	}
+
+	s.identities[org] = identity
+	if s.defaultOrg == "" {
+		s.defaultOrg = org
+	}
+	return identity, nil
+}
+
+// writeIdentityDir stores identity in its directory below SUPERVISION_DIR, nothing is left behind if that fails
+func (s *SupervisionStore) writeIdentityDir(identity *SupervisionIdentity) error {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(s.dir, ".generate-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	files := map[string][]byte{
+		supervisionCertFile:     identity.CertDER,
+		supervisionP12File:      identity.P12,
+		supervisionPasswordFile: []byte(identity.P12Password),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(tmp, name), data, 0o600); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, identity.Org))
+}
+
+type SupervisionIdentityInfo struct {
+	Org         string `json:"org"`
+	Default     bool   `json:"default"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// supervisionIdentities godoc
+// @Summary      List supervision identities
+// @Description  Returns the organisations devices can be supervised with
+// @Tags         supervision
+// @Produce      json
+// @Success      200 {array} SupervisionIdentityInfo
+// @Router       /supervision/identities [get]
+func supervisionIdentities(w http.ResponseWriter, _ *http.Request) {
+	supervision.mu.RLock()
+	infos := []SupervisionIdentityInfo{}
+	for _, org := range supervision.Orgs() {
+		infos = append(infos, SupervisionIdentityInfo{
+			Org:         org,
+			Default:     org == supervision.defaultOrg,
+			Fingerprint: supervision.identities[org].Fingerprint(),
+		})
+	}
+	supervision.mu.RUnlock()
+	result, _ := json.Marshal(infos)
+	writeResponse(w, 200, result)
+}
+
+type GenerateIdentityRequest struct {
+	Org      string `json:"org"`
+	Password string `json:"password"`
+}
+
+type GenerateIdentityResponse struct {
+	Org         string `json:"org"`
+	Fingerprint string `json:"fingerprint"`
+	CertPEM     string `json:"certPem"`
+	// B64P12 is returned so the identity can be backed up, it is the only copy if SUPERVISION_DIR is not set
+	B64P12 string `json:"b64p12"`
+}
+
+// generateSupervisionIdentity godoc
+// @Summary      Generate supervision identity
+// @Description  Creates a new supervision certificate and key for an organisation
+// @Tags         supervision
+// @Accept       json
+// @Produce      json
+// @Param        request body GenerateIdentityRequest true "Organisation name and p12 password"
+// @Success      200 {object} GenerateIdentityResponse
+// @Failure      400 {string} string "invalid JSON or org name"
+// @Failure      409 {string} string "org exists"
+// @Failure      500 {string} string "identity could not be created or stored"
+// @Router       /supervision/identities [post]
+func generateSupervisionIdentity(w http.ResponseWriter, r *http.Request) {
+	var u GenerateIdentityRequest
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	identity, err := supervision.Generate(u.Org, u.Password)
+	switch {
+	case errors.Is(err, errInvalidOrg):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errOrgExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result, _ := json.Marshal(GenerateIdentityResponse{
+		Org:         identity.Org,
+		Fingerprint: identity.Fingerprint(),
+		CertPEM:     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: identity.CertDER})),
+		B64P12:      base64.StdEncoding.EncodeToString(identity.P12),
+	})
+	writeResponse(w, 200, result)
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"golang.org/x/net/websocket"
+)
+
+// usbmuxd result codes
+const (
+	usbmuxResultOK                = 0
+	usbmuxResultBadCommand        = 1
+	usbmuxResultBadDevice         = 2
+	usbmuxResultConnectionRefused = 3
+)
+
+// usbmuxRoute is a device as its usbmuxd endpoint knows it. DeviceIDs are only unique per endpoint,
+// so exported devices get their own IDs.
+type usbmuxRoute struct {
+	socket   string
+	deviceID int
+}
+
+// UsbmuxExport serves the usbmuxd protocol for the devices of this node so libimobiledevice, Appium and
+// other usbmuxd clients can use them remotely. Exported DeviceIDs are assigned here and map to the
+// endpoint and DeviceID the device has upstream.
+type UsbmuxExport struct {
+	mu      sync.Mutex
+	ids     map[usbmuxRoute]int
+	devices map[int]ios.DeviceEntry
+	nextID  int
+}
+
+var usbmuxExport = &UsbmuxExport{ids: map[usbmuxRoute]int{}, devices: map[int]ios.DeviceEntry{}, nextID: 1}
+
+// exportedID returns the DeviceID clients see for device
+func (e *UsbmuxExport) exportedID(device ios.DeviceEntry) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	route := usbmuxRoute{device.UsbmuxdSocket, device.DeviceID}
+	id, ok := e.ids[route]
+	if !ok {
+		id = e.nextID
+		e.nextID++
+		e.ids[route] = id
+	}
+	e.devices[id] = device
+	return id
+}
+
+func (e *UsbmuxExport) device(id int) (ios.DeviceEntry, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	device, ok := e.devices[id]
+	return device, ok
+}
+
+// detachedID returns the exported ID of a device that detached upstream, its udid and whether it was known
+func (e *UsbmuxExport) detachedID(msg ios.AttachedMessage) (int, string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	route := usbmuxRoute{msg.UsbmuxdSocket, msg.DeviceID}
+	id, ok := e.ids[route]
+	if !ok {
+		return 0, "", false
+	}
+	udid := e.devices[id].Properties.SerialNumber
+	delete(e.ids, route)
+	delete(e.devices, id)
+	return id, udid, true
+}
+
+// ListenUsbmuxExport opens the TCP listener of USBMUXD_EXPORT_ADDRESS. With authentication enabled the listener
+// uses TLS and requires a client certificate, usbmuxd clients have no other way to present credentials.
+// There is no way to present a lease token either, so leased devices are hidden on this listener and lease holders
+// have to use the /usbmuxd/socket WebSocket with the X-Lease-Token header.
+func ListenUsbmuxExport(address string, auth *Auth) (net.Listener, error) {
+	if auth == nil {
+		log.Printf("usbmuxd export on %s is open to everyone who can reach it", address)
+		return net.Listen("tcp", address)
+	}
+	certFile, keyFile, caFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CLIENT_CA_FILE")
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("with AUTH_CONFIG the usbmuxd export needs TLS_CERT_FILE, TLS_KEY_FILE and TLS_CLIENT_CA_FILE for client certificates")
+	}
+	config, err := clientCertTLSConfig(caFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config.Certificates = []tls.Certificate{cert}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return tls.Listen("tcp", address, config)
+}
+
+// Serve accepts usbmuxd clients on listener until it is closed
+func (e *UsbmuxExport) Serve(listener net.Listener, auth *Auth) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("usbmuxd export stopped: %v", err)
+			}
+			return
+		}
+		go func() {
+			principal, err := e.authenticate(conn, auth)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			e.serve(conn, principal, "", conn.RemoteAddr().String())
+		}()
+	}
+}
+
+// authenticate runs the HTTP authenticators on the TLS state of conn and applies the scope of the usbmuxd socket route
+func (e *UsbmuxExport) authenticate(conn net.Conn, auth *Auth) (*Principal, error) {
+	if auth == nil {
+		return nil, nil
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, errors.New("not a TLS connection")
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	r := &http.Request{Method: "USBMUXD", URL: &url.URL{Path: "/usbmuxd"}, RemoteAddr: conn.RemoteAddr().String(), Header: http.Header{}, TLS: &state}
+	principal, err := auth.authenticate(r)
+	switch {
+	case err != nil || principal == nil:
+		reason := "no client certificate mapping"
+		if err != nil {
+			reason = err.Error()
+		}
+		auditAuthDecision(r, usbmuxSocketRoute, "", nil, false, reason)
+		return nil, errors.New(reason)
+	case principal.level() < scopeLevels[ScopeDestructive]:
+		auditAuthDecision(r, usbmuxSocketRoute, "", principal, false, "missing scope "+ScopeDestructive)
+		return nil, errors.New("missing scope")
+	}
+	auditAuthDecision(r, usbmuxSocketRoute, "", principal, true, "")
+	return principal, nil
+}
+
+// usbmuxSocketRoute is the WebSocket tunnel, it needs the destructive scope because a raw device connection can do
+// everything the destructive routes can
+const usbmuxSocketRoute = "GET /usbmuxd/socket"
+
+// usbmuxSocket godoc
+// @Summary      usbmuxd WebSocket tunnel
+// @Description  Upgrades to a WebSocket that carries the usbmuxd protocol in binary messages. ListDevices, Listen,
+// @Description  ReadBUID, ReadPairRecord and Connect are served for the devices the caller may use. Leased devices are
+// @Description  only listed and connected with the lease token in the X-Lease-Token header of the upgrade request.
+// @Tags         device
+// @Success      101
+// @Router       /usbmuxd/socket [get]
+func usbmuxSocket(w http.ResponseWriter, r *http.Request) {
+	principal := getPrincipal(r.Context())
+	leaseToken := r.Header.Get(LeaseTokenHeader)
+	server := websocket.Server{
+		// usbmuxd clients are no browsers, callers are authenticated by the middleware instead of by origin
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			usbmuxExport.serve(ws, principal, leaseToken, r.RemoteAddr)
+		},
+	}
+	server.ServeHTTP(hijackableWriter{w}, r)
+}
+
+// hijackableWriter lets the websocket package hijack connections through the middleware response writers
+type hijackableWriter struct {
+	http.ResponseWriter
+}
+
+func (w hijackableWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// serve answers usbmuxd requests of one client. A nil principal means authentication is disabled. Devices leased to
+// someone else than the holder of leaseToken are not listed and refuse connections.
+func (e *UsbmuxExport) serve(conn io.ReadWriteCloser, principal *Principal, leaseToken string, remote string) {
+	defer conn.Close()
+	muxConn := ios.NewUsbMuxConnection(ios.NewDeviceConnectionWithRWC(conn))
+	allowed := func(udid string) bool {
+		return principal == nil || principal.AllowsDevice(udid)
+	}
+	visible := func(udid string) bool {
+		_, ok := leases.Allows(udid, leaseToken)
+		return ok && allowed(udid)
+	}
+	for {
+		request, err := muxConn.ReadMessage()
+		if err != nil {
+			return
+		}
+		tag := request.Header.Tag
+		message, err := ios.ParsePlist(request.Payload)
+		if err != nil {
+			return
+		}
+		switch message["MessageType"] {
+		case "ListDevices":
+			list, listErr := ios.ListDevices()
+			if listErr != nil {
+				log.Printf("usbmuxd export: %v", listErr)
+			}
+			devices := []any{}
+			for _, device := range list.DeviceList {
+				if visible(device.Properties.SerialNumber) {
+					devices = append(devices, e.attached(device))
+				}
+			}
+			err = muxConn.Reply(tag, map[string]any{"DeviceList": devices})
+		case "Listen":
+			e.listen(muxConn, conn, tag, visible, allowed)
+			return
+		case "ReadBUID":
+			err = e.readBUID(muxConn, tag)
+		case "ReadPairRecord":
+			udid, _ := message["PairRecordID"].(string)
+			if !allowed(udid) {
+				err = usbmuxResult(muxConn, tag, usbmuxResultBadDevice)
+				break
+			}
+			data, readErr := ios.ReadPairRecordData(udid)
+			if readErr != nil {
+				err = usbmuxResult(muxConn, tag, usbmuxResultBadDevice)
+				break
+			}
+			err = muxConn.Reply(tag, map[string]any{"PairRecordData": data})
+		case "Connect":
+			e.connect(muxConn, conn, tag, message, principal, leaseToken, remote, allowed)
+			return
+		default:
+			err = usbmuxResult(muxConn, tag, usbmuxResultBadCommand)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func usbmuxResult(muxConn *ios.UsbMuxConnection, tag uint32, number int) error {
+	return muxConn.Reply(tag, map[string]any{"MessageType": "Result", "Number": number})
+}
+
+func (e *UsbmuxExport) attached(device ios.DeviceEntry) map[string]any {
+	properties := device.Properties
+	properties.DeviceID = e.exportedID(device)
+	return map[string]any{"MessageType": "Attached", "DeviceID": properties.DeviceID, "Properties": properties}
+}
+
+func (e *UsbmuxExport) readBUID(muxConn *ios.UsbMuxConnection, tag uint32) error {
+	upstream, err := ios.NewUsbMuxConnectionSimple()
+	if err != nil {
+		return usbmuxResult(muxConn, tag, usbmuxResultBadCommand)
+	}
+	defer upstream.Close()
+	buid, err := upstream.ReadBuid()
+	if err != nil {
+		return usbmuxResult(muxConn, tag, usbmuxResultBadCommand)
+	}
+	return muxConn.Reply(tag, map[string]any{"BUID": buid})
+}
+
+// listen forwards attach events of visible devices and detach events of allowed devices until the client or upstream
+// goes away
+func (e *UsbmuxExport) listen(muxConn *ios.UsbMuxConnection, conn io.ReadWriteCloser, tag uint32, visible func(string) bool, allowed func(string) bool) {
+	receive, closeListener, err := ios.Listen()
+	if err != nil {
+		usbmuxResult(muxConn, tag, usbmuxResultBadCommand)
+		return
+	}
+	defer closeListener()
+	if err := usbmuxResult(muxConn, tag, usbmuxResultOK); err != nil {
+		return
+	}
+	// clients send nothing after Listen, a read only returns once they hang up
+	go func() {
+		io.Copy(io.Discard, conn)
+		closeListener()
+	}()
+	for {
+		msg, err := receive()
+		if err != nil {
+			return
+		}
+		var event map[string]any
+		switch {
+		case msg.DeviceAttached() && visible(msg.Properties.SerialNumber):
+			event = e.attached(msg.DeviceEntry())
+		case msg.DeviceDetached():
+			id, udid, ok := e.detachedID(msg)
+			if !ok || !allowed(udid) {
+				continue
+			}
+			event = map[string]any{"MessageType": "Detached", "DeviceID": id}
+		default:
+			continue
+		}
+		if err := muxConn.Reply(0, event); err != nil {
+			return
+		}
+	}
+}
+
+// connect opens a connection to a port of the device and pipes it to the client. Devices leased to someone else
+// refuse the connection like the middleware answers 423.
+func (e *UsbmuxExport) connect(muxConn *ios.UsbMuxConnection, conn io.ReadWriteCloser, tag uint32, message map[string]any, principal *Principal, leaseToken string, remote string, allowed func(string) bool) {
+	id, _ := message["DeviceID"].(uint64)
+	port, _ := message["PortNumber"].(uint64)
+	// clients send the port in network byte order
+	hostPort := ios.Ntohs(uint16(port))
+
+	device, ok := e.device(int(id))
+	if !ok || !allowed(device.Properties.SerialNumber) {
+		usbmuxResult(muxConn, tag, usbmuxResultBadDevice)
+		return
+	}
+	entry := map[string]any{
+		"type":   "usbmuxd",
+		"method": "Connect",
+		"remote": remote,
+		"udid":   device.Properties.SerialNumber,
+		"port":   hostPort,
+	}
+	if principal != nil {
+		entry["principal"] = principal.Name
+		entry["authMethod"] = principal.Method
+	}
+	if lease, ok := leases.Allows(device.Properties.SerialNumber, leaseToken); !ok {
+		entry["ok"] = false
+		entry["error"] = "leased by " + lease.Owner
+		auditor.Record(entry)
+		usbmuxResult(muxConn, tag, usbmuxResultConnectionRefused)
+		return
+	}
+	upstream, err := ios.NewUsbMuxConnectionForDevice(device)
+	if err == nil {
+		if err = upstream.Connect(device.DeviceID, hostPort); err != nil {
+			upstream.Close()
+		}
+	}
+	if err != nil {
+		entry["ok"] = false
+		entry["error"] = err.Error()
+		auditor.Record(entry)
+		usbmuxResult(muxConn, tag, usbmuxResultConnectionRefused)
+		return
+	}
+	entry["ok"] = true
+	auditor.Record(entry)
+	deviceConn := upstream.ReleaseDeviceConnection()
+	defer deviceConn.Close()
+	if err := usbmuxResult(muxConn, tag, usbmuxResultOK); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(deviceConn.Writer(), conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, deviceConn.Reader())
+		done <- struct{}{}
+	}()
+	<-done
+}